@@ -0,0 +1,254 @@
+package bundle
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+	"unicode/utf16"
+)
+
+// macOS writes its preferences, e.g. with `defaults write`, as binary
+// property lists. They are decoded into the same Go values as XML property
+// lists.
+//
+// A binary property list is the magic, a table of objects, the offsets of
+// the objects, and a trailer. Arrays and dictionaries refer to the objects
+// they hold by their index in the offset table.
+
+// The epoch of the dates of binary property lists.
+var binaryPlistEpoch = time.Date(2001, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// binaryPlist is a binary property list being decoded.
+type binaryPlist struct {
+	data    []byte
+	offsets []uint64
+	refSize int
+	// The objects being decoded, to reject a container holding itself
+	decoding map[uint64]bool
+}
+
+// decodeBinaryPlist decodes a bplist00 property list and returns its root
+// value.
+func decodeBinaryPlist(data []byte) (interface{}, error) {
+	if len(data) < 8+32 || string(data[:8]) != binaryPlistMagic+"00" {
+		return nil, errors.New("not a bplist00 property list")
+	}
+	trailer := data[len(data)-32:]
+	offsetSize := int(trailer[6])
+	refSize := int(trailer[7])
+	numObjects := binary.BigEndian.Uint64(trailer[8:])
+	topObject := binary.BigEndian.Uint64(trailer[16:])
+	tableOffset := binary.BigEndian.Uint64(trailer[24:])
+
+	if offsetSize < 1 || offsetSize > 8 || refSize < 1 || refSize > 8 {
+		return nil, errors.New("invalid binary plist trailer")
+	}
+	tableEnd := uint64(len(data) - 32)
+	if tableOffset > tableEnd || numObjects > (tableEnd-tableOffset)/uint64(offsetSize) || topObject >= numObjects {
+		return nil, errors.New("invalid binary plist offset table")
+	}
+
+	p := &binaryPlist{data: data, refSize: refSize, decoding: make(map[uint64]bool)}
+	for i := uint64(0); i < numObjects; i++ {
+		start := tableOffset + i*uint64(offsetSize)
+		offset := readUint(data[start : start+uint64(offsetSize)])
+		if offset < 8 || offset >= tableOffset {
+			return nil, fmt.Errorf("invalid offset of object %d", i)
+		}
+		p.offsets = append(p.offsets, offset)
+	}
+	return p.object(topObject)
+}
+
+// readUint reads a big-endian unsigned integer of 1 to 8 bytes.
+func readUint(b []byte) uint64 {
+	var u uint64
+	for _, c := range b {
+		u = u<<8 | uint64(c)
+	}
+	return u
+}
+
+// bytes returns n bytes of the object table at offset.
+func (p *binaryPlist) bytes(offset uint64, n uint64) ([]byte, error) {
+	end := offset + n
+	if end < offset || end > uint64(len(p.data)-32) {
+		return nil, errors.New("object out of the binary plist")
+	}
+	return p.data[offset:end], nil
+}
+
+// length returns the length of the object with the marker at offset, and
+// the offset of its content. A length of 15 is followed by an integer
+// object with the length.
+func (p *binaryPlist) length(offset uint64) (uint64, uint64, error) {
+	n := uint64(p.data[offset] & 0x0f)
+	offset++
+	if n != 0x0f {
+		return n, offset, nil
+	}
+	marker, err := p.bytes(offset, 1)
+	if err != nil {
+		return 0, 0, err
+	}
+	if marker[0]&0xf0 != 0x10 || marker[0]&0x0f > 3 {
+		return 0, 0, errors.New("invalid length of binary plist object")
+	}
+	size := uint64(1) << (marker[0] & 0x0f)
+	b, err := p.bytes(offset+1, size)
+	if err != nil {
+		return 0, 0, err
+	}
+	return readUint(b), offset + 1 + size, nil
+}
+
+// refs returns the objects a container refers to.
+func (p *binaryPlist) refs(offset uint64, n uint64) ([]uint64, error) {
+	if n > uint64(len(p.data)) {
+		return nil, errors.New("object out of the binary plist")
+	}
+	b, err := p.bytes(offset, n*uint64(p.refSize))
+	if err != nil {
+		return nil, err
+	}
+	refs := make([]uint64, n)
+	for i := range refs {
+		refs[i] = readUint(b[i*p.refSize : (i+1)*p.refSize])
+	}
+	return refs, nil
+}
+
+func (p *binaryPlist) object(ref uint64) (interface{}, error) {
+	if ref >= uint64(len(p.offsets)) {
+		return nil, fmt.Errorf("invalid object reference %d", ref)
+	}
+	if p.decoding[ref] {
+		return nil, errors.New("the binary plist has a cycle")
+	}
+	p.decoding[ref] = true
+	defer delete(p.decoding, ref)
+
+	offset := p.offsets[ref]
+	marker := p.data[offset]
+	switch marker & 0xf0 {
+	case 0x00:
+		switch marker {
+		case 0x08:
+			return false, nil
+		case 0x09:
+			return true, nil
+		}
+	case 0x10:
+		size := uint64(1) << (marker & 0x0f)
+		b, err := p.bytes(offset+1, size)
+		if err != nil {
+			return nil, err
+		}
+		switch size {
+		case 1, 2, 4, 8:
+			return int64(readUint(b)), nil
+		case 16:
+			// Integers above the range of int64 are written on 16 bytes
+			return readUint(b[8:]), nil
+		}
+	case 0x20:
+		size := uint64(1) << (marker & 0x0f)
+		b, err := p.bytes(offset+1, size)
+		if err != nil {
+			return nil, err
+		}
+		switch size {
+		case 4:
+			return float64(math.Float32frombits(uint32(readUint(b)))), nil
+		case 8:
+			return math.Float64frombits(readUint(b)), nil
+		}
+	case 0x30:
+		if marker != 0x33 {
+			break
+		}
+		b, err := p.bytes(offset+1, 8)
+		if err != nil {
+			return nil, err
+		}
+		seconds := math.Float64frombits(readUint(b))
+		return binaryPlistEpoch.Add(time.Duration(seconds * float64(time.Second))), nil
+	case 0x40, 0x50, 0x60:
+		n, start, err := p.length(offset)
+		if err != nil {
+			return nil, err
+		}
+		if marker&0xf0 == 0x60 {
+			if n > uint64(len(p.data)) {
+				return nil, errors.New("object out of the binary plist")
+			}
+			b, err := p.bytes(start, 2*n)
+			if err != nil {
+				return nil, err
+			}
+			units := make([]uint16, n)
+			for i := range units {
+				units[i] = binary.BigEndian.Uint16(b[2*i:])
+			}
+			return string(utf16.Decode(units)), nil
+		}
+		b, err := p.bytes(start, n)
+		if err != nil {
+			return nil, err
+		}
+		if marker&0xf0 == 0x40 {
+			return append([]byte(nil), b...), nil
+		}
+		return string(b), nil
+	case 0xa0:
+		n, start, err := p.length(offset)
+		if err != nil {
+			return nil, err
+		}
+		refs, err := p.refs(start, n)
+		if err != nil {
+			return nil, err
+		}
+		array := make([]interface{}, 0, n)
+		for _, ref := range refs {
+			value, err := p.object(ref)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, value)
+		}
+		return array, nil
+	case 0xd0:
+		n, start, err := p.length(offset)
+		if err != nil {
+			return nil, err
+		}
+		if n > uint64(len(p.data)) {
+			return nil, errors.New("object out of the binary plist")
+		}
+		refs, err := p.refs(start, 2*n)
+		if err != nil {
+			return nil, err
+		}
+		dict := make(map[string]interface{}, n)
+		for i := uint64(0); i < n; i++ {
+			k, err := p.object(refs[i])
+			if err != nil {
+				return nil, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, errors.New("binary plist dictionary key is not a string")
+			}
+			value, err := p.object(refs[n+i])
+			if err != nil {
+				return nil, fmt.Errorf("key %q: %s", key, err)
+			}
+			dict[key] = value
+		}
+		return dict, nil
+	}
+	return nil, fmt.Errorf("unsupported binary plist object 0x%02x", marker)
+}
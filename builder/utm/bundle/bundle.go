@@ -0,0 +1,196 @@
+// Package bundle reads and writes UTM virtual machine bundles (.utm).
+//
+// A bundle is a directory with the VM settings in config.plist and the
+// drive images, custom icon and other files in its Data directory:
+//
+//	Linux.utm/
+//	    config.plist
+//	    Data/
+//	        <drive id>.qcow2
+//	        efi_vars.fd
+package bundle
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	// ConfigFile is the name of the settings file in a bundle.
+	ConfigFile = "config.plist"
+	// DataDir is the name of the directory holding the bundle's files.
+	DataDir = "Data"
+	// Extension is the file extension of a bundle.
+	Extension = ".utm"
+)
+
+// Bundle is a .utm bundle on disk.
+type Bundle struct {
+	// Path is the path of the bundle directory.
+	Path   string
+	Config *Config
+}
+
+// Open reads the bundle at path.
+func Open(path string) (*Bundle, error) {
+	f, err := os.Open(filepath.Join(path, ConfigFile))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	config, err := DecodeConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %s", f.Name(), err)
+	}
+
+	return &Bundle{Path: path, Config: config}, nil
+}
+
+// Create creates a new bundle at path with the given config. The path must
+// not exist yet.
+func Create(path string, config *Config) (*Bundle, error) {
+	if _, err := os.Stat(path); err == nil {
+		return nil, fmt.Errorf("%s already exists", path)
+	}
+	if err := os.MkdirAll(filepath.Join(path, DataDir), 0755); err != nil {
+		return nil, err
+	}
+
+	b := &Bundle{Path: path, Config: config}
+	if err := b.Save(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Save writes the config of the bundle back to config.plist. The file is
+// replaced atomically, so UTM never sees a partially written config.
+func (b *Bundle) Save() error {
+	var buf bytes.Buffer
+	if err := b.Config.Encode(&buf); err != nil {
+		return err
+	}
+
+	path := filepath.Join(b.Path, ConfigFile)
+	tmp, err := os.CreateTemp(b.Path, ".config-*.plist")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// DataPath returns the path of the named file in the Data directory.
+func (b *Bundle) DataPath(name string) string {
+	return filepath.Join(b.Path, DataDir, name)
+}
+
+// DataFiles returns the sorted names of the files in the Data directory.
+func (b *Bundle) DataFiles() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(b.Path, DataDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// AddDataFile copies r into the named file in the Data directory,
+// replacing any existing file.
+func (b *Bundle) AddDataFile(name string, r io.Reader) error {
+	if name != filepath.Base(name) || name == "." || name == ".." {
+		return fmt.Errorf("invalid data file name %q", name)
+	}
+	if err := os.MkdirAll(filepath.Join(b.Path, DataDir), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.Create(b.DataPath(name))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// RemoveDataFile removes the named file from the Data directory.
+func (b *Bundle) RemoveDataFile(name string) error {
+	err := os.Remove(b.DataPath(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// DriveImagePath returns the path of the image of a drive, or an empty
+// string for a drive without an image, like an empty CD drive.
+func (b *Bundle) DriveImagePath(d Drive) string {
+	if d.ImageName == "" {
+		return ""
+	}
+	return b.DataPath(d.ImageName)
+}
+
+// IconPath returns the path of the custom icon of the VM, or an empty
+// string if the VM uses a built-in icon.
+func (b *Bundle) IconPath() string {
+	info := b.Config.Information
+	if !info.IconCustom || info.Icon == "" {
+		return ""
+	}
+	return b.DataPath(info.Icon)
+}
+
+// SetCustomIcon copies the image at src into the Data directory and makes
+// it the icon of the VM. Call Save to persist the change.
+func (b *Bundle) SetCustomIcon(src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	name := filepath.Base(src)
+	if err := b.AddDataFile(name, f); err != nil {
+		return err
+	}
+
+	if old := b.IconPath(); old != "" && filepath.Base(old) != name {
+		if err := b.RemoveDataFile(filepath.Base(old)); err != nil {
+			return err
+		}
+	}
+
+	b.Config.Information.Icon = name
+	b.Config.Information.IconCustom = true
+	return nil
+}
@@ -0,0 +1,300 @@
+package bundle
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testBundle = "testdata/Linux.utm"
+
+func TestDecodeConfig(t *testing.T) {
+	b, err := Open(testBundle)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	c := b.Config
+
+	if c.Backend != BackendQEMU || c.ConfigurationVersion != 4 {
+		t.Fatalf("bad: %s %d", c.Backend, c.ConfigurationVersion)
+	}
+	if c.Information.Name != "Linux" || c.Information.Icon != "linux" || c.Information.IconCustom {
+		t.Fatalf("bad: %#v", c.Information)
+	}
+	if c.Information.Notes != "Built by Packer & friends.\nSecond line." {
+		t.Fatalf("bad notes: %q", c.Information.Notes)
+	}
+	if c.System.Architecture != "aarch64" || c.System.CPUCount != 4 || c.System.MemorySize != 4096 {
+		t.Fatalf("bad: %#v", c.System)
+	}
+	if !reflect.DeepEqual(c.QEMU.AdditionalArguments, []string{"-device", "virtio-rng-pci"}) {
+		t.Fatalf("bad: %#v", c.QEMU.AdditionalArguments)
+	}
+	if !c.QEMU.Hypervisor || !c.QEMU.UEFIBoot {
+		t.Fatalf("bad: %#v", c.QEMU)
+	}
+	if c.Sharing.DirectoryShareMode != "VirtFS" || !c.Sharing.ClipboardSharing {
+		t.Fatalf("bad: %#v", c.Sharing)
+	}
+
+	if len(c.Drives) != 2 {
+		t.Fatalf("bad: %d drives", len(c.Drives))
+	}
+	if c.Drives[0].ImageType != "Disk" || c.Drives[0].Interface != "VirtIO" || c.Drives[0].ReadOnly {
+		t.Fatalf("bad: %#v", c.Drives[0])
+	}
+	if c.Drives[1].ImageType != "CD" || c.Drives[1].ImageName != "" || !c.Drives[1].ReadOnly {
+		t.Fatalf("bad: %#v", c.Drives[1])
+	}
+	if b.DriveImagePath(c.Drives[1]) != "" {
+		t.Fatalf("empty drive should not have an image path")
+	}
+
+	if len(c.Networks) != 1 || c.Networks[0].Mode != "Emulated" || c.Networks[0].MacAddress != "3E:4A:6F:12:9B:C0" {
+		t.Fatalf("bad: %#v", c.Networks)
+	}
+	forwards := c.Networks[0].PortForwards
+	if len(forwards) != 1 || forwards[0].Protocol != "TCP" || forwards[0].GuestPort != 22 || forwards[0].HostPort != 2222 {
+		t.Fatalf("bad: %#v", forwards)
+	}
+
+	if len(c.Displays) != 1 || c.Displays[0].Hardware != "virtio-ramfb-gl" {
+		t.Fatalf("bad: %#v", c.Displays)
+	}
+}
+
+func TestConfigEncode_roundTrip(t *testing.T) {
+	original, err := os.ReadFile(filepath.Join(testBundle, ConfigFile))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	c, err := DecodeConfig(bytes.NewReader(original))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var buf bytes.Buffer
+	if err := c.Encode(&buf); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if buf.String() != string(original) {
+		t.Fatalf("round trip changed config.plist:\n%s", buf.String())
+	}
+}
+
+func TestConfigEncode_modified(t *testing.T) {
+	b, err := Open(testBundle)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	c := b.Config
+
+	c.Information.Notes = "changed"
+	c.System.MemorySize = 8192
+	c.QEMU.AdditionalArguments = append(c.QEMU.AdditionalArguments, "-fw_cfg", "name=opt/x,string=y")
+	c.Networks[0].PortForwards = append(c.Networks[0].PortForwards, PortForward{
+		Protocol:  "UDP",
+		GuestPort: 53,
+		HostPort:  5353,
+	})
+	c.Drives = c.Drives[:1]
+
+	var buf bytes.Buffer
+	if err := c.Encode(&buf); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	decoded, err := DecodeConfig(&buf)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if decoded.Information.Notes != "changed" || decoded.System.MemorySize != 8192 {
+		t.Fatalf("bad: %#v", decoded)
+	}
+	if len(decoded.QEMU.AdditionalArguments) != 4 || len(decoded.Drives) != 1 {
+		t.Fatalf("bad: %#v", decoded)
+	}
+	forward := decoded.Networks[0].PortForwards[1]
+	if forward.Protocol != "UDP" || forward.GuestPort != 53 || forward.HostPort != 5353 || forward.GuestAddress != "" {
+		t.Fatalf("bad: %#v", forward)
+	}
+
+	// Unknown keys are kept
+	if _, ok := decoded.raw["Input"]; !ok {
+		t.Fatal("Input should be kept")
+	}
+	if _, ok := decoded.System.raw["JITCacheSize"]; !ok {
+		t.Fatal("System.JITCacheSize should be kept")
+	}
+	if _, ok := decoded.QEMU.raw["RNGDevice"]; !ok {
+		t.Fatal("QEMU.RNGDevice should be kept")
+	}
+	// New port forwards do not get empty keys
+	if _, ok := forward.raw["GuestAddress"]; ok {
+		t.Fatal("GuestAddress should not be written")
+	}
+}
+
+func TestDecodeConfig_invalid(t *testing.T) {
+	cases := map[string]string{
+		"binary":     "bplist00\x00\x01",
+		"not plist":  "<dict></dict>",
+		"root array": `<plist version="1.0"><array/></plist>`,
+		"bad type":   `<plist version="1.0"><dict><key>ConfigurationVersion</key><string>4</string></dict></plist>`,
+		"bad value":  `<plist version="1.0"><dict><key>X</key><integer>four</integer></dict></plist>`,
+		"no value":   `<plist version="1.0"><dict><key>X</key></dict></plist>`,
+	}
+
+	for name, input := range cases {
+		if _, err := DecodeConfig(strings.NewReader(input)); err == nil {
+			t.Fatalf("%s: should have error", name)
+		}
+	}
+}
+
+func TestBundle_createAndSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "New"+Extension)
+
+	config := &Config{
+		Backend:              BackendQEMU,
+		ConfigurationVersion: 4,
+		Information:          Information{Name: "New", UUID: "C0FFEE00-0000-4000-8000-000000000000"},
+		Drives: []Drive{{
+			Identifier: "disk",
+			ImageName:  "disk.qcow2",
+			ImageType:  "Disk",
+			Interface:  "VirtIO",
+		}},
+	}
+	b, err := Create(path, config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := Create(path, config); err == nil {
+		t.Fatal("should not create over an existing bundle")
+	}
+
+	if err := b.AddDataFile("disk.qcow2", strings.NewReader("disk")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := b.AddDataFile("../escape", strings.NewReader("x")); err == nil {
+		t.Fatal("should reject names outside the Data directory")
+	}
+
+	icon := filepath.Join(t.TempDir(), "icon.png")
+	if err := os.WriteFile(icon, []byte("png"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := b.SetCustomIcon(icon); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := b.Save(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if reopened.IconPath() != b.DataPath("icon.png") {
+		t.Fatalf("bad icon path: %s", reopened.IconPath())
+	}
+	files, err := reopened.DataFiles()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(files, []string{"disk.qcow2", "icon.png"}) {
+		t.Fatalf("bad: %#v", files)
+	}
+	if image := reopened.DriveImagePath(reopened.Config.Drives[0]); image != b.DataPath("disk.qcow2") {
+		t.Fatalf("bad: %s", image)
+	}
+
+	if err := reopened.RemoveDataFile("disk.qcow2"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := reopened.RemoveDataFile("disk.qcow2"); err != nil {
+		t.Fatalf("removing a missing file should not fail: %s", err)
+	}
+}
+
+func TestTreeHash(t *testing.T) {
+	hash, err := TreeHash(testBundle)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if hash != "sha256:77fadf04eb9de04c397fc829c0781e7756e1eab8f3e93a28c7b6b428e840a0f4" {
+		t.Fatalf("bad: %s", hash)
+	}
+
+	// The paths are in byte order, a-c before a/b, unlike the walk
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "a"), 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	os.WriteFile(filepath.Join(dir, "a", "b"), []byte("one"), 0644)
+	os.WriteFile(filepath.Join(dir, "a-c"), []byte("two"), 0644)
+	hash, err = TreeHash(dir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if hash != "sha256:b8504049c603ae1c43f0b6162959f3f53558d3dcd631f979b34aba44d89f2269" {
+		t.Fatalf("bad: %s", hash)
+	}
+
+	// Empty directories aren't part of the hash, file contents are
+	if err := os.Mkdir(filepath.Join(dir, "empty"), 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if same, _ := TreeHash(dir); same != hash {
+		t.Fatalf("bad: %s", same)
+	}
+	os.WriteFile(filepath.Join(dir, "a-c"), []byte("three"), 0644)
+	if changed, _ := TreeHash(dir); changed == hash {
+		t.Fatalf("bad: %s", changed)
+	}
+}
+
+func TestDecodePlist_binary(t *testing.T) {
+	// Written by plistlib, like `defaults write` writes the preferences
+	f, err := os.Open("testdata/preferences.plist")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer f.Close()
+	root, err := DecodePlist(f)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := map[string]interface{}{
+		"Shared_Net_Address": "192.168.105.1",
+		"Count":              int64(-3),
+		"Big":                uint64(math.MaxUint64),
+		"Mask":               int64(255),
+		"Ratio":              0.5,
+		"On":                 true,
+		"Off":                false,
+		"Data":               []byte{1, 2},
+		"Date":               time.Date(2024, time.October, 4, 12, 0, 0, 0, time.UTC),
+		"Name":               "Café",
+		"List":               []interface{}{"a", int64(1), "a"},
+		"Nested":             map[string]interface{}{"a": "b"},
+	}
+	if !reflect.DeepEqual(root, expected) {
+		t.Fatalf("bad: %#v", root)
+	}
+
+	data, _ := os.ReadFile("testdata/preferences.plist")
+	for _, invalid := range [][]byte{data[:len(data)-1], data[:40], append([]byte("bplist00"), make([]byte, 32)...)} {
+		if _, err := DecodePlist(bytes.NewReader(invalid)); err == nil {
+			t.Fatalf("should have error: %x", invalid)
+		}
+	}
+}
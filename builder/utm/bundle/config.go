@@ -0,0 +1,486 @@
+package bundle
+
+import (
+	"fmt"
+	"io"
+)
+
+// Backends of a UTM virtual machine.
+const (
+	BackendQEMU  = "QEMU"
+	BackendApple = "Apple"
+)
+
+// Config is the content of a UTM bundle's config.plist.
+//
+// Only the settings the builders work with are available as fields. Every
+// other key is kept as decoded and written back unchanged, so a bundle
+// created by a newer UTM survives a round trip through this package.
+type Config struct {
+	Backend              string
+	ConfigurationVersion int
+	Information          Information
+	System               System
+	QEMU                 QEMU
+	Sharing              Sharing
+	Drives               []Drive
+	Networks             []Network
+	Displays             []Display
+
+	raw map[string]interface{}
+}
+
+// Information holds the name, id, icon and notes of the VM.
+type Information struct {
+	Name string
+	UUID string
+	// Icon is the name of a built-in icon, or of a file in the Data
+	// directory when IconCustom is set.
+	Icon       string
+	IconCustom bool
+	Notes      string
+
+	raw map[string]interface{}
+}
+
+// System holds the CPU and memory settings of the VM.
+type System struct {
+	Architecture string
+	Target       string
+	CPU          string
+	CPUCount     int
+	// MemorySize is the memory size in MiB.
+	MemorySize int
+
+	raw map[string]interface{}
+}
+
+// QEMU holds the QEMU specific settings of the VM.
+type QEMU struct {
+	// AdditionalArguments are passed to QEMU as-is.
+	AdditionalArguments []string
+	Hypervisor          bool
+	UEFIBoot            bool
+
+	raw map[string]interface{}
+}
+
+// Sharing holds the directory and clipboard sharing settings of the VM.
+type Sharing struct {
+	DirectoryShareMode     string
+	DirectoryShareReadOnly bool
+	ClipboardSharing       bool
+
+	raw map[string]interface{}
+}
+
+// Drive is a disk or removable drive of the VM. The image of the drive,
+// if any, is stored as ImageName in the Data directory of the bundle.
+type Drive struct {
+	Identifier       string
+	ImageName        string
+	ImageType        string
+	Interface        string
+	InterfaceVersion int
+	ReadOnly         bool
+
+	raw map[string]interface{}
+}
+
+// Network is a network interface of the VM.
+type Network struct {
+	Mode            string
+	Hardware        string
+	MacAddress      string
+	BridgeInterface string
+	IsolateFromHost bool
+	PortForwards    []PortForward
+
+	raw map[string]interface{}
+}
+
+// PortForward forwards a host port to a guest port. It is only used in
+// emulated network mode.
+type PortForward struct {
+	Protocol     string
+	GuestAddress string
+	GuestPort    int
+	HostAddress  string
+	HostPort     int
+
+	raw map[string]interface{}
+}
+
+// Display is a display device of the VM.
+type Display struct {
+	Hardware string
+
+	raw map[string]interface{}
+}
+
+// DecodeConfig reads a config.plist.
+func DecodeConfig(r io.Reader) (*Config, error) {
+	root, err := decodePlist(r)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := root.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("config.plist root is a %T, not a dictionary", root)
+	}
+
+	d := &decoder{}
+	c := &Config{raw: m}
+	c.Backend = d.string(m, "Backend")
+	c.ConfigurationVersion = d.int(m, "ConfigurationVersion")
+	c.Information.decode(d, d.dict(m, "Information"))
+	c.System.decode(d, d.dict(m, "System"))
+	c.QEMU.decode(d, d.dict(m, "QEMU"))
+	c.Sharing.decode(d, d.dict(m, "Sharing"))
+	for _, dm := range d.dicts(m, "Drive") {
+		var drive Drive
+		drive.decode(d, dm)
+		c.Drives = append(c.Drives, drive)
+	}
+	for _, nm := range d.dicts(m, "Network") {
+		var network Network
+		network.decode(d, nm)
+		c.Networks = append(c.Networks, network)
+	}
+	for _, dm := range d.dicts(m, "Display") {
+		var display Display
+		display.decode(d, dm)
+		c.Displays = append(c.Displays, display)
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+	return c, nil
+}
+
+// Encode writes the config as an XML property list.
+func (c *Config) Encode(w io.Writer) error {
+	m := clone(c.raw)
+	setString(m, "Backend", c.Backend)
+	setInt(m, "ConfigurationVersion", c.ConfigurationVersion)
+	setDict(m, "Information", c.Information.encode())
+	setDict(m, "System", c.System.encode())
+	setDict(m, "QEMU", c.QEMU.encode())
+	setDict(m, "Sharing", c.Sharing.encode())
+
+	drives := make([]interface{}, 0, len(c.Drives))
+	for _, drive := range c.Drives {
+		drives = append(drives, drive.encode())
+	}
+	setArray(m, "Drive", drives)
+
+	networks := make([]interface{}, 0, len(c.Networks))
+	for _, network := range c.Networks {
+		networks = append(networks, network.encode())
+	}
+	setArray(m, "Network", networks)
+
+	displays := make([]interface{}, 0, len(c.Displays))
+	for _, display := range c.Displays {
+		displays = append(displays, display.encode())
+	}
+	setArray(m, "Display", displays)
+
+	return encodePlist(w, m)
+}
+
+func (i *Information) decode(d *decoder, m map[string]interface{}) {
+	i.raw = m
+	i.Name = d.string(m, "Name")
+	i.UUID = d.string(m, "UUID")
+	i.Icon = d.string(m, "Icon")
+	i.IconCustom = d.bool(m, "IconCustom")
+	i.Notes = d.string(m, "Notes")
+}
+
+func (i Information) encode() map[string]interface{} {
+	m := clone(i.raw)
+	setString(m, "Name", i.Name)
+	setString(m, "UUID", i.UUID)
+	setString(m, "Icon", i.Icon)
+	setBool(m, "IconCustom", i.IconCustom)
+	setString(m, "Notes", i.Notes)
+	return m
+}
+
+func (s *System) decode(d *decoder, m map[string]interface{}) {
+	s.raw = m
+	s.Architecture = d.string(m, "Architecture")
+	s.Target = d.string(m, "Target")
+	s.CPU = d.string(m, "CPU")
+	s.CPUCount = d.int(m, "CPUCount")
+	s.MemorySize = d.int(m, "MemorySize")
+}
+
+func (s System) encode() map[string]interface{} {
+	m := clone(s.raw)
+	setString(m, "Architecture", s.Architecture)
+	setString(m, "Target", s.Target)
+	setString(m, "CPU", s.CPU)
+	setInt(m, "CPUCount", s.CPUCount)
+	setInt(m, "MemorySize", s.MemorySize)
+	return m
+}
+
+func (q *QEMU) decode(d *decoder, m map[string]interface{}) {
+	q.raw = m
+	q.AdditionalArguments = d.strings(m, "AdditionalArguments")
+	q.Hypervisor = d.bool(m, "Hypervisor")
+	q.UEFIBoot = d.bool(m, "UEFIBoot")
+}
+
+func (q QEMU) encode() map[string]interface{} {
+	m := clone(q.raw)
+	args := make([]interface{}, 0, len(q.AdditionalArguments))
+	for _, arg := range q.AdditionalArguments {
+		args = append(args, arg)
+	}
+	setArray(m, "AdditionalArguments", args)
+	setBool(m, "Hypervisor", q.Hypervisor)
+	setBool(m, "UEFIBoot", q.UEFIBoot)
+	return m
+}
+
+func (s *Sharing) decode(d *decoder, m map[string]interface{}) {
+	s.raw = m
+	s.DirectoryShareMode = d.string(m, "DirectoryShareMode")
+	s.DirectoryShareReadOnly = d.bool(m, "DirectoryShareReadOnly")
+	s.ClipboardSharing = d.bool(m, "ClipboardSharing")
+}
+
+func (s Sharing) encode() map[string]interface{} {
+	m := clone(s.raw)
+	setString(m, "DirectoryShareMode", s.DirectoryShareMode)
+	setBool(m, "DirectoryShareReadOnly", s.DirectoryShareReadOnly)
+	setBool(m, "ClipboardSharing", s.ClipboardSharing)
+	return m
+}
+
+func (dr *Drive) decode(d *decoder, m map[string]interface{}) {
+	dr.raw = m
+	dr.Identifier = d.string(m, "Identifier")
+	dr.ImageName = d.string(m, "ImageName")
+	dr.ImageType = d.string(m, "ImageType")
+	dr.Interface = d.string(m, "Interface")
+	dr.InterfaceVersion = d.int(m, "InterfaceVersion")
+	dr.ReadOnly = d.bool(m, "ReadOnly")
+}
+
+func (dr Drive) encode() map[string]interface{} {
+	m := clone(dr.raw)
+	setString(m, "Identifier", dr.Identifier)
+	setString(m, "ImageName", dr.ImageName)
+	setString(m, "ImageType", dr.ImageType)
+	setString(m, "Interface", dr.Interface)
+	setInt(m, "InterfaceVersion", dr.InterfaceVersion)
+	setBool(m, "ReadOnly", dr.ReadOnly)
+	return m
+}
+
+func (n *Network) decode(d *decoder, m map[string]interface{}) {
+	n.raw = m
+	n.Mode = d.string(m, "Mode")
+	n.Hardware = d.string(m, "Hardware")
+	n.MacAddress = d.string(m, "MacAddress")
+	n.BridgeInterface = d.string(m, "BridgeInterface")
+	n.IsolateFromHost = d.bool(m, "IsolateFromHost")
+	for _, pm := range d.dicts(m, "PortForward") {
+		var forward PortForward
+		forward.decode(d, pm)
+		n.PortForwards = append(n.PortForwards, forward)
+	}
+}
+
+func (n Network) encode() map[string]interface{} {
+	m := clone(n.raw)
+	setString(m, "Mode", n.Mode)
+	setString(m, "Hardware", n.Hardware)
+	setString(m, "MacAddress", n.MacAddress)
+	setString(m, "BridgeInterface", n.BridgeInterface)
+	setBool(m, "IsolateFromHost", n.IsolateFromHost)
+	forwards := make([]interface{}, 0, len(n.PortForwards))
+	for _, forward := range n.PortForwards {
+		forwards = append(forwards, forward.encode())
+	}
+	setArray(m, "PortForward", forwards)
+	return m
+}
+
+func (p *PortForward) decode(d *decoder, m map[string]interface{}) {
+	p.raw = m
+	p.Protocol = d.string(m, "Protocol")
+	p.GuestAddress = d.string(m, "GuestAddress")
+	p.GuestPort = d.int(m, "GuestPort")
+	p.HostAddress = d.string(m, "HostAddress")
+	p.HostPort = d.int(m, "HostPort")
+}
+
+func (p PortForward) encode() map[string]interface{} {
+	m := clone(p.raw)
+	setString(m, "Protocol", p.Protocol)
+	setString(m, "GuestAddress", p.GuestAddress)
+	setInt(m, "GuestPort", p.GuestPort)
+	setString(m, "HostAddress", p.HostAddress)
+	setInt(m, "HostPort", p.HostPort)
+	return m
+}
+
+func (di *Display) decode(d *decoder, m map[string]interface{}) {
+	di.raw = m
+	di.Hardware = d.string(m, "Hardware")
+}
+
+func (di Display) encode() map[string]interface{} {
+	m := clone(di.raw)
+	setString(m, "Hardware", di.Hardware)
+	return m
+}
+
+// decoder reads typed values out of decoded plist dictionaries and keeps
+// the first type mismatch it finds.
+type decoder struct {
+	err error
+}
+
+func (d *decoder) mismatch(key string, want string, got interface{}) {
+	if d.err == nil {
+		d.err = fmt.Errorf("config.plist: %s should be a %s, found %T", key, want, got)
+	}
+}
+
+func (d *decoder) string(m map[string]interface{}, key string) string {
+	v, ok := m[key]
+	if !ok {
+		return ""
+	}
+	s, ok := v.(string)
+	if !ok {
+		d.mismatch(key, "string", v)
+	}
+	return s
+}
+
+func (d *decoder) int(m map[string]interface{}, key string) int {
+	v, ok := m[key]
+	if !ok {
+		return 0
+	}
+	switch i := v.(type) {
+	case int64:
+		return int(i)
+	case uint64:
+		return int(i)
+	}
+	d.mismatch(key, "integer", v)
+	return 0
+}
+
+func (d *decoder) bool(m map[string]interface{}, key string) bool {
+	v, ok := m[key]
+	if !ok {
+		return false
+	}
+	b, ok := v.(bool)
+	if !ok {
+		d.mismatch(key, "boolean", v)
+	}
+	return b
+}
+
+func (d *decoder) dict(m map[string]interface{}, key string) map[string]interface{} {
+	v, ok := m[key]
+	if !ok {
+		return nil
+	}
+	dict, ok := v.(map[string]interface{})
+	if !ok {
+		d.mismatch(key, "dictionary", v)
+	}
+	return dict
+}
+
+func (d *decoder) array(m map[string]interface{}, key string) []interface{} {
+	v, ok := m[key]
+	if !ok {
+		return nil
+	}
+	array, ok := v.([]interface{})
+	if !ok {
+		d.mismatch(key, "array", v)
+	}
+	return array
+}
+
+func (d *decoder) dicts(m map[string]interface{}, key string) []map[string]interface{} {
+	var dicts []map[string]interface{}
+	for _, v := range d.array(m, key) {
+		dict, ok := v.(map[string]interface{})
+		if !ok {
+			d.mismatch(key, "array of dictionaries", v)
+			continue
+		}
+		dicts = append(dicts, dict)
+	}
+	return dicts
+}
+
+func (d *decoder) strings(m map[string]interface{}, key string) []string {
+	var strs []string
+	for _, v := range d.array(m, key) {
+		s, ok := v.(string)
+		if !ok {
+			d.mismatch(key, "array of strings", v)
+			continue
+		}
+		strs = append(strs, s)
+	}
+	return strs
+}
+
+// clone returns a shallow copy of m, which is never nil.
+func clone(m map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// The set helpers only add a key that was not in the original file when the
+// value is not empty, so that encoding does not add defaults UTM never wrote.
+
+func setString(m map[string]interface{}, key string, v string) {
+	if _, ok := m[key]; ok || v != "" {
+		m[key] = v
+	}
+}
+
+func setInt(m map[string]interface{}, key string, v int) {
+	if _, ok := m[key]; ok || v != 0 {
+		m[key] = int64(v)
+	}
+}
+
+func setBool(m map[string]interface{}, key string, v bool) {
+	if _, ok := m[key]; ok || v {
+		m[key] = v
+	}
+}
+
+func setDict(m map[string]interface{}, key string, v map[string]interface{}) {
+	if _, ok := m[key]; ok || len(v) > 0 {
+		m[key] = v
+	}
+}
+
+func setArray(m map[string]interface{}, key string, v []interface{}) {
+	if _, ok := m[key]; ok || len(v) > 0 {
+		m[key] = v
+	}
+}
@@ -0,0 +1,309 @@
+package bundle
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UTM writes its config.plist as an XML property list. We only need a small
+// part of the format, so instead of pulling in a plist library we decode
+// into plain Go values:
+//
+//	<dict>    map[string]interface{}
+//	<array>   []interface{}
+//	<string>  string
+//	<integer> int64 (uint64 if it does not fit)
+//	<real>    float64
+//	<true/>   bool
+//	<data>    []byte
+//	<date>    time.Time
+//
+// Dictionaries are written with sorted keys and tab indentation, like
+// Foundation does, so a decoded and re-encoded file stays the same.
+
+const plistHeader = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+`
+
+// Binary property lists start with this magic.
+const binaryPlistMagic = "bplist"
+
+// decodePlist reads an XML or binary property list and returns its root
+// value.
+func decodePlist(r io.Reader) (interface{}, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(len(binaryPlistMagic)); err == nil && string(magic) == binaryPlistMagic {
+		data, err := io.ReadAll(br)
+		if err != nil {
+			return nil, err
+		}
+		return decodeBinaryPlist(data)
+	}
+
+	d := xml.NewDecoder(br)
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			if err == io.EOF {
+				return nil, errors.New("no plist element found")
+			}
+			return nil, err
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			if start.Name.Local != "plist" {
+				return nil, fmt.Errorf("unexpected root element <%s>", start.Name.Local)
+			}
+			break
+		}
+	}
+
+	start, err := nextStart(d)
+	if err != nil {
+		return nil, err
+	}
+	return decodeValue(d, start)
+}
+
+// DecodePlist reads an XML or binary property list other than a UTM
+// config, e.g. one of the macOS preferences, and returns its root value.
+func DecodePlist(r io.Reader) (interface{}, error) {
+	return decodePlist(r)
+}
+
+// nextStart returns the next start element, skipping character data and
+// comments. It fails if an end element is found first.
+func nextStart(d *xml.Decoder) (xml.StartElement, error) {
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return xml.StartElement{}, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			return t, nil
+		case xml.EndElement:
+			return xml.StartElement{}, fmt.Errorf("unexpected </%s>", t.Name.Local)
+		}
+	}
+}
+
+func decodeValue(d *xml.Decoder, start xml.StartElement) (interface{}, error) {
+	switch start.Name.Local {
+	case "dict":
+		return decodeDict(d)
+	case "array":
+		return decodeArray(d)
+	case "true", "false":
+		if err := d.Skip(); err != nil {
+			return nil, err
+		}
+		return start.Name.Local == "true", nil
+	}
+
+	var text string
+	if err := d.DecodeElement(&text, &start); err != nil {
+		return nil, err
+	}
+
+	switch start.Name.Local {
+	case "string":
+		return text, nil
+	case "integer":
+		text = strings.TrimSpace(text)
+		if i, err := strconv.ParseInt(text, 10, 64); err == nil {
+			return i, nil
+		}
+		u, err := strconv.ParseUint(text, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid integer %q", text)
+		}
+		return u, nil
+	case "real":
+		f, err := strconv.ParseFloat(strings.TrimSpace(text), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid real %q", text)
+		}
+		return f, nil
+	case "data":
+		data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(text), ""))
+		if err != nil {
+			return nil, fmt.Errorf("invalid data: %s", err)
+		}
+		return data, nil
+	case "date":
+		date, err := time.Parse(time.RFC3339, strings.TrimSpace(text))
+		if err != nil {
+			return nil, fmt.Errorf("invalid date %q", text)
+		}
+		return date, nil
+	}
+
+	return nil, fmt.Errorf("unsupported plist element <%s>", start.Name.Local)
+}
+
+func decodeDict(d *xml.Decoder) (map[string]interface{}, error) {
+	dict := make(map[string]interface{})
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.EndElement:
+			return dict, nil
+		case xml.StartElement:
+			if t.Name.Local != "key" {
+				return nil, fmt.Errorf("expected <key> in <dict>, found <%s>", t.Name.Local)
+			}
+			var key string
+			if err := d.DecodeElement(&key, &t); err != nil {
+				return nil, err
+			}
+			start, err := nextStart(d)
+			if err != nil {
+				return nil, fmt.Errorf("missing value for key %q: %s", key, err)
+			}
+			value, err := decodeValue(d, start)
+			if err != nil {
+				return nil, fmt.Errorf("key %q: %s", key, err)
+			}
+			dict[key] = value
+		}
+	}
+}
+
+func decodeArray(d *xml.Decoder) ([]interface{}, error) {
+	array := make([]interface{}, 0)
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.EndElement:
+			return array, nil
+		case xml.StartElement:
+			value, err := decodeValue(d, t)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, value)
+		}
+	}
+}
+
+// encodePlist writes v as an XML property list.
+func encodePlist(w io.Writer, v interface{}) error {
+	var buf bytes.Buffer
+	buf.WriteString(plistHeader)
+	if err := encodeValue(&buf, v, 0); err != nil {
+		return err
+	}
+	buf.WriteString("</plist>\n")
+
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+func encodeValue(buf *bytes.Buffer, v interface{}, depth int) error {
+	indent := strings.Repeat("\t", depth)
+
+	switch value := v.(type) {
+	case map[string]interface{}:
+		if len(value) == 0 {
+			buf.WriteString(indent + "<dict/>\n")
+			return nil
+		}
+		keys := make([]string, 0, len(value))
+		for k := range value {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		buf.WriteString(indent + "<dict>\n")
+		for _, k := range keys {
+			buf.WriteString(indent + "\t<key>" + escapeText(k) + "</key>\n")
+			if err := encodeValue(buf, value[k], depth+1); err != nil {
+				return fmt.Errorf("key %q: %s", k, err)
+			}
+		}
+		buf.WriteString(indent + "</dict>\n")
+	case []interface{}:
+		if len(value) == 0 {
+			buf.WriteString(indent + "<array/>\n")
+			return nil
+		}
+		buf.WriteString(indent + "<array>\n")
+		for _, item := range value {
+			if err := encodeValue(buf, item, depth+1); err != nil {
+				return err
+			}
+		}
+		buf.WriteString(indent + "</array>\n")
+	case string:
+		buf.WriteString(indent + "<string>" + escapeText(value) + "</string>\n")
+	case bool:
+		if value {
+			buf.WriteString(indent + "<true/>\n")
+		} else {
+			buf.WriteString(indent + "<false/>\n")
+		}
+	case int:
+		buf.WriteString(indent + "<integer>" + strconv.Itoa(value) + "</integer>\n")
+	case int64:
+		buf.WriteString(indent + "<integer>" + strconv.FormatInt(value, 10) + "</integer>\n")
+	case uint64:
+		buf.WriteString(indent + "<integer>" + strconv.FormatUint(value, 10) + "</integer>\n")
+	case float64:
+		buf.WriteString(indent + "<real>" + formatReal(value) + "</real>\n")
+	case []byte:
+		buf.WriteString(indent + "<data>\n")
+		encoded := base64.StdEncoding.EncodeToString(value)
+		for len(encoded) > 0 {
+			n := len(encoded)
+			if n > 68 {
+				n = 68
+			}
+			buf.WriteString(indent + encoded[:n] + "\n")
+			encoded = encoded[n:]
+		}
+		buf.WriteString(indent + "</data>\n")
+	case time.Time:
+		buf.WriteString(indent + "<date>" + value.UTC().Format("2006-01-02T15:04:05Z") + "</date>\n")
+	default:
+		return fmt.Errorf("unsupported plist value of type %T", v)
+	}
+
+	return nil
+}
+
+func formatReal(f float64) string {
+	if f == math.Trunc(f) && math.Abs(f) < 1e15 {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func escapeText(s string) string {
+	var buf bytes.Buffer
+	// EscapeText only fails if the writer fails
+	_ = xml.EscapeText(&buf, []byte(s))
+	// Foundation keeps newlines and quotes as-is
+	out := buf.String()
+	out = strings.ReplaceAll(out, "&#xA;", "\n")
+	out = strings.ReplaceAll(out, "&#34;", "\"")
+	out = strings.ReplaceAll(out, "&#39;", "'")
+	out = strings.ReplaceAll(out, "&#x9;", "\t")
+	return out
+}
@@ -0,0 +1,73 @@
+package bundle
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// TreeHash returns the tree hash of the bundle at path, as
+// sha256:<hex>. A bundle is a directory, which has no checksum of its
+// own: the tree hash is the SHA-256 of the listing of the SHA-256 of its
+// files, in the format of sha256sum. The listing has a line
+// `<SHA-256 of the file>  <path>` for every file, with the path relative
+// to the bundle and separated by slashes, sorted in byte order. Directories
+// are only part of the hash through the paths of their files. It is the
+// output of:
+//
+//	cd Linux.utm && find . -type f | cut -c3- | LC_ALL=C sort | \
+//	    tr '\n' '\0' | xargs -0 sha256sum | sha256sum
+func TreeHash(path string) (string, error) {
+	var files []string
+	err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return fmt.Errorf("%s isn't a regular file", p)
+		}
+		rel, err := filepath.Rel(path, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	// WalkDir sorts the names of each directory, not the paths
+	sort.Strings(files)
+
+	tree := sha256.New()
+	for _, file := range files {
+		sum, err := fileHash(filepath.Join(path, filepath.FromSlash(file)))
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(tree, "%s  %s\n", sum, file)
+	}
+	return "sha256:" + hex.EncodeToString(tree.Sum(nil)), nil
+}
+
+func fileHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
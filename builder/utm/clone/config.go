@@ -0,0 +1,116 @@
+//go:generate packer-sdc struct-markdown
+//go:generate packer-sdc mapstructure-to-hcl2 -type Config
+
+package clone
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/packer-plugin-sdk/common"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/template/config"
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+	utmcommon "github.com/naveenrajm7/packer-plugin-utm/builder/utm/common"
+)
+
+// Config is the configuration structure for the builder.
+type Config struct {
+	common.PackerConfig             `mapstructure:",squash"`
+	utmcommon.ExportConfig          `mapstructure:",squash"`
+	utmcommon.OutputConfig          `mapstructure:",squash"`
+	utmcommon.CommConfig            `mapstructure:",squash"`
+	utmcommon.ShutdownConfig        `mapstructure:",squash"`
+	utmcommon.UtmVersionConfig      `mapstructure:",squash"`
+	utmcommon.RemoteConfig          `mapstructure:",squash"`
+	utmcommon.SnapshotConfig        `mapstructure:",squash"`
+	utmcommon.NetworkConfig         `mapstructure:",squash"`
+	utmcommon.SharedDirectoryConfig `mapstructure:",squash"`
+	// The name of the VM registered in UTM to clone. Exactly one of
+	// `source_vm_name` and `source_vm_id` must be set.
+	SourceVMName string `mapstructure:"source_vm_name" required:"true"`
+	// The UUID of the VM registered in UTM to clone, as shown by
+	// `utmctl list`.
+	SourceVMID string `mapstructure:"source_vm_id" required:"true"`
+	// This is the name of the cloned virtual machine and of the exported UTM
+	// file, without the file extension. By default this is
+	// packer-BUILDNAME-TIMESTAMP, where "BUILDNAME" is the name of the build.
+	VMName string `mapstructure:"vm_name" required:"false"`
+	// Set this to true if you would like to keep
+	// the cloned VM registered with UTM. Defaults to false.
+	KeepRegistered bool `mapstructure:"keep_registered" required:"false"`
+	// Defaults to false. When enabled, Packer will
+	// not export the VM. Useful if the build output is not the resultant image,
+	// but created inside the VM.
+	SkipExport bool `mapstructure:"skip_export" required:"false"`
+
+	ctx interpolate.Context
+}
+
+func (c *Config) Prepare(raws ...interface{}) ([]string, error) {
+	err := config.Decode(c, &config.DecodeOpts{
+		PluginType:         utmcommon.BuilderId, // "naveenrajm7.utm"
+		Interpolate:        true,
+		InterpolateContext: &c.ctx,
+		InterpolateFilter: &interpolate.RenderFilter{
+			Exclude: []string{
+				"boot_command",
+				"shared_directory",
+			},
+		},
+	}, raws...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Defaults
+	if c.VMName == "" {
+		c.VMName = fmt.Sprintf(
+			"packer-%s-%d", c.PackerBuildName, interpolate.InitTime.Unix())
+	}
+
+	// Prepare the errors
+	var errs *packersdk.MultiError
+	errs = packersdk.MultiErrorAppend(errs, c.ExportConfig.Prepare(&c.ctx)...)
+	errs = packersdk.MultiErrorAppend(errs, c.OutputConfig.Prepare(&c.ctx, &c.PackerConfig)...)
+	errs = packersdk.MultiErrorAppend(errs, c.ShutdownConfig.Prepare(&c.ctx)...)
+	errs = packersdk.MultiErrorAppend(errs, c.CommConfig.Prepare(&c.ctx)...)
+	errs = packersdk.MultiErrorAppend(errs, c.RemoteConfig.Prepare(&c.ctx)...)
+	errs = packersdk.MultiErrorAppend(errs, c.SnapshotConfig.Prepare(&c.ctx, c.ShutdownCommand)...)
+	errs = packersdk.MultiErrorAppend(errs, c.NetworkConfig.Prepare(&c.ctx, &c.CommConfig)...)
+	// The backend of the source VM is only known once it is imported
+	errs = packersdk.MultiErrorAppend(errs, c.SharedDirectoryConfig.Prepare(&c.ctx, "")...)
+	errs = packersdk.MultiErrorAppend(errs, c.UtmVersionConfig.Prepare(c.CommConfig.Comm.Type)...)
+
+	if c.SourceVMName == "" && c.SourceVMID == "" {
+		errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("one of source_vm_name or source_vm_id is required"))
+	}
+	if c.SourceVMName != "" && c.SourceVMID != "" {
+		errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("only one of source_vm_name or source_vm_id can be specified"))
+	}
+	if c.VMName == c.SourceVMName {
+		errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("vm_name must be different from source_vm_name"))
+	}
+
+	// Warnings
+	var warnings []string
+	if c.ShutdownCommand == "" {
+		warnings = append(warnings,
+			"A shutdown_command was not specified. Without a shutdown command, Packer\n"+
+				"will forcibly halt the virtual machine, which may result in data loss.")
+	}
+
+	// Check for any errors.
+	if errs != nil && len(errs.Errors) > 0 {
+		return warnings, errs
+	}
+
+	return warnings, nil
+}
+
+// sourceVM returns the name or ID that identifies the source VM.
+func (c *Config) sourceVM() string {
+	if c.SourceVMID != "" {
+		return c.SourceVMID
+	}
+	return c.SourceVMName
+}
@@ -0,0 +1,86 @@
+package clone
+
+import (
+	"testing"
+)
+
+func testConfig(t *testing.T) map[string]interface{} {
+	return map[string]interface{}{
+		"ssh_username":     "foo",
+		"shutdown_command": "foo",
+		"source_vm_name":   "debian",
+	}
+}
+
+func TestNewConfig_sourceVM(t *testing.T) {
+	// Good
+	for _, key := range []string{"source_vm_name", "source_vm_id"} {
+		cfg := testConfig(t)
+		delete(cfg, "source_vm_name")
+		cfg[key] = "debian"
+		var c Config
+		warns, err := c.Prepare(cfg)
+		if len(warns) > 0 {
+			t.Fatalf("bad: %#v", warns)
+		}
+		if err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+		if c.sourceVM() != "debian" {
+			t.Fatalf("bad: %s", c.sourceVM())
+		}
+	}
+
+	// Neither
+	cfg := testConfig(t)
+	delete(cfg, "source_vm_name")
+	var c Config
+	if _, err := c.Prepare(cfg); err == nil {
+		t.Fatalf("should error without a source VM")
+	}
+
+	// Both
+	cfg = testConfig(t)
+	cfg["source_vm_id"] = "6E1B0B4C-3C55-4A0C-9D8E-6F2B7A1C0D9E"
+	c = Config{}
+	if _, err := c.Prepare(cfg); err == nil {
+		t.Fatalf("should error with both source_vm_name and source_vm_id")
+	}
+
+	// Same name as the source
+	cfg = testConfig(t)
+	cfg["vm_name"] = "debian"
+	c = Config{}
+	if _, err := c.Prepare(cfg); err == nil {
+		t.Fatalf("should error when vm_name is the source")
+	}
+}
+
+func TestNewConfig_vmName(t *testing.T) {
+	var c Config
+	if _, err := c.Prepare(testConfig(t)); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if c.VMName == "" {
+		t.Fatalf("vm_name should have a default")
+	}
+}
+
+func TestNewConfig_sharedDirectory(t *testing.T) {
+	// The backend of the source VM isn't known
+	cfg := testConfig(t)
+	cfg["shared_directory"] = map[string]interface{}{"path": "/share"}
+	var c Config
+	if _, err := c.Prepare(cfg); err == nil {
+		t.Fatalf("should error without a mode")
+	}
+
+	cfg["shared_directory"] = map[string]interface{}{"path": "/share", "mode": "virtiofs"}
+	c = Config{}
+	if _, err := c.Prepare(cfg); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if c.SharedDirectory.Mode != "virtiofs" {
+		t.Fatalf("bad: %#v", c.SharedDirectory)
+	}
+}
@@ -0,0 +1,164 @@
+package clone
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	utmcommon "github.com/naveenrajm7/packer-plugin-utm/builder/utm/common"
+)
+
+// How long, and how often, the clone is looked up after utmctl clone.
+var (
+	cloneLookupTimeout  = 30 * time.Second
+	cloneLookupInterval = time.Second
+)
+
+// This step clones a VM registered in UTM. The source VM is only read, never
+// started or changed, and is never deleted during cleanup.
+//
+// Uses:
+//
+//	driver Driver
+//	ui packersdk.Ui
+//
+// Produces:
+//
+//	vmId string - The UUID of the clone
+//	vmName string - The name of the clone
+type StepCloneVM struct {
+	Source         string
+	Name           string
+	KeepRegistered bool
+
+	sourceId string
+	vmId     string
+}
+
+func (s *StepCloneVM) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	driver := state.Get("driver").(utmcommon.Driver)
+	ui := state.Get("ui").(packersdk.Ui)
+
+	vms, err := utmcommon.ListVMs(ctx, driver)
+	if err != nil {
+		err := fmt.Errorf("error listing VMs: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	source, err := findSource(vms, s.Source)
+	if err == nil && source.Status != "stopped" {
+		err = fmt.Errorf("source VM %s is %s, it must be stopped to be cloned", s.Source, source.Status)
+	}
+	if err == nil {
+		for _, vm := range vms {
+			if vm.Name == s.Name {
+				err = fmt.Errorf("a VM named %s already exists (%s)", s.Name, vm.ID)
+			}
+		}
+	}
+	if err != nil {
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	s.sourceId = source.ID
+
+	ui.Say(fmt.Sprintf("Cloning VM %s (%s) as %s...", source.Name, source.ID, s.Name))
+	if _, err := driver.Utmctl(ctx, "clone", "--name", s.Name, source.ID); err != nil {
+		err := fmt.Errorf("error cloning VM: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	// utmctl clone does not print the UUID of the clone, so look it up by
+	// its name, which was checked to be unique above.
+	s.vmId, err = s.findClone(ctx, driver)
+	if err != nil {
+		err := fmt.Errorf("error finding cloned VM: %s. The clone %s may be left in UTM, delete it by hand", err, s.Name)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	state.Put("vmId", s.vmId)
+	state.Put("vmName", s.Name)
+	return multistep.ActionContinue
+}
+
+func (s *StepCloneVM) Cleanup(state multistep.StateBag) {
+	// Never delete the source, whatever the clone lookup returned
+	if s.vmId == "" || strings.EqualFold(s.vmId, s.sourceId) {
+		return
+	}
+
+	driver := state.Get("driver").(utmcommon.Driver)
+	ui := state.Get("ui").(packersdk.Ui)
+
+	_, cancelled := state.GetOk(multistep.StateCancelled)
+	_, halted := state.GetOk(multistep.StateHalted)
+	if (s.KeepRegistered) && (!cancelled && !halted) {
+		ui.Say("Keeping virtual machine registered with UTM host (keep_registered = true)")
+		return
+	}
+
+	ui.Say("Deregistering and deleting cloned VM...")
+	utmcommon.DeleteVM(context.Background(), driver, ui, s.vmId)
+}
+
+// findClone looks up the UUID of the clone by its name. UTM may list the
+// clone only some time after utmctl clone returned, so the lookup is retried
+// for cloneLookupTimeout.
+func (s *StepCloneVM) findClone(ctx context.Context, driver utmcommon.Driver) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, cloneLookupTimeout)
+	defer cancel()
+
+	for {
+		vms, err := utmcommon.ListVMs(ctx, driver)
+		if err == nil {
+			err = fmt.Errorf("the clone %s was not found in UTM", s.Name)
+			for _, vm := range vms {
+				if vm.Name == s.Name && vm.ID != s.sourceId {
+					return vm.ID, nil
+				}
+			}
+		}
+		log.Printf("Looking up the clone %s: %s", s.Name, err)
+
+		select {
+		case <-ctx.Done():
+			return "", err
+		case <-time.After(cloneLookupInterval):
+		}
+	}
+}
+
+// findSource returns the VM with the given UUID or name. Names are not unique
+// in UTM, so an ambiguous name is an error.
+func findSource(vms []utmcommon.VMInfo, source string) (utmcommon.VMInfo, error) {
+	var matches []utmcommon.VMInfo
+	for _, vm := range vms {
+		if strings.EqualFold(vm.ID, source) {
+			return vm, nil
+		}
+		if vm.Name == source {
+			matches = append(matches, vm)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return utmcommon.VMInfo{}, fmt.Errorf("source VM %s was not found in UTM", source)
+	case 1:
+		return matches[0], nil
+	default:
+		return utmcommon.VMInfo{}, fmt.Errorf(
+			"there are %d VMs named %s, please use source_vm_id instead", len(matches), source)
+	}
+}
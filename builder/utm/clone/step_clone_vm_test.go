@@ -0,0 +1,139 @@
+package clone
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	utmcommon "github.com/naveenrajm7/packer-plugin-utm/builder/utm/common"
+)
+
+func TestStepCloneVM_impl(t *testing.T) {
+	var _ multistep.Step = new(StepCloneVM)
+}
+
+func TestStepCloneVM(t *testing.T) {
+	driver := new(utmcommon.DriverSimulator)
+	sourceId := driver.AddVM(utmcommon.SimulatedVM{Name: "debian"})
+
+	state := testState(t)
+	state.Put("driver", driver)
+	step := &StepCloneVM{Source: "debian", Name: "packer"}
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v: %s", action, state.Get("error"))
+	}
+
+	vmId := state.Get("vmId").(string)
+	if vmId == sourceId || state.Get("vmName").(string) != "packer" {
+		t.Fatalf("bad: %s", vmId)
+	}
+	if clone := driver.VM(vmId); clone == nil || clone.Name != "packer" {
+		t.Fatalf("bad: %#v", clone)
+	}
+
+	// The clone is deleted, the source is kept
+	step.Cleanup(state)
+	vms := driver.VMs()
+	if len(vms) != 1 || vms[0].ID != sourceId {
+		t.Fatalf("bad: %#v", vms)
+	}
+}
+
+func TestStepCloneVM_keepRegistered(t *testing.T) {
+	driver := new(utmcommon.DriverSimulator)
+	sourceId := driver.AddVM(utmcommon.SimulatedVM{Name: "debian"})
+
+	state := testState(t)
+	state.Put("driver", driver)
+	step := &StepCloneVM{Source: sourceId, Name: "packer", KeepRegistered: true}
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v: %s", action, state.Get("error"))
+	}
+
+	step.Cleanup(state)
+	if vms := driver.VMs(); len(vms) != 2 {
+		t.Fatalf("bad: %#v", vms)
+	}
+
+	// A failed build deletes the clone anyway
+	state.Put(multistep.StateHalted, true)
+	step.Cleanup(state)
+	if vms := driver.VMs(); len(vms) != 1 || vms[0].ID != sourceId {
+		t.Fatalf("bad: %#v", vms)
+	}
+}
+
+func TestStepCloneVM_refused(t *testing.T) {
+	cases := map[string]struct {
+		vms    []utmcommon.SimulatedVM
+		source string
+	}{
+		"missing": {
+			vms:    []utmcommon.SimulatedVM{{Name: "other"}},
+			source: "debian",
+		},
+		"running": {
+			vms:    []utmcommon.SimulatedVM{{Name: "debian", Status: "started"}},
+			source: "debian",
+		},
+		"ambiguous": {
+			vms:    []utmcommon.SimulatedVM{{Name: "debian"}, {Name: "debian"}},
+			source: "debian",
+		},
+		"existing clone": {
+			vms:    []utmcommon.SimulatedVM{{Name: "debian"}, {Name: "packer"}},
+			source: "debian",
+		},
+	}
+
+	for name, tc := range cases {
+		driver := new(utmcommon.DriverSimulator)
+		for _, vm := range tc.vms {
+			driver.AddVM(vm)
+		}
+
+		state := testState(t)
+		state.Put("driver", driver)
+		step := &StepCloneVM{Source: tc.source, Name: "packer"}
+		if action := step.Run(context.Background(), state); action != multistep.ActionHalt {
+			t.Fatalf("%s: bad action: %#v", name, action)
+		}
+		step.Cleanup(state)
+
+		if vms := driver.VMs(); len(vms) != len(tc.vms) {
+			t.Fatalf("%s: bad: %#v", name, vms)
+		}
+		for _, call := range driver.Calls {
+			if call[1] != "list" {
+				t.Fatalf("%s: only list should be called: %#v", name, driver.Calls)
+			}
+		}
+	}
+}
+
+func TestStepCloneVM_cloneNotFound(t *testing.T) {
+	defer func(timeout, interval time.Duration) {
+		cloneLookupTimeout, cloneLookupInterval = timeout, interval
+	}(cloneLookupTimeout, cloneLookupInterval)
+	cloneLookupTimeout, cloneLookupInterval = 50*time.Millisecond, time.Millisecond
+
+	// UTM never lists the clone
+	state := testState(t)
+	driver := state.Get("driver").(*utmcommon.DriverMock)
+	driver.UtmctlResult = "UUID                                 Status   Name\n" +
+		"0B3A5A3C-3B4D-4B2E-9E7F-1F2A3B4C5D6E stopped  debian\n"
+	step := &StepCloneVM{Source: "debian", Name: "packer"}
+	if action := step.Run(context.Background(), state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	// The lookup is retried, and the error names the clone
+	if len(driver.UtmctlCalls) < 4 {
+		t.Fatalf("bad: %#v", driver.UtmctlCalls)
+	}
+	if err := state.Get("error").(error); !strings.Contains(err.Error(), "The clone packer may be left in UTM") {
+		t.Fatalf("bad: %s", err)
+	}
+}
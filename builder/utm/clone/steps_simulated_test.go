@@ -0,0 +1,69 @@
+package clone
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/packer-plugin-sdk/communicator"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/naveenrajm7/packer-plugin-utm/builder/utm/bundle"
+	utmcommon "github.com/naveenrajm7/packer-plugin-utm/builder/utm/common"
+)
+
+func TestBuilderSteps_simulated(t *testing.T) {
+	// A VM with the shared and emulated network interfaces the builder
+	// expects
+	driver := new(utmcommon.DriverSimulator)
+	sourceId := driver.AddVM(utmcommon.SimulatedVM{
+		Name:    "debian",
+		Backend: "QeMu",
+		Drives:  []utmcommon.SimulatedDrive{{ID: "disk", Interface: "QdIv", Size: 10240}},
+		NetworkInterfaces: []utmcommon.SimulatedNetworkInterface{
+			{Mode: "ShRd"}, {Mode: "EmUd"},
+		},
+	})
+	source := driver.VM(sourceId)
+
+	state := testState(t)
+	state.Put("driver", driver)
+	state.Put("communicator", new(packersdk.MockCommunicator))
+
+	outputDir := t.TempDir()
+	runner := &multistep.BasicRunner{Steps: []multistep.Step{
+		&StepCloneVM{Source: "debian", Name: "packer"},
+		&utmcommon.StepPortForwarding{
+			CommConfig: &communicator.Config{
+				Type: "ssh",
+				SSH:  communicator.SSH{SSHPort: 22},
+			},
+			HostPortMin: 2222,
+			HostPortMax: 4444,
+		},
+		new(utmcommon.StepRun),
+		&utmcommon.StepShutdown{Timeout: 5 * time.Second},
+		&utmcommon.StepExport{Format: "utm", OutputDir: outputDir},
+	}}
+	runner.Run(context.Background(), state)
+	if rawErr, ok := state.GetOk("error"); ok {
+		t.Fatalf("err: %s", rawErr)
+	}
+
+	// The clone was deleted and the source left untouched
+	vms := driver.VMs()
+	if len(vms) != 1 || !reflect.DeepEqual(vms[0], *source) {
+		t.Fatalf("source VM was modified: %#v", vms)
+	}
+	for _, call := range driver.Calls {
+		if call[len(call)-1] == sourceId && call[1] != "clone" {
+			t.Fatalf("source VM should only be cloned: %#v", call)
+		}
+	}
+
+	if _, err := bundle.Open(filepath.Join(outputDir, "packer.utm")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
@@ -30,15 +30,16 @@ func (b *Builder) Prepare(raws ...interface{}) ([]string, []string, error) {
 		return nil, warnings, errs
 	}
 
-	return nil, warnings, nil
+	return b.config.GeneratedVars(), warnings, nil
 }
 
 func (b *Builder) Run(ctx context.Context, ui packersdk.Ui, hook packersdk.Hook) (packersdk.Artifact, error) {
 	// Create the driver that we'll use to communicate with UTM
-	driver, err := utmcommon.NewDriver()
+	driver, err := utmcommon.NewDriver(ctx, b.config.RemoteConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed creating UTM driver: %s", err)
 	}
+	defer driver.Close()
 
 	// Setup the state bag
 	state := new(multistep.BasicStateBag)
@@ -48,6 +49,44 @@ func (b *Builder) Run(ctx context.Context, ui packersdk.Ui, hook packersdk.Hook)
 	state.Put("hook", hook)
 	state.Put("ui", ui)
 
+	// The VM is also shut down and connected to again to snapshot its disks
+	shutdown := &utmcommon.StepShutdown{
+		Command:         b.config.ShutdownCommand,
+		Timeout:         b.config.ShutdownTimeout,
+		Delay:           b.config.PostShutdownDelay,
+		DisableShutdown: b.config.DisableShutdown,
+	}
+	connect := &communicator.StepConnect{
+		Config:    &b.config.CommConfig.Comm,
+		Host:      utmcommon.CommHost(&b.config.CommConfig),
+		SSHConfig: b.config.CommConfig.Comm.SSHConfigFunc(),
+		SSHPort:   utmcommon.CommPort,
+		WinRMPort: utmcommon.CommPort,
+	}
+	// The changes these steps make to the guest are undone by a rollback
+	mountSharedDirectory := &utmcommon.StepMountSharedDirectory{
+		SharedDirectory: b.config.SharedDirectory,
+	}
+	uploadVersion := &utmcommon.StepUploadVersion{
+		Path: *b.config.UtmVersionFile,
+	}
+
+	// The HTTP server is bound to the address guests reach the host on
+	httpServer := commonsteps.HTTPServerFromHTTPConfig(&b.config.HTTPConfig)
+	// A cloud_init seed is generated with the SSH key pair, after the CD is
+	// made and the HTTP server has started
+	createCD := &utmcommon.StepCreateCD{
+		Files:   b.config.CDConfig.CDFiles,
+		Content: b.config.CDConfig.CDContent,
+		Label:   b.config.CDConfig.CDLabel,
+	}
+	if b.config.CloudInit != nil {
+		createCD = new(utmcommon.StepCreateCD)
+		if !b.config.UseCD && b.config.Datasource == "nocloud" {
+			httpServer.HTTPContent = reserveSeedContent(httpServer.HTTPContent)
+		}
+	}
+
 	// Build the steps.
 	steps := []multistep.Step{
 		&commonsteps.StepDownload{
@@ -58,17 +97,21 @@ func (b *Builder) Run(ctx context.Context, ui packersdk.Ui, hook packersdk.Hook)
 			TargetPath:  b.config.TargetPath,
 			Url:         b.config.ISOUrls,
 		},
+		&stepPrepareCloudImage{
+			Checksum: b.config.ISOChecksum,
+		},
 		&commonsteps.StepOutputDir{
 			Force: b.config.PackerForce,
 			Path:  b.config.OutputDir,
 		},
-		&StepCreateCD{
-			Files:   b.config.CDConfig.CDFiles,
-			Content: b.config.CDConfig.CDContent,
-			Label:   b.config.CDConfig.CDLabel,
+		createCD,
+		&utmcommon.StepHTTPIPDiscover{
+			HTTPAddress:       b.config.HTTPAddress,
+			HTTPInterface:     b.config.HTTPInterface,
+			NetworkInterfaces: b.config.NetworkInterfaces,
+			HTTPServer:        httpServer,
 		},
-		new(utmcommon.StepHTTPIPDiscover),
-		commonsteps.HTTPServerFromHTTPConfig(&b.config.HTTPConfig),
+		httpServer,
 		&utmcommon.StepSshKeyPair{
 			Debug:        b.config.PackerDebug,
 			DebugKeyPath: fmt.Sprintf("%s.pem", b.config.PackerBuildName),
@@ -92,43 +135,61 @@ func (b *Builder) Run(ctx context.Context, ui packersdk.Ui, hook packersdk.Hook)
 			HostPortMax:            b.config.HostPortMax,
 			SkipNatMapping:         b.config.SkipNatMapping,
 			ClearNetworkInterfaces: true,
+			NetworkInterfaces:      b.config.NetworkInterfaces,
+			ForwardedPorts:         b.config.ForwardedPorts,
 		},
 		// Use this step to pass the cloud-init seed data via cd or http
 		&stepConfigureCloudSeed{
-			useCd: b.config.UseCD,
+			useCd:       b.config.UseCD,
+			datasource:  b.config.Datasource,
+			httpContent: httpServer.HTTPContent,
 		},
 		&utmcommon.StepPause{
 			Message: "UTM API Unavailable: Add a display device to the VM for debugging",
 			NoPause: b.config.DisplayNoPause,
 		},
-		&utmcommon.StepRun{},
-		&utmcommon.StepPause{
-			Message: "Confirm initial boot with cloud-init is complete and VM is running",
-			NoPause: b.config.BootNoPause,
-		},
-		&communicator.StepConnect{
-			Config:    &b.config.CommConfig.Comm,
-			Host:      utmcommon.CommHost(b.config.CommConfig.Comm.Host()),
-			SSHConfig: b.config.CommConfig.Comm.SSHConfigFunc(),
-			SSHPort:   utmcommon.CommPort,
-			WinRMPort: utmcommon.CommPort,
+		&utmcommon.StepSharedDirectory{
+			SharedDirectory: b.config.SharedDirectory,
 		},
-		&utmcommon.StepUploadVersion{
-			Path: *b.config.UtmVersionFile,
+		&utmcommon.StepRun{},
+		connect,
+		// Ignition configures the VM before the communicator connects
+		&stepWaitCloudInit{
+			Skip:    b.config.SkipCloudInitWait || b.config.Datasource == "ignition",
+			Timeout: b.config.CloudInitTimeout,
+		},
+		&utmcommon.StepSnapshot{
+			Enabled:  b.config.ProvisionSnapshot,
+			Shutdown: shutdown,
+			Connect:  connect,
+		},
+		mountSharedDirectory,
+		uploadVersion,
+		&utmcommon.StepRollbackProvision{
+			Retries:      b.config.ProvisionRetries,
+			Rollback:     b.config.ProvisionRollback,
+			Shutdown:     shutdown,
+			Connect:      connect,
+			AfterConnect: []multistep.Step{mountSharedDirectory, uploadVersion},
 		},
-		new(commonsteps.StepProvision),
 		&commonsteps.StepCleanupTempKeys{
 			Comm: &b.config.CommConfig.Comm,
 		},
-		&utmcommon.StepShutdown{
-			Command:         b.config.ShutdownCommand,
-			Timeout:         b.config.ShutdownTimeout,
-			Delay:           b.config.PostShutdownDelay,
-			DisableShutdown: b.config.DisableShutdown,
+		&utmcommon.StepZeroFreeSpace{
+			Command: b.config.ZeroFreeSpaceCommand,
+		},
+		shutdown,
+		new(utmcommon.StepRemoveSnapshot),
+		&utmcommon.StepRemoveSharedDirectory{
+			SharedDirectory: b.config.SharedDirectory,
 		},
 		&utmcommon.StepRemoveDevices{
 			Bundling: b.config.UtmBundleConfig,
 		},
+		&utmcommon.StepCompactDisks{
+			Compact:  b.config.CompactDisks,
+			Compress: b.config.CompressDisks,
+		},
 		&utmcommon.StepPause{
 			Message: "Make required changes to the VM before export.\nRemove display, Add Serial port, Icon, etc.",
 			NoPause: b.config.ExportNoPause,
@@ -160,6 +221,9 @@ func (b *Builder) Run(ctx context.Context, ui packersdk.Ui, hook packersdk.Hook)
 		return nil, errors.New("build was halted")
 	}
 
-	generatedData := map[string]interface{}{"generated_data": state.Get("generated_data")}
+	generatedData := map[string]interface{}{
+		"generated_data":  state.Get("generated_data"),
+		"compacted_disks": state.Get("compacted_disks"),
+	}
 	return utmcommon.NewArtifact(b.config.OutputDir, b.config.VMName, generatedData)
 }
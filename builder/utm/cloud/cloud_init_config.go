@@ -0,0 +1,311 @@
+//go:generate packer-sdc struct-markdown
+//go:generate packer-sdc mapstructure-to-hcl2 -type CloudInit,CloudInitUser
+
+package cloud
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+	"gopkg.in/yaml.v3"
+)
+
+// CloudInitConfig generates the NoCloud seed of cloud-init, the user-data,
+// meta-data and network-config files, instead of reading them from
+// `cd_files`, `cd_content`, `http_directory` or `http_content`. The seed
+// is served over HTTP, on a CD labeled `cidata` with `use_cd`, or on a
+// ConfigDrive with the `configdrive` datasource. The
+// public key of the SSH key pair Packer generates for the communicator is
+// added to the user named by `ssh_username`, or to the default user of
+// the image if no `user` block has that name.
+type CloudInitConfig struct {
+	// The cloud-init seed to generate. See the cloud-init configuration
+	// below.
+	CloudInit *CloudInit `mapstructure:"cloud_init" required:"false"`
+}
+
+// The cloud-init seed of the VM.
+type CloudInit struct {
+	// The users to create. Name a user `default` to keep the default user of
+	// the image, which cloud-init only creates when no users are listed.
+	Users []CloudInitUser `mapstructure:"user" required:"false"`
+	// Public keys to authorize for the default user of the image.
+	SSHAuthorizedKeys []string `mapstructure:"ssh_authorized_keys" required:"false"`
+	// Packages to install on the first boot.
+	Packages []string `mapstructure:"packages" required:"false"`
+	// Commands to run at the end of the first boot.
+	Runcmd []string `mapstructure:"runcmd" required:"false"`
+	// A cloud-config document to merge the generated user-data into. The
+	// lists of users, keys, packages and commands above are appended to
+	// the lists of the document, and the other keys are kept as is.
+	UserData string `mapstructure:"user_data" required:"false"`
+	// A network configuration, version 2, written as the network-config
+	// file of the seed. cloud-init configures the network with DHCP when
+	// this is unset.
+	NetworkConfig string `mapstructure:"network_config" required:"false"`
+	// The instance-id of the meta-data. cloud-init runs its first boot
+	// modules again when it changes. Defaults to `vm_name`.
+	InstanceID string `mapstructure:"instance_id" required:"false"`
+	// The hostname of the VM. Unset by default, which keeps the hostname of
+	// the image.
+	Hostname string `mapstructure:"hostname" required:"false"`
+
+	userData map[string]interface{}
+}
+
+// A user created by cloud-init.
+type CloudInitUser struct {
+	// The name of the user.
+	Name string `mapstructure:"name" required:"true"`
+	// Supplementary groups of the user.
+	Groups []string `mapstructure:"groups" required:"false"`
+	// The sudo rule of the user, e.g. `ALL=(ALL) NOPASSWD:ALL`.
+	Sudo string `mapstructure:"sudo" required:"false"`
+	// The login shell of the user.
+	Shell string `mapstructure:"shell" required:"false"`
+	// Public keys to authorize for the user.
+	SSHAuthorizedKeys []string `mapstructure:"ssh_authorized_keys" required:"false"`
+}
+
+// The files of a NoCloud seed.
+const (
+	seedUserData      = "user-data"
+	seedMetaData      = "meta-data"
+	seedNetworkConfig = "network-config"
+)
+
+// The files of a ConfigDrive, on a CD labeled config-2.
+const (
+	configDriveMetaData = "openstack/latest/meta_data.json"
+	configDriveUserData = "openstack/latest/user_data"
+)
+
+// Prepare sets the defaults of the seed and validates the documents it is
+// merged with. The block isn't interpolated when the config is decoded, as
+// cloud-init templates use the same delimiters, so only the instance-id
+// and hostname are rendered.
+func (c *CloudInitConfig) Prepare(ctx *interpolate.Context, vmName string) []error {
+	ci := c.CloudInit
+	if ci == nil {
+		return nil
+	}
+
+	var errs []error
+	var err error
+	if ci.InstanceID, err = interpolate.Render(ci.InstanceID, ctx); err != nil {
+		errs = append(errs, fmt.Errorf("cloud_init: error parsing instance_id: %s", err))
+	}
+	if ci.Hostname, err = interpolate.Render(ci.Hostname, ctx); err != nil {
+		errs = append(errs, fmt.Errorf("cloud_init: error parsing hostname: %s", err))
+	}
+	if ci.InstanceID == "" {
+		ci.InstanceID = vmName
+	}
+
+	for i, user := range ci.Users {
+		if user.Name == "" {
+			errs = append(errs, fmt.Errorf("cloud_init: user %d: name is required", i))
+		}
+	}
+
+	ci.userData = map[string]interface{}{}
+	if err := yaml.Unmarshal([]byte(ci.UserData), &ci.userData); err != nil {
+		errs = append(errs, fmt.Errorf("cloud_init: user_data must be a cloud-config mapping: %s", err))
+	}
+	if ci.userData == nil {
+		ci.userData = map[string]interface{}{}
+	}
+	for _, key := range []string{"users", "ssh_authorized_keys", "packages", "runcmd"} {
+		if value, ok := ci.userData[key]; ok {
+			if _, ok := value.([]interface{}); !ok {
+				errs = append(errs, fmt.Errorf("cloud_init: %s of user_data must be a list", key))
+			}
+		}
+	}
+
+	if ci.NetworkConfig != "" {
+		var network struct {
+			Version int `yaml:"version"`
+			Network struct {
+				Version int `yaml:"version"`
+			} `yaml:"network"`
+		}
+		if err := yaml.Unmarshal([]byte(ci.NetworkConfig), &network); err != nil {
+			errs = append(errs, fmt.Errorf("cloud_init: error parsing network_config: %s", err))
+		} else if network.Version != 2 && network.Network.Version != 2 {
+			errs = append(errs, fmt.Errorf("cloud_init: network_config must be version 2"))
+		}
+	}
+
+	return errs
+}
+
+// IsSeedPath reports whether a file of `cd_content` or `http_content`
+// would be replaced by the generated seed.
+func IsSeedPath(p string) bool {
+	switch strings.TrimPrefix(path.Clean("/"+p), "/") {
+	case seedUserData, seedMetaData, seedNetworkConfig:
+		return true
+	}
+	return false
+}
+
+// IsConfigDrivePath reports whether a file of `cd_content` would be
+// replaced by the generated ConfigDrive.
+func IsConfigDrivePath(p string) bool {
+	switch strings.TrimPrefix(path.Clean("/"+p), "/") {
+	case configDriveMetaData, configDriveUserData:
+		return true
+	}
+	return false
+}
+
+// Seed generates the files of the NoCloud seed, authorizing publicKey for
+// the user named sshUsername. The public key is empty when the
+// communicator doesn't use a key pair.
+func (c *CloudInit) Seed(sshUsername string, publicKey string) (map[string]string, error) {
+	userData, err := c.generateUserData(sshUsername, strings.TrimSpace(publicKey))
+	if err != nil {
+		return nil, err
+	}
+
+	metaData := map[string]string{"instance-id": c.InstanceID}
+	if c.Hostname != "" {
+		metaData["local-hostname"] = c.Hostname
+	}
+	metaDataBytes, err := yaml.Marshal(metaData)
+	if err != nil {
+		return nil, err
+	}
+
+	seed := map[string]string{
+		seedUserData: userData,
+		seedMetaData: string(metaDataBytes),
+	}
+	if c.NetworkConfig != "" {
+		seed[seedNetworkConfig] = c.NetworkConfig
+	}
+	return seed, nil
+}
+
+// ConfigDrive generates the files of the OpenStack ConfigDrive, with the
+// same user-data as the NoCloud seed. The ConfigDrive has no network
+// configuration, cloud-init configures the network with DHCP.
+func (c *CloudInit) ConfigDrive(sshUsername string, publicKey string) (map[string]string, error) {
+	userData, err := c.generateUserData(sshUsername, strings.TrimSpace(publicKey))
+	if err != nil {
+		return nil, err
+	}
+
+	// cloud-init uses the uuid as the instance-id
+	metaData := map[string]string{"uuid": c.InstanceID, "name": c.InstanceID}
+	if c.Hostname != "" {
+		metaData["hostname"] = c.Hostname
+	}
+	metaDataBytes, err := json.Marshal(metaData)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]string{
+		configDriveUserData: userData,
+		configDriveMetaData: string(metaDataBytes),
+	}, nil
+}
+
+func (c *CloudInit) generateUserData(sshUsername string, publicKey string) (string, error) {
+	// Copy the document so a build can generate the seed again
+	doc := make(map[string]interface{}, len(c.userData))
+	for key, value := range c.userData {
+		doc[key] = value
+	}
+	appendList := func(key string, values ...interface{}) {
+		if len(values) == 0 {
+			return
+		}
+		list, _ := doc[key].([]interface{})
+		doc[key] = append(append([]interface{}{}, list...), values...)
+	}
+
+	for _, user := range c.Users {
+		appendList("users", user.entry())
+	}
+	for _, key := range c.SSHAuthorizedKeys {
+		appendList("ssh_authorized_keys", key)
+	}
+	for _, pkg := range c.Packages {
+		appendList("packages", pkg)
+	}
+	for _, cmd := range c.Runcmd {
+		appendList("runcmd", cmd)
+	}
+
+	if publicKey != "" && !authorizeUser(doc, sshUsername, publicKey) {
+		appendList("ssh_authorized_keys", publicKey)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("#cloud-config\n")
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return "", fmt.Errorf("error generating cloud-init user-data: %s", err)
+	}
+	if err := enc.Close(); err != nil {
+		return "", fmt.Errorf("error generating cloud-init user-data: %s", err)
+	}
+	return buf.String(), nil
+}
+
+// authorizeUser adds the public key to the user of the document with the
+// given name, and reports whether there is such a user.
+func authorizeUser(doc map[string]interface{}, name string, publicKey string) bool {
+	// Copy the users, they may belong to the parsed user_data
+	users, _ := doc["users"].([]interface{})
+	users = append([]interface{}{}, users...)
+	for i, raw := range users {
+		user, ok := raw.(map[string]interface{})
+		if !ok || user["name"] != name {
+			continue
+		}
+		authorized := map[string]interface{}{}
+		for key, value := range user {
+			authorized[key] = value
+		}
+		keys, _ := user["ssh_authorized_keys"].([]interface{})
+		authorized["ssh_authorized_keys"] = append(append([]interface{}{}, keys...), publicKey)
+		users[i] = authorized
+		doc["users"] = users
+		return true
+	}
+	return false
+}
+
+// entry returns the user as listed in the users of a cloud-config.
+func (u CloudInitUser) entry() interface{} {
+	if u.Name == "default" {
+		return "default"
+	}
+	user := map[string]interface{}{"name": u.Name}
+	if len(u.Groups) > 0 {
+		user["groups"] = strings.Join(u.Groups, ", ")
+	}
+	if u.Sudo != "" {
+		user["sudo"] = u.Sudo
+	}
+	if u.Shell != "" {
+		user["shell"] = u.Shell
+	}
+	if len(u.SSHAuthorizedKeys) > 0 {
+		keys := make([]interface{}, 0, len(u.SSHAuthorizedKeys))
+		for _, key := range u.SSHAuthorizedKeys {
+			keys = append(keys, key)
+		}
+		user["ssh_authorized_keys"] = keys
+	}
+	return user
+}
@@ -0,0 +1,76 @@
+// Code generated by "packer-sdc mapstructure-to-hcl2"; DO NOT EDIT.
+
+package cloud
+
+import (
+	"github.com/hashicorp/hcl/v2/hcldec"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// FlatCloudInit is an auto-generated flat version of CloudInit.
+// Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
+type FlatCloudInit struct {
+	Users             []FlatCloudInitUser `mapstructure:"user" required:"false" cty:"user" hcl:"user"`
+	SSHAuthorizedKeys []string            `mapstructure:"ssh_authorized_keys" required:"false" cty:"ssh_authorized_keys" hcl:"ssh_authorized_keys"`
+	Packages          []string            `mapstructure:"packages" required:"false" cty:"packages" hcl:"packages"`
+	Runcmd            []string            `mapstructure:"runcmd" required:"false" cty:"runcmd" hcl:"runcmd"`
+	UserData          *string             `mapstructure:"user_data" required:"false" cty:"user_data" hcl:"user_data"`
+	NetworkConfig     *string             `mapstructure:"network_config" required:"false" cty:"network_config" hcl:"network_config"`
+	InstanceID        *string             `mapstructure:"instance_id" required:"false" cty:"instance_id" hcl:"instance_id"`
+	Hostname          *string             `mapstructure:"hostname" required:"false" cty:"hostname" hcl:"hostname"`
+}
+
+// FlatMapstructure returns a new FlatCloudInit.
+// FlatCloudInit is an auto-generated flat version of CloudInit.
+// Where the contents a fields with a `mapstructure:,squash` tag are bubbled up.
+func (*CloudInit) FlatMapstructure() interface{ HCL2Spec() map[string]hcldec.Spec } {
+	return new(FlatCloudInit)
+}
+
+// HCL2Spec returns the hcl spec of a CloudInit.
+// This spec is used by HCL to read the fields of CloudInit.
+// The decoded values from this spec will then be applied to a FlatCloudInit.
+func (*FlatCloudInit) HCL2Spec() map[string]hcldec.Spec {
+	s := map[string]hcldec.Spec{
+		"user":                &hcldec.BlockListSpec{TypeName: "user", Nested: hcldec.ObjectSpec((*FlatCloudInitUser)(nil).HCL2Spec())},
+		"ssh_authorized_keys": &hcldec.AttrSpec{Name: "ssh_authorized_keys", Type: cty.List(cty.String), Required: false},
+		"packages":            &hcldec.AttrSpec{Name: "packages", Type: cty.List(cty.String), Required: false},
+		"runcmd":              &hcldec.AttrSpec{Name: "runcmd", Type: cty.List(cty.String), Required: false},
+		"user_data":           &hcldec.AttrSpec{Name: "user_data", Type: cty.String, Required: false},
+		"network_config":      &hcldec.AttrSpec{Name: "network_config", Type: cty.String, Required: false},
+		"instance_id":         &hcldec.AttrSpec{Name: "instance_id", Type: cty.String, Required: false},
+		"hostname":            &hcldec.AttrSpec{Name: "hostname", Type: cty.String, Required: false},
+	}
+	return s
+}
+
+// FlatCloudInitUser is an auto-generated flat version of CloudInitUser.
+// Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
+type FlatCloudInitUser struct {
+	Name              *string  `mapstructure:"name" required:"true" cty:"name" hcl:"name"`
+	Groups            []string `mapstructure:"groups" required:"false" cty:"groups" hcl:"groups"`
+	Sudo              *string  `mapstructure:"sudo" required:"false" cty:"sudo" hcl:"sudo"`
+	Shell             *string  `mapstructure:"shell" required:"false" cty:"shell" hcl:"shell"`
+	SSHAuthorizedKeys []string `mapstructure:"ssh_authorized_keys" required:"false" cty:"ssh_authorized_keys" hcl:"ssh_authorized_keys"`
+}
+
+// FlatMapstructure returns a new FlatCloudInitUser.
+// FlatCloudInitUser is an auto-generated flat version of CloudInitUser.
+// Where the contents a fields with a `mapstructure:,squash` tag are bubbled up.
+func (*CloudInitUser) FlatMapstructure() interface{ HCL2Spec() map[string]hcldec.Spec } {
+	return new(FlatCloudInitUser)
+}
+
+// HCL2Spec returns the hcl spec of a CloudInitUser.
+// This spec is used by HCL to read the fields of CloudInitUser.
+// The decoded values from this spec will then be applied to a FlatCloudInitUser.
+func (*FlatCloudInitUser) HCL2Spec() map[string]hcldec.Spec {
+	s := map[string]hcldec.Spec{
+		"name":                &hcldec.AttrSpec{Name: "name", Type: cty.String, Required: false},
+		"groups":              &hcldec.AttrSpec{Name: "groups", Type: cty.List(cty.String), Required: false},
+		"sudo":                &hcldec.AttrSpec{Name: "sudo", Type: cty.String, Required: false},
+		"shell":               &hcldec.AttrSpec{Name: "shell", Type: cty.String, Required: false},
+		"ssh_authorized_keys": &hcldec.AttrSpec{Name: "ssh_authorized_keys", Type: cty.List(cty.String), Required: false},
+	}
+	return s
+}
@@ -0,0 +1,207 @@
+package cloud
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+	"gopkg.in/yaml.v3"
+)
+
+func testCloudInitConfig(ci *CloudInit) (*CloudInitConfig, []error) {
+	c := &CloudInitConfig{CloudInit: ci}
+	return c, c.Prepare(interpolate.NewContext(), "packer-vm")
+}
+
+func parseUserData(t *testing.T, userData string) map[string]interface{} {
+	if !strings.HasPrefix(userData, "#cloud-config\n") {
+		t.Fatalf("bad: %#v", userData)
+	}
+	doc := map[string]interface{}{}
+	if err := yaml.Unmarshal([]byte(userData), &doc); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return doc
+}
+
+func TestCloudInitConfigPrepare(t *testing.T) {
+	c, errs := testCloudInitConfig(&CloudInit{})
+	if len(errs) > 0 {
+		t.Fatalf("err: %#v", errs)
+	}
+	if c.CloudInit.InstanceID != "packer-vm" {
+		t.Fatalf("bad: %#v", c.CloudInit.InstanceID)
+	}
+
+	c, errs = testCloudInitConfig(nil)
+	if len(errs) > 0 || c.CloudInit != nil {
+		t.Fatalf("bad: %#v", errs)
+	}
+}
+
+func TestCloudInitConfigPrepare_invalid(t *testing.T) {
+	for _, ci := range []*CloudInit{
+		{Users: []CloudInitUser{{Groups: []string{"sudo"}}}},
+		{UserData: "- not a mapping"},
+		{UserData: "runcmd: echo"},
+		{NetworkConfig: "version: 1"},
+		{NetworkConfig: "version: ["},
+	} {
+		if _, errs := testCloudInitConfig(ci); len(errs) == 0 {
+			t.Fatalf("should have error: %#v", ci)
+		}
+	}
+
+	for _, networkConfig := range []string{
+		"version: 2\nethernets: {}",
+		"network:\n  version: 2",
+	} {
+		if _, errs := testCloudInitConfig(&CloudInit{NetworkConfig: networkConfig}); len(errs) > 0 {
+			t.Fatalf("err: %#v", errs)
+		}
+	}
+}
+
+func TestCloudInitSeed(t *testing.T) {
+	c, errs := testCloudInitConfig(&CloudInit{
+		Users: []CloudInitUser{
+			{Name: "default"},
+			{Name: "packer", Groups: []string{"adm", "sudo"}, Sudo: "ALL=(ALL) NOPASSWD:ALL"},
+		},
+		Packages: []string{"curl"},
+		Runcmd:   []string{"touch /done"},
+		UserData: "#cloud-config\ntimezone: UTC\npackages: [git]\n",
+		Hostname: "builder",
+	})
+	if len(errs) > 0 {
+		t.Fatalf("err: %#v", errs)
+	}
+
+	seed, err := c.CloudInit.Seed("packer", "ssh-ed25519 AAAA packer\n")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, ok := seed["network-config"]; ok {
+		t.Fatalf("bad: %#v", seed)
+	}
+	if seed["meta-data"] != "instance-id: packer-vm\nlocal-hostname: builder\n" {
+		t.Fatalf("bad: %#v", seed["meta-data"])
+	}
+
+	doc := parseUserData(t, seed["user-data"])
+	if doc["timezone"] != "UTC" {
+		t.Fatalf("bad: %#v", doc)
+	}
+	packages := doc["packages"].([]interface{})
+	if len(packages) != 2 || packages[0] != "git" || packages[1] != "curl" {
+		t.Fatalf("bad: %#v", packages)
+	}
+	// The public key is authorized for the communicator user only
+	if _, ok := doc["ssh_authorized_keys"]; ok {
+		t.Fatalf("bad: %#v", doc)
+	}
+	users := doc["users"].([]interface{})
+	if len(users) != 2 || users[0] != "default" {
+		t.Fatalf("bad: %#v", users)
+	}
+	user := users[1].(map[string]interface{})
+	if user["name"] != "packer" || user["groups"] != "adm, sudo" {
+		t.Fatalf("bad: %#v", user)
+	}
+	keys := user["ssh_authorized_keys"].([]interface{})
+	if len(keys) != 1 || keys[0] != "ssh-ed25519 AAAA packer" {
+		t.Fatalf("bad: %#v", keys)
+	}
+}
+
+func TestCloudInitSeed_defaultUser(t *testing.T) {
+	c, errs := testCloudInitConfig(&CloudInit{
+		SSHAuthorizedKeys: []string{"ssh-rsa BBBB me"},
+		UserData:          "users:\n  - name: admin\n    ssh_authorized_keys: [ssh-rsa CCCC admin]\n",
+		NetworkConfig:     "version: 2\n",
+	})
+	if len(errs) > 0 {
+		t.Fatalf("err: %#v", errs)
+	}
+
+	seed, err := c.CloudInit.Seed("ubuntu", "ssh-ed25519 AAAA packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if seed["network-config"] != "version: 2\n" {
+		t.Fatalf("bad: %#v", seed)
+	}
+
+	doc := parseUserData(t, seed["user-data"])
+	keys := doc["ssh_authorized_keys"].([]interface{})
+	if len(keys) != 2 || keys[0] != "ssh-rsa BBBB me" || keys[1] != "ssh-ed25519 AAAA packer" {
+		t.Fatalf("bad: %#v", keys)
+	}
+
+	// A user of user_data gets the key when it is the communicator user
+	seed, err = c.CloudInit.Seed("admin", "ssh-ed25519 AAAA packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	doc = parseUserData(t, seed["user-data"])
+	user := doc["users"].([]interface{})[0].(map[string]interface{})
+	if keys := user["ssh_authorized_keys"].([]interface{}); len(keys) != 2 {
+		t.Fatalf("bad: %#v", keys)
+	}
+	// The parsed user_data is left as is
+	user = c.CloudInit.userData["users"].([]interface{})[0].(map[string]interface{})
+	if keys := user["ssh_authorized_keys"].([]interface{}); len(keys) != 1 {
+		t.Fatalf("bad: %#v", keys)
+	}
+
+	// Without a key pair, nothing is added
+	seed, err = c.CloudInit.Seed("ubuntu", "")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	doc = parseUserData(t, seed["user-data"])
+	if keys := doc["ssh_authorized_keys"].([]interface{}); len(keys) != 1 {
+		t.Fatalf("bad: %#v", keys)
+	}
+}
+
+func TestIsSeedPath(t *testing.T) {
+	for _, p := range []string{"user-data", "/meta-data", "./network-config"} {
+		if !IsSeedPath(p) {
+			t.Fatalf("bad: %s", p)
+		}
+	}
+	for _, p := range []string{"vendor-data", "/seed/user-data"} {
+		if IsSeedPath(p) {
+			t.Fatalf("bad: %s", p)
+		}
+	}
+}
+
+func TestCloudInitConfigDrive(t *testing.T) {
+	c, errs := testCloudInitConfig(&CloudInit{Hostname: "builder"})
+	if len(errs) > 0 {
+		t.Fatalf("err: %#v", errs)
+	}
+
+	drive, err := c.CloudInit.ConfigDrive("packer", "ssh-ed25519 AAAA packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(drive) != 2 {
+		t.Fatalf("bad: %#v", drive)
+	}
+	if drive["openstack/latest/meta_data.json"] != `{"hostname":"builder","name":"packer-vm","uuid":"packer-vm"}` {
+		t.Fatalf("bad: %#v", drive["openstack/latest/meta_data.json"])
+	}
+	doc := parseUserData(t, drive["openstack/latest/user_data"])
+	if keys := doc["ssh_authorized_keys"].([]interface{}); len(keys) != 1 || keys[0] != "ssh-ed25519 AAAA packer" {
+		t.Fatalf("bad: %#v", keys)
+	}
+
+	for _, p := range []string{"openstack/latest/user_data", "/openstack/latest/meta_data.json"} {
+		if !IsConfigDrivePath(p) || IsSeedPath(p) {
+			t.Fatalf("bad: %s", p)
+		}
+	}
+}
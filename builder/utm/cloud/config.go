@@ -6,6 +6,8 @@ package cloud
 import (
 	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/hashicorp/packer-plugin-sdk/common"
 	"github.com/hashicorp/packer-plugin-sdk/multistep/commonsteps"
@@ -17,19 +19,25 @@ import (
 
 // Config is the configuration structure for the UTM Cloud builder.
 type Config struct {
-	common.PackerConfig            `mapstructure:",squash"`
-	commonsteps.HTTPConfig         `mapstructure:",squash"`
-	commonsteps.ISOConfig          `mapstructure:",squash"`
-	commonsteps.CDConfig           `mapstructure:",squash"`
-	utmcommon.ExportConfig         `mapstructure:",squash"`
-	utmcommon.OutputConfig         `mapstructure:",squash"`
-	utmcommon.ShutdownConfig       `mapstructure:",squash"`
-	utmcommon.CommConfig           `mapstructure:",squash"`
-	utmcommon.HWConfig             `mapstructure:",squash"`
-	utmcommon.UtmVersionConfig     `mapstructure:",squash"`
-	utmcommon.UtmBundleConfig      `mapstructure:",squash"`
-	utmcommon.GuestAdditionsConfig `mapstructure:",squash"`
-	utmcommon.NoPauseConfig        `mapstructure:",squash"`
+	common.PackerConfig             `mapstructure:",squash"`
+	commonsteps.HTTPConfig          `mapstructure:",squash"`
+	commonsteps.ISOConfig           `mapstructure:",squash"`
+	commonsteps.CDConfig            `mapstructure:",squash"`
+	utmcommon.ExportConfig          `mapstructure:",squash"`
+	utmcommon.OutputConfig          `mapstructure:",squash"`
+	utmcommon.ShutdownConfig        `mapstructure:",squash"`
+	utmcommon.CommConfig            `mapstructure:",squash"`
+	utmcommon.HWConfig              `mapstructure:",squash"`
+	utmcommon.UtmVersionConfig      `mapstructure:",squash"`
+	utmcommon.UtmBundleConfig       `mapstructure:",squash"`
+	utmcommon.GuestAdditionsConfig  `mapstructure:",squash"`
+	utmcommon.NoPauseConfig         `mapstructure:",squash"`
+	utmcommon.RemoteConfig          `mapstructure:",squash"`
+	utmcommon.SnapshotConfig        `mapstructure:",squash"`
+	utmcommon.NetworkConfig         `mapstructure:",squash"`
+	utmcommon.DiskConfig            `mapstructure:",squash"`
+	utmcommon.SharedDirectoryConfig `mapstructure:",squash"`
+	CloudInitConfig                 `mapstructure:",squash"`
 
 	// Set this to true if you would like to use Hypervisor
 	// Defaults to false.
@@ -45,7 +53,7 @@ type Config struct {
 	RTCLocalTime bool `mapstructure:"rtc_local_time" required:"false"`
 
 	// The size, in megabytes, of the hard disk to create for the VM. By
-	// default, this is 40000 (about 40 GB).
+	// default, this is 40000 (about 40 GB). Can't be used with `disk`.
 	DiskSize uint `mapstructure:"disk_size" required:"false"`
 	// The type of controller that the primary hard drive is attached to,
 	// defaults to VirtIO. When set to usb, the drive is attached to an USB
@@ -62,20 +70,50 @@ type Config struct {
 	// Additional disks to create. Attachment starts at 1 since 0
 	// is the default disk. Each value represents the disk image size in MiB.
 	// Each additional disk uses the same disk parameters as the default disk.
-	// Unset by default.
+	// Unset by default. Can't be used with `disk`, which configures each
+	// disk on its own.
 	AdditionalDiskSize []uint `mapstructure:"disk_additional_size" required:"false"`
 
 	// Wheather to resize the cloud image to the disk size. Defaults to false.
-	// If set to true, the cloud image will be resized to the disk size.
-	// Required qemu-img to be installed in the system.
+	// If set to true, the cloud image will be resized to the disk size, which
+	// can't be smaller than the cloud image. Raw cloud images are converted
+	// to qcow2 first, whether they are resized or not.
 	ResizeCloudImage bool `mapstructure:"resize_cloud_image" required:"false"`
 
 	// Pass cloud-init data to the VM using a CD-ROM. Defaults to false.
 	// If set to true, you must provide cd_files with the path to the cloud-init
 	// data and cd_label with value "cidata".
 	// If set to false, you must provide http_directory with the cloud-init data.
+	// With `cloud_init`, the generated seed is written to the CD, or served
+	// over HTTP, instead.
 	UseCD bool `mapstructure:"use_cd" required:"false"`
 
+	// The datasource the VM reads its configuration from, `nocloud`,
+	// `configdrive` or `ignition`. Defaults to `nocloud`, a NoCloud seed
+	// served over HTTP, or on a CD with `use_cd`. With `configdrive`, the
+	// seed is an OpenStack ConfigDrive, a CD labeled `config-2` with the
+	// `openstack/latest/meta_data.json` and `openstack/latest/user_data`
+	// files, from `cloud_init` or from `cd_files` and `cd_content`. With
+	// `ignition`, the Ignition config of `ignition_config` is passed to
+	// Fedora CoreOS or Flatcar through the QEMU `fw_cfg` device, and
+	// removed from the VM before it is exported.
+	Datasource string `mapstructure:"datasource" required:"false"`
+	// The Ignition config of the VM, in JSON, with the `ignition` datasource.
+	// The public key of the SSH key pair Packer generates for the
+	// communicator is added to the user named by `ssh_username`. Defaults to
+	// an empty config of version 3.0.0.
+	IgnitionConfig string `mapstructure:"ignition_config" required:"false"`
+
+	// The time to wait for cloud-init to finish once Packer is connected to
+	// the VM, before the provisioners run. The build fails if cloud-init
+	// doesn't finish in time, or finishes with errors. Guests without
+	// cloud-init, or where it is disabled, aren't waited for. Defaults to
+	// 30m.
+	CloudInitTimeout time.Duration `mapstructure:"cloud_init_timeout" required:"false"`
+	// Set this to true to start the provisioners as soon as Packer is
+	// connected to the VM, without waiting for cloud-init. Defaults to false.
+	SkipCloudInitWait bool `mapstructure:"skip_cloud_init_wait" required:"false"`
+
 	// Set this to true if you would like to keep the VM registered with
 	// UTM. Defaults to false.
 	KeepRegistered bool `mapstructure:"keep_registered" required:"false"`
@@ -111,6 +149,8 @@ func (c *Config) Prepare(raws ...interface{}) ([]string, error) {
 			Exclude: []string{
 				"guest_additions_path",
 				"guest_additions_url",
+				"shared_directory",
+				"cloud_init",
 			},
 		},
 	}, raws...)
@@ -125,6 +165,9 @@ func (c *Config) Prepare(raws ...interface{}) ([]string, error) {
 	isoWarnings, isoErrs := c.ISOConfig.Prepare(&c.ctx)
 	warnings = append(warnings, isoWarnings...)
 	errs = packersdk.MultiErrorAppend(errs, isoErrs...)
+	for i, u := range c.ISOUrls {
+		c.ISOUrls[i] = keepCompressed(u)
+	}
 
 	errs = packersdk.MultiErrorAppend(errs, c.ExportConfig.Prepare(&c.ctx)...)
 	errs = packersdk.MultiErrorAppend(errs, c.CDConfig.Prepare(&c.ctx)...)
@@ -133,18 +176,36 @@ func (c *Config) Prepare(raws ...interface{}) ([]string, error) {
 	errs = packersdk.MultiErrorAppend(errs, c.HTTPConfig.Prepare(&c.ctx)...)
 	errs = packersdk.MultiErrorAppend(errs, c.ShutdownConfig.Prepare(&c.ctx)...)
 	errs = packersdk.MultiErrorAppend(errs, c.CommConfig.Prepare(&c.ctx)...)
+	errs = packersdk.MultiErrorAppend(errs, c.RemoteConfig.Prepare(&c.ctx)...)
+	errs = packersdk.MultiErrorAppend(errs, c.SnapshotConfig.Prepare(&c.ctx, c.ShutdownCommand)...)
+	errs = packersdk.MultiErrorAppend(errs, c.NetworkConfig.Prepare(&c.ctx, &c.CommConfig)...)
 	errs = packersdk.MultiErrorAppend(errs, c.UtmBundleConfig.Prepare(&c.ctx)...)
 	errs = packersdk.MultiErrorAppend(errs, c.UtmVersionConfig.Prepare(c.CommConfig.Comm.Type)...)
 	errs = packersdk.MultiErrorAppend(errs, c.NoPauseConfig.Prepare(&c.ctx)...)
 
-	if c.DiskSize == 0 {
-		c.DiskSize = 40960
-	}
-
 	if c.HardDriveInterface == "" {
 		c.HardDriveInterface = "virtio"
 	}
 
+	if len(c.Disks) > 0 {
+		if c.DiskSize != 0 || len(c.AdditionalDiskSize) > 0 {
+			errs = packersdk.MultiErrorAppend(errs,
+				errors.New("disk can't be used with disk_size or disk_additional_size"))
+		}
+	} else {
+		if c.DiskSize == 0 {
+			c.DiskSize = 40960
+		}
+		c.Disks = utmcommon.LegacyDisks(c.DiskSize, c.AdditionalDiskSize)
+	}
+	errs = packersdk.MultiErrorAppend(errs, c.DiskConfig.Prepare(&c.ctx, c.HardDriveInterface)...)
+	// The first disk is made from the cloud image
+	if c.Disks[0].Source != "" || c.Disks[0].Format != "" ||
+		c.Disks[0].ReadOnly || c.Disks[0].SkipExport {
+		errs = packersdk.MultiErrorAppend(errs, errors.New(
+			"the first disk is the cloud image, it can't have source, format, read_only or skip_export"))
+	}
+
 	if c.VMArch == "" {
 		c.VMArch = "aarch64"
 	}
@@ -152,6 +213,7 @@ func (c *Config) Prepare(raws ...interface{}) ([]string, error) {
 	if c.VMBackend == "" {
 		c.VMBackend = "qemu"
 	}
+	errs = packersdk.MultiErrorAppend(errs, c.SharedDirectoryConfig.Prepare(&c.ctx, c.VMBackend)...)
 	// Validate and use Enums for the VM backend
 	// Only qemu cloud images are supported.
 	switch c.VMBackend {
@@ -167,9 +229,87 @@ func (c *Config) Prepare(raws ...interface{}) ([]string, error) {
 			"packer-%s-%d", c.PackerBuildName, interpolate.InitTime.Unix())
 	}
 
+	errs = packersdk.MultiErrorAppend(errs, c.CloudInitConfig.Prepare(&c.ctx, c.VMName)...)
+
+	if c.Datasource == "" {
+		c.Datasource = "nocloud"
+	}
+	if c.Datasource != "ignition" && c.IgnitionConfig != "" {
+		errs = packersdk.MultiErrorAppend(
+			errs, errors.New("ignition_config can only be used with the ignition datasource"))
+	}
+
 	// Validates the presence of the cloud-init data
 	// We either use a CD-ROM or HTTP to pass cloud-init data
-	if c.UseCD {
+	switch {
+	case c.Datasource == "configdrive":
+		// A ConfigDrive is always a CD
+		if c.CDLabel == "" {
+			c.CDLabel = "config-2"
+		}
+		if c.CDLabel != "config-2" {
+			errs = packersdk.MultiErrorAppend(
+				errs, errors.New("the configdrive datasource needs cd_label to be 'config-2'"))
+		}
+		if c.CloudInit != nil {
+			if c.CloudInit.NetworkConfig != "" {
+				errs = packersdk.MultiErrorAppend(
+					errs, errors.New("cloud_init network_config can't be used with the configdrive datasource"))
+			}
+			for path := range c.CDContent {
+				if IsConfigDrivePath(path) {
+					errs = packersdk.MultiErrorAppend(
+						errs, fmt.Errorf("cd_content %s is generated by cloud_init", path))
+				}
+			}
+		} else if c.CDFiles == nil && c.CDContent == nil {
+			errs = packersdk.MultiErrorAppend(
+				errs, errors.New("the configdrive datasource needs cloud_init, cd_files or cd_content"))
+		}
+	case c.Datasource == "ignition":
+		if c.CloudInit != nil {
+			errs = packersdk.MultiErrorAppend(
+				errs, errors.New("cloud_init can't be used with the ignition datasource"))
+		}
+		if c.UseCD {
+			errs = packersdk.MultiErrorAppend(
+				errs, errors.New("use_cd can't be used with the ignition datasource"))
+		}
+		if err := validateIgnitionConfig(c.IgnitionConfig); err != nil {
+			errs = packersdk.MultiErrorAppend(errs, err)
+		}
+	case c.Datasource != "nocloud":
+		errs = packersdk.MultiErrorAppend(
+			errs, errors.New("datasource can only be nocloud, configdrive or ignition"))
+	case c.CloudInit != nil:
+		if c.UseCD {
+			if c.CDLabel == "" {
+				c.CDLabel = "cidata"
+			}
+			if c.CDLabel != "cidata" {
+				errs = packersdk.MultiErrorAppend(
+					errs, errors.New("use_cd is true, but cd_label is not set to 'cidata'"))
+			}
+			for path := range c.CDContent {
+				if IsSeedPath(path) {
+					errs = packersdk.MultiErrorAppend(
+						errs, fmt.Errorf("cd_content %s is generated by cloud_init", path))
+				}
+			}
+		} else {
+			// The seed is served from http_content
+			if c.HTTPDir != "" {
+				errs = packersdk.MultiErrorAppend(
+					errs, errors.New("cloud_init can't be used with http_directory, use http_content instead"))
+			}
+			for path := range c.HTTPContent {
+				if IsSeedPath(path) {
+					errs = packersdk.MultiErrorAppend(
+						errs, fmt.Errorf("http_content %s is generated by cloud_init", path))
+				}
+			}
+		}
+	case c.UseCD:
 		if c.CDFiles == nil && c.CDContent == nil {
 			errs = packersdk.MultiErrorAppend(
 				errs, errors.New("use_cd is true, but neither cd_files nor cd_content is set"))
@@ -178,13 +318,17 @@ func (c *Config) Prepare(raws ...interface{}) ([]string, error) {
 			errs = packersdk.MultiErrorAppend(
 				errs, errors.New("use_cd is true, but cd_label is not set to 'cidata'"))
 		}
-	} else {
+	default:
 		if c.HTTPDir == "" && c.HTTPContent == nil {
 			errs = packersdk.MultiErrorAppend(
 				errs, errors.New("use_cd is false, but neither http_directory nor http_content is set"))
 		}
 	}
 
+	if c.CloudInitTimeout == 0 {
+		c.CloudInitTimeout = 30 * time.Minute
+	}
+
 	if c.ISOInterface == "" {
 		// Default to virtio, In Cloud builder ISO is the primary disk
 		c.ISOInterface = "virtio"
@@ -224,3 +368,26 @@ func (c *Config) Prepare(raws ...interface{}) ([]string, error) {
 	return warnings, nil
 
 }
+
+// keepCompressed disables the decompression of a compressed cloud image by
+// the download, which decompresses it again on every build: the download
+// is cached as is, and the decompressed image is cached by
+// stepPrepareCloudImage.
+func keepCompressed(u string) string {
+	path := strings.ToLower(u)
+	if i := strings.Index(path, "?"); i >= 0 {
+		if strings.Contains(path[i:], "archive=") {
+			return u
+		}
+		path = path[:i]
+	}
+	for _, ext := range []string{".gz", ".xz", ".zst", ".bz2"} {
+		if strings.HasSuffix(path, ext) && !strings.HasSuffix(path, ".tar"+ext) {
+			if strings.Contains(u, "?") {
+				return u + "&archive=false"
+			}
+			return u + "?archive=false"
+		}
+	}
+	return u
+}
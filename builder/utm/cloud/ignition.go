@@ -0,0 +1,101 @@
+package cloud
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The fw_cfg entries Ignition reads its config from with QEMU, on Fedora
+// CoreOS and on Flatcar.
+var ignitionFwCfgNames = []string{
+	"opt/com.coreos/config",
+	"opt/org.flatcar-linux/config",
+}
+
+// The config used when ignition_config is unset.
+const defaultIgnitionConfig = `{"ignition": {"version": "3.0.0"}}`
+
+// validateIgnitionConfig checks that an Ignition config is a JSON object
+// with a version.
+func validateIgnitionConfig(doc string) error {
+	_, err := parseIgnitionConfig(doc)
+	return err
+}
+
+func parseIgnitionConfig(doc string) (map[string]interface{}, error) {
+	if doc == "" {
+		doc = defaultIgnitionConfig
+	}
+	var config map[string]interface{}
+	if err := json.Unmarshal([]byte(doc), &config); err != nil {
+		return nil, fmt.Errorf("ignition_config must be a JSON object: %s", err)
+	}
+	ignition, _ := config["ignition"].(map[string]interface{})
+	if version, _ := ignition["version"].(string); version == "" {
+		return nil, errors.New("ignition_config must have an ignition version")
+	}
+	return config, nil
+}
+
+// ignitionConfig returns the Ignition config of the VM, authorizing
+// publicKey for the user named sshUsername. The public key is empty when
+// the communicator doesn't use a key pair.
+func ignitionConfig(doc string, sshUsername string, publicKey string) ([]byte, error) {
+	config, err := parseIgnitionConfig(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey = strings.TrimSpace(publicKey)
+	if publicKey != "" {
+		passwd, _ := config["passwd"].(map[string]interface{})
+		if passwd == nil {
+			passwd = map[string]interface{}{}
+			config["passwd"] = passwd
+		}
+		users, _ := passwd["users"].([]interface{})
+		authorized := false
+		for _, raw := range users {
+			user, ok := raw.(map[string]interface{})
+			if !ok || user["name"] != sshUsername {
+				continue
+			}
+			keys, _ := user["sshAuthorizedKeys"].([]interface{})
+			user["sshAuthorizedKeys"] = append(keys, publicKey)
+			authorized = true
+			break
+		}
+		if !authorized {
+			passwd["users"] = append(users, map[string]interface{}{
+				"name":              sshUsername,
+				"sshAuthorizedKeys": []interface{}{publicKey},
+			})
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(config); err != nil {
+		return nil, fmt.Errorf("error generating Ignition config: %s", err)
+	}
+	return bytes.TrimSpace(buf.Bytes()), nil
+}
+
+// ignitionQemuArgs returns the QEMU arguments passing the Ignition config
+// through fw_cfg. The config is inlined, UTM splits the arguments on
+// spaces, so the spaces of the JSON strings are escaped, and QEMU options
+// escape commas by doubling them.
+func ignitionQemuArgs(config []byte) []string {
+	value := strings.ReplaceAll(string(config), " ", `\u0020`)
+	value = strings.ReplaceAll(value, ",", ",,")
+
+	args := make([]string, 0, len(ignitionFwCfgNames))
+	for _, name := range ignitionFwCfgNames {
+		args = append(args, fmt.Sprintf("-fw_cfg name=%s,string=%s", name, value))
+	}
+	return args
+}
@@ -0,0 +1,72 @@
+package cloud
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestIgnitionConfig(t *testing.T) {
+	doc := `{
+		"ignition": {"version": "3.4.0"},
+		"passwd": {"users": [{"name": "core", "sshAuthorizedKeys": ["ssh-rsa BBBB me"]}]},
+		"storage": {"files": [{"path": "/etc/hostname", "contents": {"source": "data:,builder"}}]}
+	}`
+	config, err := ignitionConfig(doc, "core", "ssh-ed25519 AAAA packer\n")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	var parsed struct {
+		Passwd struct {
+			Users []struct {
+				Name              string   `json:"name"`
+				SSHAuthorizedKeys []string `json:"sshAuthorizedKeys"`
+			} `json:"users"`
+		} `json:"passwd"`
+	}
+	if err := json.Unmarshal(config, &parsed); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	users := parsed.Passwd.Users
+	if len(users) != 1 || len(users[0].SSHAuthorizedKeys) != 2 || users[0].SSHAuthorizedKeys[1] != "ssh-ed25519 AAAA packer" {
+		t.Fatalf("bad: %s", config)
+	}
+
+	// The user is added when the config doesn't list it
+	config, err = ignitionConfig("", "core", "ssh-ed25519 AAAA packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expected := `{"ignition":{"version":"3.0.0"},"passwd":{"users":[{"name":"core","sshAuthorizedKeys":["ssh-ed25519 AAAA packer"]}]}}`
+	if string(config) != expected {
+		t.Fatalf("bad: %s", config)
+	}
+}
+
+func TestValidateIgnitionConfig(t *testing.T) {
+	for _, doc := range []string{"", `{"ignition": {"version": "3.4.0"}}`} {
+		if err := validateIgnitionConfig(doc); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	for _, doc := range []string{"[]", `{"passwd": {}}`, `{"ignition": {"version": 3}}`, "variant: fcos"} {
+		if err := validateIgnitionConfig(doc); err == nil {
+			t.Fatalf("should have error: %s", doc)
+		}
+	}
+}
+
+func TestIgnitionQemuArgs(t *testing.T) {
+	args := ignitionQemuArgs([]byte(`{"ignition":{"version":"3.0.0"},"passwd":{"users":[{"name":"core","sshAuthorizedKeys":["ssh-ed25519 AAAA packer"]}]}}`))
+	if len(args) != 2 {
+		t.Fatalf("bad: %#v", args)
+	}
+	expected := `-fw_cfg name=opt/com.coreos/config,string={"ignition":{"version":"3.0.0"},,"passwd":{"users":[{"name":"core",,"sshAuthorizedKeys":["ssh-ed25519\u0020AAAA\u0020packer"]}]}}`
+	if args[0] != expected {
+		t.Fatalf("bad: %s", args[0])
+	}
+	// UTM splits the arguments on spaces
+	if fields := strings.Fields(args[1]); len(fields) != 2 || !strings.HasPrefix(fields[1], "name=opt/org.flatcar-linux/config,") {
+		t.Fatalf("bad: %#v", fields)
+	}
+}
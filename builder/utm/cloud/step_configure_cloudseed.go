@@ -4,30 +4,87 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"regexp"
 
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
 	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
 	utmcommon "github.com/naveenrajm7/packer-plugin-utm/builder/utm/common"
 )
 
-// This step configures the VM to send cloud init seed file.
+// This step configures the VM to send cloud init seed file. With
+// cloud_init, the seed is generated here, once the SSH key pair of the
+// communicator exists, and written to a CD or to the content of the HTTP
+// server. With the ignition datasource, the Ignition config is passed
+// through QEMU arguments instead.
 //
 // Uses:
 //
 //	config *config
 //	ui     packersdk.Ui
+//
+// Produces:
+//
+//	qemuAdditionalArgs []string - The QEMU arguments to remove before export
 type stepConfigureCloudSeed struct {
-	useCd               bool
+	useCd bool
+	// nocloud, configdrive or ignition
+	datasource string
+	// The content served by the HTTP server, with the seed files reserved
+	// by reserveSeedContent.
+	httpContent         map[string]string
 	diskUnmountCommands map[string][]string
+	seedCD              *utmcommon.StepCreateCD
 }
 
 func (s *stepConfigureCloudSeed) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("config").(*Config)
 	driver := state.Get("driver").(utmcommon.Driver)
 	ui := state.Get("ui").(packersdk.Ui)
 	vmId := state.Get("vmId").(string)
 
-	if s.useCd {
+	if s.datasource == "ignition" {
+		return s.configureIgnition(ctx, state, driver, ui, vmId)
+	}
+	// A ConfigDrive is always a CD
+	useCd := s.useCd || s.datasource == "configdrive"
+
+	if config.CloudInit != nil {
+		ui.Say("Generating cloud init seed...")
+		generate := config.CloudInit.Seed
+		if s.datasource == "configdrive" {
+			generate = config.CloudInit.ConfigDrive
+		}
+		seed, err := generate(config.Comm.SSHUsername, string(config.Comm.SSHPublicKey))
+		if err != nil {
+			err := fmt.Errorf("error generating cloud init seed: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+
+		if useCd {
+			content := make(map[string]string, len(config.CDContent)+len(seed))
+			for path, data := range config.CDContent {
+				content[path] = data
+			}
+			for name, data := range seed {
+				content[name] = data
+			}
+			s.seedCD = &utmcommon.StepCreateCD{
+				Files:   config.CDFiles,
+				Content: content,
+				Label:   config.CDLabel,
+			}
+			if action := s.seedCD.Run(ctx, state); action != multistep.ActionContinue {
+				return action
+			}
+		} else {
+			for name, data := range seed {
+				s.httpContent["/"+name] = data
+			}
+		}
+	}
+
+	if useCd {
 		return s.attachCloudInitISO(ctx, state, driver, ui, vmId)
 	} else {
 		return s.configureCloudInitHTTP(ctx, state, driver, ui, vmId)
@@ -50,6 +107,15 @@ func (s *stepConfigureCloudSeed) attachCloudInitISO(ctx context.Context, state m
 		return multistep.ActionHalt
 	}
 
+	// Copy the seed to a remote UTM host
+	cdFilesPath, err := driver.Upload(ctx, cdFilesPath)
+	if err != nil {
+		err := fmt.Errorf("error uploading cloud init seed ISO: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
 	ui.Say("Attaching cloud init seed ISO as a drive...")
 	// Convert controllerName to the corresponding enum code
 	controllerEnumCode, err := utmcommon.GetControllerEnumCode("virtio")
@@ -64,7 +130,7 @@ func (s *stepConfigureCloudSeed) attachCloudInitISO(ctx context.Context, state m
 		"--source", cdFilesPath,
 		"--removable", "false", // Not removable, required for cloud init seed on virtio
 	}
-	output, err := driver.ExecuteOsaScript(attachIsoCommand...)
+	result, err := driver.ExecuteOsaScript(ctx, attachIsoCommand...)
 	if err != nil {
 		err := fmt.Errorf("error attaching cloud init seed ISO: %s", err)
 		state.Put("error", err)
@@ -72,25 +138,19 @@ func (s *stepConfigureCloudSeed) attachCloudInitISO(ctx context.Context, state m
 		return multistep.ActionHalt
 	}
 
-	// Track the disks we've mounted so we can remove them without having
-	// to re-derive what was mounted where
-
-	// Regular expression to capture the UUID from the output
-	re := regexp.MustCompile(`[0-9a-fA-F-]{36}`)
-	matches := re.FindStringSubmatch(output)
-	if len(matches) > 0 {
-		uuid := matches[0] // Capture the UUID
-		unmountCommand := []string{
-			"remove_drive.applescript", vmId, uuid,
-		}
-		s.diskUnmountCommands["cloud_seed"] = unmountCommand
-	} else {
-		err := fmt.Errorf("error extracting UUID from output: %s", output)
+	if result.DriveID == "" {
+		err := fmt.Errorf("error attaching cloud init seed ISO: no drive id was returned")
 		state.Put("error", err)
 		ui.Error(err.Error())
 		return multistep.ActionHalt
 	}
 
+	// Track the disks we've mounted so we can remove them without having
+	// to re-derive what was mounted where
+	s.diskUnmountCommands["cloud_seed"] = []string{
+		"remove_drive.applescript", vmId, result.DriveID,
+	}
+
 	state.Put("disk_unmount_commands", s.diskUnmountCommands)
 
 	return multistep.ActionContinue
@@ -107,26 +167,45 @@ func (s *stepConfigureCloudSeed) configureCloudInitHTTP(ctx context.Context, sta
 	// Add Qemu args to send cloud init seed file
 	ui.Say("Configuring VM to send cloud init seed file...")
 	cloudQemuArg := fmt.Sprintf("-smbios type=1,serial=ds=nocloud-net;seedfrom=http://%s:%d/", hostIP, httpPort)
-	addQemuArgsCommand := []string{
-		"add_qemu_additional_args.applescript", vmId,
-		"--args", cloudQemuArg,
+	ui.Say("Adding QEMU additional arguments...")
+	if err := utmcommon.AddQemuAdditionalArgs(ctx, state, driver, vmId, cloudQemuArg); err != nil {
+		err := fmt.Errorf("error adding QEMU additional arguments: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
 	}
 
-	ui.Say("Adding QEMU additional arguments...")
-	_, err := driver.ExecuteOsaScript(addQemuArgsCommand...)
+	return multistep.ActionContinue
+}
+
+func (s *stepConfigureCloudSeed) configureIgnition(ctx context.Context, state multistep.StateBag, driver utmcommon.Driver, ui packersdk.Ui, vmId string) multistep.StepAction {
+	config := state.Get("config").(*Config)
+
+	ui.Say("Configuring VM to send Ignition config...")
+	ignition, err := ignitionConfig(config.IgnitionConfig, config.Comm.SSHUsername, string(config.Comm.SSHPublicKey))
 	if err != nil {
+		err := fmt.Errorf("error generating Ignition config: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	// The arguments hold the public key, they are removed before export
+	ui.Say("Adding QEMU additional arguments...")
+	if err := utmcommon.AddQemuAdditionalArgs(ctx, state, driver, vmId, ignitionQemuArgs(ignition)...); err != nil {
 		err := fmt.Errorf("error adding QEMU additional arguments: %s", err)
 		state.Put("error", err)
 		ui.Error(err.Error())
 		return multistep.ActionHalt
 	}
-	// Save the Cloud QEMU argument for later cleanup
-	state.Put("qemuAdditionalArg", cloudQemuArg)
 
 	return multistep.ActionContinue
 }
 
 func (s *stepConfigureCloudSeed) Cleanup(state multistep.StateBag) {
+	if s.seedCD != nil {
+		defer s.seedCD.Cleanup(state)
+	}
 	if len(s.diskUnmountCommands) == 0 {
 		return
 	}
@@ -136,10 +215,25 @@ func (s *stepConfigureCloudSeed) Cleanup(state multistep.StateBag) {
 
 	if !ok {
 		for _, command := range s.diskUnmountCommands {
-			_, err := driver.ExecuteOsaScript(command...)
+			_, err := driver.ExecuteOsaScript(context.Background(), command...)
 			if err != nil {
 				log.Printf("error detaching iso: %s", err)
 			}
 		}
 	}
 }
+
+// reserveSeedContent returns a copy of the content of the HTTP server with
+// the files of the cloud-init seed. The server only starts with some
+// content, before the seed can be generated, and serves the files the seed
+// step writes to the same map.
+func reserveSeedContent(content map[string]string) map[string]string {
+	reserved := make(map[string]string, len(content)+3)
+	for path, data := range content {
+		reserved[path] = data
+	}
+	for _, name := range []string{seedUserData, seedMetaData} {
+		reserved["/"+name] = ""
+	}
+	return reserved
+}
@@ -6,13 +6,12 @@ import (
 	"io"
 	"log"
 	"os"
-	"os/exec"
-	"strconv"
 
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
 	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
 	"github.com/hashicorp/packer-plugin-sdk/tmp"
 	utmcommon "github.com/naveenrajm7/packer-plugin-utm/builder/utm/common"
+	"github.com/naveenrajm7/packer-plugin-utm/builder/utm/common/qcow2"
 )
 
 // This step creates the virtual disk from cloud image that will be used as the
@@ -30,7 +29,8 @@ func (s *stepCreateCloudDisk) Run(ctx context.Context, state multistep.StateBag)
 	cloudImagePath := state.Get("iso_path").(string)
 
 	// Create main disk seperately for cloud image, since it uses source file
-	// Additional disks are created with use of size
+	// Additional disks are created from their disk block
+	mainDisk := config.Disks[0]
 
 	// Create a temporary file to be our cloud image drive
 	TMPF, err := tmp.File("packer*.iso")
@@ -45,10 +45,22 @@ func (s *stepCreateCloudDisk) Run(ctx context.Context, state multistep.StateBag)
 	}
 	log.Printf("Temp cloud image path: %s", TMPPath)
 	s.ResizedCloudImagePath = TMPPath
-	// Create a copy of the original cloud image
-	ui.Say("Creating a copy of the original cloud image...")
-
-	err = copyFile(cloudImagePath, s.ResizedCloudImagePath)
+	// Create a copy of the original cloud image, in the qcow2 format so its
+	// disk can be snapshotted and compacted like the disks UTM creates
+	isQcow2, err := qcow2.IsQcow2(cloudImagePath)
+	if err != nil {
+		err := fmt.Errorf("error reading cloud image: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	if isQcow2 {
+		ui.Say("Creating a copy of the original cloud image...")
+		err = copyFile(cloudImagePath, s.ResizedCloudImagePath)
+	} else {
+		ui.Say("Converting the raw cloud image to qcow2...")
+		err = qcow2.FromRaw(cloudImagePath, s.ResizedCloudImagePath)
+	}
 	if err != nil {
 		err := fmt.Errorf("error copying cloud image: %s", err)
 		state.Put("error", err)
@@ -57,17 +69,14 @@ func (s *stepCreateCloudDisk) Run(ctx context.Context, state multistep.StateBag)
 	}
 
 	// if ResizeCloudImage is true, resize the cloud image
-	// Use qemu-img to increase the size of the cloud image to config.DiskSize
+	// Increase the size of the cloud image to the size of the main disk
 	// This is required as default disk size of cloud image is small
 	// and we need to honor the user provided disk size
 	if config.ResizeCloudImage {
-		// Resize the cloud image using qemu-img
-		ui.Say(fmt.Sprintf("Resizing cloud image with size %d MiB...", config.DiskSize))
-		diskSizeStr := fmt.Sprintf("%dM", config.DiskSize)
-		cmd := exec.Command("qemu-img", "resize", s.ResizedCloudImagePath, diskSizeStr)
-		output, err := cmd.CombinedOutput()
+		ui.Say(fmt.Sprintf("Resizing cloud image with size %d MiB...", mainDisk.Size))
+		err := qcow2.Resize(s.ResizedCloudImagePath, int64(mainDisk.Size)*1024*1024)
 		if err != nil {
-			err := fmt.Errorf("error resizing cloud image: %s, output: %s", err, string(output))
+			err := fmt.Errorf("error resizing cloud image: %s", err)
 			state.Put("error", err)
 			ui.Error(err.Error())
 			return multistep.ActionHalt
@@ -77,21 +86,30 @@ func (s *stepCreateCloudDisk) Run(ctx context.Context, state multistep.StateBag)
 	}
 
 	// Convert controllerName to the corresponding enum code
-	controllerEnumCode, err := utmcommon.GetControllerEnumCode(config.HardDriveInterface)
+	controllerEnumCode, err := utmcommon.GetControllerEnumCode(mainDisk.Interface)
+	if err != nil {
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	// Copy the cloud image to a remote UTM host
+	diskImagePath, err := driver.Upload(ctx, s.ResizedCloudImagePath)
 	if err != nil {
+		err := fmt.Errorf("error uploading cloud image: %s", err)
 		state.Put("error", err)
 		ui.Error(err.Error())
 		return multistep.ActionHalt
 	}
+
 	// Attach the cloud image as a non removable drive
 	command := []string{
 		"attach_iso.applescript", vmId,
 		"--interface", controllerEnumCode,
-		"--source", s.ResizedCloudImagePath,
+		"--source", diskImagePath,
 		"--removable", "false",
 	}
 
-	_, err = driver.ExecuteOsaScript(command...)
+	_, err = driver.ExecuteOsaScript(ctx, command...)
 	if err != nil {
 		err := fmt.Errorf("error creating hard drive: %s", err)
 		state.Put("error", err)
@@ -101,36 +119,27 @@ func (s *stepCreateCloudDisk) Run(ctx context.Context, state multistep.StateBag)
 
 	// Create additional disks
 	// We do not give names to the disks, as UTM does not support it
-	diskSizes := []uint{}
-	if len(config.AdditionalDiskSize) > 0 {
-		diskSizes = append(diskSizes, config.AdditionalDiskSize...)
-	}
-
-	// Create all required disks
-	for i := range diskSizes {
-		ui.Say(fmt.Sprintf("Creating hard drive with size %d MiB...", diskSizes[i]))
-
-		// Convert controllerName to the corresponding enum code
-		controllerEnumCode, err := utmcommon.GetControllerEnumCode(config.HardDriveInterface)
-		if err != nil {
-			state.Put("error", err)
-			ui.Error(err.Error())
-			return multistep.ActionHalt
+	var excludedDrives []string
+	for _, disk := range config.Disks[1:] {
+		if disk.Source != "" {
+			ui.Say(fmt.Sprintf("Attaching hard drive with image %s...", disk.Source))
+		} else {
+			ui.Say(fmt.Sprintf("Creating hard drive with size %d MiB...", disk.Size))
 		}
 
-		command := []string{
-			"add_drive.applescript", vmId,
-			"--interface", controllerEnumCode,
-			"--size", strconv.FormatUint(uint64(diskSizes[i]), 10),
-		}
-		_, err = driver.ExecuteOsaScript(command...)
+		driveId, err := utmcommon.AddDisk(ctx, driver, vmId, disk)
 		if err != nil {
 			err := fmt.Errorf("error creating hard drive: %s", err)
 			state.Put("error", err)
 			ui.Error(err.Error())
 			return multistep.ActionHalt
 		}
+		if disk.SkipExport {
+			excludedDrives = append(excludedDrives, driveId)
+		}
 	}
+	// Detached by StepRemoveDevices before the export
+	state.Put("excluded_drives", excludedDrives)
 
 	// In UTM disk creation and attaching are done in the same step
 
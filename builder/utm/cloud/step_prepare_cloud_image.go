@@ -0,0 +1,334 @@
+package cloud
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/packer-plugin-sdk/filelock"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/tmp"
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/naveenrajm7/packer-plugin-utm/builder/utm/common/qcow2"
+	"github.com/naveenrajm7/packer-plugin-utm/builder/utm/common/vhdx"
+	"github.com/naveenrajm7/packer-plugin-utm/builder/utm/common/vmdk"
+	"github.com/ulikunitz/xz"
+)
+
+// This step prepares the downloaded cloud image: compressed images are
+// decompressed, and VMDK and VHDX images are converted to qcow2. The
+// prepared image is cached by the checksum of the download, so that the
+// next builds use it as is. A checksum like file:<url> stays the same when
+// the image it lists changes, so the cached image is only used for the
+// download it was prepared from: its path, size and modification time are
+// kept next to it.
+//
+// Uses:
+//
+//	iso_path string
+//
+// Produces:
+//
+//	iso_path string - The path of the prepared image
+type stepPrepareCloudImage struct {
+	Checksum string
+
+	// The prepared image, when it isn't cached
+	tempPath string
+}
+
+func (s *stepPrepareCloudImage) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packersdk.Ui)
+	cloudImagePath := state.Get("iso_path").(string)
+
+	img, err := openCloudImage(cloudImagePath)
+	if err != nil {
+		err := fmt.Errorf("error reading cloud image: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	img.Close()
+	if img.compression == "" && (img.format == "qcow2" || img.format == "raw") {
+		return multistep.ActionContinue
+	}
+
+	// Without a checksum, the download may change from one build to another
+	var preparedPath, source string
+	if s.Checksum == "" || s.Checksum == "none" {
+		f, err := tmp.File("packer*.img")
+		if err != nil {
+			err := fmt.Errorf("error creating temporary file for cloud image: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		f.Close()
+		preparedPath = f.Name()
+		s.tempPath = preparedPath
+	} else {
+		sum := sha1.Sum([]byte(s.Checksum))
+		preparedPath, err = packersdk.CachePath(hex.EncodeToString(sum[:]) + ".prepared.img")
+		if err != nil {
+			err := fmt.Errorf("error finding the cache path of the cloud image: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+
+		// Builds running at the same time prepare the image once
+		log.Printf("Acquiring lock for: %s", preparedPath)
+		lock := filelock.New(preparedPath + ".lock")
+		lock.Lock()
+		defer lock.Unlock()
+
+		source, err = cloudImageSource(cloudImagePath)
+		if err != nil {
+			err := fmt.Errorf("error reading cloud image: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		if _, err := os.Stat(preparedPath); err == nil {
+			cached, _ := os.ReadFile(preparedPath + ".source")
+			if string(cached) == source {
+				ui.Say(fmt.Sprintf("Using the prepared cloud image from the cache: %s", preparedPath))
+				state.Put("iso_path", preparedPath)
+				return multistep.ActionContinue
+			}
+			log.Printf("The prepared cloud image %s is from another download, preparing it again", preparedPath)
+		}
+	}
+
+	switch {
+	case img.compression != "" && (img.format == "qcow2" || img.format == "raw"):
+		ui.Say(fmt.Sprintf("Decompressing the %s compressed cloud image...", img.compression))
+	case img.compression != "":
+		ui.Say(fmt.Sprintf("Decompressing the %s compressed cloud image, and converting it from %s to qcow2...",
+			img.compression, img.format))
+	default:
+		ui.Say(fmt.Sprintf("Converting the cloud image from %s to qcow2...", img.format))
+	}
+	// The image is only cached once it is complete
+	partialPath := preparedPath + ".partial"
+	os.Remove(preparedPath + ".source")
+	err = prepareCloudImage(cloudImagePath, partialPath)
+	if err == nil {
+		err = os.Rename(partialPath, preparedPath)
+	}
+	if err == nil && source != "" {
+		err = os.WriteFile(preparedPath+".source", []byte(source), 0644)
+	}
+	if err != nil {
+		os.Remove(partialPath)
+		err := fmt.Errorf("error preparing cloud image: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	log.Printf("Prepared cloud image: %s", preparedPath)
+	state.Put("iso_path", preparedPath)
+	return multistep.ActionContinue
+}
+
+func (s *stepPrepareCloudImage) Cleanup(state multistep.StateBag) {
+	if s.tempPath == "" {
+		return
+	}
+	if err := os.Remove(s.tempPath); err != nil && !os.IsNotExist(err) {
+		ui := state.Get("ui").(packersdk.Ui)
+		ui.Error(fmt.Sprintf("error removing prepared cloud image: %s", err))
+	}
+}
+
+// cloudImageSource identifies the download a cloud image is prepared from,
+// by its path, size and modification time.
+func cloudImageSource(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s\n%d\n%d\n", path, info.Size(), info.ModTime().UnixNano()), nil
+}
+
+// The compressions cloud images are shipped with, by their magic number.
+var compressions = []struct {
+	name   string
+	magic  []byte
+	reader func(io.Reader) (io.ReadCloser, error)
+}{
+	{"gzip", []byte{0x1f, 0x8b}, func(r io.Reader) (io.ReadCloser, error) {
+		return pgzip.NewReader(r)
+	}},
+	{"xz", []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, func(r io.Reader) (io.ReadCloser, error) {
+		d, err := xz.NewReader(r)
+		return io.NopCloser(d), err
+	}},
+	{"zstd", []byte{0x28, 0xb5, 0x2f, 0xfd}, func(r io.Reader) (io.ReadCloser, error) {
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}},
+	{"bzip2", []byte("BZh"), func(r io.Reader) (io.ReadCloser, error) {
+		return io.NopCloser(bzip2.NewReader(r)), nil
+	}},
+}
+
+// cloudImageFormat returns the format of a disk image from its first
+// bytes: qcow2, vmdk, vhdx or raw.
+func cloudImageFormat(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, qcow2.Magic):
+		return "qcow2"
+	case bytes.HasPrefix(head, vmdk.Magic), bytes.HasPrefix(head, vmdk.DescriptorMagic[:8]):
+		return "vmdk"
+	case bytes.HasPrefix(head, vhdx.Magic):
+		return "vhdx"
+	default:
+		return "raw"
+	}
+}
+
+// cloudImage is a cloud image open for reading, decompressed while it is
+// read.
+type cloudImage struct {
+	// The compression of the file, empty when it isn't compressed
+	compression string
+	// The format of the disk image
+	format string
+
+	r      *bufio.Reader
+	f      *os.File
+	closer io.Closer
+}
+
+func openCloudImage(path string) (*cloudImage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	img := &cloudImage{f: f, r: bufio.NewReaderSize(f, 1024*1024)}
+
+	// Not every image is large enough to peek the longest magic number
+	head, _ := img.r.Peek(len(vmdk.DescriptorMagic))
+	for _, c := range compressions {
+		if !bytes.HasPrefix(head, c.magic) {
+			continue
+		}
+		d, err := c.reader(img.r)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("error reading the %s compressed image: %s", c.name, err)
+		}
+		img.compression, img.closer = c.name, d
+		img.r = bufio.NewReaderSize(d, 1024*1024)
+		head, _ = img.r.Peek(len(vmdk.DescriptorMagic))
+		break
+	}
+	img.format = cloudImageFormat(head)
+	return img, nil
+}
+
+func (img *cloudImage) Close() error {
+	if img.closer != nil {
+		img.closer.Close()
+	}
+	return img.f.Close()
+}
+
+// prepareCloudImage writes the cloud image at src to dst, decompressed, and
+// converted to qcow2 if it isn't a qcow2 or raw image. VMDK and VHDX images
+// are read at random, so they are decompressed to a temporary file first.
+func prepareCloudImage(src string, dst string) error {
+	img, err := openCloudImage(src)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+
+	switch {
+	case img.format == "qcow2" || img.format == "raw":
+		return writeSparse(img.r, dst)
+	case img.compression != "":
+		decompressed := dst + ".decompressed"
+		defer os.Remove(decompressed)
+		if err := writeSparse(img.r, decompressed); err != nil {
+			return err
+		}
+		return convertCloudImage(decompressed, img.format, dst)
+	default:
+		return convertCloudImage(src, img.format, dst)
+	}
+}
+
+// convertCloudImage converts a VMDK or VHDX image to qcow2.
+func convertCloudImage(src string, format string, dst string) error {
+	var disk interface {
+		io.ReaderAt
+		Size() int64
+		Close() error
+	}
+	var err error
+	switch format {
+	case "vmdk":
+		disk, err = vmdk.Open(src)
+	case "vhdx":
+		disk, err = vhdx.Open(src)
+	default:
+		err = fmt.Errorf("the %s format can't be converted", format)
+	}
+	if err != nil {
+		return err
+	}
+	defer disk.Close()
+	return qcow2.Create(dst, disk, disk.Size())
+}
+
+// writeSparse writes the data of r to the file dst, without writing the
+// blocks which only hold zeros.
+func writeSparse(r io.Reader, dst string) error {
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buf := make([]byte, 64*1024)
+	var offset int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 && !bytes.Equal(buf[:n], make([]byte, n)) {
+			if _, err := f.WriteAt(buf[:n], offset); err != nil {
+				return err
+			}
+		}
+		offset += int64(n)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := f.Truncate(offset); err != nil {
+		return err
+	}
+	return f.Sync()
+}
@@ -0,0 +1,236 @@
+package cloud
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/klauspost/compress/zstd"
+	"github.com/naveenrajm7/packer-plugin-utm/builder/utm/common/qcow2"
+	"github.com/ulikunitz/xz"
+)
+
+// testDisk is the data of testdata/disk.img.bz2.
+func testDisk() []byte {
+	disk := make([]byte, 3*1024*1024+512)
+	copy(disk, "boot")
+	copy(disk[70000:], "data")
+	copy(disk[3*1024*1024+2:], "end")
+	return disk
+}
+
+// testCompressed writes data compressed with the given compression.
+func testCompressed(t *testing.T, compression string, data []byte) string {
+	var b bytes.Buffer
+	var w io.WriteCloser
+	var err error
+	switch compression {
+	case "gzip":
+		w = gzip.NewWriter(&b)
+	case "xz":
+		w, err = xz.NewWriter(&b)
+	case "zstd":
+		w, err = zstd.NewWriter(&b)
+	default:
+		b.Write(data)
+	}
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if w != nil {
+		w.Write(data)
+		w.Close()
+	}
+
+	path := filepath.Join(t.TempDir(), "disk")
+	if err := os.WriteFile(path, b.Bytes(), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return path
+}
+
+func TestPrepareCloudImage(t *testing.T) {
+	disk := testDisk()
+	sources := map[string]string{
+		"bzip2": filepath.Join("testdata", "disk.img.bz2"),
+	}
+	for _, compression := range []string{"", "gzip", "xz", "zstd"} {
+		sources[compression] = testCompressed(t, compression, disk)
+	}
+
+	for compression, src := range sources {
+		img, err := openCloudImage(src)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		img.Close()
+		if img.compression != compression || img.format != "raw" {
+			t.Fatalf("bad: %s: %s %s", compression, img.compression, img.format)
+		}
+
+		dst := filepath.Join(t.TempDir(), "disk.img")
+		if err := prepareCloudImage(src, dst); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		prepared, err := os.ReadFile(dst)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if !bytes.Equal(prepared, disk) {
+			t.Fatalf("bad: %s: the prepared image differs", compression)
+		}
+	}
+}
+
+func TestPrepareCloudImage_qcow2(t *testing.T) {
+	raw := testCompressed(t, "", testDisk())
+	image := filepath.Join(t.TempDir(), "disk.qcow2")
+	if err := qcow2.FromRaw(raw, image); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	data, err := os.ReadFile(image)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	src := testCompressed(t, "zstd", data)
+
+	img, err := openCloudImage(src)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	img.Close()
+	if img.compression != "zstd" || img.format != "qcow2" {
+		t.Fatalf("bad: %s %s", img.compression, img.format)
+	}
+
+	dst := filepath.Join(t.TempDir(), "disk.qcow2")
+	if err := prepareCloudImage(src, dst); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if ok, err := qcow2.IsQcow2(dst); !ok || err != nil {
+		t.Fatalf("bad: %t %v", ok, err)
+	}
+	back := filepath.Join(t.TempDir(), "back.img")
+	if err := qcow2.ToRaw(dst, back); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if data, _ := os.ReadFile(back); !bytes.Equal(data, testDisk()) {
+		t.Fatal("bad: the prepared image differs")
+	}
+}
+
+func TestStepPrepareCloudImage(t *testing.T) {
+	t.Setenv("PACKER_CACHE_DIR", t.TempDir())
+	src := testCompressed(t, "xz", testDisk())
+
+	var prepared string
+	for i := 0; i < 2; i++ {
+		state := new(multistep.BasicStateBag)
+		out := new(bytes.Buffer)
+		state.Put("ui", &packersdk.BasicUi{Reader: new(bytes.Buffer), Writer: out})
+		state.Put("iso_path", src)
+
+		step := &stepPrepareCloudImage{Checksum: "sha256:1234"}
+		if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+			t.Fatalf("bad action: %#v: %s", action, state.Get("error"))
+		}
+		step.Cleanup(state)
+
+		path := state.Get("iso_path").(string)
+		if prepared == "" {
+			prepared = path
+		}
+		// The prepared image is cached
+		if path != prepared || filepath.Dir(path) != os.Getenv("PACKER_CACHE_DIR") {
+			t.Fatalf("bad: %s", path)
+		}
+		if data, _ := os.ReadFile(path); !bytes.Equal(data, testDisk()) {
+			t.Fatal("bad: the prepared image differs")
+		}
+		if cached := strings.Contains(out.String(), "from the cache"); cached != (i == 1) {
+			t.Fatalf("bad: %s", out.String())
+		}
+	}
+}
+
+func TestStepPrepareCloudImage_sharedChecksum(t *testing.T) {
+	t.Setenv("PACKER_CACHE_DIR", t.TempDir())
+	other := testDisk()
+	copy(other, "other")
+
+	// Two downloads with the same file:<url> checksum, e.g. two
+	// architectures, or an image rotated upstream
+	for _, disk := range [][]byte{testDisk(), other, testDisk()} {
+		state := new(multistep.BasicStateBag)
+		out := new(bytes.Buffer)
+		state.Put("ui", &packersdk.BasicUi{Reader: new(bytes.Buffer), Writer: out})
+		state.Put("iso_path", testCompressed(t, "gzip", disk))
+
+		step := &stepPrepareCloudImage{Checksum: "file:https://example.com/SHA256SUMS"}
+		if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+			t.Fatalf("bad action: %#v: %s", action, state.Get("error"))
+		}
+		if strings.Contains(out.String(), "from the cache") {
+			t.Fatalf("bad: %s", out.String())
+		}
+		if data, _ := os.ReadFile(state.Get("iso_path").(string)); !bytes.Equal(data, disk) {
+			t.Fatal("bad: the prepared image is from another download")
+		}
+	}
+}
+
+func TestStepPrepareCloudImage_noChecksum(t *testing.T) {
+	state := new(multistep.BasicStateBag)
+	state.Put("ui", &packersdk.BasicUi{Reader: new(bytes.Buffer), Writer: new(bytes.Buffer)})
+	src := testCompressed(t, "gzip", testDisk())
+	state.Put("iso_path", src)
+
+	step := &stepPrepareCloudImage{Checksum: "none"}
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v: %s", action, state.Get("error"))
+	}
+	path := state.Get("iso_path").(string)
+	if path == src {
+		t.Fatal("should be decompressed")
+	}
+	// The image is only prepared for this build
+	step.Cleanup(state)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("should be removed: %s", path)
+	}
+
+	// Images which aren't compressed are used as is
+	src = testCompressed(t, "", testDisk())
+	state.Put("iso_path", src)
+	step = &stepPrepareCloudImage{Checksum: "none"}
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v: %s", action, state.Get("error"))
+	}
+	if path := state.Get("iso_path").(string); path != src {
+		t.Fatalf("bad: %s", path)
+	}
+}
+
+func TestKeepCompressed(t *testing.T) {
+	cases := map[string]string{
+		"https://example.com/disk.img.xz":               "https://example.com/disk.img.xz?archive=false",
+		"https://example.com/disk.qcow2.GZ?token=1":     "https://example.com/disk.qcow2.GZ?token=1&archive=false",
+		"https://example.com/disk.raw.zst?archive=true": "https://example.com/disk.raw.zst?archive=true",
+		"./disk.img.bz2":                                 "./disk.img.bz2?archive=false",
+		"https://example.com/disk.qcow2":                 "https://example.com/disk.qcow2",
+		"https://example.com/disk.tar.gz":                "https://example.com/disk.tar.gz",
+		"https://example.com/disk.vmdk?name=disk.img.xz": "https://example.com/disk.vmdk?name=disk.img.xz",
+	}
+	for u, expected := range cases {
+		if actual := keepCompressed(u); actual != expected {
+			t.Fatalf("bad: %s: %s", u, actual)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// cloudInitStatusCommand prints the result of cloud-init once it is done,
+// which is what `cloud-init status` reads. It exits with 3 while cloud-init
+// runs, with 4 when the guest has no cloud-init, and with 5 when cloud-init
+// is disabled, so it never writes a result: the systemd generator of
+// cloud-init writes /run/cloud-init/disabled when it is disabled, by
+// /etc/cloud/cloud-init.disabled, by cloud-init=disabled on the kernel
+// command line, or when no datasource is found. The file and the command
+// line are also checked on the guests without the generator.
+const cloudInitStatusCommand = `if [ -f /run/cloud-init/result.json ]; then cat /run/cloud-init/result.json; ` +
+	`elif [ -f /run/cloud-init/disabled ] || [ -f /etc/cloud/cloud-init.disabled ] || ` +
+	`grep -qw cloud-init=disabled /proc/cmdline 2>/dev/null; then exit 5; ` +
+	`elif [ -d /run/cloud-init ] || command -v cloud-init >/dev/null 2>&1; then exit 3; else exit 4; fi`
+
+// cloudInitResult is /run/cloud-init/result.json.
+type cloudInitResult struct {
+	V1 struct {
+		Datasource string   `json:"datasource"`
+		Errors     []string `json:"errors"`
+		// Warnings and deprecations, by level, since cloud-init 23.4
+		RecoverableErrors map[string][]string `json:"recoverable_errors"`
+	} `json:"v1"`
+}
+
+// This step waits for cloud-init to finish in the guest, so that the
+// provisioners run once the VM is configured, and fails if cloud-init
+// reports errors.
+//
+// Uses:
+//
+//	communicator packersdk.Communicator
+//	ui packersdk.Ui
+//
+// Produces:
+//
+//	<nothing>
+type stepWaitCloudInit struct {
+	Skip    bool
+	Timeout time.Duration
+	// The time between two checks of the status, 5 seconds if unset
+	PollInterval time.Duration
+}
+
+func (s *stepWaitCloudInit) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	if s.Skip {
+		return multistep.ActionContinue
+	}
+
+	ui := state.Get("ui").(packersdk.Ui)
+	comm, ok := state.Get("communicator").(packersdk.Communicator)
+	if !ok {
+		ui.Say("No communicator, not waiting for cloud-init.")
+		return multistep.ActionContinue
+	}
+
+	pollInterval := s.PollInterval
+	if pollInterval == 0 {
+		pollInterval = 5 * time.Second
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, s.Timeout)
+	defer cancel()
+
+	ui.Say("Waiting for cloud-init to finish...")
+	var result cloudInitResult
+	for {
+		output, status, err := runCommand(waitCtx, comm, cloudInitStatusCommand)
+		if err == nil && status == 0 {
+			if err := json.Unmarshal([]byte(output), &result); err != nil {
+				err := fmt.Errorf("error reading the cloud-init result: %s", err)
+				state.Put("error", err)
+				ui.Error(err.Error())
+				return multistep.ActionHalt
+			}
+			break
+		}
+		if err == nil && status == 4 {
+			ui.Say("The guest has no cloud-init, not waiting for it.")
+			return multistep.ActionContinue
+		}
+		if err == nil && status == 5 {
+			ui.Say("cloud-init is disabled in the guest, not waiting for it.")
+			return multistep.ActionContinue
+		}
+		if err == nil && status != 3 {
+			err := fmt.Errorf("the cloud-init status command exited with status %d", status)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		// cloud-init may reboot the guest, which breaks the connection
+		if err != nil && waitCtx.Err() == nil {
+			log.Printf("Error checking the cloud-init status, retrying: %s", err)
+		}
+
+		select {
+		case <-time.After(pollInterval):
+		case <-waitCtx.Done():
+			if ctx.Err() != nil {
+				return multistep.ActionHalt
+			}
+			err := fmt.Errorf("cloud-init didn't finish within %s", s.Timeout)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+
+	levels := make([]string, 0, len(result.V1.RecoverableErrors))
+	for level := range result.V1.RecoverableErrors {
+		levels = append(levels, level)
+	}
+	sort.Strings(levels)
+	for _, level := range levels {
+		for _, message := range result.V1.RecoverableErrors[level] {
+			ui.Message(fmt.Sprintf("cloud-init %s: %s", strings.ToLower(level), message))
+		}
+	}
+	if errs := result.V1.Errors; len(errs) > 0 {
+		err := fmt.Errorf("cloud-init finished with errors:\n%s", strings.Join(errs, "\n"))
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	log.Printf("cloud-init datasource: %s", result.V1.Datasource)
+	ui.Say("cloud-init finished.")
+	return multistep.ActionContinue
+}
+
+func (s *stepWaitCloudInit) Cleanup(state multistep.StateBag) {}
+
+// runCommand runs a command in the guest, and returns its output and its
+// exit status.
+func runCommand(ctx context.Context, comm packersdk.Communicator, command string) (string, int, error) {
+	var stdout bytes.Buffer
+	cmd := &packersdk.RemoteCmd{
+		Command: command,
+		Stdout:  &stdout,
+		Stderr:  io.Discard,
+	}
+	if err := comm.Start(ctx, cmd); err != nil {
+		return "", 0, err
+	}
+
+	exited := make(chan int, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	select {
+	case status := <-exited:
+		return stdout.String(), status, nil
+	case <-ctx.Done():
+		return "", 0, errors.New("the command was cancelled")
+	}
+}
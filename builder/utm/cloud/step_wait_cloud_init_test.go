@@ -0,0 +1,183 @@
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// statusCommunicator answers the cloud-init status command with a
+// sequence of results.
+type statusCommunicator struct {
+	packersdk.MockCommunicator
+
+	results []statusResult
+	calls   int
+}
+
+type statusResult struct {
+	stdout string
+	status int
+	err    error
+}
+
+func (c *statusCommunicator) Start(ctx context.Context, cmd *packersdk.RemoteCmd) error {
+	result := c.results[len(c.results)-1]
+	if c.calls < len(c.results) {
+		result = c.results[c.calls]
+	}
+	c.calls++
+	if result.err != nil {
+		return result.err
+	}
+	cmd.Stdout.Write([]byte(result.stdout))
+	cmd.SetExited(result.status)
+	return nil
+}
+
+func testWaitCloudInit(t *testing.T, results ...statusResult) (multistep.StepAction, multistep.StateBag, *statusCommunicator, string) {
+	comm := &statusCommunicator{results: results}
+	state := new(multistep.BasicStateBag)
+	out := new(bytes.Buffer)
+	state.Put("ui", &packersdk.BasicUi{Reader: new(bytes.Buffer), Writer: out, ErrorWriter: out})
+	state.Put("communicator", comm)
+
+	step := &stepWaitCloudInit{Timeout: time.Second, PollInterval: time.Millisecond}
+	action := step.Run(context.Background(), state)
+	return action, state, comm, out.String()
+}
+
+func TestStepWaitCloudInit_impl(t *testing.T) {
+	var _ multistep.Step = new(stepWaitCloudInit)
+}
+
+func TestStepWaitCloudInit(t *testing.T) {
+	// The connection breaks while cloud-init reboots the guest
+	action, state, comm, out := testWaitCloudInit(t,
+		statusResult{status: 3},
+		statusResult{err: errors.New("connection reset")},
+		statusResult{status: 3},
+		statusResult{stdout: `{"v1": {"datasource": "DataSourceNoCloud", "errors": [],
+			"recoverable_errors": {"DEPRECATED": ["Key 'chpasswd.list' is deprecated"]}}}`},
+	)
+	if action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v: %s", action, state.Get("error"))
+	}
+	if comm.calls != 4 {
+		t.Fatalf("bad: %d", comm.calls)
+	}
+	if !strings.Contains(out, "cloud-init deprecated: Key 'chpasswd.list' is deprecated") {
+		t.Fatalf("bad: %s", out)
+	}
+}
+
+func TestStepWaitCloudInit_errors(t *testing.T) {
+	action, state, _, _ := testWaitCloudInit(t, statusResult{
+		stdout: `{"v1": {"datasource": "DataSourceNoCloud", "errors": ["('scripts_user', RuntimeError('Runparts: 1 failures'))"]}}`,
+	})
+	if action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if err := state.Get("error").(error); !strings.Contains(err.Error(), "Runparts: 1 failures") {
+		t.Fatalf("bad: %s", err)
+	}
+}
+
+func TestStepWaitCloudInit_timeout(t *testing.T) {
+	action, state, _, _ := testWaitCloudInit(t, statusResult{status: 3})
+	if action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if err := state.Get("error").(error); !strings.Contains(err.Error(), "didn't finish within 1s") {
+		t.Fatalf("bad: %s", err)
+	}
+}
+
+func TestStepWaitCloudInit_noCloudInit(t *testing.T) {
+	action, state, comm, _ := testWaitCloudInit(t, statusResult{status: 4})
+	if action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v: %s", action, state.Get("error"))
+	}
+	if comm.calls != 1 {
+		t.Fatalf("bad: %d", comm.calls)
+	}
+}
+
+func TestStepWaitCloudInit_disabled(t *testing.T) {
+	action, state, comm, out := testWaitCloudInit(t, statusResult{status: 5})
+	if action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v: %s", action, state.Get("error"))
+	}
+	if comm.calls != 1 || !strings.Contains(out, "cloud-init is disabled") {
+		t.Fatalf("bad: %d: %s", comm.calls, out)
+	}
+}
+
+func TestCloudInitStatusCommand(t *testing.T) {
+	root := t.TempDir()
+	command := strings.NewReplacer(
+		"/run/", root+"/run/",
+		"/etc/", root+"/etc/",
+		"/proc/cmdline", root+"/cmdline",
+		"command -v cloud-init", "true",
+	).Replace(cloudInitStatusCommand)
+	write := func(path string, data string) {
+		path = filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	status := func() int {
+		err := exec.Command("/bin/sh", "-c", command).Run()
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitErr.ExitCode()
+		}
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return 0
+	}
+
+	write("cmdline", "console=ttyAMA0 root=LABEL=root")
+	if actual := status(); actual != 3 {
+		t.Fatalf("bad: %d", actual)
+	}
+	write("cmdline", "console=ttyAMA0 cloud-init=disabled")
+	if actual := status(); actual != 5 {
+		t.Fatalf("bad: %d", actual)
+	}
+	write("cmdline", "")
+	write("etc/cloud/cloud-init.disabled", "")
+	if actual := status(); actual != 5 {
+		t.Fatalf("bad: %d", actual)
+	}
+	os.Remove(filepath.Join(root, "etc/cloud/cloud-init.disabled"))
+	write("run/cloud-init/disabled", "")
+	if actual := status(); actual != 5 {
+		t.Fatalf("bad: %d", actual)
+	}
+	write("run/cloud-init/result.json", "{}")
+	if actual := status(); actual != 0 {
+		t.Fatalf("bad: %d", actual)
+	}
+}
+
+func TestStepWaitCloudInit_skip(t *testing.T) {
+	state := new(multistep.BasicStateBag)
+	step := &stepWaitCloudInit{Skip: true}
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+}
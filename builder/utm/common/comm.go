@@ -7,9 +7,14 @@ import (
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
 )
 
-func CommHost(host string) func(multistep.StateBag) (string, error) {
+// CommHost returns the host of the communicator, or discovers the address
+// of the guest if it isn't set, which is the case with skip_nat_mapping.
+func CommHost(config *CommConfig) func(multistep.StateBag) (string, error) {
 	return func(state multistep.StateBag) (string, error) {
-		return host, nil
+		if host := config.Comm.Host(); host != "" {
+			return host, nil
+		}
+		return discoverGuestIP(state, config.GuestIPDiscovery, config.GuestIPTimeout)
 	}
 }
 
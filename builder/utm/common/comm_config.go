@@ -7,6 +7,8 @@ package common
 
 import (
 	"errors"
+	"fmt"
+	"time"
 
 	"github.com/hashicorp/packer-plugin-sdk/communicator"
 	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
@@ -24,8 +26,20 @@ type CommConfig struct {
 	HostPortMax int `mapstructure:"host_port_max" required:"false"`
 	// Defaults to false. When enabled, Packer
 	// does not setup forwarded port mapping for communicator (SSH or WinRM) requests and uses ssh_port or winrm_port
-	// on the host to communicate to the virtual machine.
+	// on ssh_host or winrm_host to communicate to the virtual machine. Without a host, the address of the
+	// guest is discovered, see `guest_ip_discovery`.
 	SkipNatMapping bool `mapstructure:"skip_nat_mapping" required:"false"`
+	// The strategies to discover the address of the guest with, in order,
+	// when `skip_nat_mapping` is set and `ssh_host` or `winrm_host` isn't:
+	// `utmctl` asks UTM, which needs the QEMU guest agent in the guest,
+	// `dhcpd_leases` looks up the MAC addresses of the VM in the leases of
+	// the shared and host only networks in `/var/db/dhcpd_leases`, and
+	// `arp` looks them up in the ARP table of the host, e.g. for a bridged
+	// network. Defaults to `["utmctl", "dhcpd_leases", "arp"]`.
+	GuestIPDiscovery []string `mapstructure:"guest_ip_discovery" required:"false"`
+	// How long to try the `guest_ip_discovery` strategies until the guest
+	// has an address. By default this is 5m.
+	GuestIPTimeout time.Duration `mapstructure:"guest_ip_timeout" required:"false"`
 
 	// These are deprecated, but we keep them around for backwards compatibility
 	// TODO: remove later
@@ -53,11 +67,20 @@ func (c *CommConfig) Prepare(ctx *interpolate.Context) []error {
 		c.SkipNatMapping = c.SSHSkipNatMapping
 	}
 
-	if c.Comm.Host() == "" {
+	// Without NAT mapping, the address of the guest is discovered
+	if c.Comm.Host() == "" && !c.SkipNatMapping {
 		c.Comm.SSHHost = "127.0.0.1"
 		c.Comm.WinRMHost = "127.0.0.1"
 	}
 
+	if len(c.GuestIPDiscovery) == 0 {
+		c.GuestIPDiscovery = defaultGuestIPDiscovery
+	}
+
+	if c.GuestIPTimeout == 0 {
+		c.GuestIPTimeout = 5 * time.Minute
+	}
+
 	if c.HostPortMin == 0 {
 		c.HostPortMin = 2222
 	}
@@ -72,5 +95,12 @@ func (c *CommConfig) Prepare(ctx *interpolate.Context) []error {
 			errors.New("host_port_min must be less than host_port_max"))
 	}
 
+	for _, strategy := range c.GuestIPDiscovery {
+		if _, ok := guestIPStrategies[strategy]; !ok {
+			errs = append(errs, fmt.Errorf(
+				"guest_ip_discovery: unknown strategy %q, must be utmctl, dhcpd_leases or arp", strategy))
+		}
+	}
+
 	return errs
 }
@@ -182,3 +182,33 @@ eHLc1nkCgYEApm/motCTPN32nINZ+Vvywbv64ZD+gtpeMNP3CLrbe1X9O+H52AXa
 3bfQ8hKYcSnTfE0gPtLDnqCIxTocaGLSHeG3TH9fTw+dA8FvWpUztI4=
 -----END RSA PRIVATE KEY-----
 `
+
+func TestCommConfigPrepare_guestIPDiscovery(t *testing.T) {
+	// With NAT mapping, the forwarded port is on the host
+	c := testCommConfig()
+	if errs := c.Prepare(interpolate.NewContext()); len(errs) > 0 {
+		t.Fatalf("err: %#v", errs)
+	}
+	if c.Comm.Host() != "127.0.0.1" {
+		t.Fatalf("bad: %s", c.Comm.Host())
+	}
+
+	// Without, the address of the guest is discovered
+	c = testCommConfig()
+	c.SkipNatMapping = true
+	if errs := c.Prepare(interpolate.NewContext()); len(errs) > 0 {
+		t.Fatalf("err: %#v", errs)
+	}
+	if c.Comm.Host() != "" {
+		t.Fatalf("bad: %s", c.Comm.Host())
+	}
+	if len(c.GuestIPDiscovery) != 3 || c.GuestIPTimeout != 5*time.Minute {
+		t.Fatalf("bad: %#v %s", c.GuestIPDiscovery, c.GuestIPTimeout)
+	}
+
+	c = testCommConfig()
+	c.GuestIPDiscovery = []string{"arp", "mdns"}
+	if errs := c.Prepare(interpolate.NewContext()); len(errs) != 1 {
+		t.Fatalf("should error: %#v", errs)
+	}
+}
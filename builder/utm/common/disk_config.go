@@ -0,0 +1,148 @@
+//go:generate packer-sdc struct-markdown
+//go:generate packer-sdc mapstructure-to-hcl2 -type Disk
+
+package common
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+)
+
+// DiskConfig configures the disks of the VM with `disk` blocks, in the order
+// they are attached. Each disk is either a new disk of the given size, or a
+// data disk made from a `source` image, which UTM copies into the bundle.
+// The blocks replace `disk_size` and `disk_additional_size`, which can't be
+// used together with them.
+type DiskConfig struct {
+	// The disks of the VM. See the disk configuration below. Defaults to a
+	// disk of `disk_size` followed by a disk for every
+	// `disk_additional_size`.
+	Disks []Disk `mapstructure:"disk" required:"false"`
+}
+
+// A disk of the VM.
+type Disk struct {
+	// The controller the disk is attached to: `none`, `ide`, `scsi`,
+	// `virtio`, `nvme` or `usb`. Defaults to `hard_drive_interface`.
+	Interface string `mapstructure:"interface" required:"false"`
+	// The size of a new disk, in MiB.
+	Size uint `mapstructure:"size" required:"false"`
+	// The image format of a new disk: `qcow2` or `raw`. Defaults to
+	// `qcow2`.
+	Format string `mapstructure:"format" required:"false"`
+	// The path of an image to attach as a data disk, instead of creating a
+	// new disk.
+	Source string `mapstructure:"source" required:"false"`
+	// Attach the disk read-only. This needs a UTM version whose scripting
+	// supports read-only drives.
+	ReadOnly bool `mapstructure:"read_only" required:"false"`
+	// Detach the disk before the VM is exported, e.g. for a disk that is
+	// only used during the build. Defaults to `false`.
+	SkipExport bool `mapstructure:"skip_export" required:"false"`
+}
+
+// LegacyDisks returns the disks of the disk_size and disk_additional_size
+// options.
+func LegacyDisks(diskSize uint, additionalDiskSizes []uint) []Disk {
+	disks := []Disk{{Size: diskSize}}
+	for _, size := range additionalDiskSizes {
+		disks = append(disks, Disk{Size: size})
+	}
+	return disks
+}
+
+func (c *DiskConfig) Prepare(ctx *interpolate.Context, hardDriveInterface string) []error {
+	var errs []error
+
+	for i := range c.Disks {
+		disk := &c.Disks[i]
+		if disk.Interface == "" {
+			disk.Interface = hardDriveInterface
+		}
+
+		switch disk.Interface {
+		case "none", "ide", "scsi", "virtio", "nvme", "usb":
+			// do nothing
+		default:
+			errs = append(errs, fmt.Errorf("disk %d: interface can only be none, ide, scsi, virtio, nvme or usb", i))
+		}
+		switch disk.Format {
+		case "", "qcow2", "raw":
+			// do nothing
+		default:
+			errs = append(errs, fmt.Errorf("disk %d: format can only be qcow2 or raw", i))
+		}
+
+		if disk.Source != "" {
+			if disk.Size != 0 || disk.Format != "" {
+				errs = append(errs, fmt.Errorf("disk %d: size and format can't be used with source", i))
+			}
+			if _, err := os.Stat(disk.Source); err != nil {
+				errs = append(errs, fmt.Errorf("disk %d: source is invalid: %s", i, err))
+			}
+		} else if disk.Size == 0 {
+			errs = append(errs, fmt.Errorf("disk %d: size or source is required", i))
+		}
+	}
+
+	return errs
+}
+
+// AddDisk creates the disk, or attaches its source image, and returns the id
+// of the drive.
+func AddDisk(ctx context.Context, driver Driver, vmId string, disk Disk) (string, error) {
+	// Check before the drive is added, so a failure leaves no drive behind
+	if disk.ReadOnly && !driver.HasFeature(FeatureReadOnlyDrives) {
+		return "", fmt.Errorf("the installed UTM does not support read-only drives")
+	}
+
+	controllerEnumCode, err := GetControllerEnumCode(disk.Interface)
+	if err != nil {
+		return "", err
+	}
+
+	var command []string
+	if disk.Source != "" {
+		// Copy the image to a remote UTM host
+		sourcePath, err := driver.Upload(ctx, disk.Source)
+		if err != nil {
+			return "", fmt.Errorf("error uploading %s: %s", disk.Source, err)
+		}
+		command = []string{
+			"attach_iso.applescript", vmId,
+			"--interface", controllerEnumCode,
+			"--source", sourcePath,
+			"--removable", "false",
+		}
+	} else {
+		command = []string{
+			"add_drive.applescript", vmId,
+			"--interface", controllerEnumCode,
+			"--size", strconv.FormatUint(uint64(disk.Size), 10),
+		}
+		if disk.Format == "raw" {
+			command = append(command, "--raw", "true")
+		}
+	}
+
+	result, err := driver.ExecuteOsaScript(ctx, command...)
+	if err != nil {
+		return "", err
+	}
+	if result.DriveID == "" {
+		return "", fmt.Errorf("%s did not return the id of the drive", command[0])
+	}
+
+	if disk.ReadOnly {
+		// A separate script, as older versions of UTM can't compile it
+		if _, err := driver.ExecuteOsaScript(ctx,
+			"set_drive_read_only.applescript", vmId, result.DriveID); err != nil {
+			return "", fmt.Errorf("error making the drive read-only: %s", err)
+		}
+	}
+	return result.DriveID, nil
+}
@@ -0,0 +1,41 @@
+// Code generated by "packer-sdc mapstructure-to-hcl2"; DO NOT EDIT.
+
+package common
+
+import (
+	"github.com/hashicorp/hcl/v2/hcldec"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// FlatDisk is an auto-generated flat version of Disk.
+// Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
+type FlatDisk struct {
+	Interface  *string `mapstructure:"interface" required:"false" cty:"interface" hcl:"interface"`
+	Size       *uint   `mapstructure:"size" required:"false" cty:"size" hcl:"size"`
+	Format     *string `mapstructure:"format" required:"false" cty:"format" hcl:"format"`
+	Source     *string `mapstructure:"source" required:"false" cty:"source" hcl:"source"`
+	ReadOnly   *bool   `mapstructure:"read_only" required:"false" cty:"read_only" hcl:"read_only"`
+	SkipExport *bool   `mapstructure:"skip_export" required:"false" cty:"skip_export" hcl:"skip_export"`
+}
+
+// FlatMapstructure returns a new FlatDisk.
+// FlatDisk is an auto-generated flat version of Disk.
+// Where the contents a fields with a `mapstructure:,squash` tag are bubbled up.
+func (*Disk) FlatMapstructure() interface{ HCL2Spec() map[string]hcldec.Spec } {
+	return new(FlatDisk)
+}
+
+// HCL2Spec returns the hcl spec of a Disk.
+// This spec is used by HCL to read the fields of Disk.
+// The decoded values from this spec will then be applied to a FlatDisk.
+func (*FlatDisk) HCL2Spec() map[string]hcldec.Spec {
+	s := map[string]hcldec.Spec{
+		"interface":   &hcldec.AttrSpec{Name: "interface", Type: cty.String, Required: false},
+		"size":        &hcldec.AttrSpec{Name: "size", Type: cty.Number, Required: false},
+		"format":      &hcldec.AttrSpec{Name: "format", Type: cty.String, Required: false},
+		"source":      &hcldec.AttrSpec{Name: "source", Type: cty.String, Required: false},
+		"read_only":   &hcldec.AttrSpec{Name: "read_only", Type: cty.Bool, Required: false},
+		"skip_export": &hcldec.AttrSpec{Name: "skip_export", Type: cty.Bool, Required: false},
+	}
+	return s
+}
@@ -0,0 +1,88 @@
+package common
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+)
+
+func TestDiskConfigPrepare(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "data.qcow2")
+	if err := os.WriteFile(source, nil, 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	c := &DiskConfig{Disks: []Disk{
+		{Size: 65536},
+		{Interface: "nvme", Size: 1024, Format: "raw", SkipExport: true},
+		{Interface: "usb", Source: source, ReadOnly: true},
+	}}
+	if errs := c.Prepare(interpolate.NewContext(), "virtio"); len(errs) > 0 {
+		t.Fatalf("err: %#v", errs)
+	}
+	if c.Disks[0].Interface != "virtio" || c.Disks[1].Interface != "nvme" {
+		t.Fatalf("bad: %#v", c.Disks)
+	}
+
+	for _, disk := range []Disk{
+		{},
+		{Interface: "sd", Size: 1024},
+		{Size: 1024, Format: "vmdk"},
+		{Size: 1024, Source: source},
+		{Source: filepath.Join(t.TempDir(), "missing.qcow2")},
+	} {
+		c := &DiskConfig{Disks: []Disk{disk}}
+		if errs := c.Prepare(interpolate.NewContext(), "virtio"); len(errs) != 1 {
+			t.Fatalf("should error: %#v: %#v", disk, errs)
+		}
+	}
+}
+
+func TestLegacyDisks(t *testing.T) {
+	disks := LegacyDisks(40960, []uint{1024, 2048})
+	expected := []Disk{{Size: 40960}, {Size: 1024}, {Size: 2048}}
+	if !reflect.DeepEqual(disks, expected) {
+		t.Fatalf("bad: %#v", disks)
+	}
+}
+
+func TestAddDisk(t *testing.T) {
+	driver := new(DriverSimulator)
+	vmId := driver.AddVM(SimulatedVM{Name: "packer"})
+	ctx := context.Background()
+
+	rawId, err := AddDisk(ctx, driver, vmId, Disk{Interface: "virtio", Size: 1024, Format: "raw"})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	dataId, err := AddDisk(ctx, driver, vmId, Disk{Interface: "usb", Source: "/data.qcow2", ReadOnly: true})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := []SimulatedDrive{
+		{ID: rawId, Interface: "QdIv", Size: 1024, Raw: true},
+		{ID: dataId, Interface: "QdIu", Source: "/data.qcow2", ReadOnly: true},
+	}
+	if drives := driver.VM(vmId).Drives; !reflect.DeepEqual(drives, expected) {
+		t.Fatalf("bad: %#v", drives)
+	}
+}
+
+func TestAddDisk_readOnlyUnsupported(t *testing.T) {
+	driver := new(DriverSimulator)
+	driver.UnsupportedFeatures = []Feature{FeatureReadOnlyDrives}
+	vmId := driver.AddVM(SimulatedVM{Name: "packer"})
+
+	if _, err := AddDisk(context.Background(), driver, vmId,
+		Disk{Interface: "virtio", Size: 1024, ReadOnly: true}); err == nil {
+		t.Fatal("should error")
+	}
+	if drives := driver.VM(vmId).Drives; len(drives) != 0 {
+		t.Fatalf("no drive should be added: %#v", drives)
+	}
+}
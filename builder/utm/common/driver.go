@@ -1,11 +1,22 @@
 package common
 
 import (
+	"bytes"
+	"context"
 	"embed"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os/exec"
+	"path"
+	"path/filepath"
 	"strings"
+	"time"
+
+	"github.com/hashicorp/go-version"
+	"github.com/naveenrajm7/packer-plugin-utm/builder/utm/bundle"
 )
 
 var (
@@ -13,6 +24,25 @@ var (
 	osascripts embed.FS
 )
 
+// Feature is a capability of the installed UTM that builder steps may
+// depend on. Steps ask the driver with HasFeature instead of assuming a
+// particular UTM version.
+type Feature string
+
+const (
+	// UTM can import a .utm bundle and report the id of the new VM.
+	FeatureImport Feature = "import"
+	// UTM can export a VM to a .utm bundle.
+	FeatureExport Feature = "export"
+	// UTM downloads the guest tools ISO into its own container.
+	FeatureGuestTools Feature = "guest-tools"
+	// UTM can attach drives read-only.
+	FeatureReadOnlyDrives Feature = "read-only-drives"
+	// UTM can update the registry of a VM, which holds its shared
+	// directories.
+	FeatureSharedDirectories Feature = "shared-directories"
+)
+
 // A driver is able to talk to UTM and perform certain
 // operations with it. Some of the operations on here may seem overly
 // specific, but they were built specifically in mind to handle features
@@ -21,79 +51,422 @@ var (
 // extremely specific.
 type Driver interface {
 	// Delete a VM by name
-	Delete(string) error
+	Delete(context.Context, string) error
 
-	// Executes the given AppleScript with the given arguments.
-	ExecuteOsaScript(command ...string) (string, error)
+	// Executes the given AppleScript with the given arguments and
+	// returns the result the script printed.
+	ExecuteOsaScript(ctx context.Context, command ...string) (ScriptResult, error)
 
 	// Export a VM to a UTM file
-	Export(string, string) error
+	Export(context.Context, string, string) error
+
+	// HasFeature reports whether the installed UTM supports the feature.
+	// The features are detected by NewDriver, so this does not talk to UTM.
+	HasFeature(Feature) bool
 
 	// Import a VM
-	Import(string) (string, error)
+	Import(context.Context, string) (string, error)
 
 	// Checks if the VM with the given id is running.
-	IsRunning(string) (bool, error)
+	IsRunning(context.Context, string) (bool, error)
 
 	// Get guest tools iso path
-	GuestToolsIsoPath() (string, error)
+	GuestToolsIsoPath(context.Context) (string, error)
+
+	// DiskImages returns the paths of the disk images of the VM with the
+	// given id on the machine that runs UTM. Removable drives are skipped.
+	DiskImages(context.Context, string) ([]string, error)
+
+	// MacAddresses returns the MAC addresses of the network interfaces of
+	// the VM with the given id.
+	MacAddresses(context.Context, string) ([]string, error)
+
+	// DhcpLeases returns the DHCP leases of the vmnet networks of the
+	// machine that runs UTM, in the format of /var/db/dhcpd_leases.
+	DhcpLeases(context.Context) (string, error)
+
+	// ArpTable returns the ARP table of the machine that runs UTM, as
+	// printed by `arp -an`.
+	ArpTable(context.Context) (string, error)
+
+	// QemuImg executes qemu-img with the given arguments on the machine
+	// that runs UTM and returns its stdout. The images of a VM may only be
+	// changed while the VM is stopped.
+	QemuImg(context.Context, ...string) (string, error)
+
+	// MoveFile renames a file on the machine that runs UTM, replacing the
+	// destination, e.g. to swap in an image written by qemu-img.
+	MoveFile(context.Context, string, string) error
+
+	// RemoveFile removes a file on the machine that runs UTM. A missing
+	// file is not an error.
+	RemoveFile(context.Context, string) error
+
+	// Upload makes a local file available to UTM and returns its path on
+	// the machine that runs UTM. A local UTM can use the file as is.
+	Upload(context.Context, string) (string, error)
+
+	// Tunnel makes the TCP address that UTM listens on reachable at the
+	// same address on this machine, until the returned io.Closer is
+	// closed. The error wraps errPortInUse when the port is already used on
+	// the machine that runs UTM. This is a no-op for a local UTM.
+	Tunnel(context.Context, string) (io.Closer, error)
+
+	// Close releases the resources of the driver, e.g. the connection to
+	// a remote UTM host. The driver can't be used afterwards.
+	Close() error
 
 	// Stop stops a running machine, forcefully.
-	Stop(string) error
+	Stop(context.Context, string) error
 
 	// Utmctl executes the given Utmctl command
 	// and returns the stdout channel as string
-	Utmctl(...string) (string, error)
+	Utmctl(context.Context, ...string) (string, error)
 
 	// Verify checks to make sure that this driver should function
 	// properly. If there is any indication the driver can't function,
 	// this will return an error.
-	Verify() error
+	Verify(context.Context) error
 
 	// Version reads the version of UTM that is installed.
-	Version() (string, error)
+	Version(context.Context) (string, error)
+}
+
+// ScriptResult is the JSON document printed by the embedded AppleScripts.
+// Every script prints an object; only the fields that make sense for the
+// script are set.
+type ScriptResult struct {
+	// The id of the VM created by create_vm or import_vm.
+	VMID string `json:"vm_id,omitempty"`
+	// The id of the drive added by add_drive or attach_iso.
+	DriveID string `json:"drive_id,omitempty"`
+	// The id of the display added by add_qemu_display.
+	DisplayID string `json:"display_id,omitempty"`
+	// The index of the network interface added by add_network_interface.
+	InterfaceIndex *int `json:"interface_index,omitempty"`
+	// The directories in the registry of the VM, by get_shared_directory.
+	SharedDirectories []string `json:"shared_directories,omitempty"`
+	// The enum code of the directory share mode of a QEMU VM, by
+	// get_shared_directory.
+	DirectoryShareMode string `json:"directory_share_mode,omitempty"`
+	// Things the script could not do, but that did not fail the script,
+	// e.g. removing a drive that does not exist.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// scriptLibrary is prepended to every script before it is run. It defines
+// the handlers the scripts use to print their result.
+const scriptLibrary = "scripts/lib/json.applescript"
+
+// decodeScriptResult decodes the output of the given script.
+func decodeScriptResult(script string, output string) (ScriptResult, error) {
+	var result ScriptResult
+	output = strings.TrimSpace(output)
+	if output == "" {
+		return result, fmt.Errorf("invalid output from %s: no result was printed", script)
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(output))
+	if err := decoder.Decode(&result); err != nil {
+		return result, fmt.Errorf("invalid output from %s: %s: %q", script, err, output)
+	}
+	if decoder.More() {
+		return result, fmt.Errorf("invalid output from %s: unexpected data after the result: %q", script, output)
+	}
+	return result, nil
 }
 
-// NewDriver creates a new driver for UTM.
-func NewDriver() (Driver, error) {
-	var utmctlPath string
+// The DHCP leases of the vmnet networks on macOS.
+const dhcpdLeasesPath = "/var/db/dhcpd_leases"
 
-	var err error
-	utmctlPath, err = exec.LookPath("utmctl")
+// Timeouts of the driver operations. Every operation also stops when the
+// context passed to the driver is cancelled, e.g. when the build is
+// interrupted, which kills the utmctl or osascript process.
+const (
+	utmctlTimeout    = 2 * time.Minute
+	osaScriptTimeout = 2 * time.Minute
+	versionTimeout   = 30 * time.Second
+	importTimeout    = 30 * time.Minute
+	exportTimeout    = 60 * time.Minute
+	sdefTimeout      = 30 * time.Second
+	qemuImgTimeout   = 30 * time.Minute
+	lookupTimeout    = 30 * time.Second
+	fileTimeout      = time.Minute
+	commandWaitDelay = 5 * time.Second
+)
+
+// driverVersion describes a known UTM release (major.minor): the features
+// it is known to support and how to build the driver for it.
+type driverVersion struct {
+	Version  string
+	Features []Feature
+	New      func(base Utm45Driver) Driver
+}
+
+// knownDrivers is the driver registry, ordered from the oldest to the
+// newest supported UTM release.
+var knownDrivers = []driverVersion{
+	{
+		Version: "4.5",
+		New:     func(base Utm45Driver) Driver { return &base },
+	},
+	{
+		Version:  "4.6",
+		Features: []Feature{FeatureImport, FeatureExport, FeatureGuestTools},
+		New:      func(base Utm45Driver) Driver { return &Utm46Driver{base} },
+	},
+}
+
+// NewDriver creates a new driver for UTM. If a remote host is configured,
+// the driver runs UTM on that host over SSH, otherwise UTM must be
+// installed on this machine.
+func NewDriver(ctx context.Context, remote RemoteConfig) (Driver, error) {
+	if remote.RemoteHost != "" {
+		return newRemoteDriver(ctx, remote)
+	}
+
+	utmctlPath, err := exec.LookPath("utmctl")
 	if err != nil {
 		return nil, err
 	}
 	log.Printf("utmctl path: %s", utmctlPath)
 
+	// utmctl is usually a symlink to UTM.app/Contents/MacOS/utmctl
+	appPath := utmAppPath(utmctlPath)
+	if resolved, err := filepath.EvalSymlinks(utmctlPath); err == nil {
+		appPath = utmAppPath(resolved)
+	}
+
+	return newDriver(ctx, Utm45Driver{UtmctlPath: utmctlPath}, appPath)
+}
+
+// newDriver detects the version and features of UTM with the base driver
+// and returns the driver for that version. appPath is the path of UTM.app
+// on the machine the base driver runs its commands on.
+func newDriver(ctx context.Context, base Utm45Driver, appPath string) (Driver, error) {
 	// Get the version of UTM
-	var driver Driver
-	driver = &Utm45Driver{utmctlPath}
-	version, err := driver.Version()
+	utmVersion, err := base.Version(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting UTM version: %s", err)
+	}
+	log.Printf("UTM version: %s", utmVersion)
+
+	known, err := selectDriverVersion(utmVersion)
 	if err != nil {
-		log.Fatalf("Error getting UTM version: %v", err)
+		return nil, err
 	}
-	fmt.Printf("UTM version: %s\n", version)
+	log.Printf("Using UTM %s driver for UTM %s", known.Version, utmVersion)
 
-	// Parse the version to get major and minor parts
-	versionParts := strings.Split(version, ".")
-	if len(versionParts) < 2 {
-		log.Fatalf("Invalid UTM version format: %s", version)
+	base.features = make(map[Feature]bool)
+	for _, feature := range known.Features {
+		base.features[feature] = true
 	}
-	majorMinorVersion := fmt.Sprintf("%s.%s", versionParts[0], versionParts[1])
 
-	// Decide which driver to use based on the version
-	switch majorMinorVersion {
-	case "4.5":
-		driver = &Utm45Driver{utmctlPath}
-	case "4.6":
-		driver = &Utm46Driver{Utm45Driver{utmctlPath}}
-	default:
-		log.Fatalf("Unsupported UTM version: %s", version)
+	// The scripting dictionary of the installed UTM is the most reliable
+	// source for what can be automated, so prefer it when we can read it.
+	if sdef, err := scriptingDefinition(ctx, &base, appPath); err != nil {
+		log.Printf("Could not read UTM scripting definition, using known features: %s", err)
+	} else {
+		for feature, supported := range scriptingFeatures(sdef) {
+			base.features[feature] = supported
+		}
 	}
+	log.Printf("UTM features: %v", base.features)
 
-	if err := driver.Verify(); err != nil {
+	driver := known.New(base)
+	if err := driver.Verify(ctx); err != nil {
 		return nil, err
 	}
 
 	return driver, nil
 }
+
+// selectDriverVersion picks the newest known driver that is not newer than
+// the installed UTM version. Releases newer than every known driver are
+// treated as the closest (newest) known one.
+func selectDriverVersion(utmVersion string) (driverVersion, error) {
+	installed, err := version.NewVersion(utmVersion)
+	if err != nil {
+		return driverVersion{}, fmt.Errorf("invalid UTM version format %q: %s", utmVersion, err)
+	}
+
+	// Only major.minor is relevant for the driver selection.
+	segments := installed.Segments()
+	majorMinor, err := version.NewVersion(fmt.Sprintf("%d.%d", segments[0], segments[1]))
+	if err != nil {
+		return driverVersion{}, err
+	}
+
+	var selected *driverVersion
+	for i := range knownDrivers {
+		if version.Must(version.NewVersion(knownDrivers[i].Version)).LessThanOrEqual(majorMinor) {
+			selected = &knownDrivers[i]
+		}
+	}
+
+	if selected == nil {
+		return driverVersion{}, fmt.Errorf(
+			"unsupported UTM version %s: UTM %s or newer is required", utmVersion, knownDrivers[0].Version)
+	}
+
+	newest := knownDrivers[len(knownDrivers)-1]
+	if selected.Version == newest.Version &&
+		majorMinor.GreaterThan(version.Must(version.NewVersion(newest.Version))) {
+		log.Printf("UTM %s is newer than the newest known version %s, treating it as %s",
+			utmVersion, newest.Version, newest.Version)
+	}
+
+	return *selected, nil
+}
+
+// utmAppPath returns the path of the UTM application that the utmctl at
+// the given path belongs to.
+func utmAppPath(utmctlPath string) string {
+	if strings.HasSuffix(utmctlPath, path.Join("Contents", "MacOS", "utmctl")) {
+		return path.Dir(path.Dir(path.Dir(utmctlPath)))
+	}
+	return "/Applications/UTM.app"
+}
+
+// scriptingDefinition returns the AppleScript dictionary (sdef) of the UTM
+// application at appPath.
+func scriptingDefinition(ctx context.Context, driver *Utm45Driver, appPath string) ([]byte, error) {
+	stdout, _, err := driver.command(ctx, sdefTimeout, nil, "sdef", appPath)
+	return []byte(stdout), err
+}
+
+// scriptingFeatures reports the features that can be detected from the
+// commands present in a UTM scripting definition.
+func scriptingFeatures(sdef []byte) map[Feature]bool {
+	hasCommand := func(name string) bool {
+		return strings.Contains(string(sdef), fmt.Sprintf(`<command name="%s"`, name))
+	}
+	hasProperty := func(name string) bool {
+		return strings.Contains(string(sdef), fmt.Sprintf(`<property name="%s"`, name))
+	}
+
+	return map[Feature]bool{
+		FeatureImport:            hasCommand("import"),
+		FeatureExport:            hasCommand("export"),
+		FeatureReadOnlyDrives:    hasProperty("read only"),
+		FeatureSharedDirectories: hasCommand("update registry"),
+	}
+}
+
+// commandRunner runs a command on the machine with UTM, see runCommand.
+type commandRunner func(ctx context.Context, timeout time.Duration, stdin io.Reader, name string, args ...string) (string, string, error)
+
+// nopCloser is returned by Tunnel when there is nothing to close.
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+// runCommand runs a command and returns its trimmed stdout and stderr. The
+// command is killed when the timeout expires or ctx is cancelled. If the
+// command exits with an error, the error is a *DriverError classified from
+// stderr.
+func runCommand(ctx context.Context, timeout time.Duration, stdin io.Reader, name string, args ...string) (string, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdin = stdin
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// Don't wait forever for children that inherited the output pipes
+	cmd.WaitDelay = commandWaitDelay
+	err := cmd.Run()
+
+	stdoutString := strings.TrimSpace(stdout.String())
+	stderrString := strings.TrimSpace(stderr.String())
+
+	if err != nil {
+		tool := filepath.Base(name)
+		switch {
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			err = fmt.Errorf("%s timed out after %s", tool, timeout)
+		case ctx.Err() != nil:
+			err = fmt.Errorf("%s interrupted: %w", tool, ctx.Err())
+		default:
+			if _, ok := err.(*exec.ExitError); ok {
+				err = newDriverError(tool, stderrString, err)
+			}
+		}
+	}
+
+	return stdoutString, stderrString, err
+}
+
+// utmDocumentsPath is where UTM keeps the bundles of its VMs, relative to
+// the home directory.
+const utmDocumentsPath = "Library/Containers/com.utmapp.UTM/Data/Documents"
+
+// findDiskImages returns the disk images of the VM with the given id, looking
+// for its bundle in documentsDir. glob and open access the files of the
+// machine that runs UTM, which is always a Mac, so the paths use slashes.
+func findDiskImages(vmId string, documentsDir string,
+	glob func(string) ([]string, error), open func(string) (io.ReadCloser, error)) ([]string, error) {
+	bundlePath, config, err := findBundle(vmId, documentsDir, glob, open)
+	if err != nil {
+		return nil, err
+	}
+
+	var images []string
+	for _, drive := range config.Drives {
+		if drive.ImageName == "" || drive.ImageType != "Disk" {
+			continue
+		}
+		images = append(images, path.Join(bundlePath, bundle.DataDir, drive.ImageName))
+	}
+	return images, nil
+}
+
+// findMacAddresses returns the MAC addresses of the network interfaces of the
+// VM with the given id, like findDiskImages.
+func findMacAddresses(vmId string, documentsDir string,
+	glob func(string) ([]string, error), open func(string) (io.ReadCloser, error)) ([]string, error) {
+	_, config, err := findBundle(vmId, documentsDir, glob, open)
+	if err != nil {
+		return nil, err
+	}
+
+	var addresses []string
+	for _, network := range config.Networks {
+		if network.MacAddress != "" {
+			addresses = append(addresses, network.MacAddress)
+		}
+	}
+	return addresses, nil
+}
+
+// findBundle returns the path and config of the bundle of the VM with the
+// given id in documentsDir.
+func findBundle(vmId string, documentsDir string,
+	glob func(string) ([]string, error), open func(string) (io.ReadCloser, error)) (string, *bundle.Config, error) {
+	bundles, err := glob(path.Join(documentsDir, "*"+bundle.Extension))
+	if err != nil {
+		return "", nil, err
+	}
+
+	// The bundle is named after the VM when it is created, but keeps that
+	// name when the VM is renamed, so look at the UUID of every bundle
+	for _, bundlePath := range bundles {
+		f, err := open(path.Join(bundlePath, bundle.ConfigFile))
+		if err != nil {
+			log.Printf("Skipping %s: %s", bundlePath, err)
+			continue
+		}
+		config, err := bundle.DecodeConfig(f)
+		f.Close()
+		if err != nil {
+			log.Printf("Skipping %s: %s", bundlePath, err)
+			continue
+		}
+		if strings.EqualFold(config.Information.UUID, vmId) {
+			return bundlePath, config, nil
+		}
+	}
+
+	return "", nil, fmt.Errorf("the bundle of VM %s was not found in %s", vmId, documentsDir)
+}
@@ -2,138 +2,169 @@ package common
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"log"
-	"os/exec"
+	"os"
+	"path"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 )
 
 // Utm45Driver is the base type for UTM drivers
 type Utm45Driver struct {
 	// This is the path to the utmctl binary
 	UtmctlPath string
+
+	// This is the path to the qemu-img binary, "qemu-img" if empty
+	QemuImgPath string
+
+	// features supported by the installed UTM, see NewDriver
+	features map[Feature]bool
+
+	// runs the commands on a remote UTM host, runCommand if nil
+	runner commandRunner
+}
+
+// command runs a command on the machine with UTM.
+func (d *Utm45Driver) command(ctx context.Context, timeout time.Duration, stdin io.Reader, name string, args ...string) (string, string, error) {
+	if d.runner != nil {
+		return d.runner(ctx, timeout, stdin, name, args...)
+	}
+	return runCommand(ctx, timeout, stdin, name, args...)
 }
 
-func (d *Utm45Driver) Delete(name string) error {
-	_, err := d.Utmctl("delete", name)
+func (d *Utm45Driver) Close() error {
+	return nil
+}
+
+func (d *Utm45Driver) Delete(ctx context.Context, name string) error {
+	_, err := d.Utmctl(ctx, "delete", name)
 	return err
 }
 
 // ExecuteOsaScript executes an AppleScript command with the given arguments.
-func (d *Utm45Driver) ExecuteOsaScript(command ...string) (string, error) {
+func (d *Utm45Driver) ExecuteOsaScript(ctx context.Context, command ...string) (ScriptResult, error) {
+	return d.runScript(ctx, osaScriptTimeout, command...)
+}
+
+// runScript runs one of the embedded scripts and decodes its result. The
+// data is only passed to the script through its arguments, never by
+// generating AppleScript code.
+func (d *Utm45Driver) runScript(ctx context.Context, timeout time.Duration, command ...string) (ScriptResult, error) {
 	if len(command) == 0 {
-		return "", fmt.Errorf("no command provided")
+		return ScriptResult{}, fmt.Errorf("no command provided")
 	}
 
 	// log the command to be executed
 	log.Printf("Executing OSA script command: %s", command)
 
 	// Read the script content from the embedded files
-	scriptPath := filepath.Join("scripts", command[0])
+	scriptPath := path.Join("scripts", command[0])
 	scriptContent, err := osascripts.ReadFile(scriptPath)
 	if err != nil {
-		return "", fmt.Errorf("failed to read script %s: %v", scriptPath, err)
+		return ScriptResult{}, fmt.Errorf("failed to read script %s: %v", scriptPath, err)
 	}
+	library, err := osascripts.ReadFile(scriptLibrary)
+	if err != nil {
+		return ScriptResult{}, fmt.Errorf("failed to read script %s: %v", scriptLibrary, err)
+	}
+	script := append(append(library, '\n'), scriptContent...)
 
-	// Construct the command to execute
-	cmd := exec.Command("osascript", "-")
+	// The script is read from stdin, the arguments are passed to its run handler
+	args := append([]string{"-"}, command[1:]...)
+	stdout, stderr, err := d.command(ctx, timeout, bytes.NewReader(script), "osascript", args...)
 
-	// Append additional arguments to the command
-	if len(command) > 1 {
-		cmd.Args = append(cmd.Args, command[1:]...)
+	if stdout != "" {
+		log.Printf("stdout: %s", stdout)
+	}
+	if stderr != "" {
+		log.Printf("stderr: %s", stderr)
 	}
-
-	stdin, err := cmd.StdinPipe()
 	if err != nil {
-		return "", err
+		return ScriptResult{}, err
 	}
 
-	go func() {
-		defer stdin.Close()
-		io.WriteString(stdin, string(scriptContent))
-	}()
-
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	err = cmd.Run()
+	result, err := decodeScriptResult(command[0], stdout)
+	if err != nil {
+		return ScriptResult{}, err
+	}
+	for _, warning := range result.Warnings {
+		log.Printf("%s: warning: %s", command[0], warning)
+	}
+	return result, nil
+}
 
-	stdoutString := strings.TrimSpace(stdout.String())
-	stderrString := strings.TrimSpace(stderr.String())
+// UTM 4.5 Doesn't support exporting VMs
+func (d *Utm45Driver) Export(ctx context.Context, vmId string, path string) error {
+	return fmt.Errorf("exporting VMs is not supported by this version of UTM")
+}
 
-	if stdoutString != "" {
-		log.Printf("stdout: %s", stdoutString)
+// DiskImages finds the bundle of the VM in the UTM documents directory and
+// returns the images of its disks.
+func (d *Utm45Driver) DiskImages(ctx context.Context, vmId string) ([]string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
 	}
-	if stderrString != "" {
-		log.Printf("stderr: %s", stderrString)
+	return findDiskImages(vmId, path.Join(home, utmDocumentsPath), filepath.Glob,
+		func(name string) (io.ReadCloser, error) { return os.Open(name) })
+}
+
+func (d *Utm45Driver) MacAddresses(ctx context.Context, vmId string) ([]string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
 	}
+	return findMacAddresses(vmId, path.Join(home, utmDocumentsPath), filepath.Glob,
+		func(name string) (io.ReadCloser, error) { return os.Open(name) })
+}
 
-	return stdoutString, err
+func (d *Utm45Driver) DhcpLeases(ctx context.Context) (string, error) {
+	stdout, _, err := d.command(ctx, lookupTimeout, nil, "cat", dhcpdLeasesPath)
+	return stdout, err
 }
 
-// UTM 4.5 Doesn't support exporting VMs
-func (d *Utm45Driver) Export(vmId string, path string) error {
-	// just print a message to the user
-	log.Printf("UTM API does not support exporting VMs yet.")
-	log.Printf("Please manually export the VM using 'Share...' action in UTM VM menu.")
-	log.Printf("Please make sure the VM is exported to the path %s ", path)
-	log.Printf("The exported UTM file in the output directory will be passed as build Artifact.")
-
-	// TODO: Pause and wait for the user to export the VM
-	// // ask user to input the path of the exported file
-	// confirmOption, err := ui.Ask(
-	// 	fmt.Sprintf("Confirm you have exported the VM to path [%s] [Y/n]:", outputPath))
-
-	// if err != nil {
-	// 	err := fmt.Errorf("error during export step: %s", err)
-	// 	state.Put("error", err)
-	// 	ui.Error(err.Error())
-	// 	return multistep.ActionHalt
-	// }
-	return nil
+func (d *Utm45Driver) ArpTable(ctx context.Context) (string, error) {
+	stdout, _, err := d.command(ctx, lookupTimeout, nil, "/usr/sbin/arp", "-an")
+	return stdout, err
+}
+
+func (d *Utm45Driver) MoveFile(ctx context.Context, src string, dst string) error {
+	_, _, err := d.command(ctx, fileTimeout, nil, "mv", "-f", src, dst)
+	return err
+}
+
+func (d *Utm45Driver) RemoveFile(ctx context.Context, path string) error {
+	_, _, err := d.command(ctx, fileTimeout, nil, "rm", "-f", path)
+	return err
 }
 
 // UTM 4.5 : doesn't support adding support guest tools
-func (d *Utm45Driver) GuestToolsIsoPath() (string, error) {
+func (d *Utm45Driver) GuestToolsIsoPath(ctx context.Context) (string, error) {
 	return "", fmt.Errorf("UTM driver does not provide guest additions")
 }
 
-// UTM 4.5 : We just create a VM shortcut using UTM open command.
-func (d *Utm45Driver) Import(path string) (string, error) {
-	var stdout bytes.Buffer
-	// TODO: While importing we should have ability to set the name of the VM
-	// UTM does not support setting the name of the VM while importing
-	// So we make sure VM name is same as the name in plist.config (previous name in UTM bundle)
-	// This is a limitation of UTM
-	cmd := exec.Command(
-		"osascript", "-e",
-		fmt.Sprintf(`tell application "UTM" to open POSIX file "%s"`, path),
-	)
-	cmd.Stdout = &stdout
-	if err := cmd.Run(); err != nil {
-		return "", err
-	}
-	// "missing value" in the output means AppleScript was successful
-	// but not necessarily the VM was imported successfully
-	// UTM does not provide a way to check if the VM was imported successfully
-	// So we pray!
-	// The error appears in UI, but not through script
-	return "", nil
+func (d *Utm45Driver) HasFeature(feature Feature) bool {
+	return d.features[feature]
 }
 
-func (d *Utm45Driver) IsRunning(name string) (bool, error) {
-	var stdout bytes.Buffer
+// UTM 4.5 : Doesn't support importing VMs. UTM can only open a bundle,
+// which does not tell us the id of the opened VM.
+func (d *Utm45Driver) Import(ctx context.Context, path string) (string, error) {
+	return "", fmt.Errorf("importing VMs is not supported by this version of UTM")
+}
 
-	cmd := exec.Command(d.UtmctlPath, "status", name)
-	cmd.Stdout = &stdout
-	if err := cmd.Run(); err != nil {
+func (d *Utm45Driver) IsRunning(ctx context.Context, name string) (bool, error) {
+	// Not logged like Utmctl, as this is polled while waiting for the VM
+	output, _, err := d.command(ctx, utmctlTimeout, nil, d.UtmctlPath, "status", name)
+	if err != nil {
 		return false, err
 	}
 
-	output := strings.TrimSpace(stdout.String())
 	if output == "started" {
 		return true, nil
 	}
@@ -157,56 +188,65 @@ func (d *Utm45Driver) IsRunning(name string) (bool, error) {
 	return false, nil
 }
 
-func (d *Utm45Driver) Stop(name string) error {
-	if _, err := d.Utmctl("stop", name); err != nil {
+func (d *Utm45Driver) QemuImg(ctx context.Context, args ...string) (string, error) {
+	qemuImgPath := d.QemuImgPath
+	if qemuImgPath == "" {
+		qemuImgPath = "qemu-img"
+	}
+
+	log.Printf("Executing qemu-img: %#v", args)
+	stdout, stderr, err := d.command(ctx, qemuImgTimeout, nil, qemuImgPath, args...)
+
+	if stdout != "" {
+		log.Printf("stdout: %s", stdout)
+	}
+	if stderr != "" {
+		log.Printf("stderr: %s", stderr)
+	}
+
+	return stdout, err
+}
+
+func (d *Utm45Driver) Stop(ctx context.Context, name string) error {
+	if _, err := d.Utmctl(ctx, "stop", name); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (d *Utm45Driver) Utmctl(args ...string) (string, error) {
-	var stdout, stderr bytes.Buffer
-
-	log.Printf("Executing utmctl: %#v", args)
-	cmd := exec.Command(d.UtmctlPath, args...)
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	err := cmd.Run()
+func (d *Utm45Driver) Tunnel(ctx context.Context, addr string) (io.Closer, error) {
+	return nopCloser{}, nil
+}
 
-	stdoutString := strings.TrimSpace(stdout.String())
-	stderrString := strings.TrimSpace(stderr.String())
+func (d *Utm45Driver) Upload(ctx context.Context, path string) (string, error) {
+	return path, nil
+}
 
-	if _, ok := err.(*exec.ExitError); ok {
-		err = fmt.Errorf("Utmctl error: %s", stderrString)
-	}
+func (d *Utm45Driver) Utmctl(ctx context.Context, args ...string) (string, error) {
+	log.Printf("Executing utmctl: %#v", args)
+	stdout, stderr, err := d.command(ctx, utmctlTimeout, nil, d.UtmctlPath, args...)
 
-	if stdoutString != "" {
-		log.Printf("stdout: %s", stdoutString)
+	if stdout != "" {
+		log.Printf("stdout: %s", stdout)
 	}
-	if stderrString != "" {
-		log.Printf("stderr: %s", stderrString)
+	if stderr != "" {
+		log.Printf("stderr: %s", stderr)
 	}
 
-	return stdoutString, err
+	return stdout, err
 }
 
-func (d *Utm45Driver) Verify() error {
+func (d *Utm45Driver) Verify(ctx context.Context) error {
 	return nil
 }
 
 // Version reads the version of UTM that is installed.
-func (d *Utm45Driver) Version() (string, error) {
-	var stdout bytes.Buffer
-
-	cmd := exec.Command("osascript", "-e",
+func (d *Utm45Driver) Version(ctx context.Context) (string, error) {
+	versionOutput, _, err := d.command(ctx, versionTimeout, nil, "osascript", "-e",
 		`tell application "System Events" to return version of application "UTM"`)
-
-	cmd.Stdout = &stdout
-	if err := cmd.Run(); err != nil {
+	if err != nil {
 		return "", err
 	}
-
-	versionOutput := strings.TrimSpace(stdout.String())
 	log.Printf("UTM version output : %s", versionOutput)
 
 	// Check if the output contains the error message
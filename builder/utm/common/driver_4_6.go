@@ -1,73 +1,44 @@
 package common
 
 import (
-	"bytes"
+	"context"
 	"fmt"
-	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"regexp"
 )
 
+// guestToolsIsoPath is where UTM downloads the guest tools, relative to the
+// home directory.
+const guestToolsIsoPath = "Library/Containers/com.utmapp.UTM/Data/Library/Application Support/GuestSupportTools/utm-guest-tools-latest.iso"
+
 // Utm46Driver are inherited from Utm45Driver.
 type Utm46Driver struct {
 	Utm45Driver
 }
 
 // UTM 4.6 : We import a VM by utm file using UTM import command.
-func (d *Utm46Driver) Import(path string) (string, error) {
-	var stdout bytes.Buffer
-
-	// Import VM
-	cmd := exec.Command(
-		"osascript", "-e",
-		fmt.Sprintf(`tell application "UTM" to import new virtual machine from POSIX file "%s"`, path),
-	)
-	cmd.Stdout = &stdout
-	if err := cmd.Run(); err != nil {
+func (d *Utm46Driver) Import(ctx context.Context, path string) (string, error) {
+	result, err := d.runScript(ctx, importTimeout, "import_vm.applescript", path)
+	if err != nil {
 		return "", err
 	}
-
-	// Get the output of the command
-	output := stdout.String()
-
-	// Regular expression to capture the VM ID
-	re := regexp.MustCompile(`virtual machine id ([A-F0-9-]+)`)
-	matches := re.FindStringSubmatch(output)
-	if len(matches) > 1 {
-		vmId := matches[1] // Capture the VM ID
-		return vmId, nil
+	if result.VMID == "" {
+		return "", fmt.Errorf("failed to import VM: no VM id was returned")
 	}
 
-	return "", fmt.Errorf("failed to import VM: %s", output)
+	return result.VMID, nil
 }
 
 // Export VM to UTM file
-func (d *Utm46Driver) Export(vmId string, path string) error {
-	var stdout bytes.Buffer
-
-	// Export VM
-	cmd := exec.Command(
-		"osascript", "-e",
-		fmt.Sprintf(`tell application "UTM" to export virtual machine id "%s" to POSIX file "%s"`, vmId, path),
-	)
-	// print command to log
-	log.Printf("Executing command: %s", cmd.String())
-	cmd.Stdout = &stdout
-	if err := cmd.Run(); err != nil {
-		return err
-	}
-
-	log.Printf("Export output: %s", stdout.String())
-
-	return nil
+func (d *Utm46Driver) Export(ctx context.Context, vmId string, path string) error {
+	_, err := d.runScript(ctx, exportTimeout, "export_vm.applescript", vmId, path)
+	return err
 }
 
 // Return the downloaded guest tools path if available.
-func (d *Utm46Driver) GuestToolsIsoPath() (string, error) {
+func (d *Utm46Driver) GuestToolsIsoPath(ctx context.Context) (string, error) {
 	// The default path to the guest tools, where UTM downloads it
-	guestToolsPath := filepath.Join(os.Getenv("HOME"), "Library/Containers/com.utmapp.UTM/Data/Library/Application Support/GuestSupportTools/utm-guest-tools-latest.iso")
+	guestToolsPath := filepath.Join(os.Getenv("HOME"), guestToolsIsoPath)
 
 	// Check if the file exists
 	if _, err := os.Stat(guestToolsPath); os.IsNotExist(err) {
@@ -1,6 +1,11 @@
 package common
 
-import "sync"
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
 
 type DriverMock struct {
 	sync.Mutex
@@ -11,11 +16,28 @@ type DriverMock struct {
 
 	ExecuteOsaCalls  [][]string
 	ExecuteOsaErrs   []error
-	ExecuteOsaResult string
+	ExecuteOsaResult ScriptResult
+
+	DiskImagesId     string
+	DiskImagesResult []string
+	DiskImagesErr    error
+
+	MacAddressesId     string
+	MacAddressesResult []string
+	MacAddressesErr    error
+
+	DhcpLeasesResult string
+	DhcpLeasesErr    error
+
+	ArpTableResult string
+	ArpTableErr    error
 
 	GuestToolsIsoPathCalled bool
 	GuestToolsIsoPathErr    error
 
+	HasFeatureCalls     []Feature
+	UnsupportedFeatures []Feature
+
 	ImportCalled bool
 	ImportId     string
 	ImportPath   string
@@ -25,9 +47,25 @@ type DriverMock struct {
 	IsRunningReturn bool
 	IsRunningErr    error
 
+	QemuImgCalls  [][]string
+	QemuImgErrs   []error
+	QemuImgResult string
+
+	MoveFileCalls [][]string
+	MoveFileErr   error
+
+	RemoveFilePaths []string
+	RemoveFileErr   error
+
 	StopName string
 	StopErr  error
 
+	TunnelAddrs []string
+	TunnelInUse []string
+
+	UploadPaths []string
+	UploadErr   error
+
 	UtmctlCalls  [][]string
 	UtmctlErrs   []error
 	UtmctlResult string
@@ -40,37 +78,57 @@ type DriverMock struct {
 	VersionErr    error
 }
 
-func (d *DriverMock) Delete(name string) error {
+func (d *DriverMock) Close() error {
+	return nil
+}
+
+func (d *DriverMock) Delete(ctx context.Context, name string) error {
 	d.DeleteCalled = true
 	d.DeleteName = name
 	return d.DeleteErr
 }
 
-func (d *DriverMock) ExecuteOsaScript(command ...string) (string, error) {
+func (d *DriverMock) ExecuteOsaScript(ctx context.Context, command ...string) (ScriptResult, error) {
 	d.ExecuteOsaCalls = append(d.ExecuteOsaCalls, command)
 
 	if len(d.ExecuteOsaErrs) >= len(d.ExecuteOsaCalls) {
-		return "", d.ExecuteOsaErrs[len(d.ExecuteOsaCalls)-1]
+		return ScriptResult{}, d.ExecuteOsaErrs[len(d.ExecuteOsaCalls)-1]
 	}
 	return d.ExecuteOsaResult, nil
 }
 
-func (d *DriverMock) Export(vmId string, path string) error {
+func (d *DriverMock) DiskImages(ctx context.Context, vmId string) ([]string, error) {
+	d.DiskImagesId = vmId
+	return d.DiskImagesResult, d.DiskImagesErr
+}
+
+func (d *DriverMock) Export(ctx context.Context, vmId string, path string) error {
 	return nil
 }
 
-func (d *DriverMock) GuestToolsIsoPath() (string, error) {
+func (d *DriverMock) GuestToolsIsoPath(ctx context.Context) (string, error) {
 	d.GuestToolsIsoPathCalled = true
 	return "", d.GuestToolsIsoPathErr
 }
 
-func (d *DriverMock) Import(path string) (string, error) {
+func (d *DriverMock) HasFeature(feature Feature) bool {
+	d.HasFeatureCalls = append(d.HasFeatureCalls, feature)
+
+	for _, unsupported := range d.UnsupportedFeatures {
+		if unsupported == feature {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *DriverMock) Import(ctx context.Context, path string) (string, error) {
 	d.ImportCalled = true
 	d.ImportPath = path
 	return "", d.ImportErr
 }
 
-func (d *DriverMock) IsRunning(name string) (bool, error) {
+func (d *DriverMock) IsRunning(ctx context.Context, name string) (bool, error) {
 	d.Lock()
 	defer d.Unlock()
 
@@ -78,12 +136,59 @@ func (d *DriverMock) IsRunning(name string) (bool, error) {
 	return d.IsRunningReturn, d.IsRunningErr
 }
 
-func (d *DriverMock) Stop(name string) error {
+func (d *DriverMock) MacAddresses(ctx context.Context, vmId string) ([]string, error) {
+	d.MacAddressesId = vmId
+	return d.MacAddressesResult, d.MacAddressesErr
+}
+
+func (d *DriverMock) DhcpLeases(ctx context.Context) (string, error) {
+	return d.DhcpLeasesResult, d.DhcpLeasesErr
+}
+
+func (d *DriverMock) ArpTable(ctx context.Context) (string, error) {
+	return d.ArpTableResult, d.ArpTableErr
+}
+
+func (d *DriverMock) MoveFile(ctx context.Context, src string, dst string) error {
+	d.MoveFileCalls = append(d.MoveFileCalls, []string{src, dst})
+	return d.MoveFileErr
+}
+
+func (d *DriverMock) RemoveFile(ctx context.Context, path string) error {
+	d.RemoveFilePaths = append(d.RemoveFilePaths, path)
+	return d.RemoveFileErr
+}
+
+func (d *DriverMock) QemuImg(ctx context.Context, args ...string) (string, error) {
+	d.QemuImgCalls = append(d.QemuImgCalls, args)
+
+	if len(d.QemuImgErrs) >= len(d.QemuImgCalls) {
+		return "", d.QemuImgErrs[len(d.QemuImgCalls)-1]
+	}
+	return d.QemuImgResult, nil
+}
+
+func (d *DriverMock) Stop(ctx context.Context, name string) error {
 	d.StopName = name
 	return d.StopErr
 }
 
-func (d *DriverMock) Utmctl(args ...string) (string, error) {
+func (d *DriverMock) Tunnel(ctx context.Context, addr string) (io.Closer, error) {
+	d.TunnelAddrs = append(d.TunnelAddrs, addr)
+	for _, inUse := range d.TunnelInUse {
+		if addr == inUse {
+			return nil, fmt.Errorf("%s: %w", addr, errPortInUse)
+		}
+	}
+	return nopCloser{}, nil
+}
+
+func (d *DriverMock) Upload(ctx context.Context, path string) (string, error) {
+	d.UploadPaths = append(d.UploadPaths, path)
+	return path, d.UploadErr
+}
+
+func (d *DriverMock) Utmctl(ctx context.Context, args ...string) (string, error) {
 	d.UtmctlCalls = append(d.UtmctlCalls, args)
 
 	if len(d.UtmctlErrs) >= len(d.UtmctlCalls) {
@@ -92,12 +197,12 @@ func (d *DriverMock) Utmctl(args ...string) (string, error) {
 	return d.UtmctlResult, nil
 }
 
-func (d *DriverMock) Verify() error {
+func (d *DriverMock) Verify(ctx context.Context) error {
 	d.VerifyCalled = true
 	return d.VerifyErr
 }
 
-func (d *DriverMock) Version() (string, error) {
+func (d *DriverMock) Version(ctx context.Context) (string, error) {
 	d.VersionCalled = true
 	return d.VersionResult, d.VersionErr
 }
@@ -0,0 +1,579 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// RemoteDriver is a driver for a UTM that runs on another Mac. The utmctl
+// commands and AppleScripts of the embedded driver are run over SSH, and
+// the files UTM reads or writes are copied over SFTP:
+//
+//   - Upload copies ISOs, seeds and cd_files into a temporary directory on
+//     the remote host, which is removed by Close.
+//   - Import uploads the bundle before importing it.
+//   - Export exports to the temporary directory and downloads the bundle.
+//   - GuestToolsIsoPath downloads the guest tools ISO of the remote UTM.
+//   - DiskImages reads the VM bundles of the remote UTM.
+//   - Tunnel forwards a local port to the remote host, for the
+//     communicator and VNC.
+type RemoteDriver struct {
+	Driver
+
+	host *sshHost
+}
+
+// newRemoteDriver connects to the remote host and returns the driver for
+// the UTM version installed there.
+func newRemoteDriver(ctx context.Context, config RemoteConfig) (Driver, error) {
+	host, err := dialSSHHost(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	base := Utm45Driver{
+		UtmctlPath:  config.RemoteUtmctlPath,
+		QemuImgPath: config.RemoteQemuImgPath,
+		runner:      host.Run,
+	}
+	driver, err := newDriver(ctx, base, utmAppPath(config.RemoteUtmctlPath))
+	if err != nil {
+		host.Close()
+		return nil, fmt.Errorf("%s: %w", host.addr, err)
+	}
+
+	return &RemoteDriver{Driver: driver, host: host}, nil
+}
+
+func (d *RemoteDriver) Close() error {
+	return d.host.Close()
+}
+
+func (d *RemoteDriver) DiskImages(ctx context.Context, vmId string) ([]string, error) {
+	home, err := d.host.sftp.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	return findDiskImages(vmId, path.Join(home, utmDocumentsPath), d.host.sftp.Glob,
+		func(name string) (io.ReadCloser, error) { return d.host.sftp.Open(name) })
+}
+
+func (d *RemoteDriver) MacAddresses(ctx context.Context, vmId string) ([]string, error) {
+	home, err := d.host.sftp.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	return findMacAddresses(vmId, path.Join(home, utmDocumentsPath), d.host.sftp.Glob,
+		func(name string) (io.ReadCloser, error) { return d.host.sftp.Open(name) })
+}
+
+func (d *RemoteDriver) Export(ctx context.Context, vmId string, path string) error {
+	hostPath, err := d.host.tempPath(filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer d.host.remove(hostPath)
+
+	if err := d.Driver.Export(ctx, vmId, hostPath); err != nil {
+		return err
+	}
+
+	log.Printf("Downloading %s from %s to %s", hostPath, d.host.addr, path)
+	return d.host.Download(ctx, hostPath, path)
+}
+
+func (d *RemoteDriver) GuestToolsIsoPath(ctx context.Context) (string, error) {
+	if !d.HasFeature(FeatureGuestTools) {
+		return d.Driver.GuestToolsIsoPath(ctx)
+	}
+
+	localDir, err := d.host.localTempDir()
+	if err != nil {
+		return "", err
+	}
+	localPath := filepath.Join(localDir, path.Base(guestToolsIsoPath))
+
+	// SFTP paths are relative to the home directory of the user
+	if err := d.host.Download(ctx, guestToolsIsoPath, localPath); err != nil {
+		return "", fmt.Errorf("guest tools ISO not found on %s: %s", d.host.addr, err)
+	}
+	return localPath, nil
+}
+
+func (d *RemoteDriver) Import(ctx context.Context, path string) (string, error) {
+	hostPath, err := d.host.Upload(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	// UTM copies the bundle into its library
+	defer d.host.remove(hostPath)
+
+	return d.Driver.Import(ctx, hostPath)
+}
+
+func (d *RemoteDriver) Tunnel(ctx context.Context, addr string) (io.Closer, error) {
+	return d.host.Tunnel(ctx, addr)
+}
+
+func (d *RemoteDriver) Upload(ctx context.Context, path string) (string, error) {
+	return d.host.Upload(ctx, path)
+}
+
+// sshHost runs commands on a remote host and copies files to and from it.
+type sshHost struct {
+	addr   string
+	client *ssh.Client
+	sftp   *sftp.Client
+	// The connection to the SSH agent, if it is used to authenticate
+	agent net.Conn
+
+	mu       sync.Mutex
+	tempDir  string
+	uploads  int
+	localDir string
+}
+
+// dialSSHHost connects to the remote host of the config.
+func dialSSHHost(ctx context.Context, config RemoteConfig) (*sshHost, error) {
+	clientConfig, agentConn, err := sshClientConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	closeAgent := func() {
+		if agentConn != nil {
+			agentConn.Close()
+		}
+	}
+
+	addr := net.JoinHostPort(config.RemoteHost, strconv.Itoa(config.RemotePort))
+	log.Printf("Connecting to remote UTM host %s as %s", addr, clientConfig.User)
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		closeAgent()
+		return nil, fmt.Errorf("error connecting to remote UTM host %s: %s", addr, err)
+	}
+	// The handshake does not take a context
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, clientConfig)
+	if err != nil {
+		conn.Close()
+		closeAgent()
+		return nil, fmt.Errorf("error connecting to remote UTM host %s: %s", addr, err)
+	}
+	conn.SetDeadline(time.Time{})
+	client := ssh.NewClient(c, chans, reqs)
+
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		client.Close()
+		closeAgent()
+		return nil, fmt.Errorf("error starting SFTP on remote UTM host %s: %s", addr, err)
+	}
+
+	return &sshHost{addr: addr, client: client, sftp: sftpClient, agent: agentConn}, nil
+}
+
+// sshClientConfig returns the SSH client configuration for the config, and
+// the connection to the SSH agent when it is used, which is kept open for
+// as long as the client is.
+func sshClientConfig(config RemoteConfig) (*ssh.ClientConfig, net.Conn, error) {
+	username := config.RemoteUsername
+	if username == "" {
+		current, err := user.Current()
+		if err != nil {
+			return nil, nil, fmt.Errorf("error getting the current user for remote_username: %s", err)
+		}
+		username = current.Username
+	}
+
+	var auth []ssh.AuthMethod
+	if config.RemotePrivateKeyFile != "" {
+		key, err := os.ReadFile(config.RemotePrivateKeyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading remote_private_key_file: %s", err)
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error parsing remote_private_key_file: %s", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if config.RemotePassword != "" {
+		auth = append(auth, ssh.Password(config.RemotePassword))
+	}
+
+	hostKeyCallback := ssh.InsecureIgnoreHostKey()
+	if !config.RemoteSkipHostKeyCheck {
+		knownHostsFile := config.RemoteKnownHostsFile
+		if knownHostsFile == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, nil, fmt.Errorf("error finding known_hosts: %s", err)
+			}
+			knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+		}
+		var err error
+		hostKeyCallback, err = knownhosts.New(knownHostsFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading remote_known_hosts_file: %s", err)
+		}
+	}
+
+	// The agent is connected to last, as the connection has to be closed
+	// once it is no longer used
+	var agentConn net.Conn
+	if len(auth) == 0 {
+		socket := os.Getenv("SSH_AUTH_SOCK")
+		if socket == "" {
+			return nil, nil, fmt.Errorf("no authentication for remote_host: set remote_private_key_file or remote_password, or run an SSH agent")
+		}
+		var err error
+		agentConn, err = net.Dial("unix", socket)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error connecting to the SSH agent: %s", err)
+		}
+		auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(agentConn).Signers))
+	}
+
+	return &ssh.ClientConfig{
+		User:            username,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	}, agentConn, nil
+}
+
+// Run runs a command on the remote host like runCommand runs it locally.
+// The command is killed when the timeout expires or ctx is cancelled.
+func (h *sshHost) Run(ctx context.Context, timeout time.Duration, stdin io.Reader, name string, args ...string) (string, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	tool := path.Base(name)
+	session, err := h.client.NewSession()
+	if err != nil {
+		return "", "", fmt.Errorf("error running %s on %s: %s", tool, h.addr, err)
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdin = stdin
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	if err := session.Start(shellQuote(append([]string{name}, args...))); err != nil {
+		return "", "", fmt.Errorf("error running %s on %s: %s", tool, h.addr, err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- session.Wait() }()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		session.Signal(ssh.SIGKILL)
+		session.Close()
+		// Don't wait forever for a command that ignores the signal
+		select {
+		case <-done:
+		case <-time.After(commandWaitDelay):
+		}
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return "", "", fmt.Errorf("%s timed out after %s", tool, timeout)
+		}
+		return "", "", fmt.Errorf("%s interrupted: %w", tool, ctx.Err())
+	}
+
+	stdoutString := strings.TrimSpace(stdout.String())
+	stderrString := strings.TrimSpace(stderr.String())
+
+	if err != nil {
+		var exitErr *ssh.ExitError
+		if errors.As(err, &exitErr) {
+			err = newDriverError(tool, stderrString, err)
+		} else {
+			err = fmt.Errorf("error running %s on %s: %s", tool, h.addr, err)
+		}
+	}
+
+	return stdoutString, stderrString, err
+}
+
+// Upload copies a local file or directory into the temporary directory on
+// the remote host and returns its remote path. The name is kept, as UTM
+// shows it for removable drives.
+func (h *sshHost) Upload(ctx context.Context, localPath string) (string, error) {
+	h.mu.Lock()
+	h.uploads++
+	n := h.uploads
+	h.mu.Unlock()
+
+	dir, err := h.tempPath(strconv.Itoa(n))
+	if err != nil {
+		return "", err
+	}
+	if err := h.sftp.Mkdir(dir); err != nil {
+		return "", fmt.Errorf("error creating %s on %s: %s", dir, h.addr, err)
+	}
+	hostPath := path.Join(dir, filepath.Base(localPath))
+
+	log.Printf("Uploading %s to %s on %s", localPath, hostPath, h.addr)
+	err = filepath.Walk(localPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(localPath, p)
+		if err != nil {
+			return err
+		}
+		target := path.Join(hostPath, filepath.ToSlash(rel))
+
+		if info.IsDir() {
+			return h.sftp.MkdirAll(target)
+		}
+		return h.uploadFile(ctx, p, target, info.Mode().Perm())
+	})
+	if err != nil {
+		return "", fmt.Errorf("error uploading %s to %s: %s", localPath, h.addr, err)
+	}
+
+	return hostPath, nil
+}
+
+func (h *sshHost) uploadFile(ctx context.Context, localPath string, hostPath string, mode os.FileMode) error {
+	src, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := h.sftp.Create(hostPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, &contextReader{ctx, src}); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Chmod(mode); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// Download copies a file or directory from the remote host to a local path.
+func (h *sshHost) Download(ctx context.Context, hostPath string, localPath string) error {
+	walker := h.sftp.Walk(hostPath)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return err
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(walker.Path(), hostPath), "/")
+		target := filepath.Join(localPath, filepath.FromSlash(rel))
+
+		info := walker.Stat()
+		if info.IsDir() {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := h.downloadFile(ctx, walker.Path(), target, info.Mode().Perm()); err != nil {
+			return fmt.Errorf("error downloading %s from %s: %s", walker.Path(), h.addr, err)
+		}
+	}
+	return nil
+}
+
+func (h *sshHost) downloadFile(ctx context.Context, hostPath string, localPath string, mode os.FileMode) error {
+	src, err := h.sftp.Open(hostPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return err
+	}
+	dst, err := os.OpenFile(localPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, &contextReader{ctx, src}); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// Tunnel listens on addr on this machine and forwards the connections to
+// the same address on the remote host. Unspecified addresses like 0.0.0.0
+// are forwarded to the loopback address of the remote host. The port is in
+// use on the remote host when it accepts a connection before UTM listens on
+// it.
+func (h *sshHost) Tunnel(ctx context.Context, addr string) (io.Closer, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	hostAddr := net.JoinHostPort(host, port)
+	if conn, err := h.client.Dial("tcp", hostAddr); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("%s on %s: %w", hostAddr, h.addr, errPortInUse)
+	}
+	return h.tunnel(ctx, addr, hostAddr)
+}
+
+func (h *sshHost) tunnel(ctx context.Context, localAddr string, hostAddr string) (io.Closer, error) {
+	var lc net.ListenConfig
+	l, err := lc.Listen(ctx, "tcp", localAddr)
+	if err != nil {
+		return nil, fmt.Errorf("error tunneling %s to %s: %s", localAddr, h.addr, err)
+	}
+	log.Printf("Tunneling %s to %s on %s", localAddr, hostAddr, h.addr)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go h.forward(conn, hostAddr)
+		}
+	}()
+
+	return l, nil
+}
+
+// forward copies the data between a local connection and a new connection
+// to hostAddr on the remote host.
+func (h *sshHost) forward(conn net.Conn, hostAddr string) {
+	defer conn.Close()
+
+	remote, err := h.client.Dial("tcp", hostAddr)
+	if err != nil {
+		log.Printf("error connecting to %s on %s: %s", hostAddr, h.addr, err)
+		return
+	}
+	defer remote.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(remote, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, remote)
+		done <- struct{}{}
+	}()
+	// Either side closing ends the connection
+	<-done
+}
+
+// tempPath returns the path of name in the temporary directory on the
+// remote host, which is created on first use.
+func (h *sshHost) tempPath(name string) (string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.tempDir == "" {
+		dir, _, err := h.Run(context.Background(), utmctlTimeout, nil,
+			"sh", "-c", `mktemp -d "${TMPDIR:-/tmp}/packer-utm.XXXXXXXX"`)
+		if err != nil {
+			return "", fmt.Errorf("error creating a temporary directory on %s: %s", h.addr, err)
+		}
+		h.tempDir = dir
+	}
+	return path.Join(h.tempDir, name), nil
+}
+
+// localTempDir returns a local temporary directory for downloads, which is
+// created on first use.
+func (h *sshHost) localTempDir() (string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.localDir == "" {
+		dir, err := os.MkdirTemp("", "packer-utm")
+		if err != nil {
+			return "", err
+		}
+		h.localDir = dir
+	}
+	return h.localDir, nil
+}
+
+// remove removes a file or directory from the remote host.
+func (h *sshHost) remove(hostPath string) {
+	if _, _, err := h.Run(context.Background(), utmctlTimeout, nil, "rm", "-rf", hostPath); err != nil {
+		log.Printf("error removing %s from %s: %s", hostPath, h.addr, err)
+	}
+}
+
+// Close removes the temporary directories and closes the connection.
+func (h *sshHost) Close() error {
+	h.mu.Lock()
+	tempDir, localDir := h.tempDir, h.localDir
+	h.mu.Unlock()
+
+	if tempDir != "" {
+		h.remove(tempDir)
+	}
+	if localDir != "" {
+		os.RemoveAll(localDir)
+	}
+	h.sftp.Close()
+	err := h.client.Close()
+	if h.agent != nil {
+		h.agent.Close()
+	}
+	return err
+}
+
+// shellQuote returns the command line that runs the command with the
+// arguments in a POSIX shell, the login shell of the remote user.
+func shellQuote(command []string) string {
+	quoted := make([]string, len(command))
+	for i, arg := range command {
+		quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
+
+// contextReader stops reading when the context is cancelled.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
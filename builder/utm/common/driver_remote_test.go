@@ -0,0 +1,460 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testSSHServer is an in-process stand-in for the sshd of a remote UTM
+// host. It runs exec requests with sh on this machine, serves SFTP and
+// forwards direct-tcpip channels.
+type testSSHServer struct {
+	Addr string
+	// The config to connect to the server with
+	Config RemoteConfig
+
+	listener net.Listener
+	wg       sync.WaitGroup
+}
+
+func newTestSSHServer(t *testing.T) *testSSHServer {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	clientPublic, clientKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	authorized, err := ssh.NewPublicKey(clientPublic)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == "packer" && bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown key for %s", conn.User())
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	s := &testSSHServer{Addr: l.Addr().String(), listener: l}
+	go s.serve(config)
+	t.Cleanup(func() {
+		l.Close()
+		s.wg.Wait()
+	})
+
+	dir := t.TempDir()
+	keyBlock, err := ssh.MarshalPrivateKey(clientKey, "")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	keyFile := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(keyBlock), 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	knownHostsFile := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(s.Addr)}, hostSigner.PublicKey())
+	if err := os.WriteFile(knownHostsFile, []byte(line+"\n"), 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	host, port, _ := net.SplitHostPort(s.Addr)
+	s.Config = RemoteConfig{
+		RemoteHost:           host,
+		RemoteUsername:       "packer",
+		RemotePrivateKeyFile: keyFile,
+		RemoteKnownHostsFile: knownHostsFile,
+	}
+	s.Config.RemotePort, _ = strconv.Atoi(port)
+	return s
+}
+
+func (s *testSSHServer) serve(config *ssh.ServerConfig) {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			serverConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+			if err != nil {
+				return
+			}
+			defer serverConn.Close()
+			go ssh.DiscardRequests(reqs)
+			for newChannel := range chans {
+				go s.handleChannel(newChannel)
+			}
+		}()
+	}
+}
+
+func (s *testSSHServer) handleChannel(newChannel ssh.NewChannel) {
+	switch newChannel.ChannelType() {
+	case "session":
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		s.handleSession(channel, requests)
+	case "direct-tcpip":
+		// host string, port uint32, origin host string, origin port uint32
+		data := newChannel.ExtraData()
+		hostLen := binary.BigEndian.Uint32(data)
+		host := string(data[4 : 4+hostLen])
+		port := binary.BigEndian.Uint32(data[4+hostLen:])
+		conn, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+		if err != nil {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			return
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			conn.Close()
+			return
+		}
+		go ssh.DiscardRequests(requests)
+		go func() {
+			io.Copy(channel, conn)
+			channel.Close()
+		}()
+		io.Copy(conn, channel)
+		conn.Close()
+	default:
+		newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+	}
+}
+
+func (s *testSSHServer) handleSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+
+	var cmd *exec.Cmd
+	for req := range requests {
+		switch req.Type {
+		case "exec":
+			command := string(req.Payload[4:])
+			cmd = exec.Command("sh", "-c", command)
+			cmd.Stdin = channel
+			cmd.Stdout = channel
+			cmd.Stderr = channel.Stderr()
+			if err := cmd.Start(); err != nil {
+				req.Reply(false, nil)
+				return
+			}
+			req.Reply(true, nil)
+			go func() {
+				status := 0
+				if err := cmd.Wait(); err != nil {
+					status = 255
+					if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() >= 0 {
+						status = exitErr.ExitCode()
+					}
+				}
+				channel.SendRequest("exit-status", false, binary.BigEndian.AppendUint32(nil, uint32(status)))
+				channel.Close()
+			}()
+		case "subsystem":
+			if string(req.Payload[4:]) != "sftp" {
+				req.Reply(false, nil)
+				return
+			}
+			req.Reply(true, nil)
+			server, err := sftp.NewServer(channel)
+			if err != nil {
+				return
+			}
+			go func() {
+				server.Serve()
+				server.Close()
+			}()
+		case "signal":
+			if cmd != nil && cmd.Process != nil {
+				cmd.Process.Signal(syscall.SIGKILL)
+			}
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+func testSSHHost(t *testing.T, server *testSSHServer) *sshHost {
+	host, err := dialSSHHost(context.Background(), server.Config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	t.Cleanup(func() { host.Close() })
+	return host
+}
+
+func TestRemoteDriver_impl(t *testing.T) {
+	var _ Driver = new(RemoteDriver)
+}
+
+func TestSSHHost_run(t *testing.T) {
+	host := testSSHHost(t, newTestSSHServer(t))
+	ctx := context.Background()
+
+	stdout, _, err := host.Run(ctx, time.Minute, strings.NewReader("from stdin"),
+		"sh", "-c", `cat; printf ' %s' "$1"`, "sh", "it's a \"quoted\" $argument")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if stdout != `from stdin it's a "quoted" $argument` {
+		t.Fatalf("bad: %q", stdout)
+	}
+
+	// utmctl errors are classified like local ones
+	utmctl := filepath.Join(t.TempDir(), "utmctl")
+	script := "#!/bin/sh\necho 'Error: Virtual machine not found.' >&2\nexit 1\n"
+	if err := os.WriteFile(utmctl, []byte(script), 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	driver := &Utm45Driver{UtmctlPath: utmctl, runner: host.Run}
+	_, err = driver.Utmctl(ctx, "status", "missing")
+	if !errors.Is(err, ErrVMNotFound) {
+		t.Fatalf("bad: %v", err)
+	}
+	var driverErr *DriverError
+	if !errors.As(err, &driverErr) || driverErr.Tool != "utmctl" {
+		t.Fatalf("bad: %#v", err)
+	}
+}
+
+func TestSSHHost_runCancel(t *testing.T) {
+	host := testSSHHost(t, newTestSSHServer(t))
+
+	start := time.Now()
+	_, _, err := host.Run(context.Background(), 100*time.Millisecond, nil, "sleep", "30")
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("should time out: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	if _, _, err := host.Run(ctx, time.Minute, nil, "sleep", "30"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("should be cancelled: %v", err)
+	}
+
+	if time.Since(start) > 10*time.Second {
+		t.Fatal("the command should be killed")
+	}
+
+	// The connection can still be used
+	if stdout, _, err := host.Run(context.Background(), time.Minute, nil, "echo", "ok"); err != nil || stdout != "ok" {
+		t.Fatalf("bad: %q %v", stdout, err)
+	}
+}
+
+func TestSSHHost_unknownHostKey(t *testing.T) {
+	server := newTestSSHServer(t)
+
+	config := server.Config
+	config.RemoteKnownHostsFile = filepath.Join(t.TempDir(), "known_hosts")
+	if err := os.WriteFile(config.RemoteKnownHostsFile, nil, 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := dialSSHHost(context.Background(), config); err == nil {
+		t.Fatal("unknown host keys should be rejected")
+	}
+
+	config.RemoteKnownHostsFile = ""
+	config.RemoteSkipHostKeyCheck = true
+	host, err := dialSSHHost(context.Background(), config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	host.Close()
+}
+
+func TestSSHHost_copy(t *testing.T) {
+	host := testSSHHost(t, newTestSSHServer(t))
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	isoPath := filepath.Join(dir, "boot.iso")
+	if err := os.WriteFile(isoPath, []byte("iso"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The name is kept, even if another file has the same name
+	first, err := host.Upload(ctx, isoPath)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	second, err := host.Upload(ctx, isoPath)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if filepath.Base(first) != "boot.iso" || first == second || first == isoPath {
+		t.Fatalf("bad: %s %s", first, second)
+	}
+	if content, err := os.ReadFile(first); err != nil || string(content) != "iso" {
+		t.Fatalf("bad: %q %v", content, err)
+	}
+
+	// Directories, like .utm bundles, are copied recursively
+	bundlePath := filepath.Join(dir, "test.utm")
+	if err := os.MkdirAll(filepath.Join(bundlePath, "Data"), 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	files := map[string]string{
+		"config.plist":     "<plist/>",
+		"Data/disk.qcow2":  "disk",
+		"Data/efi_vars.fd": "vars",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(bundlePath, name), []byte(content), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	hostPath, err := host.Upload(ctx, bundlePath)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	downloadPath := filepath.Join(t.TempDir(), "output", "test.utm")
+	if err := host.Download(ctx, hostPath, downloadPath); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for name, content := range files {
+		if actual, err := os.ReadFile(filepath.Join(downloadPath, name)); err != nil || string(actual) != content {
+			t.Fatalf("%s: bad: %q %v", name, actual, err)
+		}
+	}
+
+	// The temporary directory is removed on close
+	host.Close()
+	if _, err := os.Stat(first); !os.IsNotExist(err) {
+		t.Fatalf("uploads should be removed: %v", err)
+	}
+}
+
+func TestSSHHost_tunnel(t *testing.T) {
+	host := testSSHHost(t, newTestSSHServer(t))
+
+	// A service on the remote host, e.g. the forwarded SSH port of a VM
+	service, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer service.Close()
+	go func() {
+		for {
+			conn, err := service.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	// The remote host is this machine, so listen on another port
+	tunnel, err := host.tunnel(context.Background(), "127.0.0.1:0", service.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	localAddr := tunnel.(net.Listener).Addr().String()
+
+	conn, err := net.Dial("tcp", localAddr)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "ping" {
+		t.Fatalf("bad: %q %v", reply, err)
+	}
+
+	tunnel.Close()
+	if conn, err := net.Dial("tcp", localAddr); err == nil {
+		conn.Close()
+		t.Fatal("the tunnel should be closed")
+	}
+}
+
+func TestRemoteDriver_exportImport(t *testing.T) {
+	host := testSSHHost(t, newTestSSHServer(t))
+	ctx := context.Background()
+
+	// The simulator stands in for the UTM on the remote host
+	simulator := new(DriverSimulator)
+	driver := &RemoteDriver{Driver: simulator, host: host}
+	vmId := simulator.AddVM(SimulatedVM{
+		Name:    "test",
+		Backend: "QeMu",
+		Drives:  []SimulatedDrive{{ID: "DISK", Interface: "QdIv", Size: 1024}},
+	})
+
+	outputPath := filepath.Join(t.TempDir(), "test.utm")
+	if err := driver.Export(ctx, vmId, outputPath); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	exported := simulator.Calls[len(simulator.Calls)-1]
+	if exported[0] != "export_vm.applescript" || exported[2] == outputPath {
+		t.Fatalf("the VM should be exported on the remote host: %#v", exported)
+	}
+	if _, err := os.Stat(filepath.Join(outputPath, "config.plist")); err != nil {
+		t.Fatalf("the bundle should be downloaded: %s", err)
+	}
+	if _, err := os.Stat(exported[2]); !os.IsNotExist(err) {
+		t.Fatalf("the remote copy should be removed: %v", err)
+	}
+
+	importedId, err := driver.Import(ctx, outputPath)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	imported := simulator.Calls[len(simulator.Calls)-1]
+	if imported[0] != "import_vm.applescript" || imported[1] == outputPath {
+		t.Fatalf("the bundle should be uploaded: %#v", imported)
+	}
+	if vm := simulator.VM(importedId); vm == nil || vm.Name != "test" {
+		t.Fatalf("bad: %#v", vm)
+	}
+}
@@ -0,0 +1,1376 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/naveenrajm7/packer-plugin-utm/builder/utm/bundle"
+)
+
+// DriverSimulator is a Driver that simulates UTM in memory, so whole step
+// lists can be run in tests. Unlike DriverMock it keeps state: it
+// understands the embedded AppleScripts and the utmctl commands used by the
+// steps, keeps an inventory of virtual machines with their drives, network
+// interfaces, displays and run state, and returns the same results as the
+// scripts do, e.g. the UUID of a created VM or drive.
+//
+// Operations on unknown VMs, and configuration changes to running VMs, fail
+// like they do in UTM.
+type DriverSimulator struct {
+	sync.Mutex
+
+	// UTMVersion is returned by Version, 4.6.4 if empty.
+	UTMVersion string
+
+	// UnsupportedFeatures are reported as missing by HasFeature.
+	UnsupportedFeatures []Feature
+
+	// GuestToolsPath is returned by GuestToolsIsoPath if set.
+	GuestToolsPath string
+
+	// Leases is returned by DhcpLeases and Arp by ArpTable.
+	Leases string
+	Arp    string
+
+	// Errors are returned instead of running an operation. The keys are
+	// script names ("create_vm.applescript", "import_vm.applescript"),
+	// utmctl commands ("start"), qemu-img commands ("qemu-img snapshot"),
+	// "dhcpd_leases", "arp", "mv" or "rm".
+	Errors map[string]error
+
+	// Calls records every script, utmctl, qemu-img, cat, arp, mv and rm
+	// command that was run.
+	Calls [][]string
+
+	vms []*SimulatedVM
+	// images written by qemu-img convert, until they are moved over the
+	// image of a drive
+	images map[string]simulatedImage
+}
+
+// simulatedImage is an image written by qemu-img convert.
+type simulatedImage struct {
+	Size       int64
+	Compressed bool
+}
+
+// SimulatedVM is a virtual machine known to the DriverSimulator. Enum
+// values are stored as passed to the scripts, e.g. "QdIv" for a VirtIO
+// drive interface.
+type SimulatedVM struct {
+	ID                      string
+	Name                    string
+	Backend                 string
+	Architecture            string
+	Icon                    string
+	Notes                   string
+	CPUCount                int
+	MemorySize              int
+	Hypervisor              bool
+	UEFIBoot                bool
+	DirectoryShareMode      string
+	Drives                  []SimulatedDrive
+	NetworkInterfaces       []SimulatedNetworkInterface
+	Displays                []SimulatedDisplay
+	QEMUAdditionalArguments []string
+	// Status is the utmctl status, "stopped" or "started".
+	Status string
+	// IPAddresses are reported by utmctl ip-address while the VM runs, as
+	// by the QEMU guest agent.
+	IPAddresses []string
+	// SharedDirectories are the paths in the registry of the VM.
+	SharedDirectories []string
+}
+
+// SimulatedDrive is a drive of a SimulatedVM.
+type SimulatedDrive struct {
+	ID        string
+	Interface string
+	// Size of a new disk in MiB.
+	Size int
+	// Source is the image of a removable drive, or of a data disk.
+	Source    string
+	Removable bool
+	// Raw is set for a new disk with a raw image instead of a qcow2 image.
+	Raw      bool
+	ReadOnly bool
+	// Snapshots are the names of the internal snapshots of a disk, as
+	// managed with qemu-img.
+	Snapshots []string
+	// ImageSize is the size of the image file of a disk in bytes, as
+	// reported by qemu-img info. It defaults to Size.
+	ImageSize int64
+	// Compressed is set once the image was rewritten with qemu-img
+	// convert -c.
+	Compressed bool
+}
+
+// SimulatedNetworkInterface is a network interface of a SimulatedVM.
+type SimulatedNetworkInterface struct {
+	Mode          string
+	Hardware      string
+	MacAddress    string
+	HostInterface string
+	PortForwards  []SimulatedPortForward
+}
+
+// SimulatedPortForward is a port forward of a SimulatedNetworkInterface.
+type SimulatedPortForward struct {
+	Protocol     string
+	GuestAddress string
+	GuestPort    int
+	HostAddress  string
+	HostPort     int
+}
+
+// SimulatedDisplay is a display of a SimulatedVM.
+type SimulatedDisplay struct {
+	ID       string
+	Hardware string
+}
+
+// errSimulatedExit stands in for the exit error of utmctl and osascript.
+var errSimulatedExit = errors.New("exit status 1")
+
+// simulatedScripts implements the embedded scripts. Each function gets
+// the arguments after the script name.
+var simulatedScripts = map[string]func(d *DriverSimulator, args []string) (ScriptResult, error){
+	"add_drive.applescript":                   (*DriverSimulator).addDrive,
+	"add_network_interface.applescript":       (*DriverSimulator).addNetworkInterface,
+	"add_port_forwards.applescript":           (*DriverSimulator).addPortForwards,
+	"add_qemu_additional_args.applescript":    (*DriverSimulator).addQemuAdditionalArgs,
+	"add_qemu_display.applescript":            (*DriverSimulator).addQemuDisplay,
+	"attach_iso.applescript":                  (*DriverSimulator).attachISO,
+	"clear_network_interfaces.applescript":    (*DriverSimulator).clearNetworkInterfaces,
+	"clear_port_forwards.applescript":         (*DriverSimulator).clearPortForwards,
+	"create_vm.applescript":                   (*DriverSimulator).createVM,
+	"customize_vm.applescript":                (*DriverSimulator).customizeVM,
+	"export_vm.applescript":                   (*DriverSimulator).exportVM,
+	"get_shared_directory.applescript":        (*DriverSimulator).getSharedDirectory,
+	"import_vm.applescript":                   (*DriverSimulator).importVM,
+	"remove_drive.applescript":                (*DriverSimulator).removeDrive,
+	"remove_first_drive.applescript":          (*DriverSimulator).removeFirstDrive,
+	"remove_qemu_additional_args.applescript": (*DriverSimulator).removeQemuAdditionalArgs,
+	"remove_qemu_display.applescript":         (*DriverSimulator).removeQemuDisplay,
+	"remove_qemu_display_by_name.applescript": (*DriverSimulator).removeQemuDisplayByName,
+	"set_drive_read_only.applescript":         (*DriverSimulator).setDriveReadOnly,
+	"set_shared_directory.applescript":        (*DriverSimulator).setSharedDirectory,
+}
+
+// AddVM adds a stopped VM to the inventory, as if it was created in UTM.
+// A missing ID is generated. It returns the ID of the VM.
+func (d *DriverSimulator) AddVM(vm SimulatedVM) string {
+	d.Lock()
+	defer d.Unlock()
+
+	if vm.ID == "" {
+		vm.ID = newSimulatedID()
+	}
+	if vm.Status == "" {
+		vm.Status = "stopped"
+	}
+	d.vms = append(d.vms, &vm)
+	return vm.ID
+}
+
+// VM returns a copy of the VM with the given ID or name, or nil.
+func (d *DriverSimulator) VM(identifier string) *SimulatedVM {
+	d.Lock()
+	defer d.Unlock()
+
+	vm, err := d.find(identifier)
+	if err != nil {
+		return nil
+	}
+	c := vm.clone()
+	return &c
+}
+
+// VMs returns copies of all VMs in the inventory.
+func (d *DriverSimulator) VMs() []SimulatedVM {
+	d.Lock()
+	defer d.Unlock()
+
+	vms := make([]SimulatedVM, 0, len(d.vms))
+	for _, vm := range d.vms {
+		vms = append(vms, vm.clone())
+	}
+	return vms
+}
+
+// clone returns a copy of the VM that shares no slices with it.
+func (vm *SimulatedVM) clone() SimulatedVM {
+	c := *vm
+	c.Drives = append([]SimulatedDrive(nil), vm.Drives...)
+	for i := range c.Drives {
+		c.Drives[i].Snapshots = append([]string(nil), vm.Drives[i].Snapshots...)
+	}
+	c.Displays = append([]SimulatedDisplay(nil), vm.Displays...)
+	c.QEMUAdditionalArguments = append([]string(nil), vm.QEMUAdditionalArguments...)
+	c.IPAddresses = append([]string(nil), vm.IPAddresses...)
+	c.SharedDirectories = append([]string(nil), vm.SharedDirectories...)
+	c.NetworkInterfaces = nil
+	for _, netIf := range vm.NetworkInterfaces {
+		netIf.PortForwards = append([]SimulatedPortForward(nil), netIf.PortForwards...)
+		c.NetworkInterfaces = append(c.NetworkInterfaces, netIf)
+	}
+	return c
+}
+
+func (d *DriverSimulator) Close() error {
+	return nil
+}
+
+func (d *DriverSimulator) Delete(ctx context.Context, name string) error {
+	_, err := d.Utmctl(ctx, "delete", name)
+	return err
+}
+
+func (d *DriverSimulator) ExecuteOsaScript(ctx context.Context, command ...string) (ScriptResult, error) {
+	if len(command) == 0 {
+		return ScriptResult{}, fmt.Errorf("no command provided")
+	}
+	if err := ctx.Err(); err != nil {
+		return ScriptResult{}, fmt.Errorf("osascript interrupted: %w", err)
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	d.Calls = append(d.Calls, command)
+	if err := d.Errors[command[0]]; err != nil {
+		return ScriptResult{}, err
+	}
+
+	script, ok := simulatedScripts[command[0]]
+	if !ok {
+		return ScriptResult{}, fmt.Errorf("failed to read script scripts/%s: file does not exist", command[0])
+	}
+	return script(d, command[1:])
+}
+
+// MacAddresses returns the MAC addresses of the network interfaces of the VM.
+func (d *DriverSimulator) MacAddresses(ctx context.Context, vmId string) ([]string, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	vm, err := d.find(vmId)
+	if err != nil {
+		return nil, fmt.Errorf("the bundle of VM %s was not found", vmId)
+	}
+	var addresses []string
+	for _, netIf := range vm.NetworkInterfaces {
+		if netIf.MacAddress != "" {
+			addresses = append(addresses, netIf.MacAddress)
+		}
+	}
+	return addresses, nil
+}
+
+func (d *DriverSimulator) DhcpLeases(ctx context.Context) (string, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.Calls = append(d.Calls, []string{"cat", dhcpdLeasesPath})
+	if err := d.Errors["dhcpd_leases"]; err != nil {
+		return "", err
+	}
+	return d.Leases, nil
+}
+
+func (d *DriverSimulator) ArpTable(ctx context.Context) (string, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.Calls = append(d.Calls, []string{"arp", "-an"})
+	if err := d.Errors["arp"]; err != nil {
+		return "", err
+	}
+	return d.Arp, nil
+}
+
+// DiskImages returns made up paths for the disks of the VM, which QemuImg
+// understands.
+func (d *DriverSimulator) DiskImages(ctx context.Context, vmId string) ([]string, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	vm, err := d.find(vmId)
+	if err != nil {
+		return nil, fmt.Errorf("the bundle of VM %s was not found", vmId)
+	}
+	var images []string
+	for _, drive := range vm.Drives {
+		if !drive.Removable {
+			images = append(images, simulatedImagePath(vm, drive))
+		}
+	}
+	return images, nil
+}
+
+func simulatedImagePath(vm *SimulatedVM, drive SimulatedDrive) string {
+	return fmt.Sprintf("/simulated/%s.utm/Data/%s", vm.ID, simulatedImageName(drive))
+}
+
+func simulatedImageName(drive SimulatedDrive) string {
+	if drive.Raw {
+		return drive.ID + ".img"
+	}
+	return drive.ID + ".qcow2"
+}
+
+func (d *DriverSimulator) Export(ctx context.Context, vmId string, path string) error {
+	_, err := d.ExecuteOsaScript(ctx, "export_vm.applescript", vmId, path)
+	return err
+}
+
+func (d *DriverSimulator) GuestToolsIsoPath(ctx context.Context) (string, error) {
+	if d.GuestToolsPath == "" {
+		return "", fmt.Errorf("guest tools ISO not found")
+	}
+	return d.GuestToolsPath, nil
+}
+
+func (d *DriverSimulator) HasFeature(feature Feature) bool {
+	for _, unsupported := range d.UnsupportedFeatures {
+		if unsupported == feature {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *DriverSimulator) Import(ctx context.Context, path string) (string, error) {
+	result, err := d.ExecuteOsaScript(ctx, "import_vm.applescript", path)
+	return result.VMID, err
+}
+
+func (d *DriverSimulator) IsRunning(ctx context.Context, name string) (bool, error) {
+	status, err := d.Utmctl(ctx, "status", name)
+	if err != nil {
+		return false, err
+	}
+	switch status {
+	case "started", "stopping", "paused":
+		return true, nil
+	}
+	return false, nil
+}
+
+// QemuImg simulates the snapshot, info and convert commands of qemu-img on
+// the images returned by DiskImages. Like qemu-img, changes fail while the
+// VM is running, as UTM holds a lock on the images. A converted image is
+// half the size of its source, a compressed one a quarter.
+func (d *DriverSimulator) QemuImg(ctx context.Context, args ...string) (string, error) {
+	if len(args) == 0 {
+		return "", newDriverError("qemu-img", "qemu-img: Not enough arguments", errSimulatedExit)
+	}
+	if err := ctx.Err(); err != nil {
+		return "", fmt.Errorf("qemu-img interrupted: %w", err)
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	d.Calls = append(d.Calls, append([]string{"qemu-img"}, args...))
+	if err := d.Errors["qemu-img "+args[0]]; err != nil {
+		return "", err
+	}
+	switch args[0] {
+	case "info":
+		return d.qemuImgInfo(args[1:])
+	case "convert":
+		return d.qemuImgConvert(args[1:])
+	}
+	if args[0] != "snapshot" || len(args) < 3 {
+		return "", newDriverError("qemu-img",
+			fmt.Sprintf("qemu-img: Command not supported: %s", strings.Join(args, " ")), errSimulatedExit)
+	}
+
+	// The image is the last argument
+	vm, drive, err := d.findImage(args[len(args)-1])
+	if err != nil {
+		return "", err
+	}
+
+	switch args[1] {
+	case "-l":
+		lines := []string{"Snapshot list:", "ID        TAG"}
+		for i, name := range drive.Snapshots {
+			lines = append(lines, fmt.Sprintf("%-9d %s", i+1, name))
+		}
+		return strings.Join(lines, "\n"), nil
+	case "-c", "-a", "-d":
+		if vm.Status != "stopped" {
+			return "", newDriverError("qemu-img", fmt.Sprintf(
+				"qemu-img: Could not open '%s': Failed to get \"write\" lock", args[len(args)-1]),
+				errSimulatedExit)
+		}
+		name, err := argAt(args, 2)
+		if err != nil {
+			return "", err
+		}
+		if args[1] == "-c" {
+			drive.Snapshots = append(drive.Snapshots, name)
+			return "", nil
+		}
+		for i, other := range drive.Snapshots {
+			if other == name {
+				if args[1] == "-d" {
+					drive.Snapshots = append(drive.Snapshots[:i], drive.Snapshots[i+1:]...)
+				}
+				return "", nil
+			}
+		}
+		return "", newDriverError("qemu-img", fmt.Sprintf(
+			"qemu-img: Could not find snapshot '%s'", name), errSimulatedExit)
+	}
+
+	return "", newDriverError("qemu-img",
+		fmt.Sprintf("qemu-img: Invalid snapshot option: %s", args[1]), errSimulatedExit)
+}
+
+// qemuImgInfo simulates qemu-img info --output=json <image>.
+func (d *DriverSimulator) qemuImgInfo(args []string) (string, error) {
+	if len(args) != 2 || args[0] != "--output=json" {
+		return "", newDriverError("qemu-img",
+			fmt.Sprintf("qemu-img: Invalid info arguments: %s", strings.Join(args, " ")), errSimulatedExit)
+	}
+
+	var virtualSize, size int64
+	var snapshots []string
+	if image, ok := d.images[args[1]]; ok {
+		size = image.Size
+	} else {
+		_, drive, err := d.findImage(args[1])
+		if err != nil {
+			return "", err
+		}
+		virtualSize, size = simulatedImageSizes(drive)
+		for i, name := range drive.Snapshots {
+			snapshots = append(snapshots, fmt.Sprintf(`{"id": "%d", "name": %q}`, i+1, name))
+		}
+	}
+	// qemu-img only lists the snapshots of images which have some
+	var list string
+	if len(snapshots) > 0 {
+		list = fmt.Sprintf(`, "snapshots": [%s]`, strings.Join(snapshots, ", "))
+	}
+	return fmt.Sprintf(`{"filename": %q, "format": "qcow2", "virtual-size": %d, "actual-size": %d%s}`,
+		args[1], virtualSize, size, list), nil
+}
+
+// qemuImgConvert simulates qemu-img convert -O qcow2 [-c] <image> <output>.
+func (d *DriverSimulator) qemuImgConvert(args []string) (string, error) {
+	if len(args) < 4 || args[0] != "-O" || args[1] != "qcow2" {
+		return "", newDriverError("qemu-img",
+			fmt.Sprintf("qemu-img: Invalid convert arguments: %s", strings.Join(args, " ")), errSimulatedExit)
+	}
+	compressed := args[len(args)-3] == "-c"
+
+	source, output := args[len(args)-2], args[len(args)-1]
+	vm, drive, err := d.findImage(source)
+	if err != nil {
+		return "", err
+	}
+	if vm.Status != "stopped" {
+		return "", newDriverError("qemu-img", fmt.Sprintf(
+			"qemu-img: Could not open '%s': Failed to get shared \"write\" lock", source),
+			errSimulatedExit)
+	}
+
+	_, size := simulatedImageSizes(drive)
+	image := simulatedImage{Size: size / 2, Compressed: compressed}
+	if compressed {
+		image.Size = size / 4
+	}
+	if d.images == nil {
+		d.images = make(map[string]simulatedImage)
+	}
+	d.images[output] = image
+	return "", nil
+}
+
+// simulatedImageSizes returns the virtual size of the disk and the size of
+// its image file, in bytes.
+func simulatedImageSizes(drive *SimulatedDrive) (int64, int64) {
+	virtualSize := int64(drive.Size) * 1024 * 1024
+	if drive.ImageSize != 0 {
+		return virtualSize, drive.ImageSize
+	}
+	return virtualSize, virtualSize
+}
+
+// MoveFile only supports moving an image written by qemu-img convert over
+// the image of a drive, which drops the snapshots of the drive.
+func (d *DriverSimulator) MoveFile(ctx context.Context, src string, dst string) error {
+	d.Lock()
+	defer d.Unlock()
+
+	d.Calls = append(d.Calls, []string{"mv", "-f", src, dst})
+	if err := d.Errors["mv"]; err != nil {
+		return err
+	}
+	image, ok := d.images[src]
+	if !ok {
+		return newDriverError("mv", fmt.Sprintf("mv: %s: No such file or directory", src), errSimulatedExit)
+	}
+	_, drive, err := d.findImage(dst)
+	if err != nil {
+		return fmt.Errorf("simulator: %s is not the image of a drive", dst)
+	}
+
+	delete(d.images, src)
+	drive.ImageSize = image.Size
+	drive.Compressed = image.Compressed
+	drive.Snapshots = nil
+	return nil
+}
+
+func (d *DriverSimulator) RemoveFile(ctx context.Context, path string) error {
+	d.Lock()
+	defer d.Unlock()
+
+	d.Calls = append(d.Calls, []string{"rm", "-f", path})
+	if err := d.Errors["rm"]; err != nil {
+		return err
+	}
+	delete(d.images, path)
+	return nil
+}
+
+func (d *DriverSimulator) Stop(ctx context.Context, name string) error {
+	_, err := d.Utmctl(ctx, "stop", name)
+	return err
+}
+
+func (d *DriverSimulator) Tunnel(ctx context.Context, addr string) (io.Closer, error) {
+	return nopCloser{}, nil
+}
+
+func (d *DriverSimulator) Upload(ctx context.Context, path string) (string, error) {
+	return path, nil
+}
+
+func (d *DriverSimulator) Utmctl(ctx context.Context, args ...string) (string, error) {
+	if len(args) == 0 {
+		return "", newDriverError("utmctl", "Error: Missing expected argument '<subcommand>'", errSimulatedExit)
+	}
+	if err := ctx.Err(); err != nil {
+		return "", fmt.Errorf("utmctl interrupted: %w", err)
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	d.Calls = append(d.Calls, append([]string{"utmctl"}, args...))
+	if err := d.Errors[args[0]]; err != nil {
+		return "", err
+	}
+
+	if args[0] == "list" {
+		lines := []string{"UUID                                 Status   Name"}
+		for _, vm := range d.vms {
+			lines = append(lines, fmt.Sprintf("%-36s %-8s %s", vm.ID, vm.Status, vm.Name))
+		}
+		return strings.Join(lines, "\n"), nil
+	}
+
+	// The VM is the last argument, after any flags like --force
+	vm, err := d.findUtmctl(args[len(args)-1])
+	if err != nil {
+		return "", err
+	}
+
+	switch args[0] {
+	case "start":
+		vm.Status = "started"
+	case "stop":
+		vm.Status = "stopped"
+	case "status":
+		return vm.Status, nil
+	case "ip-address":
+		if vm.Status != "started" || len(vm.IPAddresses) == 0 {
+			return "", newDriverError("utmctl", "Error: Operation not available.", errSimulatedExit)
+		}
+		return strings.Join(vm.IPAddresses, "\n"), nil
+	case "clone":
+		clone := vm.clone()
+		clone.ID = newSimulatedID()
+		clone.Name = flagValues(args[1:])["--name"]
+		if clone.Name == "" {
+			clone.Name = vm.Name + " (clone)"
+		}
+		clone.Status = "stopped"
+		for i := range clone.Drives {
+			clone.Drives[i].ID = newSimulatedID()
+		}
+		d.vms = append(d.vms, &clone)
+	case "delete":
+		for i, other := range d.vms {
+			if other == vm {
+				d.vms = append(d.vms[:i], d.vms[i+1:]...)
+				break
+			}
+		}
+	default:
+		return "", newDriverError("utmctl",
+			fmt.Sprintf("Error: Unknown subcommand '%s'", args[0]), errSimulatedExit)
+	}
+
+	return "", nil
+}
+
+func (d *DriverSimulator) Verify(ctx context.Context) error {
+	return nil
+}
+
+func (d *DriverSimulator) Version(ctx context.Context) (string, error) {
+	if d.UTMVersion == "" {
+		return "4.6.4", nil
+	}
+	return d.UTMVersion, nil
+}
+
+// find returns the VM with the given ID or name, failing like osascript.
+func (d *DriverSimulator) find(identifier string) (*SimulatedVM, error) {
+	for _, vm := range d.vms {
+		if strings.EqualFold(vm.ID, identifier) || vm.Name == identifier {
+			return vm, nil
+		}
+	}
+	return nil, newDriverError("osascript", fmt.Sprintf(
+		`execution error: UTM got an error: Can’t get virtual machine id "%s". (-1728)`, identifier),
+		errSimulatedExit)
+}
+
+// findImage returns the VM and disk of an image path returned by
+// DiskImages, failing like qemu-img.
+func (d *DriverSimulator) findImage(imagePath string) (*SimulatedVM, *SimulatedDrive, error) {
+	for _, vm := range d.vms {
+		for i := range vm.Drives {
+			if !vm.Drives[i].Removable && simulatedImagePath(vm, vm.Drives[i]) == imagePath {
+				return vm, &vm.Drives[i], nil
+			}
+		}
+	}
+	return nil, nil, newDriverError("qemu-img", fmt.Sprintf(
+		"qemu-img: Could not open '%s': No such file or directory", imagePath), errSimulatedExit)
+}
+
+// findUtmctl returns the VM with the given ID or name, failing like utmctl.
+func (d *DriverSimulator) findUtmctl(identifier string) (*SimulatedVM, error) {
+	vm, err := d.find(identifier)
+	if err != nil {
+		return nil, newDriverError("utmctl", "Error: Virtual machine not found.", errSimulatedExit)
+	}
+	return vm, nil
+}
+
+// configurable returns the VM for a script that updates its configuration,
+// which UTM only allows while the VM is stopped.
+func (d *DriverSimulator) configurable(args []string) (*SimulatedVM, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("simulator: missing VM id")
+	}
+	vm, err := d.find(args[0])
+	if err != nil {
+		return nil, err
+	}
+	if vm.Status != "stopped" {
+		return nil, newDriverError("osascript",
+			"execution error: UTM got an error: The virtual machine must be stopped before this operation can be performed. (-2700)",
+			errSimulatedExit)
+	}
+	return vm, nil
+}
+
+// argAt returns the argument at index i like "item i+1 of argv" does.
+func argAt(args []string, i int) (string, error) {
+	if i >= len(args) {
+		return "", fmt.Errorf("simulator: missing argument %d in %q", i+1, args)
+	}
+	return args[i], nil
+}
+
+// flagValues returns the values of --flag arguments.
+func flagValues(args []string) map[string]string {
+	values := make(map[string]string)
+	for i := 0; i+1 < len(args); i++ {
+		if strings.HasPrefix(args[i], "--") {
+			values[args[i]] = args[i+1]
+		}
+	}
+	return values
+}
+
+// argsAfter returns the arguments after the given flag.
+func argsAfter(args []string, flag string) []string {
+	for i, arg := range args {
+		if arg == flag {
+			return args[i+1:]
+		}
+	}
+	return nil
+}
+
+func (d *DriverSimulator) createVM(args []string) (ScriptResult, error) {
+	flags := flagValues(args)
+
+	vm := &SimulatedVM{
+		ID:           newSimulatedID(),
+		Name:         flags["--name"],
+		Backend:      flags["--backend"],
+		Architecture: flags["--arch"],
+		Icon:         flags["--icon"],
+		MemorySize:   512,
+		Status:       "stopped",
+	}
+	// UTM creates new QEMU VMs with a shared network and a display. The
+	// default drives are removed by the script.
+	if vm.Backend != "ApPl" {
+		vm.NetworkInterfaces = []SimulatedNetworkInterface{newSimulatedNetworkInterface("ShRd")}
+		vm.Displays = []SimulatedDisplay{{ID: newSimulatedID(), Hardware: "virtio-ramfb"}}
+	}
+	d.vms = append(d.vms, vm)
+
+	return ScriptResult{VMID: vm.ID}, nil
+}
+
+func (d *DriverSimulator) customizeVM(args []string) (ScriptResult, error) {
+	vm, err := d.configurable(args)
+	if err != nil {
+		return ScriptResult{}, err
+	}
+
+	flags := flagValues(args[1:])
+	if name := flags["--name"]; name != "" {
+		vm.Name = name
+	}
+	if cpus, ok := flags["--cpus"]; ok {
+		if vm.CPUCount, err = strconv.Atoi(cpus); err != nil {
+			return ScriptResult{}, fmt.Errorf("simulator: invalid --cpus %q", cpus)
+		}
+	}
+	if memory, ok := flags["--memory"]; ok && memory != "0" {
+		if vm.MemorySize, err = strconv.Atoi(memory); err != nil {
+			return ScriptResult{}, fmt.Errorf("simulator: invalid --memory %q", memory)
+		}
+	}
+	if notes := flags["--notes"]; notes != "" {
+		vm.Notes = notes
+	}
+	if hypervisor, ok := flags["--use-hypervisor"]; ok {
+		vm.Hypervisor = hypervisor == "true"
+	}
+	if uefi, ok := flags["--uefi-boot"]; ok {
+		vm.UEFIBoot = uefi == "true"
+	}
+	if mode, ok := flags["--directory-share-mode"]; ok {
+		vm.DirectoryShareMode = mode
+	}
+
+	return ScriptResult{}, nil
+}
+
+func (d *DriverSimulator) addDrive(args []string) (ScriptResult, error) {
+	vm, err := d.configurable(args)
+	if err != nil {
+		return ScriptResult{}, err
+	}
+	driveInterface, err := argAt(args, 2)
+	if err != nil {
+		return ScriptResult{}, err
+	}
+	sizeArg, err := argAt(args, 4)
+	if err != nil {
+		return ScriptResult{}, err
+	}
+	size, err := strconv.Atoi(sizeArg)
+	if err != nil {
+		return ScriptResult{}, fmt.Errorf("simulator: invalid size %q", sizeArg)
+	}
+
+	drive := SimulatedDrive{
+		ID:        newSimulatedID(),
+		Interface: driveInterface,
+		Size:      size,
+		Raw:       flagValues(args[5:])["--raw"] == "true",
+	}
+	vm.Drives = append(vm.Drives, drive)
+	return ScriptResult{DriveID: drive.ID}, nil
+}
+
+func (d *DriverSimulator) attachISO(args []string) (ScriptResult, error) {
+	vm, err := d.configurable(args)
+	if err != nil {
+		return ScriptResult{}, err
+	}
+	isoInterface, err := argAt(args, 2)
+	if err != nil {
+		return ScriptResult{}, err
+	}
+	source, err := argAt(args, 4)
+	if err != nil {
+		return ScriptResult{}, err
+	}
+
+	drive := SimulatedDrive{
+		ID:        newSimulatedID(),
+		Interface: isoInterface,
+		Source:    source,
+		Removable: flagValues(args[5:])["--removable"] != "false",
+	}
+	vm.Drives = append(vm.Drives, drive)
+	return ScriptResult{DriveID: drive.ID}, nil
+}
+
+func (d *DriverSimulator) removeDrive(args []string) (ScriptResult, error) {
+	vm, err := d.configurable(args)
+	if err != nil {
+		return ScriptResult{}, err
+	}
+	driveId, err := argAt(args, 1)
+	if err != nil {
+		return ScriptResult{}, err
+	}
+
+	var result ScriptResult
+	drives := vm.Drives[:0]
+	for _, drive := range vm.Drives {
+		if drive.ID != driveId {
+			drives = append(drives, drive)
+		}
+	}
+	if len(drives) == len(vm.Drives) {
+		result.Warnings = append(result.Warnings, "no drive with id "+driveId)
+	}
+	vm.Drives = drives
+	return result, nil
+}
+
+func (d *DriverSimulator) setDriveReadOnly(args []string) (ScriptResult, error) {
+	if !d.HasFeature(FeatureReadOnlyDrives) {
+		// The script doesn't compile without the read only property
+		return ScriptResult{}, errSimulatedExit
+	}
+	vm, err := d.configurable(args)
+	if err != nil {
+		return ScriptResult{}, err
+	}
+	driveId, err := argAt(args, 1)
+	if err != nil {
+		return ScriptResult{}, err
+	}
+
+	for i := range vm.Drives {
+		if vm.Drives[i].ID == driveId {
+			vm.Drives[i].ReadOnly = true
+			return ScriptResult{}, nil
+		}
+	}
+	return ScriptResult{Warnings: []string{"no drive with id " + driveId}}, nil
+}
+
+func (d *DriverSimulator) setSharedDirectory(args []string) (ScriptResult, error) {
+	if !d.HasFeature(FeatureSharedDirectories) {
+		// The script doesn't compile without the update registry command
+		return ScriptResult{}, errSimulatedExit
+	}
+	vm, err := d.configurable(args)
+	if err != nil {
+		return ScriptResult{}, err
+	}
+	vm.SharedDirectories = append([]string(nil), args[1:]...)
+	return ScriptResult{}, nil
+}
+
+func (d *DriverSimulator) getSharedDirectory(args []string) (ScriptResult, error) {
+	if !d.HasFeature(FeatureSharedDirectories) {
+		// The script doesn't compile without the registry property
+		return ScriptResult{}, errSimulatedExit
+	}
+	vmId, err := argAt(args, 0)
+	if err != nil {
+		return ScriptResult{}, err
+	}
+	vm, err := d.find(vmId)
+	if err != nil {
+		return ScriptResult{}, err
+	}
+	result := ScriptResult{SharedDirectories: append([]string(nil), vm.SharedDirectories...)}
+	if vm.Backend != "ApPl" {
+		// UTM doesn't share directories by default
+		result.DirectoryShareMode = vm.DirectoryShareMode
+		if result.DirectoryShareMode == "" {
+			result.DirectoryShareMode = DirectoryShareModeEnumMap["none"]
+		}
+	}
+	return result, nil
+}
+
+func (d *DriverSimulator) removeFirstDrive(args []string) (ScriptResult, error) {
+	vm, err := d.configurable(args)
+	if err != nil {
+		return ScriptResult{}, err
+	}
+	if len(vm.Drives) == 0 {
+		return ScriptResult{Warnings: []string{"the virtual machine has no drives"}}, nil
+	}
+	vm.Drives = vm.Drives[1:]
+	return ScriptResult{}, nil
+}
+
+func (d *DriverSimulator) addNetworkInterface(args []string) (ScriptResult, error) {
+	vm, err := d.configurable(args)
+	if err != nil {
+		return ScriptResult{}, err
+	}
+	mode, err := argAt(args, 1)
+	if err != nil {
+		return ScriptResult{}, err
+	}
+
+	if _, ok := simulatedNetworkModeNames[mode]; !ok {
+		return ScriptResult{}, newDriverError("osascript", fmt.Sprintf(
+			"execution error: UTM got an error: Can’t make \"%s\" into type constant. (-1700)", mode),
+			errSimulatedExit)
+	}
+
+	netIf := newSimulatedNetworkInterface(mode)
+	flags := flagValues(args[2:])
+	if hardware := flags["--hardware"]; hardware != "" {
+		netIf.Hardware = hardware
+	}
+	if address := flags["--address"]; address != "" {
+		netIf.MacAddress = address
+	}
+	netIf.HostInterface = flags["--host-interface"]
+	vm.NetworkInterfaces = append(vm.NetworkInterfaces, netIf)
+	index := len(vm.NetworkInterfaces) - 1
+	return ScriptResult{InterfaceIndex: &index}, nil
+}
+
+func (d *DriverSimulator) clearNetworkInterfaces(args []string) (ScriptResult, error) {
+	vm, err := d.configurable(args)
+	if err != nil {
+		return ScriptResult{}, err
+	}
+	vm.NetworkInterfaces = nil
+	return ScriptResult{}, nil
+}
+
+func (d *DriverSimulator) addPortForwards(args []string) (ScriptResult, error) {
+	vm, err := d.configurable(args)
+	if err != nil {
+		return ScriptResult{}, err
+	}
+
+	var result ScriptResult
+	// --index <index> "protocol,guestAddress,guestPort,hostAddress,hostPort" ...
+	for i := 1; i < len(args); i += 3 {
+		if i+2 >= len(args) {
+			return ScriptResult{}, fmt.Errorf("simulator: incomplete port forward in %q", args)
+		}
+		index, err := strconv.Atoi(args[i+1])
+		if err != nil {
+			return ScriptResult{}, fmt.Errorf("simulator: invalid index %q", args[i+1])
+		}
+		rule := strings.Split(args[i+2], ",")
+		if len(rule) != 5 {
+			return ScriptResult{}, fmt.Errorf("simulator: invalid port forward %q", args[i+2])
+		}
+		guestPort, err := strconv.Atoi(rule[2])
+		if err != nil {
+			return ScriptResult{}, fmt.Errorf("simulator: invalid guest port %q", rule[2])
+		}
+		hostPort, err := strconv.Atoi(rule[4])
+		if err != nil {
+			return ScriptResult{}, fmt.Errorf("simulator: invalid host port %q", rule[4])
+		}
+
+		// Rules for interfaces that don't exist are not added
+		if index < 0 || index >= len(vm.NetworkInterfaces) {
+			result.Warnings = append(result.Warnings, fmt.Sprintf(
+				"no network interface with index %d, port forward to guest port %d was not added", index, guestPort))
+			continue
+		}
+		netIf := &vm.NetworkInterfaces[index]
+		netIf.PortForwards = append(netIf.PortForwards, SimulatedPortForward{
+			Protocol:     rule[0],
+			GuestAddress: rule[1],
+			GuestPort:    guestPort,
+			HostAddress:  rule[3],
+			HostPort:     hostPort,
+		})
+	}
+	return result, nil
+}
+
+func (d *DriverSimulator) clearPortForwards(args []string) (ScriptResult, error) {
+	vm, err := d.configurable(args)
+	if err != nil {
+		return ScriptResult{}, err
+	}
+
+	var result ScriptResult
+	// --index <index> <hostPort> ...
+	for i := 1; i < len(args); i += 3 {
+		if i+2 >= len(args) {
+			return ScriptResult{}, fmt.Errorf("simulator: incomplete port in %q", args)
+		}
+		index, err := strconv.Atoi(args[i+1])
+		if err != nil {
+			return ScriptResult{}, fmt.Errorf("simulator: invalid index %q", args[i+1])
+		}
+		hostPort, err := strconv.Atoi(args[i+2])
+		if err != nil {
+			return ScriptResult{}, fmt.Errorf("simulator: invalid host port %q", args[i+2])
+		}
+		if index < 0 || index >= len(vm.NetworkInterfaces) {
+			continue
+		}
+
+		netIf := &vm.NetworkInterfaces[index]
+		forwards := netIf.PortForwards[:0]
+		for _, forward := range netIf.PortForwards {
+			if forward.HostPort != hostPort {
+				forwards = append(forwards, forward)
+			}
+		}
+		if len(forwards) == len(netIf.PortForwards) {
+			result.Warnings = append(result.Warnings, fmt.Sprintf(
+				"no port forward with host port %d on network interface %d", hostPort, index))
+		}
+		netIf.PortForwards = forwards
+	}
+	return result, nil
+}
+
+func (d *DriverSimulator) addQemuAdditionalArgs(args []string) (ScriptResult, error) {
+	vm, err := d.configurable(args)
+	if err != nil {
+		return ScriptResult{}, err
+	}
+	vm.QEMUAdditionalArguments = append(vm.QEMUAdditionalArguments, argsAfter(args, "--args")...)
+	return ScriptResult{}, nil
+}
+
+func (d *DriverSimulator) removeQemuAdditionalArgs(args []string) (ScriptResult, error) {
+	vm, err := d.configurable(args)
+	if err != nil {
+		return ScriptResult{}, err
+	}
+
+	remove := make(map[string]bool)
+	for _, arg := range argsAfter(args, "--args") {
+		remove[arg] = true
+	}
+	var kept []string
+	for _, arg := range vm.QEMUAdditionalArguments {
+		if !remove[arg] {
+			kept = append(kept, arg)
+		}
+	}
+	vm.QEMUAdditionalArguments = kept
+	return ScriptResult{}, nil
+}
+
+func (d *DriverSimulator) addQemuDisplay(args []string) (ScriptResult, error) {
+	vm, err := d.configurable(args)
+	if err != nil {
+		return ScriptResult{}, err
+	}
+	hardware, err := argAt(args, 2)
+	if err != nil {
+		return ScriptResult{}, err
+	}
+
+	display := SimulatedDisplay{ID: newSimulatedID(), Hardware: hardware}
+	vm.Displays = append(vm.Displays, display)
+	return ScriptResult{DisplayID: display.ID}, nil
+}
+
+func (d *DriverSimulator) removeQemuDisplay(args []string) (ScriptResult, error) {
+	vm, err := d.configurable(args)
+	if err != nil {
+		return ScriptResult{}, err
+	}
+	displayId, err := argAt(args, 1)
+	if err != nil {
+		return ScriptResult{}, err
+	}
+
+	displays := vm.Displays[:0]
+	for _, display := range vm.Displays {
+		if display.ID != displayId {
+			displays = append(displays, display)
+		}
+	}
+	vm.Displays = displays
+	return ScriptResult{}, nil
+}
+
+func (d *DriverSimulator) removeQemuDisplayByName(args []string) (ScriptResult, error) {
+	vm, err := d.configurable(args)
+	if err != nil {
+		return ScriptResult{}, err
+	}
+	hardware, err := argAt(args, 2)
+	if err != nil {
+		return ScriptResult{}, err
+	}
+
+	displays := vm.Displays[:0]
+	for _, display := range vm.Displays {
+		if display.Hardware != hardware {
+			displays = append(displays, display)
+		}
+	}
+	vm.Displays = displays
+	return ScriptResult{}, nil
+}
+
+func (d *DriverSimulator) importVM(args []string) (ScriptResult, error) {
+	path, err := argAt(args, 0)
+	if err != nil {
+		return ScriptResult{}, err
+	}
+
+	vm, err := importSimulatedVM(path)
+	if err != nil {
+		return ScriptResult{}, newDriverError("osascript",
+			fmt.Sprintf("execution error: UTM got an error: %s (-2700)", err), errSimulatedExit)
+	}
+	// UTM gives the imported VM a new id if the bundle's id is taken
+	if _, err := d.find(vm.ID); err == nil || vm.ID == "" {
+		vm.ID = newSimulatedID()
+	}
+	d.vms = append(d.vms, vm)
+	return ScriptResult{VMID: vm.ID}, nil
+}
+
+func (d *DriverSimulator) exportVM(args []string) (ScriptResult, error) {
+	vmId, err := argAt(args, 0)
+	if err != nil {
+		return ScriptResult{}, err
+	}
+	path, err := argAt(args, 1)
+	if err != nil {
+		return ScriptResult{}, err
+	}
+
+	vm, err := d.find(vmId)
+	if err != nil {
+		return ScriptResult{}, err
+	}
+	return ScriptResult{}, exportSimulatedVM(vm, path)
+}
+
+func newSimulatedID() string {
+	return strings.ToUpper(uuid.NewString())
+}
+
+func newSimulatedNetworkInterface(mode string) SimulatedNetworkInterface {
+	id := uuid.New()
+	return SimulatedNetworkInterface{
+		Mode:     mode,
+		Hardware: "virtio-net-pci",
+		// Locally administered unicast address, like UTM generates
+		MacAddress: fmt.Sprintf("%02X:%02X:%02X:%02X:%02X:%02X",
+			id[0]&0xfe|0x02, id[1], id[2], id[3], id[4], id[5]),
+	}
+}
+
+// Names used in config.plist for the enum values passed to the scripts.
+var (
+	simulatedBackendNames = map[string]string{
+		"QeMu": bundle.BackendQEMU,
+		"ApPl": bundle.BackendApple,
+	}
+	simulatedInterfaceNames = map[string]string{
+		"QdIi": "IDE",
+		"QdIs": "SCSI",
+		"QdId": "SD",
+		"QdIm": "MTD",
+		"QdIf": "Floppy",
+		"QdIp": "PFlash",
+		"QdIv": "VirtIO",
+		"QdIe": "NVMe",
+		"QdIu": "USB",
+		"QdIn": "None",
+	}
+	simulatedNetworkModeNames = map[string]string{
+		"ShRd": "Shared",
+		"EmUd": "Emulated",
+		"BrDg": "Bridged",
+		"HsOn": "Host",
+	}
+	simulatedProtocolNames = map[string]string{
+		"TcPp": "TCP",
+		"UdPp": "UDP",
+	}
+)
+
+func lookupName(names map[string]string, value string) string {
+	if name, ok := names[value]; ok {
+		return name
+	}
+	return value
+}
+
+func lookupValue(names map[string]string, name string) string {
+	for value, n := range names {
+		if n == name {
+			return value
+		}
+	}
+	return name
+}
+
+// exportSimulatedVM writes a VM as a .utm bundle, with empty files as the
+// disk images.
+func exportSimulatedVM(vm *SimulatedVM, path string) error {
+	config := &bundle.Config{
+		Backend:              lookupName(simulatedBackendNames, vm.Backend),
+		ConfigurationVersion: 4,
+		Information: bundle.Information{
+			Name:  vm.Name,
+			UUID:  vm.ID,
+			Icon:  vm.Icon,
+			Notes: vm.Notes,
+		},
+		System: bundle.System{
+			Architecture: vm.Architecture,
+			CPUCount:     vm.CPUCount,
+			MemorySize:   vm.MemorySize,
+		},
+		QEMU: bundle.QEMU{
+			AdditionalArguments: vm.QEMUAdditionalArguments,
+			Hypervisor:          vm.Hypervisor,
+			UEFIBoot:            vm.UEFIBoot,
+		},
+		Sharing: bundle.Sharing{
+			DirectoryShareMode: vm.DirectoryShareMode,
+		},
+	}
+
+	var images []string
+	for _, drive := range vm.Drives {
+		d := bundle.Drive{
+			Identifier: drive.ID,
+			Interface:  lookupName(simulatedInterfaceNames, drive.Interface),
+			ImageType:  "Disk",
+			ReadOnly:   drive.Removable || drive.ReadOnly,
+		}
+		if drive.Removable {
+			// Removable drives only reference their image
+			d.ImageType = "CD"
+		} else {
+			d.ImageName = simulatedImageName(drive)
+			images = append(images, d.ImageName)
+		}
+		config.Drives = append(config.Drives, d)
+	}
+	for _, netIf := range vm.NetworkInterfaces {
+		n := bundle.Network{
+			Mode:            lookupName(simulatedNetworkModeNames, netIf.Mode),
+			Hardware:        netIf.Hardware,
+			MacAddress:      netIf.MacAddress,
+			BridgeInterface: netIf.HostInterface,
+		}
+		for _, forward := range netIf.PortForwards {
+			n.PortForwards = append(n.PortForwards, bundle.PortForward{
+				Protocol:     lookupName(simulatedProtocolNames, forward.Protocol),
+				GuestAddress: forward.GuestAddress,
+				GuestPort:    forward.GuestPort,
+				HostAddress:  forward.HostAddress,
+				HostPort:     forward.HostPort,
+			})
+		}
+		config.Networks = append(config.Networks, n)
+	}
+	for _, display := range vm.Displays {
+		config.Displays = append(config.Displays, bundle.Display{Hardware: display.Hardware})
+	}
+
+	b, err := bundle.Create(path, config)
+	if err != nil {
+		return newDriverError("osascript",
+			fmt.Sprintf("execution error: UTM got an error: %s (-2700)", err), errSimulatedExit)
+	}
+	for _, image := range images {
+		if err := b.AddDataFile(image, strings.NewReader("")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importSimulatedVM reads a VM from a .utm bundle.
+func importSimulatedVM(path string) (*SimulatedVM, error) {
+	if _, err := os.Stat(filepath.Join(path, bundle.ConfigFile)); err != nil {
+		return nil, fmt.Errorf("%s is not a UTM virtual machine", path)
+	}
+	b, err := bundle.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	c := b.Config
+
+	vm := &SimulatedVM{
+		ID:                      c.Information.UUID,
+		Name:                    c.Information.Name,
+		Backend:                 lookupValue(simulatedBackendNames, c.Backend),
+		Architecture:            c.System.Architecture,
+		Icon:                    c.Information.Icon,
+		Notes:                   c.Information.Notes,
+		CPUCount:                c.System.CPUCount,
+		MemorySize:              c.System.MemorySize,
+		Hypervisor:              c.QEMU.Hypervisor,
+		UEFIBoot:                c.QEMU.UEFIBoot,
+		DirectoryShareMode:      c.Sharing.DirectoryShareMode,
+		QEMUAdditionalArguments: c.QEMU.AdditionalArguments,
+		Status:                  "stopped",
+	}
+	for _, drive := range c.Drives {
+		vm.Drives = append(vm.Drives, SimulatedDrive{
+			ID:        drive.Identifier,
+			Interface: lookupValue(simulatedInterfaceNames, drive.Interface),
+			Removable: drive.ImageType == "CD",
+			Raw:       strings.HasSuffix(drive.ImageName, ".img"),
+			ReadOnly:  drive.ImageType != "CD" && drive.ReadOnly,
+		})
+	}
+	for _, network := range c.Networks {
+		netIf := SimulatedNetworkInterface{
+			Mode:          lookupValue(simulatedNetworkModeNames, network.Mode),
+			Hardware:      network.Hardware,
+			MacAddress:    network.MacAddress,
+			HostInterface: network.BridgeInterface,
+		}
+		for _, forward := range network.PortForwards {
+			netIf.PortForwards = append(netIf.PortForwards, SimulatedPortForward{
+				Protocol:     lookupValue(simulatedProtocolNames, forward.Protocol),
+				GuestAddress: forward.GuestAddress,
+				GuestPort:    forward.GuestPort,
+				HostAddress:  forward.HostAddress,
+				HostPort:     forward.HostPort,
+			})
+		}
+		vm.NetworkInterfaces = append(vm.NetworkInterfaces, netIf)
+	}
+	for _, display := range c.Displays {
+		vm.Displays = append(vm.Displays, SimulatedDisplay{ID: newSimulatedID(), Hardware: display.Hardware})
+	}
+
+	return vm, nil
+}
@@ -0,0 +1,334 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/packer-plugin-sdk/communicator"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/naveenrajm7/packer-plugin-utm/builder/utm/bundle"
+)
+
+func TestDriverSimulator_impl(t *testing.T) {
+	var _ Driver = new(DriverSimulator)
+}
+
+func TestDriverSimulator_allScripts(t *testing.T) {
+	entries, err := osascripts.ReadDir("scripts")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if _, ok := simulatedScripts[entry.Name()]; !ok {
+			t.Fatalf("%s is not simulated", entry.Name())
+		}
+	}
+}
+
+func TestDriverSimulator_scripts(t *testing.T) {
+	ctx := context.Background()
+	driver := new(DriverSimulator)
+
+	created, err := driver.ExecuteOsaScript(ctx, "create_vm.applescript",
+		"--name", "test", "--backend", "QeMu", "--arch", "aarch64", "--icon", "linux")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	vmId := created.VMID
+	if !regexp.MustCompile(`^[0-9A-F-]{36}$`).MatchString(vmId) {
+		t.Fatalf("bad VM id: %s", vmId)
+	}
+
+	disk, err := driver.ExecuteOsaScript(ctx, "add_drive.applescript", vmId, "--interface", "QdIv", "--size", "10240")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	iso, err := driver.ExecuteOsaScript(ctx, "attach_iso.applescript", vmId,
+		"--interface", "QdIu", "--source", "/tmp/boot.iso")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	diskId, isoId := disk.DriveID, iso.DriveID
+	if diskId == isoId || len(isoId) != 36 {
+		t.Fatalf("bad drive ids: %s %s", diskId, isoId)
+	}
+
+	for _, command := range [][]string{
+		{"customize_vm.applescript", vmId, "--cpus", "4", "--memory", "4096", "--uefi-boot", "true"},
+		{"clear_network_interfaces.applescript", vmId},
+		{"add_network_interface.applescript", vmId, "ShRd"},
+		{"add_network_interface.applescript", vmId, "EmUd"},
+		{"add_port_forwards.applescript", vmId, "--index", "1", "TcPp,,22,127.0.0.1,2222", "--index", "1", "UdPp,,53,,5353"},
+		{"clear_port_forwards.applescript", vmId, "--index", "1", "5353"},
+		{"add_qemu_additional_args.applescript", vmId, "--args", "-vnc 127.0.0.1:1", "-s"},
+		{"remove_qemu_additional_args.applescript", vmId, "--args", "-s"},
+		{"remove_drive.applescript", vmId, isoId},
+	} {
+		result, err := driver.ExecuteOsaScript(ctx, command...)
+		if err != nil {
+			t.Fatalf("%s: %s", command[0], err)
+		}
+		if len(result.Warnings) > 0 {
+			t.Fatalf("%s: bad warnings: %#v", command[0], result.Warnings)
+		}
+		if command[0] == "add_network_interface.applescript" &&
+			(result.InterfaceIndex == nil || *result.InterfaceIndex != len(driver.VM(vmId).NetworkInterfaces)-1) {
+			t.Fatalf("bad interface index: %#v", result.InterfaceIndex)
+		}
+	}
+
+	// Things that can't be done are reported as warnings
+	result, err := driver.ExecuteOsaScript(ctx, "remove_drive.applescript", vmId, isoId)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(result.Warnings) != 1 {
+		t.Fatalf("bad: %#v", result)
+	}
+	result, err = driver.ExecuteOsaScript(ctx, "add_port_forwards.applescript", vmId, "--index", "5", "TcPp,,22,,2223")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(result.Warnings) != 1 {
+		t.Fatalf("bad: %#v", result)
+	}
+
+	vm := driver.VM(vmId)
+	if vm.Name != "test" || vm.CPUCount != 4 || vm.MemorySize != 4096 || !vm.UEFIBoot {
+		t.Fatalf("bad: %#v", vm)
+	}
+	if len(vm.Drives) != 1 || vm.Drives[0].ID != diskId || vm.Drives[0].Size != 10240 {
+		t.Fatalf("bad drives: %#v", vm.Drives)
+	}
+	if len(vm.NetworkInterfaces) != 2 || vm.NetworkInterfaces[1].Mode != "EmUd" {
+		t.Fatalf("bad network interfaces: %#v", vm.NetworkInterfaces)
+	}
+	forwards := vm.NetworkInterfaces[1].PortForwards
+	if len(forwards) != 1 || forwards[0] != (SimulatedPortForward{"TcPp", "", 22, "127.0.0.1", 2222}) {
+		t.Fatalf("bad port forwards: %#v", forwards)
+	}
+	if len(vm.QEMUAdditionalArguments) != 1 || vm.QEMUAdditionalArguments[0] != "-vnc 127.0.0.1:1" {
+		t.Fatalf("bad QEMU arguments: %#v", vm.QEMUAdditionalArguments)
+	}
+
+	// Copies are returned
+	vm.Drives[0].Size = 1
+	if driver.VM(vmId).Drives[0].Size != 10240 {
+		t.Fatal("VM should return a copy")
+	}
+}
+
+func TestDriverSimulator_errors(t *testing.T) {
+	ctx := context.Background()
+	driver := new(DriverSimulator)
+
+	if _, err := driver.ExecuteOsaScript(ctx, "remove_first_drive.applescript", "missing"); !errors.Is(err, ErrVMNotFound) {
+		t.Fatalf("bad: %v", err)
+	}
+	if _, err := driver.IsRunning(ctx, "missing"); !errors.Is(err, ErrVMNotFound) {
+		t.Fatalf("bad: %v", err)
+	}
+
+	vmId := driver.AddVM(SimulatedVM{Name: "test"})
+	if _, err := driver.Utmctl(ctx, "start", vmId); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if running, _ := driver.IsRunning(ctx, "test"); !running {
+		t.Fatal("should be running")
+	}
+	if _, err := driver.ExecuteOsaScript(ctx, "add_network_interface.applescript", vmId, "ShRd"); err == nil {
+		t.Fatal("running VMs can not be configured")
+	}
+
+	driver.Errors = map[string]error{
+		"stop":                  &DriverError{Tool: "utmctl", Kind: ErrUTMBusy},
+		"import_vm.applescript": &DriverError{Tool: "osascript", Kind: ErrAutomationDenied},
+	}
+	if err := driver.Stop(ctx, vmId); !errors.Is(err, ErrUTMBusy) {
+		t.Fatalf("bad: %v", err)
+	}
+	if _, err := driver.Import(ctx, "/tmp/test.utm"); !errors.Is(err, ErrAutomationDenied) {
+		t.Fatalf("bad: %v", err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := driver.Utmctl(cancelled, "status", vmId); !errors.Is(err, context.Canceled) {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestDriverSimulator_exportImport(t *testing.T) {
+	ctx := context.Background()
+	driver := new(DriverSimulator)
+
+	vmId := driver.AddVM(SimulatedVM{
+		Name:    "test",
+		Backend: "QeMu",
+		Drives:  []SimulatedDrive{{ID: "DISK", Interface: "QdIv", Size: 1024}},
+		NetworkInterfaces: []SimulatedNetworkInterface{{
+			Mode:         "EmUd",
+			PortForwards: []SimulatedPortForward{{Protocol: "TcPp", GuestPort: 22, HostPort: 2222}},
+		}},
+	})
+
+	path := filepath.Join(t.TempDir(), "test.utm")
+	if err := driver.Export(ctx, vmId, path); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	b, err := bundle.Open(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if b.Config.Backend != bundle.BackendQEMU || b.Config.Drives[0].Interface != "VirtIO" {
+		t.Fatalf("bad: %#v", b.Config)
+	}
+	if _, err := os.Stat(b.DriveImagePath(b.Config.Drives[0])); err != nil {
+		t.Fatalf("disk image should be exported: %s", err)
+	}
+
+	importedId, err := driver.Import(ctx, path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if importedId == vmId {
+		t.Fatal("imported VM should get a new id")
+	}
+	imported := driver.VM(importedId)
+	if imported.NetworkInterfaces[0].Mode != "EmUd" || imported.NetworkInterfaces[0].PortForwards[0].HostPort != 2222 {
+		t.Fatalf("bad: %#v", imported)
+	}
+}
+
+func TestDriverSimulator_steps(t *testing.T) {
+	driver := new(DriverSimulator)
+	isoPath := filepath.Join(t.TempDir(), "boot.iso")
+	if err := os.WriteFile(isoPath, []byte("iso"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	outputDir := t.TempDir()
+
+	state := testState(t)
+	state.Put("driver", driver)
+	state.Put("iso_path", isoPath)
+	state.Put("communicator", new(packersdk.MockCommunicator))
+
+	steps := []multistep.Step{
+		&StepCreateVM{
+			VMName:         "packer",
+			VMBackend:      "QeMu",
+			VMArch:         "aarch64",
+			HWConfig:       HWConfig{CpuCount: 2, MemorySize: 2048},
+			KeepRegistered: true,
+		},
+		&StepAttachISOs{
+			AttachBootISO: true,
+			ISOInterface:  "usb",
+		},
+		&StepPortForwarding{
+			CommConfig: &communicator.Config{
+				Type: "ssh",
+				SSH:  communicator.SSH{SSHPort: 22},
+			},
+			HostPortMin:            2222,
+			HostPortMax:            4444,
+			ClearNetworkInterfaces: true,
+		},
+		new(StepRun),
+		&StepShutdown{Timeout: 5 * time.Second},
+		new(StepRemoveDevices),
+		&StepExport{
+			Format:    "utm",
+			OutputDir: outputDir,
+		},
+	}
+
+	// Check the VM after the last step, before the steps are cleaned up
+	var running *SimulatedVM
+	steps = append(steps, &testInspectStep{func(state multistep.StateBag) {
+		running = driver.VM(state.Get("vmId").(string))
+	}})
+
+	runner := &multistep.BasicRunner{Steps: steps}
+	runner.Run(context.Background(), state)
+	if rawErr, ok := state.GetOk("error"); ok {
+		t.Fatalf("err: %s", rawErr)
+	}
+
+	if running == nil {
+		t.Fatal("VM should be registered")
+	}
+	if running.Status != "stopped" || running.CPUCount != 2 || running.MemorySize != 2048 {
+		t.Fatalf("bad: %#v", running)
+	}
+	if len(running.Drives) != 0 {
+		t.Fatalf("boot ISO should be removed: %#v", running.Drives)
+	}
+	if len(running.NetworkInterfaces) != 2 || running.NetworkInterfaces[0].Mode != "ShRd" ||
+		running.NetworkInterfaces[1].Mode != "EmUd" {
+		t.Fatalf("bad network interfaces: %#v", running.NetworkInterfaces)
+	}
+	if len(running.NetworkInterfaces[1].PortForwards) != 0 {
+		t.Fatalf("communicator port forward should be removed: %#v", running.NetworkInterfaces[1].PortForwards)
+	}
+
+	exportPath := state.Get("exportPath").(string)
+	if exportPath != filepath.Join(outputDir, "packer.utm") {
+		t.Fatalf("bad: %s", exportPath)
+	}
+	b, err := bundle.Open(exportPath)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if b.Config.Information.Name != "packer" || len(b.Config.Networks) != 2 {
+		t.Fatalf("bad: %#v", b.Config)
+	}
+
+	// The VM is kept registered
+	if len(driver.VMs()) != 1 {
+		t.Fatalf("bad: %#v", driver.VMs())
+	}
+}
+
+func TestDriverSimulator_stepsHalted(t *testing.T) {
+	driver := new(DriverSimulator)
+	driver.Errors = map[string]error{"start": errors.New("boom")}
+
+	state := testState(t)
+	state.Put("driver", driver)
+
+	runner := &multistep.BasicRunner{Steps: []multistep.Step{
+		&StepCreateVM{VMName: "packer", VMBackend: "QeMu", VMArch: "aarch64", KeepRegistered: true},
+		new(StepRun),
+	}}
+	runner.Run(context.Background(), state)
+
+	if _, ok := state.GetOk("error"); !ok {
+		t.Fatal("should have error")
+	}
+	if len(driver.VMs()) != 0 {
+		t.Fatalf("failed builds should delete the VM: %#v", driver.VMs())
+	}
+}
+
+// testInspectStep calls a function with the state when it runs.
+type testInspectStep struct {
+	inspect func(multistep.StateBag)
+}
+
+func (s *testInspectStep) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	s.inspect(state)
+	return multistep.ActionContinue
+}
+
+func (s *testInspectStep) Cleanup(multistep.StateBag) {}
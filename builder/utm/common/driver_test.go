@@ -0,0 +1,199 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package common
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSelectDriverVersion(t *testing.T) {
+	cases := []struct {
+		Version  string
+		Expected string
+	}{
+		{"4.5.0", "4.5"},
+		{"4.5.4", "4.5"},
+		{"4.6.4", "4.6"},
+		// Newer releases are treated as the newest known one
+		{"4.7.1", "4.6"},
+		{"5.0.0", "4.6"},
+	}
+
+	for _, tc := range cases {
+		known, err := selectDriverVersion(tc.Version)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", tc.Version, err)
+		}
+		if known.Version != tc.Expected {
+			t.Fatalf("%s: expected driver %s, got %s", tc.Version, tc.Expected, known.Version)
+		}
+	}
+}
+
+func TestSelectDriverVersion_unsupported(t *testing.T) {
+	for _, v := range []string{"4.4.5", "3.7.4", "not-a-version"} {
+		if _, err := selectDriverVersion(v); err == nil {
+			t.Fatalf("%s: should have error", v)
+		}
+	}
+}
+
+func TestScriptingFeatures(t *testing.T) {
+	sdef := []byte(`<dictionary>
+  <suite name="UTM Suite" code="UTMs">
+    <command name="start" code="UTMsStar"/>
+    <command name="import" code="UTMsImpo"/>
+    <command name="update registry" code="UTMsUpRg"/>
+    <record-type name="qemu drive configuration" code="QdDc">
+      <property name="read only" code="RdOn" type="boolean"/>
+    </record-type>
+  </suite>
+</dictionary>`)
+
+	features := scriptingFeatures(sdef)
+	if !features[FeatureImport] {
+		t.Fatal("import should be detected")
+	}
+	if features[FeatureExport] {
+		t.Fatal("export should not be detected")
+	}
+	if !features[FeatureReadOnlyDrives] {
+		t.Fatal("read-only drives should be detected")
+	}
+	if !features[FeatureSharedDirectories] {
+		t.Fatal("shared directories should be detected")
+	}
+	if _, ok := features[FeatureGuestTools]; ok {
+		t.Fatal("guest tools can not be detected from the scripting definition")
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+
+	stdout, stderr, err := runCommand(context.Background(), time.Minute, strings.NewReader("in"),
+		"sh", "-c", "cat; echo ' out'; echo 'Error: Virtual machine not found.' >&2; exit 1")
+	if stdout != "in out" || stderr != "Error: Virtual machine not found." {
+		t.Fatalf("bad: %q %q", stdout, stderr)
+	}
+	if !errors.Is(err, ErrVMNotFound) {
+		t.Fatalf("bad: %s", err)
+	}
+}
+
+func TestRunCommand_cancel(t *testing.T) {
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip("sleep not available")
+	}
+
+	start := time.Now()
+	if _, _, err := runCommand(context.Background(), 100*time.Millisecond, nil, "sleep", "30"); err == nil ||
+		!strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("should time out: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	if _, _, err := runCommand(ctx, time.Minute, nil, "sleep", "30"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("should be cancelled: %v", err)
+	}
+
+	if time.Since(start) > 10*time.Second {
+		t.Fatal("the command should be killed")
+	}
+}
+
+func TestDecodeScriptResult(t *testing.T) {
+	result, err := decodeScriptResult("add_network_interface.applescript",
+		"{\"interface_index\":1,\"warnings\":[\"a \\\"b\\\"\"]}\n")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if result.InterfaceIndex == nil || *result.InterfaceIndex != 1 ||
+		len(result.Warnings) != 1 || result.Warnings[0] != `a "b"` {
+		t.Fatalf("bad: %#v", result)
+	}
+
+	result, err = decodeScriptResult("customize_vm.applescript", "{}")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if result.InterfaceIndex != nil || result.VMID != "" {
+		t.Fatalf("bad: %#v", result)
+	}
+
+	for _, output := range []string{
+		"",
+		"virtual machine id A1B2C3 of application \"UTM\"",
+		"{\"vm_id\":1}",
+		"{} {}",
+	} {
+		_, err := decodeScriptResult("create_vm.applescript", output)
+		if err == nil || !strings.Contains(err.Error(), "invalid output from create_vm.applescript") {
+			t.Fatalf("%q: bad: %v", output, err)
+		}
+	}
+}
+
+func TestScripts_returnJSON(t *testing.T) {
+	entries, err := osascripts.ReadDir("scripts")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		script, err := osascripts.ReadFile(path.Join("scripts", entry.Name()))
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if !strings.Contains(string(script), "return my jsonObject(") {
+			t.Fatalf("%s should return its result as JSON", entry.Name())
+		}
+		if strings.Contains(string(script), "do shell script") || strings.Contains(string(script), "run script") {
+			t.Fatalf("%s should only get data through its arguments", entry.Name())
+		}
+	}
+}
+
+func TestFindDiskImages(t *testing.T) {
+	open := func(name string) (io.ReadCloser, error) { return os.Open(name) }
+
+	images, err := findDiskImages("5c2e8b7a-9d41-4f3e-a6b0-1c2d3e4f5a6b", "../bundle/testdata", filepath.Glob, open)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expected := "../bundle/testdata/Linux.utm/Data/D1A3E2F4-5B6C-4D7E-8F90-A1B2C3D4E5F6.qcow2"
+	if len(images) != 1 || images[0] != expected {
+		t.Fatalf("the CD drive should be skipped: %#v", images)
+	}
+
+	if _, err := findDiskImages("6E1B0B4C-3C55-4A0C-9D8E-6F2B7A1C0D9E", "../bundle/testdata", filepath.Glob, open); err == nil {
+		t.Fatal("should error for an unknown VM")
+	}
+}
+
+func TestFindMacAddresses(t *testing.T) {
+	open := func(name string) (io.ReadCloser, error) { return os.Open(name) }
+
+	addresses, err := findMacAddresses("5c2e8b7a-9d41-4f3e-a6b0-1c2d3e4f5a6b", "../bundle/testdata", filepath.Glob, open)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(addresses) != 1 || addresses[0] != "3E:4A:6F:12:9B:C0" {
+		t.Fatalf("bad: %#v", addresses)
+	}
+}
@@ -0,0 +1,137 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Errors returned by the driver when utmctl or osascript fail for a known
+// reason. Use errors.Is to test for them.
+var (
+	// ErrVMNotFound means UTM does not know the given virtual machine.
+	ErrVMNotFound = errors.New("virtual machine not found")
+	// ErrUTMNotRunning means UTM is not running, or quit while being used.
+	ErrUTMNotRunning = errors.New("UTM is not running")
+	// ErrAutomationDenied means macOS does not allow the controlling
+	// process to send Apple Events to UTM.
+	ErrAutomationDenied = errors.New("automation of UTM is not permitted")
+	// ErrUTMBusy means UTM did not handle the request because it was busy,
+	// e.g. while the virtual machine is starting or stopping.
+	ErrUTMBusy = errors.New("UTM is busy")
+)
+
+// errPortInUse is wrapped by the error of Driver.Tunnel when the port is
+// already used on the machine that runs UTM.
+var errPortInUse = errors.New("port is already in use")
+
+// DriverError is returned when utmctl or osascript exits with an error.
+type DriverError struct {
+	// Tool is the program that failed, "utmctl" or "osascript".
+	Tool string
+	// Stderr is the error output of the tool.
+	Stderr string
+	// Kind is one of the Err* errors, or nil if the error is not known.
+	Kind error
+	// Err is the error of running the tool.
+	Err error
+}
+
+func newDriverError(tool string, stderr string, err error) *DriverError {
+	return &DriverError{
+		Tool:   tool,
+		Stderr: stderr,
+		Kind:   classifyDriverError(stderr),
+		Err:    err,
+	}
+}
+
+func (e *DriverError) Error() string {
+	msg := e.Stderr
+	if msg == "" && e.Err != nil {
+		msg = e.Err.Error()
+	}
+	if e.Kind != nil {
+		if msg == "" {
+			return fmt.Sprintf("%s error: %s", e.Tool, e.Kind)
+		}
+		return fmt.Sprintf("%s error: %s: %s", e.Tool, e.Kind, msg)
+	}
+	return fmt.Sprintf("%s error: %s", e.Tool, msg)
+}
+
+func (e *DriverError) Unwrap() []error {
+	var errs []error
+	if e.Kind != nil {
+		errs = append(errs, e.Kind)
+	}
+	if e.Err != nil {
+		errs = append(errs, e.Err)
+	}
+	return errs
+}
+
+// driverErrorPatterns maps the messages and Apple Event error codes that
+// utmctl and osascript print to the error kinds. Both tools report the
+// error code of the failed Apple Event, e.g. "(-1743)".
+var driverErrorPatterns = []struct {
+	Kind     error
+	Patterns []string
+}{
+	{ErrAutomationDenied, []string{
+		"-1743",
+		"not authorized to send apple events",
+		"not allowed to send apple events",
+	}},
+	{ErrUTMNotRunning, []string{
+		"(-600)",
+		"error -600.",
+		"(-609)",
+		"error -609.",
+		"isn't running",
+		"isn’t running",
+		"connection is invalid",
+	}},
+	// -1728 is reported for any missing object, e.g. a drive of the
+	// virtual machine, so only a missing virtual machine is matched
+	{ErrVMNotFound, []string{
+		"virtual machine not found",
+		"can't get virtual machine",
+		"can’t get virtual machine",
+	}},
+	{ErrUTMBusy, []string{
+		"-1712",
+		"appleevent timed out",
+		"operation not available",
+		"is busy",
+	}},
+}
+
+// classifyDriverError returns the kind of error described by the error
+// output of utmctl or osascript, or nil if it is not known.
+func classifyDriverError(stderr string) error {
+	lower := strings.ToLower(stderr)
+	for _, kind := range driverErrorPatterns {
+		for _, pattern := range kind.Patterns {
+			if strings.Contains(lower, pattern) {
+				return kind.Kind
+			}
+		}
+	}
+	return nil
+}
+
+// DriverErrorHint returns advice on how to resolve a driver error, or an
+// empty string if there is none.
+func DriverErrorHint(err error) string {
+	switch {
+	case errors.Is(err, ErrAutomationDenied):
+		return "Allow the terminal or CI agent running Packer to control UTM in " +
+			"System Settings > Privacy & Security > Automation."
+	case errors.Is(err, ErrUTMNotRunning):
+		return "Make sure UTM is running and is not closed during the build."
+	case errors.Is(err, ErrUTMBusy):
+		return "UTM is busy, wait for the virtual machine to finish starting or stopping and try again."
+	}
+	return ""
+}
@@ -0,0 +1,65 @@
+package common
+
+import (
+	"errors"
+	"os/exec"
+	"testing"
+)
+
+func TestClassifyDriverError(t *testing.T) {
+	cases := []struct {
+		Stderr   string
+		Expected error
+	}{
+		{"Error from event: The operation couldn’t be completed. (OSStatus error -1743.)", ErrAutomationDenied},
+		{"execution error: Not authorized to send Apple events to UTM. (-1743)", ErrAutomationDenied},
+		{"Error from event: The operation couldn’t be completed. (OSStatus error -600.)", ErrUTMNotRunning},
+		{"execution error: UTM got an error: Application isn’t running. (-600)", ErrUTMNotRunning},
+		{"Error: Virtual machine not found.", ErrVMNotFound},
+		{`execution error: UTM got an error: Can’t get virtual machine id "C0FFEE". (-1728)`, ErrVMNotFound},
+		{`execution error: UTM got an error: Can’t get virtual machine "debian". (-1728)`, ErrVMNotFound},
+		{`execution error: UTM got an error: Can’t get drive id "D15C" of virtual machine id "C0FFEE". (-1728)`, nil},
+		{`execution error: Can’t get item 3 of {"a", "b"}. (-1728)`, nil},
+		{"execution error: UTM got an error: AppleEvent timed out. (-1712)", ErrUTMBusy},
+		{"execution error: UTM got an error: Operation not available. (-2700)", ErrUTMBusy},
+		{"execution error: Invalid index. (-1719)", nil},
+		{"", nil},
+	}
+
+	for _, tc := range cases {
+		if kind := classifyDriverError(tc.Stderr); kind != tc.Expected {
+			t.Fatalf("%q: expected %v, got %v", tc.Stderr, tc.Expected, kind)
+		}
+	}
+}
+
+func TestDriverError(t *testing.T) {
+	exitErr := &exec.ExitError{}
+	err := error(newDriverError("utmctl", "Error: Virtual machine not found.", exitErr))
+
+	if !errors.Is(err, ErrVMNotFound) {
+		t.Fatal("should be ErrVMNotFound")
+	}
+	if errors.Is(err, ErrUTMNotRunning) {
+		t.Fatal("should not be ErrUTMNotRunning")
+	}
+	var target *exec.ExitError
+	if !errors.As(err, &target) {
+		t.Fatal("should unwrap to the exit error")
+	}
+	if err.Error() != "utmctl error: virtual machine not found: Error: Virtual machine not found." {
+		t.Fatalf("bad: %s", err)
+	}
+
+	unknown := newDriverError("osascript", "something else", exitErr)
+	if unknown.Kind != nil || unknown.Error() != "osascript error: something else" {
+		t.Fatalf("bad: %#v", unknown)
+	}
+
+	if DriverErrorHint(unknown) != "" {
+		t.Fatal("unknown errors have no hint")
+	}
+	if DriverErrorHint(newDriverError("osascript", "(-1743)", exitErr)) == "" {
+		t.Fatal("denied automation should have a hint")
+	}
+}
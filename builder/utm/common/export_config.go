@@ -15,6 +15,23 @@ type ExportConfig struct {
 	// Only UTM, this specifies the output format
 	// of the exported virtual machine. This defaults to utm.
 	Format string `mapstructure:"format" required:"false"`
+	// Rewrite the qcow2 disk images of the VM with `qemu-img convert` after
+	// it is shut down, which leaves out the unused space the images grew
+	// by. Raw images are left as they are, and so are qcow2 images which
+	// still have internal snapshots, e.g. the ones of a source VM, as
+	// `qemu-img convert` doesn't copy them. Defaults to false.
+	CompactDisks bool `mapstructure:"compact_disks" required:"false"`
+	// Compress the qcow2 disk images while they are compacted, which makes
+	// them smaller but slower to read. Implies `compact_disks`. Defaults
+	// to false.
+	CompressDisks bool `mapstructure:"compress_disks" required:"false"`
+	// A command that fills the free space of the guest with zeros before
+	// it is shut down, so that the space can be left out when the disks
+	// are compacted, e.g.
+	// `sudo sh -c 'dd if=/dev/zero of=/var/tmp/zero bs=1M; rm -f /var/tmp/zero; sync'`.
+	// The command may fail once the disk is full. Needs `compact_disks`
+	// or `compress_disks`.
+	ZeroFreeSpaceCommand string `mapstructure:"zero_free_space_command" required:"false"`
 	// TODO: add export options when utm export with options is supported
 }
 
@@ -23,11 +40,20 @@ func (c *ExportConfig) Prepare(ctx *interpolate.Context) []error {
 		c.Format = "utm"
 	}
 
+	if c.CompressDisks {
+		c.CompactDisks = true
+	}
+
 	var errs []error
 	if c.Format != "utm" {
 		errs = append(errs,
 			errors.New("invalid format, only 'utm' is allowed"))
 	}
 
+	if c.ZeroFreeSpaceCommand != "" && !c.CompactDisks {
+		errs = append(errs,
+			errors.New("zero_free_space_command needs compact_disks or compress_disks"))
+	}
+
 	return errs
 }
@@ -38,4 +38,19 @@ func TestExportConfigPrepare_BootWait(t *testing.T) {
 	}
 }
 
+func TestExportConfigPrepare_compactDisks(t *testing.T) {
+	c := &ExportConfig{CompressDisks: true, ZeroFreeSpaceCommand: "zero"}
+	if errs := c.Prepare(interpolate.NewContext()); len(errs) > 0 {
+		t.Fatalf("should not have error: %s", errs)
+	}
+	if !c.CompactDisks {
+		t.Fatal("compress_disks should compact the disks")
+	}
+
+	c = &ExportConfig{ZeroFreeSpaceCommand: "zero"}
+	if errs := c.Prepare(interpolate.NewContext()); len(errs) != 1 {
+		t.Fatalf("bad: %#v", errs)
+	}
+}
+
 // TODO: add export opts test, when utm export with options is supported
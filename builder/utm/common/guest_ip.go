@@ -0,0 +1,256 @@
+package common
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+)
+
+// The strategies to discover the address of the guest, in the default order.
+var defaultGuestIPDiscovery = []string{"utmctl", "dhcpd_leases", "arp"}
+
+// guestIPStrategies look up the address of the VM with the given id. They
+// return an empty address if the guest has none yet.
+var guestIPStrategies = map[string]func(context.Context, Driver, string) (string, error){
+	"utmctl":       guestIPFromUtmctl,
+	"dhcpd_leases": guestIPFromDhcpLeases,
+	"arp":          guestIPFromArp,
+}
+
+// How often the strategies are tried until the guest has an address.
+var guestIPPollInterval = 5 * time.Second
+
+// The emulated VLAN network of the guest, which the host can't reach.
+var emulatedNetwork = &net.IPNet{IP: net.IPv4(10, 0, 2, 0), Mask: net.CIDRMask(24, 32)}
+
+// discoverGuestIP tries the strategies in order until one finds the address
+// of the VM, for at most timeout. It stops early when the build is
+// cancelled.
+func discoverGuestIP(state multistep.StateBag, strategies []string, timeout time.Duration) (string, error) {
+	driver := state.Get("driver").(Driver)
+	vmId := state.Get("vmId").(string)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for {
+		for _, strategy := range strategies {
+			ip, err := guestIPStrategies[strategy](ctx, driver, vmId)
+			if err != nil {
+				log.Printf("Guest IP discovery with %s failed: %s", strategy, err)
+				continue
+			}
+			if ip != "" {
+				log.Printf("Guest IP discovered with %s: %s", strategy, ip)
+				return ip, nil
+			}
+		}
+
+		if _, ok := state.GetOk(multistep.StateCancelled); ok {
+			return "", fmt.Errorf("guest IP discovery was cancelled")
+		}
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("timeout discovering the guest IP with %s", strings.Join(strategies, ", "))
+		case <-time.After(guestIPPollInterval):
+		}
+	}
+}
+
+// guestIPFromUtmctl asks UTM for the addresses of the guest, which needs the
+// QEMU guest agent in the guest.
+func guestIPFromUtmctl(ctx context.Context, driver Driver, vmId string) (string, error) {
+	output, err := driver.Utmctl(ctx, "ip-address", vmId)
+	if err != nil {
+		return "", err
+	}
+	return parseUtmctlIPAddress(output), nil
+}
+
+// parseUtmctlIPAddress returns the first address printed by utmctl
+// ip-address that the host can reach: an IPv4 address outside of the
+// emulated VLAN network, which is not a loopback or link-local address.
+func parseUtmctlIPAddress(output string) string {
+	for _, line := range strings.Split(output, "\n") {
+		ip := net.ParseIP(strings.TrimSpace(line))
+		if ip == nil || ip.To4() == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() ||
+			emulatedNetwork.Contains(ip) {
+			continue
+		}
+		return ip.String()
+	}
+	return ""
+}
+
+// guestIPFromDhcpLeases looks up the MAC addresses of the VM in the leases of
+// the vmnet DHCP server, which serves shared and host only networks.
+func guestIPFromDhcpLeases(ctx context.Context, driver Driver, vmId string) (string, error) {
+	addresses, err := driver.MacAddresses(ctx, vmId)
+	if err != nil {
+		return "", err
+	}
+	leases, err := driver.DhcpLeases(ctx)
+	if err != nil {
+		return "", err
+	}
+	return findDhcpLease(parseDhcpLeases(leases), addresses), nil
+}
+
+// A dhcpLease is an entry of /var/db/dhcpd_leases.
+type dhcpLease struct {
+	IPAddress string
+	HwAddress string
+	// Lease is the end of the lease, in seconds since the epoch.
+	Lease int64
+}
+
+// parseDhcpLeases parses the leases file of the macOS DHCP server, which
+// has an entry like this for every lease:
+//
+//	{
+//		name=ubuntu
+//		ip_address=192.168.64.5
+//		hw_address=1,a6:5e:e:66:42:f4
+//		identifier=1,a6:5e:e:66:42:f4
+//		lease=0x6730f0c2
+//	}
+//
+// The hardware address starts with its type, 1 for ethernet.
+func parseDhcpLeases(content string) []dhcpLease {
+	var leases []dhcpLease
+	var lease *dhcpLease
+
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "{":
+			lease = &dhcpLease{}
+		case line == "}":
+			if lease != nil && lease.IPAddress != "" && lease.HwAddress != "" {
+				leases = append(leases, *lease)
+			}
+			lease = nil
+		case lease != nil:
+			key, value, ok := strings.Cut(line, "=")
+			if !ok {
+				continue
+			}
+			switch key {
+			case "ip_address":
+				lease.IPAddress = value
+			case "hw_address":
+				if _, address, ok := strings.Cut(value, ","); ok {
+					lease.HwAddress = normalizeMacAddress(address)
+				}
+			case "lease":
+				lease.Lease, _ = strconv.ParseInt(strings.TrimPrefix(value, "0x"), 16, 64)
+			}
+		}
+	}
+	return leases
+}
+
+// findDhcpLease returns the address of the latest lease of one of the MAC
+// addresses.
+func findDhcpLease(leases []dhcpLease, addresses []string) string {
+	var found *dhcpLease
+	for i, lease := range leases {
+		if !containsMacAddress(addresses, lease.HwAddress) {
+			continue
+		}
+		if found == nil || lease.Lease > found.Lease {
+			found = &leases[i]
+		}
+	}
+	if found == nil {
+		return ""
+	}
+	return found.IPAddress
+}
+
+// guestIPFromArp looks up the MAC addresses of the VM in the ARP table of
+// the host, which only has the guest once they talked, e.g. on a bridged
+// network.
+func guestIPFromArp(ctx context.Context, driver Driver, vmId string) (string, error) {
+	addresses, err := driver.MacAddresses(ctx, vmId)
+	if err != nil {
+		return "", err
+	}
+	table, err := driver.ArpTable(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range parseArpTable(table) {
+		if containsMacAddress(addresses, entry.HwAddress) {
+			return entry.IPAddress, nil
+		}
+	}
+	return "", nil
+}
+
+// An arpEntry is an entry of the ARP table.
+type arpEntry struct {
+	IPAddress string
+	HwAddress string
+}
+
+// parseArpTable parses the output of `arp -an` on macOS, which has a line
+// like this for every entry:
+//
+//	? (192.168.1.23) at a6:5e:e:66:42:f4 on en0 ifscope [ethernet]
+//
+// Incomplete entries have "(incomplete)" as their hardware address and are
+// skipped.
+func parseArpTable(output string) []arpEntry {
+	var entries []arpEntry
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[2] != "at" {
+			continue
+		}
+		ip := strings.TrimSuffix(strings.TrimPrefix(fields[1], "("), ")")
+		if net.ParseIP(ip) == nil {
+			continue
+		}
+		address := normalizeMacAddress(fields[3])
+		if address == "" {
+			continue
+		}
+		entries = append(entries, arpEntry{IPAddress: ip, HwAddress: address})
+	}
+	return entries
+}
+
+// normalizeMacAddress returns the MAC address with two lower case digits per
+// octet, as macOS leaves out leading zeros, or "" if it isn't a MAC address.
+func normalizeMacAddress(address string) string {
+	octets := strings.Split(address, ":")
+	if len(octets) != 6 {
+		return ""
+	}
+	for i, octet := range octets {
+		n, err := strconv.ParseUint(octet, 16, 8)
+		if err != nil {
+			return ""
+		}
+		octets[i] = fmt.Sprintf("%02x", n)
+	}
+	return strings.Join(octets, ":")
+}
+
+func containsMacAddress(addresses []string, address string) bool {
+	for _, other := range addresses {
+		if normalizeMacAddress(other) == address {
+			return true
+		}
+	}
+	return false
+}
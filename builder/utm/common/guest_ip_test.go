@@ -0,0 +1,154 @@
+package common
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+)
+
+func readTestdata(t *testing.T, name string) string {
+	data, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return string(data)
+}
+
+func TestParseDhcpLeases(t *testing.T) {
+	leases := parseDhcpLeases(readTestdata(t, "dhcpd_leases"))
+	expected := []dhcpLease{
+		{IPAddress: "192.168.64.5", HwAddress: "a6:5e:0e:66:42:f4", Lease: 0x6730e4a2},
+		{IPAddress: "192.168.64.3", HwAddress: "3e:4a:6f:12:9b:c0", Lease: 0x6730d1f0},
+		{IPAddress: "192.168.64.7", HwAddress: "a6:5e:0e:66:42:f4", Lease: 0x6730f0c2},
+	}
+	if !reflect.DeepEqual(leases, expected) {
+		t.Fatalf("bad: %#v", leases)
+	}
+
+	// The latest lease of the MAC address wins
+	if ip := findDhcpLease(leases, []string{"A6:5E:0E:66:42:F4"}); ip != "192.168.64.7" {
+		t.Fatalf("bad: %s", ip)
+	}
+	if ip := findDhcpLease(leases, []string{"52:54:00:12:34:56"}); ip != "" {
+		t.Fatalf("bad: %s", ip)
+	}
+}
+
+func TestParseArpTable(t *testing.T) {
+	entries := parseArpTable(readTestdata(t, "arp"))
+	expected := []arpEntry{
+		{IPAddress: "192.168.1.1", HwAddress: "00:1a:2b:3c:4d:5e"},
+		{IPAddress: "192.168.1.23", HwAddress: "3e:4a:6f:12:9b:c0"},
+		{IPAddress: "192.168.64.5", HwAddress: "a6:5e:0e:66:42:f4"},
+		{IPAddress: "224.0.0.251", HwAddress: "01:00:5e:00:00:fb"},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Fatalf("bad: %#v", entries)
+	}
+}
+
+func TestParseUtmctlIPAddress(t *testing.T) {
+	// The emulated VLAN and link-local addresses are skipped
+	if ip := parseUtmctlIPAddress(readTestdata(t, "utmctl_ip_address")); ip != "192.168.64.5" {
+		t.Fatalf("bad: %s", ip)
+	}
+	if ip := parseUtmctlIPAddress("10.0.2.15\nfe80::1\n"); ip != "" {
+		t.Fatalf("bad: %s", ip)
+	}
+}
+
+func TestNormalizeMacAddress(t *testing.T) {
+	for address, expected := range map[string]string{
+		"a6:5e:e:66:42:f4":  "a6:5e:0e:66:42:f4",
+		"3E:4A:6F:12:9B:C0": "3e:4a:6f:12:9b:c0",
+		"3e:4a:6f:12:9b":    "",
+		"3e:4a:6f:12:9b:xx": "",
+		"(incomplete)":      "",
+	} {
+		if actual := normalizeMacAddress(address); actual != expected {
+			t.Fatalf("bad: %s: %s", address, actual)
+		}
+	}
+}
+
+func TestCommHost_discovery(t *testing.T) {
+	defer func(interval time.Duration) { guestIPPollInterval = interval }(guestIPPollInterval)
+	guestIPPollInterval = time.Millisecond
+
+	driver := new(DriverSimulator)
+	driver.Leases = readTestdata(t, "dhcpd_leases")
+	driver.Arp = readTestdata(t, "arp")
+	vmId := driver.AddVM(SimulatedVM{
+		Name:              "packer",
+		Status:            "started",
+		NetworkInterfaces: []SimulatedNetworkInterface{{Mode: "BrDg", MacAddress: "3E:4A:6F:12:9B:C0"}},
+	})
+
+	state := testState(t)
+	state.Put("driver", driver)
+	state.Put("vmId", vmId)
+
+	config := &CommConfig{
+		GuestIPDiscovery: []string{"utmctl", "arp", "dhcpd_leases"},
+		GuestIPTimeout:   time.Second,
+	}
+	host, err := CommHost(config)(state)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	// Without the guest agent, the ARP table has the address
+	if host != "192.168.1.23" {
+		t.Fatalf("bad: %s", host)
+	}
+
+	// The first strategy that finds an address wins
+	state.Put("vmId", driver.AddVM(SimulatedVM{
+		Name:              "agent",
+		Status:            "started",
+		NetworkInterfaces: []SimulatedNetworkInterface{{Mode: "BrDg", MacAddress: "3E:4A:6F:12:9B:C0"}},
+		IPAddresses:       []string{"10.0.2.15", "192.168.1.24"},
+	}))
+	host, err = CommHost(config)(state)
+	if err != nil || host != "192.168.1.24" {
+		t.Fatalf("bad: %s: %v", host, err)
+	}
+
+	// A configured host is not discovered
+	config.Comm.SSHHost = "192.168.1.99"
+	config.Comm.Type = "ssh"
+	if host, err := CommHost(config)(state); err != nil || host != "192.168.1.99" {
+		t.Fatalf("bad: %s: %v", host, err)
+	}
+}
+
+func TestCommHost_discoveryTimeout(t *testing.T) {
+	defer func(interval time.Duration) { guestIPPollInterval = interval }(guestIPPollInterval)
+	guestIPPollInterval = time.Millisecond
+
+	driver := new(DriverSimulator)
+	driver.Errors = map[string]error{"dhcpd_leases": errors.New("no leases")}
+	vmId := driver.AddVM(SimulatedVM{Name: "packer", Status: "started"})
+
+	state := testState(t)
+	state.Put("driver", driver)
+	state.Put("vmId", vmId)
+
+	config := &CommConfig{
+		GuestIPDiscovery: []string{"dhcpd_leases", "arp"},
+		GuestIPTimeout:   20 * time.Millisecond,
+	}
+	if _, err := CommHost(config)(state); err == nil {
+		t.Fatal("should error")
+	}
+
+	// The discovery stops when the build is cancelled
+	config.GuestIPTimeout = time.Hour
+	state.Put(multistep.StateCancelled, true)
+	if _, err := CommHost(config)(state); err == nil {
+		t.Fatal("should error")
+	}
+}
@@ -0,0 +1,776 @@
+// Package iso9660 writes ISO 9660 images with the Joliet and Rock Ridge
+// extensions, so that CDs can be made without external tools.
+//
+// Files are listed three times: with restricted ISO 9660 names, with their
+// names in the Joliet tree, read by Windows, and with their names and
+// POSIX attributes in Rock Ridge entries, read by Linux and macOS. Both
+// trees share the data of the files.
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const sectorSize = 2048
+
+// The first sectors of an image are reserved for the system area.
+const systemAreaSectors = 16
+
+// Limits of the identifiers of the volume descriptors and of the trees.
+const (
+	maxLabelLength      = 32
+	maxISONameLength    = 30
+	maxJolietNameLength = 64
+	maxRecordLength     = 255
+)
+
+// ErrFileTooLarge is returned for files that don't fit in one extent.
+// Larger files need several directory records, which aren't written.
+var ErrFileTooLarge = errors.New("file is larger than 4 GiB")
+
+// Create writes an image of the directory source to dest, with label as
+// the volume identifier.
+func Create(dest string, label string, source string) error {
+	if label == "" || len(label) > maxLabelLength {
+		return fmt.Errorf("the label must have 1 to %d characters: %q", maxLabelLength, label)
+	}
+
+	root, err := readTree(source)
+	if err != nil {
+		return err
+	}
+	img := newImage(label, root)
+
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if err := img.write(f); err != nil {
+		f.Close()
+		os.Remove(dest)
+		return err
+	}
+	return f.Close()
+}
+
+// A file or directory of the image.
+type node struct {
+	name     string
+	dir      bool
+	children []*node
+	source   string
+	size     int64
+	mode     os.FileMode
+	modTime  time.Time
+
+	// The first sector of the data of a file
+	lba uint32
+}
+
+func readTree(source string) (*node, error) {
+	info, err := os.Stat(source)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", source)
+	}
+	return readNode(source, info)
+}
+
+func readNode(path string, info os.FileInfo) (*node, error) {
+	n := &node{
+		name:    info.Name(),
+		dir:     info.IsDir(),
+		source:  path,
+		mode:    info.Mode(),
+		modTime: info.ModTime(),
+	}
+	if !n.dir {
+		if info.Size() > math.MaxUint32 {
+			return nil, fmt.Errorf("%s: %w", path, ErrFileTooLarge)
+		}
+		n.size = info.Size()
+		return n, nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		childPath := filepath.Join(path, entry.Name())
+		// Links are followed, like by the external tools
+		childInfo, err := os.Stat(childPath)
+		if err != nil {
+			return nil, err
+		}
+		if !childInfo.IsDir() && !childInfo.Mode().IsRegular() {
+			return nil, fmt.Errorf("%s is not a regular file or a directory", childPath)
+		}
+		child, err := readNode(childPath, childInfo)
+		if err != nil {
+			return nil, err
+		}
+		n.children = append(n.children, child)
+	}
+	return n, nil
+}
+
+// A directory record of a tree.
+type record struct {
+	ident []byte
+	node  *node
+	// The directory of the tree the record points to, nil for files
+	dir *directory
+	// The system use entries of the record, and the entries of its
+	// continuation area
+	systemUse    []byte
+	continuation []byte
+	// The location of the continuation area
+	ceLBA    uint32
+	ceOffset uint32
+}
+
+func (r *record) length() int {
+	l := 33 + len(r.ident) + len(r.systemUse)
+	if len(r.ident)%2 == 0 {
+		l++
+	}
+	return l
+}
+
+// A directory of a tree.
+type directory struct {
+	node   *node
+	parent *directory
+	// The number of the directory in the path table, starting at 1
+	number int
+	ident  []byte
+	// The records of the directory, starting with "." and ".."
+	records []*record
+	lba     uint32
+	size    uint32
+}
+
+// A tree of directories, described by a volume descriptor.
+type tree struct {
+	joliet bool
+	// The directories in the order of the path table
+	dirs []*directory
+
+	pathTableSize uint32
+	pathTableLBA  uint32
+	pathTableMLBA uint32
+}
+
+type image struct {
+	label   string
+	created time.Time
+	root    *node
+	primary *tree
+	joliet  *tree
+	// The files with data, in the order of their sectors
+	files   []*node
+	sectors uint32
+}
+
+func newImage(label string, root *node) *image {
+	img := &image{
+		label:   label,
+		created: time.Now().UTC(),
+		root:    root,
+	}
+	img.primary = newTree(root, false)
+	img.joliet = newTree(root, true)
+	img.layout()
+	return img
+}
+
+// newTree lists the directories breadth first, which is the order of the
+// path table, as the records of each directory are sorted.
+func newTree(root *node, joliet bool) *tree {
+	t := &tree{joliet: joliet}
+	rootDir := &directory{node: root, number: 1, ident: []byte{0}}
+	rootDir.parent = rootDir
+	queue := []*directory{rootDir}
+	for len(queue) > 0 {
+		dir := queue[0]
+		queue = queue[1:]
+		t.dirs = append(t.dirs, dir)
+
+		dir.records = []*record{
+			{ident: []byte{0}, node: dir.node, dir: dir},
+			{ident: []byte{1}, node: dir.parent.node, dir: dir.parent},
+		}
+		children := t.childRecords(dir.node)
+		for _, r := range children {
+			if r.node.dir {
+				r.dir = &directory{node: r.node, parent: dir, ident: r.ident}
+				r.dir.number = len(t.dirs) + len(queue) + 1
+				queue = append(queue, r.dir)
+			}
+		}
+		dir.records = append(dir.records, children...)
+		if !joliet {
+			t.addRockRidge(dir)
+		}
+	}
+	return t
+}
+
+// childRecords returns the records of the children of a directory, with
+// unique identifiers, in the order of the directory.
+func (t *tree) childRecords(n *node) []*record {
+	records := make([]*record, 0, len(n.children))
+	used := map[string]bool{}
+	// Sort by name so the identifiers don't depend on the file system
+	children := append([]*node{}, n.children...)
+	sort.Slice(children, func(i, j int) bool { return children[i].name < children[j].name })
+	for _, child := range children {
+		var ident []byte
+		for i := 0; ; i++ {
+			if t.joliet {
+				ident = jolietIdent(child.name, child.dir, i)
+			} else {
+				ident = isoIdent(child.name, child.dir, i)
+			}
+			if !used[string(ident)] {
+				break
+			}
+		}
+		used[string(ident)] = true
+		records = append(records, &record{ident: ident, node: child})
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if t.joliet {
+			return bytes.Compare(records[i].ident, records[j].ident) < 0
+		}
+		return compareISOIdents(records[i].ident, records[j].ident) < 0
+	})
+	return records
+}
+
+// isoIdent returns the ISO 9660 identifier of a name, made of upper case
+// letters, digits and underscores. The seq-th alternative is returned when
+// the identifier is already used in the directory.
+func isoIdent(name string, dir bool, seq int) []byte {
+	base, ext := name, ""
+	if !dir {
+		if i := strings.LastIndex(name, "."); i > 0 {
+			base, ext = name[:i], name[i+1:]
+		}
+	}
+	clean := func(s string) string {
+		return strings.Map(func(r rune) rune {
+			switch {
+			case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+				return r
+			case r >= 'a' && r <= 'z':
+				return r - 'a' + 'A'
+			}
+			return '_'
+		}, s)
+	}
+	base, ext = clean(base), clean(ext)
+
+	maxLength := maxISONameLength + 1
+	if !dir {
+		if len(ext) > maxISONameLength/2 {
+			ext = ext[:maxISONameLength/2]
+		}
+		maxLength = maxISONameLength - len(ext)
+	}
+	if seq > 0 {
+		suffix := "_" + strconv.Itoa(seq)
+		if len(base) > maxLength-len(suffix) {
+			base = base[:maxLength-len(suffix)]
+		}
+		base += suffix
+	} else if len(base) > maxLength {
+		base = base[:maxLength]
+	}
+
+	if dir {
+		return []byte(base)
+	}
+	return []byte(base + "." + ext + ";1")
+}
+
+// compareISOIdents compares file identifiers the way ISO 9660 orders the
+// records of a directory: by name, then by extension, with the shorter
+// one padded with spaces.
+func compareISOIdents(a, b []byte) int {
+	split := func(ident []byte) (string, string) {
+		s := strings.TrimSuffix(string(ident), ";1")
+		if i := strings.Index(s, "."); i >= 0 {
+			return s[:i], s[i+1:]
+		}
+		return s, ""
+	}
+	padded := func(a, b string) int {
+		for len(a) < len(b) {
+			a += " "
+		}
+		for len(b) < len(a) {
+			b += " "
+		}
+		return strings.Compare(a, b)
+	}
+	aName, aExt := split(a)
+	bName, bExt := split(b)
+	if c := padded(aName, bName); c != 0 {
+		return c
+	}
+	return padded(aExt, bExt)
+}
+
+// jolietIdent returns the Joliet identifier of a name, in UCS-2 big
+// endian, without the characters Joliet doesn't allow. Long names are
+// truncated before their extension.
+func jolietIdent(name string, dir bool, seq int) []byte {
+	name = strings.Map(func(r rune) rune {
+		switch r {
+		case '*', '/', ':', ';', '?', '\\':
+			return '_'
+		}
+		return r
+	}, name)
+	base, ext := name, ""
+	if !dir {
+		if i := strings.LastIndex(name, "."); i > 0 {
+			base, ext = name[:i], name[i:]
+		}
+	}
+	if seq > 0 {
+		ext = "_" + strconv.Itoa(seq) + ext
+	}
+	baseUnits, extUnits := utf16.Encode([]rune(base)), utf16.Encode([]rune(ext))
+	if len(extUnits) > maxJolietNameLength/2 {
+		extUnits = extUnits[:maxJolietNameLength/2]
+	}
+	if len(baseUnits) > maxJolietNameLength-len(extUnits) {
+		baseUnits = baseUnits[:maxJolietNameLength-len(extUnits)]
+	}
+	units := append(baseUnits, extUnits...)
+
+	ident := make([]byte, 2*len(units))
+	for i, u := range units {
+		binary.BigEndian.PutUint16(ident[2*i:], u)
+	}
+	return ident
+}
+
+// The Rock Ridge extension, announced in the root directory.
+const (
+	rockRidgeID          = "RRIP_1991A"
+	rockRidgeDescription = "THE ROCK RIDGE INTERCHANGE PROTOCOL PROVIDES SUPPORT FOR POSIX FILE SYSTEM SEMANTICS"
+	rockRidgeSource      = "PLEASE CONTACT DISC PUBLISHER FOR SPECIFICATION SOURCE.  SEE PUBLISHER IDENTIFIER IN PRIMARY VOLUME DESCRIPTOR FOR CONTACT INFORMATION."
+)
+
+// The length of a CE entry, which points to a continuation area.
+const ceLength = 28
+
+// addRockRidge adds the Rock Ridge entries of the records of a directory.
+// Entries that don't fit in a record are moved to a continuation area,
+// keeping the first ones in the record, as readers like libarchive look
+// for Rock Ridge in the records themselves.
+func (t *tree) addRockRidge(dir *directory) {
+	for i, r := range dir.records {
+		var entries [][]byte
+		if dir.number == 1 && i == 0 {
+			// The SP entry of the root marks the use of the extensions
+			r.systemUse = suspEntry("SP", []byte{0xbe, 0xef, 0})
+		}
+		entries = append(entries, pxEntry(r.node), tfEntry(r.node.modTime))
+		if i > 1 {
+			entries = append(entries, nmEntry(r.node.name))
+		}
+		if dir.number == 1 && i == 0 {
+			entries = append(entries, erEntry())
+		}
+
+		all := bytes.Join(entries, nil)
+		if r.length()+len(all) <= maxRecordLength {
+			r.systemUse = append(r.systemUse, all...)
+			continue
+		}
+		for len(entries) > 0 && r.length()+len(entries[0])+ceLength <= maxRecordLength {
+			r.systemUse = append(r.systemUse, entries[0]...)
+			entries = entries[1:]
+		}
+		r.systemUse = append(r.systemUse, make([]byte, ceLength)...)
+		r.continuation = bytes.Join(entries, nil)
+	}
+}
+
+func suspEntry(signature string, data []byte) []byte {
+	entry := append([]byte(signature), byte(4+len(data)), 1)
+	return append(entry, data...)
+}
+
+func erEntry() []byte {
+	data := []byte{byte(len(rockRidgeID)), byte(len(rockRidgeDescription)), byte(len(rockRidgeSource)), 1}
+	data = append(data, rockRidgeID...)
+	data = append(data, rockRidgeDescription...)
+	data = append(data, rockRidgeSource...)
+	return suspEntry("ER", data)
+}
+
+func pxEntry(n *node) []byte {
+	mode := uint32(n.mode.Perm())
+	links := uint32(1)
+	if n.dir {
+		mode |= 0o040000
+		links = 2
+		for _, child := range n.children {
+			if child.dir {
+				links++
+			}
+		}
+	} else {
+		mode |= 0o100000
+	}
+	data := make([]byte, 32)
+	putBoth32(data[0:], mode)
+	putBoth32(data[8:], links)
+	// Files belong to root
+	putBoth32(data[16:], 0)
+	putBoth32(data[24:], 0)
+	return suspEntry("PX", data)
+}
+
+func tfEntry(t time.Time) []byte {
+	// The modification and access times
+	data := []byte{0x06}
+	data = append(data, recordingDate(t)...)
+	data = append(data, recordingDate(t)...)
+	return suspEntry("TF", data)
+}
+
+func nmEntry(name string) []byte {
+	return suspEntry("NM", append([]byte{0}, name...))
+}
+
+// layout assigns the sectors of the image: the volume descriptors, the path
+// tables, the directories of both trees, the continuation areas and the
+// data of the files.
+func (img *image) layout() {
+	// The primary and supplementary volume descriptors, and the terminator
+	lba := uint32(systemAreaSectors + 3)
+
+	for _, t := range []*tree{img.primary, img.joliet} {
+		for _, dir := range t.dirs {
+			l := 8 + len(dir.ident)
+			t.pathTableSize += uint32(l + l%2)
+		}
+		t.pathTableLBA = lba
+		lba += sectors(int64(t.pathTableSize))
+		t.pathTableMLBA = lba
+		lba += sectors(int64(t.pathTableSize))
+	}
+
+	// Records don't cross sectors
+	for _, t := range []*tree{img.primary, img.joliet} {
+		for _, dir := range t.dirs {
+			size := uint32(0)
+			for _, r := range dir.records {
+				l := uint32(r.length())
+				if size%sectorSize+l > sectorSize {
+					size += sectorSize - size%sectorSize
+				}
+				size += l
+			}
+			dir.lba = lba
+			dir.size = sectors(int64(size)) * sectorSize
+			lba += dir.size / sectorSize
+		}
+	}
+
+	// Continuation areas don't cross sectors either. They follow the
+	// directories, as readers like libarchive only read forward.
+	offset := uint32(0)
+	for _, dir := range img.primary.dirs {
+		for _, r := range dir.records {
+			if len(r.continuation) == 0 {
+				continue
+			}
+			if offset+uint32(len(r.continuation)) > sectorSize {
+				lba++
+				offset = 0
+			}
+			r.ceLBA, r.ceOffset = lba, offset
+			offset += uint32(len(r.continuation))
+		}
+	}
+	if offset > 0 {
+		lba++
+	}
+
+	// Both trees share the data of the files
+	var walk func(n *node)
+	walk = func(n *node) {
+		for _, child := range n.children {
+			if child.dir {
+				walk(child)
+			} else if child.size > 0 {
+				child.lba = lba
+				lba += sectors(child.size)
+				img.files = append(img.files, child)
+			}
+		}
+	}
+	walk(img.root)
+	img.sectors = lba
+}
+
+func sectors(size int64) uint32 {
+	return uint32((size + sectorSize - 1) / sectorSize)
+}
+
+func (img *image) write(w io.Writer) error {
+	bw := &sectorWriter{w: w}
+
+	bw.Write(make([]byte, systemAreaSectors*sectorSize))
+	bw.Write(img.volumeDescriptor(img.primary))
+	bw.Write(img.volumeDescriptor(img.joliet))
+	terminator := make([]byte, sectorSize)
+	terminator[0] = 255
+	copy(terminator[1:], "CD001")
+	terminator[6] = 1
+	bw.Write(terminator)
+
+	for _, t := range []*tree{img.primary, img.joliet} {
+		bw.Write(t.pathTable(binary.LittleEndian))
+		bw.pad()
+		bw.Write(t.pathTable(binary.BigEndian))
+		bw.pad()
+	}
+
+	for _, t := range []*tree{img.primary, img.joliet} {
+		for _, dir := range t.dirs {
+			for _, r := range dir.records {
+				l := int64(r.length())
+				if bw.offset()%sectorSize+l > sectorSize {
+					bw.pad()
+				}
+				bw.Write(r.bytes())
+			}
+			bw.pad()
+		}
+	}
+
+	for _, dir := range img.primary.dirs {
+		for _, r := range dir.records {
+			if len(r.continuation) > 0 {
+				if bw.offset()%sectorSize+int64(len(r.continuation)) > sectorSize {
+					bw.pad()
+				}
+				bw.Write(r.continuation)
+			}
+		}
+	}
+	bw.pad()
+
+	for _, n := range img.files {
+		if bw.err != nil {
+			break
+		}
+		if err := bw.copyFile(n); err != nil {
+			return err
+		}
+		bw.pad()
+	}
+
+	if bw.err == nil && bw.offset() != int64(img.sectors)*sectorSize {
+		return fmt.Errorf("wrote %d bytes instead of %d sectors", bw.offset(), img.sectors)
+	}
+	return bw.err
+}
+
+// bytes returns the record, with its CE entry pointing to its
+// continuation area.
+func (r *record) bytes() []byte {
+	b := make([]byte, r.length())
+	b[0] = byte(len(b))
+	lba, size := uint32(0), uint32(0)
+	if r.dir != nil {
+		lba, size = r.dir.lba, r.dir.size
+	} else {
+		lba, size = r.node.lba, uint32(r.node.size)
+	}
+	putBoth32(b[2:], lba)
+	putBoth32(b[10:], size)
+	copy(b[18:], recordingDate(r.node.modTime))
+	if r.node.dir {
+		b[25] = 0x02
+	}
+	putBoth16(b[28:], 1)
+	b[32] = byte(len(r.ident))
+	copy(b[33:], r.ident)
+
+	su := b[len(b)-len(r.systemUse):]
+	copy(su, r.systemUse)
+	if len(r.continuation) > 0 {
+		ce := make([]byte, 24)
+		putBoth32(ce[0:], r.ceLBA)
+		putBoth32(ce[8:], r.ceOffset)
+		putBoth32(ce[16:], uint32(len(r.continuation)))
+		copy(su[len(su)-ceLength:], suspEntry("CE", ce))
+	}
+	return b
+}
+
+func (t *tree) pathTable(order binary.ByteOrder) []byte {
+	b := make([]byte, 0, t.pathTableSize)
+	for _, dir := range t.dirs {
+		entry := make([]byte, 8+len(dir.ident)+len(dir.ident)%2)
+		entry[0] = byte(len(dir.ident))
+		order.PutUint32(entry[2:], dir.lba)
+		order.PutUint16(entry[6:], uint16(dir.parent.number))
+		copy(entry[8:], dir.ident)
+		b = append(b, entry...)
+	}
+	return b
+}
+
+func (img *image) volumeDescriptor(t *tree) []byte {
+	b := make([]byte, sectorSize)
+	copy(b[1:], "CD001")
+	b[6] = 1
+
+	text := func(s string, length int) []byte {
+		if !t.joliet {
+			return []byte(fmt.Sprintf("%-*s", length, s))
+		}
+		units := utf16.Encode([]rune(s))
+		if len(units) > length/2 {
+			units = units[:length/2]
+		}
+		field := make([]byte, length)
+		for i := 0; i < length/2; i++ {
+			u := uint16(' ')
+			if i < len(units) {
+				u = units[i]
+			}
+			binary.BigEndian.PutUint16(field[2*i:], u)
+		}
+		return field
+	}
+
+	if t.joliet {
+		b[0] = 2
+		// UCS-2 level 3
+		copy(b[88:], "%/E")
+	} else {
+		b[0] = 1
+	}
+	copy(b[8:40], text("", 32))
+	copy(b[40:72], text(img.label, 32))
+	putBoth32(b[80:], img.sectors)
+	putBoth16(b[120:], 1)
+	putBoth16(b[124:], 1)
+	putBoth16(b[128:], sectorSize)
+	putBoth32(b[132:], t.pathTableSize)
+	binary.LittleEndian.PutUint32(b[140:], t.pathTableLBA)
+	binary.BigEndian.PutUint32(b[148:], t.pathTableMLBA)
+	root := &record{ident: []byte{0}, node: img.root, dir: t.dirs[0]}
+	copy(b[156:190], root.bytes())
+	copy(b[190:318], text("", 128))
+	copy(b[318:446], text("", 128))
+	copy(b[446:574], text("", 128))
+	copy(b[574:702], text("PACKER", 128))
+	copy(b[702:739], text("", 37))
+	copy(b[739:776], text("", 37))
+	copy(b[776:813], text("", 37))
+	copy(b[813:830], volumeDate(img.created))
+	copy(b[830:847], volumeDate(img.created))
+	copy(b[847:864], volumeDate(time.Time{}))
+	copy(b[864:881], volumeDate(time.Time{}))
+	b[881] = 1
+	return b
+}
+
+// recordingDate returns the 7 bytes date of directory records.
+func recordingDate(t time.Time) []byte {
+	t = t.UTC()
+	year := t.Year() - 1900
+	if year < 0 || year > 255 {
+		return make([]byte, 7)
+	}
+	return []byte{byte(year), byte(t.Month()), byte(t.Day()), byte(t.Hour()), byte(t.Minute()), byte(t.Second()), 0}
+}
+
+// volumeDate returns the 17 bytes date of volume descriptors, which is
+// unset for the zero time.
+func volumeDate(t time.Time) []byte {
+	if t.IsZero() {
+		return append([]byte("0000000000000000"), 0)
+	}
+	return append([]byte(t.UTC().Format("20060102150405")+fmt.Sprintf("%02d", t.Nanosecond()/1e7)), 0)
+}
+
+func putBoth16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b[0:], v)
+	binary.BigEndian.PutUint16(b[2:], v)
+}
+
+func putBoth32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b[0:], v)
+	binary.BigEndian.PutUint32(b[4:], v)
+}
+
+// sectorWriter keeps the first error and the offset of the image.
+type sectorWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (s *sectorWriter) Write(p []byte) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	n, err := s.w.Write(p)
+	s.n += int64(n)
+	s.err = err
+	return n, err
+}
+
+func (s *sectorWriter) offset() int64 {
+	return s.n
+}
+
+// pad fills the current sector with zeros.
+func (s *sectorWriter) pad() {
+	if rest := s.n % sectorSize; rest != 0 {
+		s.Write(make([]byte, sectorSize-rest))
+	}
+}
+
+func (s *sectorWriter) copyFile(n *node) error {
+	f, err := os.Open(n.source)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.CopyN(s, f, n.size); err != nil {
+		if s.err != nil {
+			return s.err
+		}
+		return fmt.Errorf("error copying %s: %s", n.source, err)
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// testImage reads the files of an image, by their Rock Ridge names in the
+// primary tree, or by their Joliet names.
+type testImage struct {
+	t    *testing.T
+	data []byte
+}
+
+func (img testImage) sector(lba uint32) []byte {
+	return img.data[lba*sectorSize:]
+}
+
+func (img testImage) root(descriptor uint32) (uint32, uint32) {
+	root := img.sector(descriptor)[156:190]
+	return binary.LittleEndian.Uint32(root[2:]), binary.LittleEndian.Uint32(root[10:])
+}
+
+// entries returns the system use entries of a record, with the entries of
+// its continuation area.
+func (img testImage) entries(su []byte) map[string][]byte {
+	entries := map[string][]byte{}
+	for len(su) >= 4 && su[2] >= 4 && int(su[2]) <= len(su) {
+		signature, data := string(su[:2]), su[4:su[2]]
+		if signature == "CE" {
+			lba := binary.LittleEndian.Uint32(data[0:])
+			offset := binary.LittleEndian.Uint32(data[8:])
+			size := binary.LittleEndian.Uint32(data[16:])
+			for k, v := range img.entries(img.sector(lba)[offset : offset+size]) {
+				entries[k] = v
+			}
+		}
+		entries[signature] = data
+		su = su[su[2]:]
+	}
+	return entries
+}
+
+func (img testImage) walk(lba, size uint32, joliet bool, dir string, files map[string]string) {
+	extent := img.sector(lba)[:size]
+	for offset := 0; offset < len(extent); {
+		length := int(extent[offset])
+		if length == 0 {
+			offset = (offset/sectorSize + 1) * sectorSize
+			continue
+		}
+		r := extent[offset : offset+length]
+		offset += length
+
+		ident := r[33 : 33+r[32]]
+		if len(ident) == 1 && ident[0] <= 1 {
+			continue
+		}
+		name := string(ident)
+		if joliet {
+			units := make([]uint16, len(ident)/2)
+			for i := range units {
+				units[i] = binary.BigEndian.Uint16(ident[2*i:])
+			}
+			name = string(utf16.Decode(units))
+		} else {
+			suStart := 33 + len(ident) + (len(ident)+1)%2
+			entries := img.entries(r[suStart:])
+			if _, ok := entries["PX"]; !ok {
+				img.t.Fatalf("no PX entry: %s", name)
+			}
+			name = string(entries["NM"][1:])
+		}
+
+		childLBA := binary.LittleEndian.Uint32(r[2:])
+		childSize := binary.LittleEndian.Uint32(r[10:])
+		if r[25]&0x02 != 0 {
+			img.walk(childLBA, childSize, joliet, dir+name+"/", files)
+		} else {
+			files[dir+name] = string(img.sector(childLBA)[:childSize])
+		}
+	}
+}
+
+func (img testImage) files(descriptor uint32) map[string]string {
+	files := map[string]string{}
+	lba, size := img.root(descriptor)
+	img.walk(lba, size, img.sector(descriptor)[0] == 2, "", files)
+	return files
+}
+
+func TestCreate(t *testing.T) {
+	source := t.TempDir()
+	longName := strings.Repeat("a long name ", 8) + ".yaml"
+	files := map[string]string{
+		"user-data":            "#cloud-config\n",
+		"meta-data":            "instance-id: packer\n",
+		"empty":                "",
+		"scripts/Setup.sh":     "echo setup\n",
+		"scripts/setup.SH":     "echo other\n",
+		"scripts/" + longName:  "long: true\n",
+		"scripts/deep/big.bin": strings.Repeat("0123456789", 1000),
+	}
+	for name, content := range files {
+		path := filepath.Join(source, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	dest := filepath.Join(t.TempDir(), "seed.iso")
+	if err := Create(dest, "cidata", source); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	data, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(data)%sectorSize != 0 {
+		t.Fatalf("bad: %d", len(data))
+	}
+	img := testImage{t: t, data: data}
+
+	// The primary and Joliet volume descriptors, and the terminator
+	for lba, kind := range map[uint32]byte{16: 1, 17: 2, 18: 255} {
+		if d := img.sector(lba); d[0] != kind || string(d[1:6]) != "CD001" {
+			t.Fatalf("bad: %d %#v", lba, d[:7])
+		}
+	}
+	if label := string(img.sector(16)[40:72]); strings.TrimSpace(label) != "cidata" {
+		t.Fatalf("bad: %q", label)
+	}
+	if label := img.sector(17)[40:52]; !bytes.Equal(label, []byte("\x00c\x00i\x00d\x00a\x00t\x00a")) {
+		t.Fatalf("bad: %q", label)
+	}
+	if sectors := binary.LittleEndian.Uint32(img.sector(16)[80:]); int(sectors)*sectorSize != len(data) {
+		t.Fatalf("bad: %d", sectors)
+	}
+
+	rockRidge := img.files(16)
+	if len(rockRidge) != len(files) {
+		t.Fatalf("bad: %#v", rockRidge)
+	}
+	for name, content := range files {
+		if rockRidge[name] != content {
+			t.Fatalf("bad: %s: %q", name, rockRidge[name])
+		}
+	}
+
+	// Joliet names are truncated before their extension
+	joliet := img.files(17)
+	if len(joliet) != len(files) {
+		t.Fatalf("bad: %#v", joliet)
+	}
+	truncated := "scripts/" + longName[:maxJolietNameLength-len(".yaml")] + ".yaml"
+	if joliet[truncated] != files["scripts/"+longName] {
+		t.Fatalf("bad: %#v", joliet)
+	}
+	if joliet["scripts/Setup.sh"] != files["scripts/Setup.sh"] {
+		t.Fatalf("bad: %#v", joliet)
+	}
+}
+
+func TestCreate_badLabel(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "seed.iso")
+	for _, label := range []string{"", strings.Repeat("x", 33)} {
+		if err := Create(dest, label, t.TempDir()); err == nil {
+			t.Fatalf("should have error: %q", label)
+		}
+	}
+}
+
+func TestIsoIdent(t *testing.T) {
+	cases := []struct {
+		name  string
+		dir   bool
+		seq   int
+		ident string
+	}{
+		{"user-data", false, 0, "USER_DATA.;1"},
+		{"setup.sh", false, 0, "SETUP.SH;1"},
+		{"setup.sh", false, 1, "SETUP_1.SH;1"},
+		{".hidden", false, 0, "_HIDDEN.;1"},
+		{"my.dir", true, 0, "MY_DIR"},
+		{strings.Repeat("x", 40) + ".txt", false, 2, strings.Repeat("X", 25) + "_2.TXT;1"},
+	}
+	for _, tc := range cases {
+		if ident := string(isoIdent(tc.name, tc.dir, tc.seq)); ident != tc.ident {
+			t.Fatalf("bad: %s: %s", tc.name, ident)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+//go:generate packer-sdc struct-markdown
+//go:generate packer-sdc mapstructure-to-hcl2 -type NetworkInterface,ForwardedPort
+
+package common
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+)
+
+// NetworkConfig replaces the network interfaces of the VM. Without any
+// `network_interface` blocks, the iso and cloud builders add a shared
+// network interface and an emulated VLAN interface for the communicator, and
+// the utm and clone builders keep the interfaces of the source VM.
+//
+// The interfaces are exported in the given order. The communicator port is
+// forwarded on an emulated VLAN interface during the build, as UTM only
+// supports port forwarding in that mode, and the forward is removed before
+// the export.
+//
+// Additional ports of the guest can be forwarded with `forwarded_port`
+// blocks, e.g. to reach a service in the guest from a provisioner that runs
+// on the host. They are forwarded on the same interface as the communicator
+// port.
+type NetworkConfig struct {
+	// The network interfaces of the VM. See the network interface
+	// configuration below.
+	NetworkInterfaces []NetworkInterface `mapstructure:"network_interface" required:"false"`
+	// Ports of the guest to forward to the host during the build. See the
+	// forwarded port configuration below.
+	ForwardedPorts []ForwardedPort `mapstructure:"forwarded_port" required:"false"`
+}
+
+// A network interface of the VM.
+type NetworkInterface struct {
+	// The network mode: `shared`, `bridged`, `host` (host only) or
+	// `emulated` (emulated VLAN).
+	Mode string `mapstructure:"mode" required:"true"`
+	// The host interface to bridge, e.g. `en0`. Only for the `bridged`
+	// mode. Defaults to the interface UTM chooses.
+	BridgeInterface string `mapstructure:"bridge_interface" required:"false"`
+	// The emulated network card, e.g. `virtio-net-pci` or `e1000`. Defaults
+	// to the card UTM chooses for the architecture.
+	Hardware string `mapstructure:"hardware" required:"false"`
+	// The MAC address of the interface. Defaults to a random address.
+	MacAddress string `mapstructure:"mac_address" required:"false"`
+	// Forward the communicator port on this interface. Only one `emulated`
+	// interface can be marked. Defaults to the first `emulated` interface.
+	Communicator bool `mapstructure:"communicator" required:"false"`
+}
+
+// A port of the guest forwarded to the host. The host port is available to
+// provisioners as `build.ForwardedPort_<name>`.
+type ForwardedPort struct {
+	// The name of the rule, made of letters, digits and underscores.
+	// Defaults to the protocol followed by the guest port, e.g. `tcp8080`.
+	Name string `mapstructure:"name" required:"false"`
+	// The protocol to forward: `tcp` or `udp`. Defaults to `tcp`.
+	Protocol string `mapstructure:"protocol" required:"false"`
+	// The address of the guest to forward to. Defaults to the address the
+	// guest gets from UTM.
+	GuestAddress string `mapstructure:"guest_address" required:"false"`
+	// The port of the guest to forward to.
+	GuestPort int `mapstructure:"guest_port" required:"true"`
+	// The address of the host to listen on. Defaults to `127.0.0.1`.
+	HostAddress string `mapstructure:"host_address" required:"false"`
+	// The port of the host to listen on. Without it, a free port between
+	// `host_port_min` and `host_port_max` is picked.
+	HostPort int `mapstructure:"host_port" required:"false"`
+	// The minimum port to pick the host port from.
+	HostPortMin int `mapstructure:"host_port_min" required:"false"`
+	// The maximum port to pick the host port from.
+	HostPortMax int `mapstructure:"host_port_max" required:"false"`
+	// Keep the rule in the exported VM, with the host port used during the
+	// build. Defaults to `false`, which removes the rule before the export.
+	KeepInExport bool `mapstructure:"keep_in_export" required:"false"`
+}
+
+// NetworkModeEnumMap maps the network modes to their UTM enum codes.
+var NetworkModeEnumMap = map[string]string{
+	"shared":   "ShRd",
+	"bridged":  "BrDg",
+	"host":     "HsOn",
+	"emulated": "EmUd",
+}
+
+// ForwardedPortProtocolEnumMap maps the forwarded port protocols to their
+// UTM enum codes.
+var ForwardedPortProtocolEnumMap = map[string]string{
+	"tcp": "TcPp",
+	"udp": "UdPp",
+}
+
+var forwardedPortNameRe = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// defaultNetworkInterfaces are the interfaces the iso and cloud builders add
+// without network_interface blocks, as expected by Vagrant and Packer.
+var defaultNetworkInterfaces = []NetworkInterface{
+	{Mode: "shared"},
+	{Mode: "emulated", Communicator: true},
+}
+
+func (c *NetworkConfig) Prepare(ctx *interpolate.Context, comm *CommConfig) []error {
+	var errs []error
+
+	communicators := 0
+	for i, netIf := range c.NetworkInterfaces {
+		if _, ok := NetworkModeEnumMap[netIf.Mode]; !ok {
+			errs = append(errs, fmt.Errorf(
+				"network_interface %d: mode must be one of shared, bridged, host or emulated", i))
+		}
+		if netIf.BridgeInterface != "" && netIf.Mode != "bridged" {
+			errs = append(errs, fmt.Errorf(
+				"network_interface %d: bridge_interface can only be used in bridged mode", i))
+		}
+		if netIf.MacAddress != "" {
+			if _, err := net.ParseMAC(netIf.MacAddress); err != nil {
+				errs = append(errs, fmt.Errorf("network_interface %d: invalid mac_address: %s", i, err))
+			}
+		}
+		if netIf.Communicator {
+			communicators++
+			if netIf.Mode != "emulated" {
+				errs = append(errs, fmt.Errorf(
+					"network_interface %d: the communicator port can only be forwarded in emulated mode", i))
+			}
+		}
+	}
+	if communicators > 1 {
+		errs = append(errs, fmt.Errorf("only one network_interface can be marked for the communicator"))
+	}
+
+	if len(c.NetworkInterfaces) > 0 && comm.Comm.Type != "none" && !comm.SkipNatMapping &&
+		communicatorInterface(c.NetworkInterfaces) < 0 {
+		errs = append(errs, fmt.Errorf("an emulated network_interface is required "+
+			"to forward the communicator port, unless skip_nat_mapping is set"))
+	}
+
+	names := make(map[string]bool)
+	for i := range c.ForwardedPorts {
+		port := &c.ForwardedPorts[i]
+		if port.Protocol == "" {
+			port.Protocol = "tcp"
+		}
+		if port.HostAddress == "" {
+			port.HostAddress = "127.0.0.1"
+		}
+		if port.Name == "" {
+			port.Name = fmt.Sprintf("%s%d", port.Protocol, port.GuestPort)
+		}
+
+		if _, ok := ForwardedPortProtocolEnumMap[port.Protocol]; !ok {
+			errs = append(errs, fmt.Errorf("forwarded_port %d: protocol must be tcp or udp", i))
+		}
+		if !forwardedPortNameRe.MatchString(port.Name) {
+			errs = append(errs, fmt.Errorf(
+				"forwarded_port %d: name can only contain letters, digits and underscores", i))
+		} else if names[port.Name] {
+			errs = append(errs, fmt.Errorf("forwarded_port %d: duplicate name %q", i, port.Name))
+		}
+		names[port.Name] = true
+		if port.GuestPort < 1 || port.GuestPort > 65535 {
+			errs = append(errs, fmt.Errorf("forwarded_port %d: guest_port must be between 1 and 65535", i))
+		}
+		if port.GuestAddress != "" && net.ParseIP(port.GuestAddress) == nil {
+			errs = append(errs, fmt.Errorf("forwarded_port %d: invalid guest_address %q", i, port.GuestAddress))
+		}
+		if net.ParseIP(port.HostAddress) == nil {
+			errs = append(errs, fmt.Errorf("forwarded_port %d: invalid host_address %q", i, port.HostAddress))
+		}
+		if port.HostPort != 0 {
+			if port.HostPortMin != 0 || port.HostPortMax != 0 {
+				errs = append(errs, fmt.Errorf(
+					"forwarded_port %d: host_port can't be used with host_port_min and host_port_max", i))
+			}
+			if port.HostPort < 1 || port.HostPort > 65535 {
+				errs = append(errs, fmt.Errorf("forwarded_port %d: host_port must be between 1 and 65535", i))
+			}
+		} else if port.HostPortMin < 1 || port.HostPortMax > 65535 || port.HostPortMin > port.HostPortMax {
+			errs = append(errs, fmt.Errorf(
+				"forwarded_port %d: host_port, or a host_port_min and host_port_max range, is required", i))
+		}
+	}
+	if len(c.NetworkInterfaces) > 0 && len(c.ForwardedPorts) > 0 &&
+		communicatorInterface(c.NetworkInterfaces) < 0 {
+		errs = append(errs, fmt.Errorf("an emulated network_interface is required for forwarded_port"))
+	}
+
+	return errs
+}
+
+// GeneratedVars returns the names of the build variables with the host
+// ports of the forwarded ports.
+func (c *NetworkConfig) GeneratedVars() []string {
+	var vars []string
+	for _, port := range c.ForwardedPorts {
+		vars = append(vars, forwardedPortVar(port.Name))
+	}
+	return vars
+}
+
+func forwardedPortVar(name string) string {
+	return "ForwardedPort_" + name
+}
+
+// communicatorInterface returns the position of the interface to forward the
+// communicator port on, or -1 if there is none.
+func communicatorInterface(interfaces []NetworkInterface) int {
+	for i, netIf := range interfaces {
+		if netIf.Communicator {
+			return i
+		}
+	}
+	for i, netIf := range interfaces {
+		if netIf.Mode == "emulated" {
+			return i
+		}
+	}
+	return -1
+}
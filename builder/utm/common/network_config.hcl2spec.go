@@ -0,0 +1,78 @@
+// Code generated by "packer-sdc mapstructure-to-hcl2"; DO NOT EDIT.
+
+package common
+
+import (
+	"github.com/hashicorp/hcl/v2/hcldec"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// FlatForwardedPort is an auto-generated flat version of ForwardedPort.
+// Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
+type FlatForwardedPort struct {
+	Name         *string `mapstructure:"name" required:"false" cty:"name" hcl:"name"`
+	Protocol     *string `mapstructure:"protocol" required:"false" cty:"protocol" hcl:"protocol"`
+	GuestAddress *string `mapstructure:"guest_address" required:"false" cty:"guest_address" hcl:"guest_address"`
+	GuestPort    *int    `mapstructure:"guest_port" required:"true" cty:"guest_port" hcl:"guest_port"`
+	HostAddress  *string `mapstructure:"host_address" required:"false" cty:"host_address" hcl:"host_address"`
+	HostPort     *int    `mapstructure:"host_port" required:"false" cty:"host_port" hcl:"host_port"`
+	HostPortMin  *int    `mapstructure:"host_port_min" required:"false" cty:"host_port_min" hcl:"host_port_min"`
+	HostPortMax  *int    `mapstructure:"host_port_max" required:"false" cty:"host_port_max" hcl:"host_port_max"`
+	KeepInExport *bool   `mapstructure:"keep_in_export" required:"false" cty:"keep_in_export" hcl:"keep_in_export"`
+}
+
+// FlatMapstructure returns a new FlatForwardedPort.
+// FlatForwardedPort is an auto-generated flat version of ForwardedPort.
+// Where the contents a fields with a `mapstructure:,squash` tag are bubbled up.
+func (*ForwardedPort) FlatMapstructure() interface{ HCL2Spec() map[string]hcldec.Spec } {
+	return new(FlatForwardedPort)
+}
+
+// HCL2Spec returns the hcl spec of a ForwardedPort.
+// This spec is used by HCL to read the fields of ForwardedPort.
+// The decoded values from this spec will then be applied to a FlatForwardedPort.
+func (*FlatForwardedPort) HCL2Spec() map[string]hcldec.Spec {
+	s := map[string]hcldec.Spec{
+		"name":           &hcldec.AttrSpec{Name: "name", Type: cty.String, Required: false},
+		"protocol":       &hcldec.AttrSpec{Name: "protocol", Type: cty.String, Required: false},
+		"guest_address":  &hcldec.AttrSpec{Name: "guest_address", Type: cty.String, Required: false},
+		"guest_port":     &hcldec.AttrSpec{Name: "guest_port", Type: cty.Number, Required: false},
+		"host_address":   &hcldec.AttrSpec{Name: "host_address", Type: cty.String, Required: false},
+		"host_port":      &hcldec.AttrSpec{Name: "host_port", Type: cty.Number, Required: false},
+		"host_port_min":  &hcldec.AttrSpec{Name: "host_port_min", Type: cty.Number, Required: false},
+		"host_port_max":  &hcldec.AttrSpec{Name: "host_port_max", Type: cty.Number, Required: false},
+		"keep_in_export": &hcldec.AttrSpec{Name: "keep_in_export", Type: cty.Bool, Required: false},
+	}
+	return s
+}
+
+// FlatNetworkInterface is an auto-generated flat version of NetworkInterface.
+// Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
+type FlatNetworkInterface struct {
+	Mode            *string `mapstructure:"mode" required:"true" cty:"mode" hcl:"mode"`
+	BridgeInterface *string `mapstructure:"bridge_interface" required:"false" cty:"bridge_interface" hcl:"bridge_interface"`
+	Hardware        *string `mapstructure:"hardware" required:"false" cty:"hardware" hcl:"hardware"`
+	MacAddress      *string `mapstructure:"mac_address" required:"false" cty:"mac_address" hcl:"mac_address"`
+	Communicator    *bool   `mapstructure:"communicator" required:"false" cty:"communicator" hcl:"communicator"`
+}
+
+// FlatMapstructure returns a new FlatNetworkInterface.
+// FlatNetworkInterface is an auto-generated flat version of NetworkInterface.
+// Where the contents a fields with a `mapstructure:,squash` tag are bubbled up.
+func (*NetworkInterface) FlatMapstructure() interface{ HCL2Spec() map[string]hcldec.Spec } {
+	return new(FlatNetworkInterface)
+}
+
+// HCL2Spec returns the hcl spec of a NetworkInterface.
+// This spec is used by HCL to read the fields of NetworkInterface.
+// The decoded values from this spec will then be applied to a FlatNetworkInterface.
+func (*FlatNetworkInterface) HCL2Spec() map[string]hcldec.Spec {
+	s := map[string]hcldec.Spec{
+		"mode":             &hcldec.AttrSpec{Name: "mode", Type: cty.String, Required: false},
+		"bridge_interface": &hcldec.AttrSpec{Name: "bridge_interface", Type: cty.String, Required: false},
+		"hardware":         &hcldec.AttrSpec{Name: "hardware", Type: cty.String, Required: false},
+		"mac_address":      &hcldec.AttrSpec{Name: "mac_address", Type: cty.String, Required: false},
+		"communicator":     &hcldec.AttrSpec{Name: "communicator", Type: cty.Bool, Required: false},
+	}
+	return s
+}
@@ -0,0 +1,113 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/hashicorp/packer-plugin-sdk/communicator"
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+)
+
+func TestNetworkConfigPrepare(t *testing.T) {
+	ssh := &CommConfig{Comm: communicator.Config{Type: "ssh"}}
+
+	for _, c := range []*NetworkConfig{
+		{},
+		{NetworkInterfaces: []NetworkInterface{
+			{Mode: "bridged", BridgeInterface: "en0", MacAddress: "3E:4A:6F:12:9B:C0"},
+			{Mode: "emulated", Hardware: "e1000"},
+		}},
+		{NetworkInterfaces: []NetworkInterface{
+			{Mode: "emulated"},
+			{Mode: "emulated", Communicator: true},
+		}},
+	} {
+		if errs := c.Prepare(interpolate.NewContext(), ssh); len(errs) > 0 {
+			t.Fatalf("err: %#v", errs)
+		}
+	}
+
+	for _, c := range []*NetworkConfig{
+		{NetworkInterfaces: []NetworkInterface{{Mode: "nat"}, {Mode: "emulated"}}},
+		{NetworkInterfaces: []NetworkInterface{{Mode: "shared", BridgeInterface: "en0"}, {Mode: "emulated"}}},
+		{NetworkInterfaces: []NetworkInterface{{Mode: "emulated", MacAddress: "foo"}}},
+		{NetworkInterfaces: []NetworkInterface{{Mode: "shared", Communicator: true}, {Mode: "emulated"}}},
+		{NetworkInterfaces: []NetworkInterface{{Mode: "shared"}}},
+	} {
+		if errs := c.Prepare(interpolate.NewContext(), ssh); len(errs) != 1 {
+			t.Fatalf("should error: %#v: %#v", c, errs)
+		}
+	}
+
+	// Two interfaces marked for the communicator
+	c := &NetworkConfig{NetworkInterfaces: []NetworkInterface{
+		{Mode: "emulated", Communicator: true},
+		{Mode: "emulated", Communicator: true},
+	}}
+	if errs := c.Prepare(interpolate.NewContext(), ssh); len(errs) != 1 {
+		t.Fatalf("should error: %#v", errs)
+	}
+
+	// No forward is needed without a communicator or NAT mapping
+	c = &NetworkConfig{NetworkInterfaces: []NetworkInterface{{Mode: "bridged"}}}
+	for _, comm := range []*CommConfig{
+		{Comm: communicator.Config{Type: "none"}},
+		{Comm: communicator.Config{Type: "ssh"}, SkipNatMapping: true},
+	} {
+		if errs := c.Prepare(interpolate.NewContext(), comm); len(errs) > 0 {
+			t.Fatalf("err: %#v", errs)
+		}
+	}
+}
+
+func TestNetworkConfigPrepare_forwardedPorts(t *testing.T) {
+	ssh := &CommConfig{Comm: communicator.Config{Type: "ssh"}}
+
+	c := &NetworkConfig{ForwardedPorts: []ForwardedPort{
+		{GuestPort: 80, HostPort: 8080},
+		{Name: "dns", Protocol: "udp", GuestPort: 53, HostPortMin: 5300, HostPortMax: 5400, KeepInExport: true},
+	}}
+	if errs := c.Prepare(interpolate.NewContext(), ssh); len(errs) > 0 {
+		t.Fatalf("err: %#v", errs)
+	}
+	web := c.ForwardedPorts[0]
+	if web.Name != "tcp80" || web.Protocol != "tcp" || web.HostAddress != "127.0.0.1" {
+		t.Fatalf("bad: %#v", web)
+	}
+	if vars := c.GeneratedVars(); len(vars) != 2 || vars[0] != "ForwardedPort_tcp80" || vars[1] != "ForwardedPort_dns" {
+		t.Fatalf("bad: %#v", vars)
+	}
+
+	for _, port := range []ForwardedPort{
+		{Protocol: "sctp", GuestPort: 80, HostPort: 8080},
+		{Name: "web-1", GuestPort: 80, HostPort: 8080},
+		{GuestPort: 0, HostPort: 8080},
+		{GuestPort: 80, HostPort: 8080, GuestAddress: "guest"},
+		{GuestPort: 80, HostPort: 8080, HostAddress: "localhost"},
+		{GuestPort: 80, HostPort: 8080, HostPortMin: 8000, HostPortMax: 8100},
+		{GuestPort: 80},
+		{GuestPort: 80, HostPortMin: 8100, HostPortMax: 8000},
+	} {
+		c := &NetworkConfig{ForwardedPorts: []ForwardedPort{port}}
+		if errs := c.Prepare(interpolate.NewContext(), ssh); len(errs) != 1 {
+			t.Fatalf("should error: %#v: %#v", port, errs)
+		}
+	}
+
+	// The names are unique
+	c = &NetworkConfig{ForwardedPorts: []ForwardedPort{
+		{GuestPort: 80, HostPort: 8080},
+		{GuestPort: 80, GuestAddress: "10.0.2.16", HostPort: 8081},
+	}}
+	if errs := c.Prepare(interpolate.NewContext(), ssh); len(errs) != 1 {
+		t.Fatalf("should error: %#v", errs)
+	}
+
+	// The ports are forwarded on an emulated interface
+	c = &NetworkConfig{
+		NetworkInterfaces: []NetworkInterface{{Mode: "shared"}},
+		ForwardedPorts:    []ForwardedPort{{GuestPort: 80, HostPort: 8080}},
+	}
+	if errs := c.Prepare(interpolate.NewContext(), &CommConfig{Comm: communicator.Config{Type: "none"}}); len(errs) != 1 {
+		t.Fatalf("should error: %#v", errs)
+	}
+}
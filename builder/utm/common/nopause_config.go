@@ -16,7 +16,8 @@ type NoPauseConfig struct {
 	// false by default
 	DisplayNoPause bool `mapstructure:"display_nopause" required:"false"`
 	// If true, the build process will not pause to confirm successful boot.
-	// false by default
+	// false by default. The cloud builder doesn't pause, it waits for
+	// cloud-init to finish instead.
 	BootNoPause bool `mapstructure:"boot_nopause" required:"false"`
 	// If true, the build process will not pause to allow pre-export steps.
 	// false by default
@@ -0,0 +1,22 @@
+//go:build !windows
+// +build !windows
+
+package qcow2
+
+import (
+	"os"
+	"syscall"
+)
+
+// allocatedSize returns the disk space used by a file, which is smaller
+// than its size when it is sparse.
+func allocatedSize(f *os.File) (int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return int64(stat.Blocks) * 512, nil
+	}
+	return fi.Size(), nil
+}
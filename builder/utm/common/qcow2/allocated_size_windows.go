@@ -0,0 +1,16 @@
+//go:build windows
+// +build windows
+
+package qcow2
+
+import "os"
+
+// allocatedSize returns the size of a file, as Windows doesn't report the
+// disk space of sparse files through os.Stat.
+func allocatedSize(f *os.File) (int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
@@ -0,0 +1,314 @@
+package qcow2
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// The layout of the images written by FromRaw: 64 KiB clusters and 16 bits
+// refcounts, the defaults of qemu-img.
+const (
+	defaultClusterBits   = 16
+	defaultRefcountOrder = 4
+	// The length of a version 3 header, with the compression type
+	defaultHeaderLength = 112
+)
+
+// FromRaw converts the raw disk image src to the qcow2 image dst. Clusters
+// that only hold zeros aren't allocated.
+func FromRaw(src string, dst string) error {
+	return fromRaw(src, dst, defaultClusterBits)
+}
+
+func fromRaw(src string, dst string, clusterBits uint32) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	return create(dst, in, fi.Size(), clusterBits)
+}
+
+// Create writes the qcow2 image dst of a virtual disk of size bytes, whose
+// data is read from src, like the disk images of other formats. Clusters
+// that only hold zeros aren't allocated.
+func Create(dst string, src io.ReaderAt, size int64) error {
+	return create(dst, src, size, defaultClusterBits)
+}
+
+func create(dst string, in io.ReaderAt, size int64, clusterBits uint32) error {
+	cs := int64(1) << clusterBits
+	l2Entries := cs / 8
+	size = (size + 511) / 512 * 512
+	clusters := (size + cs - 1) / cs
+
+	// Find the clusters with data
+	buf := make([]byte, cs)
+	var data []int64
+	for i := int64(0); i < clusters; i++ {
+		if err := readCluster(in, buf, i*cs); err != nil {
+			return err
+		}
+		if !isZero(buf) {
+			data = append(data, i)
+		}
+	}
+
+	// The L2 tables of the L1 entries with data
+	l1Size := (clusters + l2Entries - 1) / l2Entries
+	l1Clusters := (l1Size*8 + cs - 1) / cs
+	tables := map[int64]int64{}
+	var tableOrder []int64
+	for _, c := range data {
+		if _, ok := tables[c/l2Entries]; !ok {
+			tables[c/l2Entries] = int64(len(tableOrder))
+			tableOrder = append(tableOrder, c/l2Entries)
+		}
+	}
+
+	// The refcount blocks cover every cluster, including themselves
+	perBlock := cs * 8 / (1 << defaultRefcountOrder)
+	tableClusters, blocks := int64(1), int64(1)
+	var total int64
+	for {
+		total = 1 + tableClusters + blocks + l1Clusters + int64(len(tableOrder)) + int64(len(data))
+		needBlocks := (total + perBlock - 1) / perBlock
+		needTableClusters := (needBlocks*8 + cs - 1) / cs
+		if needBlocks == blocks && needTableClusters == tableClusters {
+			break
+		}
+		blocks, tableClusters = needBlocks, needTableClusters
+	}
+	refcountTableOffset := cs
+	blocksOffset := refcountTableOffset + tableClusters*cs
+	l1Offset := blocksOffset + blocks*cs
+	l2Offset := l1Offset + l1Clusters*cs
+	dataOffset := l2Offset + int64(len(tableOrder))*cs
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if err := writeQcow2(out, in, clusterBits, size, data, tables, l1Size, refcountTableOffset,
+		blocksOffset, l1Offset, l2Offset, dataOffset, blocks, total); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+func writeQcow2(out *os.File, in io.ReaderAt, clusterBits uint32, size int64, data []int64,
+	tables map[int64]int64, l1Size, refcountTableOffset, blocksOffset, l1Offset, l2Offset,
+	dataOffset, blocks, total int64) error {
+	cs := int64(1) << clusterBits
+	l2Entries := cs / 8
+	be := binary.BigEndian
+
+	h := make([]byte, cs)
+	copy(h, Magic)
+	be.PutUint32(h[4:], 3)
+	be.PutUint32(h[20:], clusterBits)
+	be.PutUint64(h[24:], uint64(size))
+	be.PutUint32(h[36:], uint32(l1Size))
+	if l1Size > 0 {
+		be.PutUint64(h[40:], uint64(l1Offset))
+	}
+	be.PutUint64(h[48:], uint64(refcountTableOffset))
+	be.PutUint32(h[56:], uint32((blocksOffset-refcountTableOffset)/cs))
+	be.PutUint32(h[96:], defaultRefcountOrder)
+	be.PutUint32(h[100:], defaultHeaderLength)
+	// The header extensions end with a zeroed extension, after the header
+
+	refcountTable := make([]byte, blocksOffset-refcountTableOffset)
+	for i := int64(0); i < blocks; i++ {
+		be.PutUint64(refcountTable[8*i:], uint64(blocksOffset+i*cs))
+	}
+	refcounts := make([]byte, blocks*cs)
+	for i := int64(0); i < total; i++ {
+		be.PutUint16(refcounts[2*i:], 1)
+	}
+
+	l1 := make([]byte, l2Offset-l1Offset)
+	l2 := make([]byte, int64(len(tables))*cs)
+	for l1Index, table := range tables {
+		be.PutUint64(l1[8*l1Index:], uint64(l2Offset+table*cs)|entryCopied)
+	}
+	for i, c := range data {
+		table := tables[c/l2Entries]
+		be.PutUint64(l2[table*cs+8*(c%l2Entries):], uint64(dataOffset+int64(i)*cs)|entryCopied)
+	}
+
+	for _, w := range []struct {
+		b      []byte
+		offset int64
+	}{
+		{h, 0},
+		{refcountTable, refcountTableOffset},
+		{refcounts, blocksOffset},
+		{l1, l1Offset},
+		{l2, l2Offset},
+	} {
+		if _, err := out.WriteAt(w.b, w.offset); err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, cs)
+	for i, c := range data {
+		if err := readCluster(in, buf, c*cs); err != nil {
+			return err
+		}
+		if _, err := out.WriteAt(buf, dataOffset+int64(i)*cs); err != nil {
+			return err
+		}
+	}
+	return out.Sync()
+}
+
+// ToRaw converts the qcow2 image src to the raw disk image dst, which is
+// sparse where the image has no data.
+func ToRaw(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	h, err := readHeader(in)
+	if err != nil {
+		return fmt.Errorf("%s: %s", src, err)
+	}
+	switch {
+	case h.BackingFileOffset != 0:
+		return errors.New("images with a backing file aren't supported")
+	case h.IncompatibleFeatures&featureExternalData != 0:
+		return errors.New("images with an external data file aren't supported")
+	case h.IncompatibleFeatures&featureExtendedL2 != 0:
+		return errors.New("images with extended L2 entries aren't supported")
+	case h.CompressionType != 0:
+		return errors.New("only zlib compressed images are supported")
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if err := copyToRaw(out, in, h); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+func copyToRaw(out *os.File, in *os.File, h *header) error {
+	size := int64(h.Size)
+	if err := out.Truncate(size); err != nil {
+		return err
+	}
+
+	cs := h.clusterSize()
+	l2Entries := h.l2Entries()
+	l1 := make([]byte, int64(h.L1Size)*8)
+	if _, err := in.ReadAt(l1, int64(h.L1TableOffset)); err != nil {
+		return fmt.Errorf("error reading the L1 table: %s", err)
+	}
+
+	l2 := make([]byte, cs)
+	buf := make([]byte, cs)
+	for i := int64(0); i < int64(h.L1Size); i++ {
+		table := int64(binary.BigEndian.Uint64(l1[8*i:]) & offsetMask)
+		if table == 0 {
+			continue
+		}
+		if _, err := in.ReadAt(l2, table); err != nil {
+			return fmt.Errorf("error reading an L2 table: %s", err)
+		}
+
+		for j := int64(0); j < l2Entries; j++ {
+			guest := (i*l2Entries + j) * cs
+			if guest >= size {
+				break
+			}
+			n := cs
+			if size-guest < n {
+				n = size - guest
+			}
+
+			entry := binary.BigEndian.Uint64(l2[8*j:])
+			switch {
+			case entry&entryCompressed != 0:
+				if err := readCompressed(in, h, entry, buf); err != nil {
+					return err
+				}
+			case h.Version == 3 && entry&entryZero != 0, entry&offsetMask == 0:
+				continue
+			default:
+				if err := readCluster(in, buf, int64(entry&offsetMask)); err != nil {
+					return err
+				}
+			}
+			if isZero(buf[:n]) {
+				continue
+			}
+			if _, err := out.WriteAt(buf[:n], guest); err != nil {
+				return err
+			}
+		}
+	}
+	return out.Sync()
+}
+
+// readCompressed inflates a cluster compressed with zlib.
+func readCompressed(in io.ReaderAt, h *header, entry uint64, buf []byte) error {
+	descriptor := entry & (entryCompressed - 1)
+	offsetBits := 62 - (h.ClusterBits - 8)
+	offset := int64(descriptor & (1<<offsetBits - 1))
+	sectors := int64(descriptor >> offsetBits)
+	length := (sectors+1)*512 - offset%512
+
+	compressed := make([]byte, length)
+	// The last cluster may end before its last sector
+	n, err := in.ReadAt(compressed, offset)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	r := flate.NewReader(bytes.NewReader(compressed[:n]))
+	defer r.Close()
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return fmt.Errorf("error inflating the cluster at %d: %s", offset, err)
+	}
+	return nil
+}
+
+// readCluster reads the cluster at offset into buf, padded with zeros at
+// the end of the file.
+func readCluster(r io.ReaderAt, buf []byte, offset int64) error {
+	n, err := r.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	for i := n; i < len(buf); i++ {
+		buf[i] = 0
+	}
+	return nil
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,251 @@
+// Package qcow2 reads, grows and converts qcow2 disk images, the format of
+// the disks of QEMU VMs in UTM, so that cloud images can be prepared
+// without qemu-img.
+//
+// Only the active state of an image is read: images with a backing file,
+// encryption or an external data file aren't supported, and images with
+// internal snapshots can't be resized, like with qemu-img.
+package qcow2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Magic is the first bytes of a qcow2 image.
+var Magic = []byte{'Q', 'F', 'I', 0xfb}
+
+// Incompatible features of version 3 images.
+const (
+	featureDirty        = 1 << 0
+	featureCorrupt      = 1 << 1
+	featureExternalData = 1 << 2
+	featureCompression  = 1 << 3
+	featureExtendedL2   = 1 << 4
+	knownFeatures       = featureDirty | featureCorrupt | featureExternalData |
+		featureCompression | featureExtendedL2
+)
+
+// Flags and offsets of the L1 and L2 table entries.
+const (
+	entryCopied     = 1 << 63
+	entryCompressed = 1 << 62
+	entryZero       = 1 << 0
+	offsetMask      = 0x00fffffffffffe00
+)
+
+// header is the header of a qcow2 image.
+type header struct {
+	Version               uint32
+	BackingFileOffset     uint64
+	BackingFileSize       uint32
+	ClusterBits           uint32
+	Size                  uint64
+	CryptMethod           uint32
+	L1Size                uint32
+	L1TableOffset         uint64
+	RefcountTableOffset   uint64
+	RefcountTableClusters uint32
+	NbSnapshots           uint32
+	SnapshotsOffset       uint64
+	// Version 3 fields, with their defaults for version 2
+	IncompatibleFeatures uint64
+	CompatibleFeatures   uint64
+	AutoclearFeatures    uint64
+	RefcountOrder        uint32
+	HeaderLength         uint32
+	CompressionType      uint8
+}
+
+func readHeader(r io.ReaderAt) (*header, error) {
+	b := make([]byte, 105)
+	n, err := r.ReadAt(b, 0)
+	if n < 72 {
+		if err == nil || err == io.EOF {
+			err = errors.New("the image is too small")
+		}
+		return nil, err
+	}
+	if string(b[0:4]) != string(Magic) {
+		return nil, errors.New("the image isn't a qcow2 image")
+	}
+
+	be := binary.BigEndian
+	h := &header{
+		Version:               be.Uint32(b[4:]),
+		BackingFileOffset:     be.Uint64(b[8:]),
+		BackingFileSize:       be.Uint32(b[16:]),
+		ClusterBits:           be.Uint32(b[20:]),
+		Size:                  be.Uint64(b[24:]),
+		CryptMethod:           be.Uint32(b[32:]),
+		L1Size:                be.Uint32(b[36:]),
+		L1TableOffset:         be.Uint64(b[40:]),
+		RefcountTableOffset:   be.Uint64(b[48:]),
+		RefcountTableClusters: be.Uint32(b[56:]),
+		NbSnapshots:           be.Uint32(b[60:]),
+		SnapshotsOffset:       be.Uint64(b[64:]),
+		RefcountOrder:         4,
+		HeaderLength:          72,
+	}
+	switch h.Version {
+	case 2:
+	case 3:
+		if n < 104 {
+			return nil, errors.New("the header of the image is truncated")
+		}
+		h.IncompatibleFeatures = be.Uint64(b[72:])
+		h.CompatibleFeatures = be.Uint64(b[80:])
+		h.AutoclearFeatures = be.Uint64(b[88:])
+		h.RefcountOrder = be.Uint32(b[96:])
+		h.HeaderLength = be.Uint32(b[100:])
+		if h.HeaderLength > 104 && n > 104 {
+			h.CompressionType = b[104]
+		}
+	default:
+		return nil, fmt.Errorf("qcow2 version %d isn't supported", h.Version)
+	}
+
+	if h.ClusterBits < 9 || h.ClusterBits > 21 {
+		return nil, fmt.Errorf("the cluster size 2^%d is invalid", h.ClusterBits)
+	}
+	if h.RefcountOrder > 6 {
+		return nil, fmt.Errorf("the refcount order %d is invalid", h.RefcountOrder)
+	}
+	if h.IncompatibleFeatures&^knownFeatures != 0 {
+		return nil, fmt.Errorf("the image has unknown incompatible features: %#x", h.IncompatibleFeatures)
+	}
+	if h.IncompatibleFeatures&featureCorrupt != 0 {
+		return nil, errors.New("the image is marked corrupt")
+	}
+	if h.IncompatibleFeatures&featureDirty != 0 {
+		return nil, errors.New("the image is dirty, its refcounts must be repaired with qemu-img check -r all")
+	}
+	if h.CryptMethod != 0 {
+		return nil, errors.New("encrypted images aren't supported")
+	}
+	return h, nil
+}
+
+// write writes the fields of the header that are changed by a resize.
+func (h *header) write(w io.WriterAt) error {
+	b := make([]byte, 64-24)
+	be := binary.BigEndian
+	be.PutUint64(b[0:], h.Size)
+	be.PutUint32(b[8:], h.CryptMethod)
+	be.PutUint32(b[12:], h.L1Size)
+	be.PutUint64(b[16:], h.L1TableOffset)
+	be.PutUint64(b[24:], h.RefcountTableOffset)
+	be.PutUint32(b[32:], h.RefcountTableClusters)
+	be.PutUint32(b[36:], h.NbSnapshots)
+	_, err := w.WriteAt(b, 24)
+	return err
+}
+
+func (h *header) clusterSize() int64 {
+	return 1 << h.ClusterBits
+}
+
+// l2Entries returns the number of entries of an L2 table.
+func (h *header) l2Entries() int64 {
+	if h.IncompatibleFeatures&featureExtendedL2 != 0 {
+		return h.clusterSize() / 16
+	}
+	return h.clusterSize() / 8
+}
+
+// l1Entries returns the size of the L1 table of an image of the given size.
+func (h *header) l1Entries(size uint64) uint64 {
+	covered := uint64(h.clusterSize() * h.l2Entries())
+	return (size + covered - 1) / covered
+}
+
+// IsQcow2 reports whether the file at path is a qcow2 image.
+func IsQcow2(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	b := make([]byte, len(Magic))
+	if _, err := io.ReadFull(f, b); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		}
+		return false, err
+	}
+	return string(b) == string(Magic), nil
+}
+
+// Info is the information qemu-img info prints about a qcow2 image, with
+// the same JSON names.
+type Info struct {
+	VirtualSize    int64          `json:"virtual-size"`
+	Filename       string         `json:"filename"`
+	ClusterSize    int64          `json:"cluster-size"`
+	Format         string         `json:"format"`
+	ActualSize     int64          `json:"actual-size"`
+	DirtyFlag      bool           `json:"dirty-flag"`
+	FormatSpecific FormatSpecific `json:"format-specific"`
+}
+
+type FormatSpecific struct {
+	Type string      `json:"type"`
+	Data Qcow2Detail `json:"data"`
+}
+
+type Qcow2Detail struct {
+	Compat          string `json:"compat"`
+	CompressionType string `json:"compression-type,omitempty"`
+	LazyRefcounts   bool   `json:"lazy-refcounts"`
+	RefcountBits    int    `json:"refcount-bits"`
+	Corrupt         bool   `json:"corrupt"`
+	ExtendedL2      bool   `json:"extended-l2"`
+}
+
+// ReadInfo returns the information of the qcow2 image at path.
+func ReadInfo(path string) (*Info, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h, err := readHeader(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	actualSize, err := allocatedSize(f)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &Info{
+		VirtualSize: int64(h.Size),
+		Filename:    path,
+		ClusterSize: h.clusterSize(),
+		Format:      "qcow2",
+		ActualSize:  actualSize,
+		FormatSpecific: FormatSpecific{
+			Type: "qcow2",
+			Data: Qcow2Detail{
+				Compat:       "0.10",
+				RefcountBits: 1 << h.RefcountOrder,
+			},
+		},
+	}
+	if h.Version == 3 {
+		info.FormatSpecific.Data.Compat = "1.1"
+		info.FormatSpecific.Data.CompressionType = "zlib"
+		if h.CompressionType == 1 {
+			info.FormatSpecific.Data.CompressionType = "zstd"
+		}
+		// The lazy refcounts compatible feature
+		info.FormatSpecific.Data.LazyRefcounts = h.CompatibleFeatures&1 != 0
+		info.FormatSpecific.Data.ExtendedL2 = h.IncompatibleFeatures&featureExtendedL2 != 0
+	}
+	return info, nil
+}
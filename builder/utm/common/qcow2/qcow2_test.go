@@ -0,0 +1,332 @@
+package qcow2
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// testRawImage writes a raw image of the given size, with data at the
+// given offsets.
+func testRawImage(t *testing.T, size int64, data map[int64]string) string {
+	path := filepath.Join(t.TempDir(), "disk.img")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for offset, content := range data {
+		if _, err := f.WriteAt([]byte(content), offset); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	return path
+}
+
+// checkImage checks the refcounts of an image like qemu-img check: every
+// cluster used by the metadata or the data has a refcount of 1, and the
+// other clusters have none.
+func checkImage(t *testing.T, path string) {
+	img, err := openImage(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer img.f.Close()
+	h := img.h
+	cs := h.clusterSize()
+
+	used := map[int64]uint64{0: 1}
+	use := func(offset, length int64) {
+		for c := offset / cs; c < (offset+length+cs-1)/cs; c++ {
+			used[c]++
+		}
+	}
+	use(int64(h.RefcountTableOffset), int64(h.RefcountTableClusters)*cs)
+	for _, block := range img.refcountTable {
+		if block != 0 {
+			use(int64(block), cs)
+		}
+	}
+	use(int64(h.L1TableOffset), int64(h.L1Size)*8)
+	l1 := make([]byte, int64(h.L1Size)*8)
+	if _, err := img.f.ReadAt(l1, int64(h.L1TableOffset)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	l2 := make([]byte, cs)
+	for i := 0; i < len(l1); i += 8 {
+		table := int64(binary.BigEndian.Uint64(l1[i:]) & offsetMask)
+		if table == 0 {
+			continue
+		}
+		use(table, cs)
+		if _, err := img.f.ReadAt(l2, table); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		for j := 0; j < len(l2); j += 8 {
+			entry := binary.BigEndian.Uint64(l2[j:])
+			if entry&entryCompressed == 0 && entry&offsetMask != 0 {
+				use(int64(entry&offsetMask), cs)
+			}
+		}
+	}
+
+	for c := int64(0); c < img.end/cs; c++ {
+		refcount, err := img.refcount(c)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if refcount != used[c] {
+			t.Fatalf("bad refcount of cluster %d: %d, used %d times", c, refcount, used[c])
+		}
+	}
+}
+
+// checkQemuImg compares the image with qemu-img, when it is installed.
+func checkQemuImg(t *testing.T, path string) {
+	qemuImg, err := exec.LookPath("qemu-img")
+	if err != nil {
+		t.Log("qemu-img isn't installed")
+		return
+	}
+	if out, err := exec.Command(qemuImg, "check", path).CombinedOutput(); err != nil {
+		t.Fatalf("bad: %s: %s", err, out)
+	}
+	out, err := exec.Command(qemuImg, "info", "--output=json", path).Output()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	var expected, info Info
+	if err := json.Unmarshal(out, &expected); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	actual, err := ReadInfo(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	info = *actual
+	expected.Filename, info.Filename = "", ""
+	// Older versions of qemu-img don't print the compression type
+	if expected.FormatSpecific.Data.CompressionType == "" {
+		info.FormatSpecific.Data.CompressionType = ""
+	}
+	if expected != info {
+		t.Fatalf("bad: %#v, qemu-img: %#v", info, expected)
+	}
+}
+
+func readRaw(t *testing.T, path string) []byte {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return data
+}
+
+func TestFromRaw(t *testing.T) {
+	raw := testRawImage(t, 3*1024*1024+100, map[int64]string{
+		0:               "boot",
+		70000:           "data",
+		3*1024*1024 + 2: "end",
+	})
+	qcow2 := filepath.Join(t.TempDir(), "disk.qcow2")
+	if err := FromRaw(raw, qcow2); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if ok, err := IsQcow2(qcow2); !ok || err != nil {
+		t.Fatalf("bad: %t %v", ok, err)
+	}
+	if ok, err := IsQcow2(raw); ok || err != nil {
+		t.Fatalf("bad: %t %v", ok, err)
+	}
+
+	info, err := ReadInfo(qcow2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	// The size is rounded to sectors
+	if info.VirtualSize != 3*1024*1024+512 || info.ClusterSize != 65536 || info.Format != "qcow2" {
+		t.Fatalf("bad: %#v", info)
+	}
+	if data := info.FormatSpecific.Data; data.Compat != "1.1" || data.RefcountBits != 16 || data.CompressionType != "zlib" {
+		t.Fatalf("bad: %#v", info)
+	}
+	// The clusters without data aren't allocated: the header, refcount
+	// table and block, L1 and L2 tables, and 3 data clusters
+	if fi, _ := os.Stat(qcow2); fi.Size() != 8*65536 {
+		t.Fatalf("bad: %d", fi.Size())
+	}
+	checkImage(t, qcow2)
+	checkQemuImg(t, qcow2)
+
+	back := filepath.Join(t.TempDir(), "back.img")
+	if err := ToRaw(qcow2, back); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expected := append(readRaw(t, raw), make([]byte, 412)...)
+	if !bytes.Equal(readRaw(t, back), expected) {
+		t.Fatal("bad: the converted image differs")
+	}
+}
+
+func TestResize(t *testing.T) {
+	raw := testRawImage(t, 1024*1024, map[int64]string{4096: "data"})
+	qcow2 := filepath.Join(t.TempDir(), "disk.qcow2")
+	if err := FromRaw(raw, qcow2); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The L1 table grows in its cluster
+	if err := Resize(qcow2, 2*1024*1024*1024); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	info, err := ReadInfo(qcow2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if info.VirtualSize != 2*1024*1024*1024 {
+		t.Fatalf("bad: %#v", info)
+	}
+	checkImage(t, qcow2)
+	checkQemuImg(t, qcow2)
+
+	// The L1 table of 5 TiB needs 2 clusters
+	fi, _ := os.Stat(qcow2)
+	sizeBefore := fi.Size()
+	if err := Resize(qcow2, 5*1024*1024*1024*1024); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	img, err := openImage(qcow2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	img.f.Close()
+	if img.h.L1Size != 10240 || int64(img.h.L1TableOffset) != sizeBefore {
+		t.Fatalf("bad: %#v", img.h)
+	}
+	checkImage(t, qcow2)
+	checkQemuImg(t, qcow2)
+
+	// The data is kept
+	small := filepath.Join(t.TempDir(), "small.qcow2")
+	if err := FromRaw(raw, small); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := Resize(small, 64*1024*1024); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	back := filepath.Join(t.TempDir(), "back.img")
+	if err := ToRaw(small, back); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	data := readRaw(t, back)
+	if len(data) != 64*1024*1024 || string(data[4096:4100]) != "data" {
+		t.Fatalf("bad: %d", len(data))
+	}
+}
+
+func TestResize_refcountTable(t *testing.T) {
+	// With 512 bytes clusters, a cluster of the refcount table covers 8
+	// MiB, which a large L1 table exceeds
+	raw := testRawImage(t, 64*1024, map[int64]string{0: "boot"})
+	qcow2 := filepath.Join(t.TempDir(), "disk.qcow2")
+	if err := fromRaw(raw, qcow2, 9); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	checkImage(t, qcow2)
+
+	if err := Resize(qcow2, 64*1024*1024*1024); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	img, err := openImage(qcow2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	img.f.Close()
+	if img.h.RefcountTableClusters < 2 || img.h.RefcountTableOffset == 512 {
+		t.Fatalf("bad: %#v", img.h)
+	}
+	checkImage(t, qcow2)
+	checkQemuImg(t, qcow2)
+}
+
+func TestResize_invalid(t *testing.T) {
+	raw := testRawImage(t, 1024*1024, nil)
+	qcow2 := filepath.Join(t.TempDir(), "disk.qcow2")
+	if err := FromRaw(raw, qcow2); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for _, size := range []int64{0, 1000, 512 * 1024} {
+		if err := Resize(qcow2, size); err == nil {
+			t.Fatalf("should have error: %d", size)
+		}
+	}
+	if err := Resize(raw, 2*1024*1024); err == nil {
+		t.Fatal("should have error")
+	}
+
+	// Images with snapshots can't be resized
+	f, err := os.OpenFile(qcow2, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := f.WriteAt([]byte{0, 0, 0, 1}, 60); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	f.Close()
+	if err := Resize(qcow2, 2*1024*1024); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestToRaw_compressed(t *testing.T) {
+	content := bytes.Repeat([]byte("compressed "), 65536/11)
+	raw := testRawImage(t, 1024*1024, map[int64]string{65536: string(content)})
+	qcow2 := filepath.Join(t.TempDir(), "disk.qcow2")
+	if err := FromRaw(raw, qcow2); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Compress the data cluster at the end of the image, like qemu-img
+	// convert -c, at an offset which isn't aligned on sectors
+	f, err := os.OpenFile(qcow2, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	h, err := readHeader(f)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	l1 := make([]byte, 8)
+	f.ReadAt(l1, int64(h.L1TableOffset))
+	l2Offset := int64(binary.BigEndian.Uint64(l1) & offsetMask)
+	var compressed bytes.Buffer
+	w, _ := flate.NewWriter(&compressed, flate.BestCompression)
+	w.Write(append(content, make([]byte, 65536-len(content))...))
+	w.Close()
+	fi, _ := f.Stat()
+	offset := fi.Size() + 100
+	f.WriteAt(compressed.Bytes(), offset)
+	sectors := (offset%512+int64(compressed.Len())+511)/512 - 1
+	entry := uint64(entryCompressed) | uint64(sectors)<<54 | uint64(offset)
+	binary.BigEndian.PutUint64(l1, entry)
+	f.WriteAt(l1, l2Offset+8)
+	f.Close()
+
+	back := filepath.Join(t.TempDir(), "back.img")
+	if err := ToRaw(qcow2, back); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !bytes.Equal(readRaw(t, back), readRaw(t, raw)) {
+		t.Fatal("bad: the converted image differs")
+	}
+}
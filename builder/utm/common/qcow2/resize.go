@@ -0,0 +1,321 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// The largest L1 table qemu opens, in entries.
+const maxL1Entries = 32 * 1024 * 1024 / 8
+
+// Resize grows the virtual disk of the qcow2 image at path to size bytes.
+// The L1 table is moved to the end of the image when it is too small for
+// the new size, and the refcounts are updated for the clusters it uses.
+func Resize(path string, size int64) error {
+	if size <= 0 || size%512 != 0 {
+		return fmt.Errorf("the size must be a positive multiple of 512 bytes: %d", size)
+	}
+
+	img, err := openImage(path)
+	if err != nil {
+		return err
+	}
+	defer img.f.Close()
+
+	h := img.h
+	if h.NbSnapshots > 0 {
+		return errors.New("can't resize an image which has snapshots")
+	}
+	if uint64(size) < h.Size {
+		return fmt.Errorf("can't shrink the image from %d to %d bytes", h.Size, size)
+	}
+	if uint64(size) == h.Size {
+		return nil
+	}
+
+	if entries := h.l1Entries(uint64(size)); entries > uint64(h.L1Size) {
+		if entries > maxL1Entries {
+			return fmt.Errorf("the size %d is too large for the image", size)
+		}
+		if err := img.growL1(uint32(entries)); err != nil {
+			return fmt.Errorf("error growing the L1 table: %s", err)
+		}
+	}
+
+	h.Size = uint64(size)
+	if err := h.write(img.f); err != nil {
+		return err
+	}
+	if err := img.f.Sync(); err != nil {
+		return err
+	}
+	return img.f.Close()
+}
+
+// image is a qcow2 image open for writing. Clusters are allocated at its
+// end.
+type image struct {
+	f   *os.File
+	h   *header
+	end int64
+	// The refcount table, with the offsets of the refcount blocks
+	refcountTable []uint64
+}
+
+func openImage(path string) (*image, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	img := &image{f: f}
+	if err := img.load(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return img, nil
+}
+
+func (img *image) load() error {
+	h, err := readHeader(img.f)
+	if err != nil {
+		return err
+	}
+	img.h = h
+
+	fi, err := img.f.Stat()
+	if err != nil {
+		return err
+	}
+	cs := h.clusterSize()
+	img.end = (fi.Size() + cs - 1) / cs * cs
+
+	b := make([]byte, int64(h.RefcountTableClusters)*cs)
+	if _, err := img.f.ReadAt(b, int64(h.RefcountTableOffset)); err != nil {
+		return fmt.Errorf("error reading the refcount table: %s", err)
+	}
+	img.refcountTable = make([]uint64, len(b)/8)
+	for i := range img.refcountTable {
+		img.refcountTable[i] = binary.BigEndian.Uint64(b[8*i:])
+	}
+	return nil
+}
+
+// growL1 makes room for the given number of entries in the L1 table, in
+// its clusters if they are large enough, or in new clusters.
+func (img *image) growL1(entries uint32) error {
+	h := img.h
+	cs := h.clusterSize()
+	oldSize := int64(h.L1Size) * 8
+	oldClusters := (oldSize + cs - 1) / cs
+	newSize := int64(entries) * 8
+
+	if newSize <= oldClusters*cs {
+		// The padding of the table may not be zeroed
+		if _, err := img.f.WriteAt(make([]byte, newSize-oldSize), int64(h.L1TableOffset)+oldSize); err != nil {
+			return err
+		}
+		h.L1Size = entries
+		return nil
+	}
+
+	table := make([]byte, oldSize)
+	if _, err := img.f.ReadAt(table, int64(h.L1TableOffset)); err != nil {
+		return err
+	}
+	offset, err := img.allocate((newSize + cs - 1) / cs)
+	if err != nil {
+		return err
+	}
+	if _, err := img.f.WriteAt(table, offset); err != nil {
+		return err
+	}
+
+	oldOffset := int64(h.L1TableOffset)
+	h.L1TableOffset = uint64(offset)
+	h.L1Size = entries
+	if err := h.write(img.f); err != nil {
+		return err
+	}
+	for i := int64(0); i < oldClusters; i++ {
+		if err := img.addRefcount(oldOffset/cs+i, -1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allocate adds n zeroed clusters at the end of the image, and returns
+// their offset.
+func (img *image) allocate(n int64) (int64, error) {
+	cs := img.h.clusterSize()
+	offset := img.end
+	img.end += n * cs
+	if err := img.f.Truncate(img.end); err != nil {
+		return 0, err
+	}
+	for i := int64(0); i < n; i++ {
+		if err := img.addRefcount(offset/cs+i, 1); err != nil {
+			return 0, err
+		}
+	}
+	return offset, nil
+}
+
+// addRefcount adds delta to the refcount of a cluster, allocating its
+// refcount block, and a larger refcount table, when needed.
+func (img *image) addRefcount(cluster int64, delta int64) error {
+	h := img.h
+	cs := h.clusterSize()
+	bits := int64(1) << h.RefcountOrder
+	perBlock := cs * 8 / bits
+
+	index := cluster / perBlock
+	if index >= int64(len(img.refcountTable)) {
+		if err := img.growRefcountTable(index + 1); err != nil {
+			return err
+		}
+	}
+	if img.refcountTable[index] == 0 {
+		block := img.end
+		img.end += cs
+		if err := img.f.Truncate(img.end); err != nil {
+			return err
+		}
+		if err := img.setRefcountTableEntry(index, uint64(block)); err != nil {
+			return err
+		}
+		if err := img.addRefcount(block/cs, 1); err != nil {
+			return err
+		}
+	}
+
+	value, err := img.refcount(cluster)
+	if err != nil {
+		return err
+	}
+	updated := int64(value) + delta
+	if updated < 0 || (bits < 64 && updated >= 1<<bits) {
+		return fmt.Errorf("the refcount of cluster %d is out of range", cluster)
+	}
+	return img.setRefcount(cluster, uint64(updated))
+}
+
+// refcountLocation returns the offset of the byte, or first byte, of the
+// refcount of a cluster, and the bit of the refcount in that byte.
+func (img *image) refcountLocation(cluster int64) (int64, uint, int) {
+	h := img.h
+	bits := int64(1) << h.RefcountOrder
+	perBlock := h.clusterSize() * 8 / bits
+	block := int64(img.refcountTable[cluster/perBlock] &^ 511)
+	if block == 0 {
+		return 0, 0, 0
+	}
+	bit := (cluster % perBlock) * bits
+	width := int(bits / 8)
+	if width == 0 {
+		width = 1
+	}
+	return block + bit/8, uint(bit % 8), width
+}
+
+// refcount returns the refcount of a cluster, which is 0 if its refcount
+// block isn't allocated.
+func (img *image) refcount(cluster int64) (uint64, error) {
+	bits := uint(1) << img.h.RefcountOrder
+	perBlock := img.h.clusterSize() * 8 / int64(bits)
+	if cluster/perBlock >= int64(len(img.refcountTable)) {
+		return 0, nil
+	}
+	offset, shift, width := img.refcountLocation(cluster)
+	if offset == 0 {
+		return 0, nil
+	}
+	b := make([]byte, width)
+	if _, err := img.f.ReadAt(b, offset); err != nil {
+		return 0, err
+	}
+	if bits < 8 {
+		return uint64(b[0]>>shift) & (1<<bits - 1), nil
+	}
+	var value uint64
+	for _, c := range b {
+		value = value<<8 | uint64(c)
+	}
+	return value, nil
+}
+
+// setRefcount sets the refcount of a cluster, whose refcount block must
+// be allocated.
+func (img *image) setRefcount(cluster int64, value uint64) error {
+	bits := uint(1) << img.h.RefcountOrder
+	offset, shift, width := img.refcountLocation(cluster)
+	b := make([]byte, width)
+	if bits < 8 {
+		if _, err := img.f.ReadAt(b, offset); err != nil {
+			return err
+		}
+		mask := byte(1<<bits-1) << shift
+		b[0] = b[0]&^mask | byte(value)<<shift
+	} else {
+		for i := len(b) - 1; i >= 0; i-- {
+			b[i] = byte(value)
+			value >>= 8
+		}
+	}
+	_, err := img.f.WriteAt(b, offset)
+	return err
+}
+
+func (img *image) setRefcountTableEntry(index int64, block uint64) error {
+	img.refcountTable[index] = block
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, block)
+	_, err := img.f.WriteAt(b, int64(img.h.RefcountTableOffset)+index*8)
+	return err
+}
+
+// growRefcountTable moves the refcount table to the end of the image, with
+// room for the given number of refcount blocks, and one more for the
+// refcount block of the table itself.
+func (img *image) growRefcountTable(entries int64) error {
+	h := img.h
+	cs := h.clusterSize()
+	clusters := (entries*8+cs-1)/cs + 1
+
+	offset := img.end
+	img.end += clusters * cs
+	if err := img.f.Truncate(img.end); err != nil {
+		return err
+	}
+	table := make([]uint64, clusters*cs/8)
+	copy(table, img.refcountTable)
+	b := make([]byte, clusters*cs)
+	for i, entry := range table {
+		binary.BigEndian.PutUint64(b[8*i:], entry)
+	}
+	if _, err := img.f.WriteAt(b, offset); err != nil {
+		return err
+	}
+
+	oldOffset, oldClusters := int64(h.RefcountTableOffset), int64(h.RefcountTableClusters)
+	img.refcountTable = table
+	h.RefcountTableOffset = uint64(offset)
+	h.RefcountTableClusters = uint32(clusters)
+	if err := h.write(img.f); err != nil {
+		return err
+	}
+
+	for i := int64(0); i < clusters; i++ {
+		if err := img.addRefcount(offset/cs+i, 1); err != nil {
+			return err
+		}
+	}
+	for i := int64(0); i < oldClusters; i++ {
+		if err := img.addRefcount(oldOffset/cs+i, -1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
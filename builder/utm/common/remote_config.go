@@ -0,0 +1,109 @@
+//go:generate packer-sdc struct-markdown
+
+package common
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/hashicorp/packer-plugin-sdk/pathing"
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+)
+
+// RemoteConfig configures a UTM that runs on another Mac. When
+// `remote_host` is set, the utmctl commands and AppleScripts are run on that
+// host over SSH, the ISOs, seeds and cd_files are copied to it, the exported
+// VM is copied back into `output_directory`, and the communicator and VNC
+// connections are tunneled through the same SSH connection. The host ports
+// of the communicator and of the TCP `forwarded_ports` are picked to be
+// free on both machines. This lets
+// Packer run on a machine without UTM, e.g. a Linux CI controller. The
+// HTTP server for `http_directory` still runs on the Packer machine, so
+// `http_bind_address` or `http_interface` must be set to an address of it
+// that the VMs on the remote host can reach: the address can't be
+// discovered from the networks of the VMs, which are the remote host's.
+// The cloud builder can write its seed to a CD with `use_cd` instead.
+//
+// ```hcl
+// remote_host             = "mac-mini-01.example.com"
+// remote_username         = "ci"
+// remote_private_key_file = "~/.ssh/id_ed25519"
+// ```
+type RemoteConfig struct {
+	// The hostname or IP address of the Mac that runs UTM. By default UTM
+	// runs on the same machine as Packer.
+	RemoteHost string `mapstructure:"remote_host" required:"false"`
+	// The SSH port of the remote host. Defaults to `22`.
+	RemotePort int `mapstructure:"remote_port" required:"false"`
+	// The user to log in to the remote host as. Defaults to the current user.
+	// The user must be logged in to the Mac's desktop session, as UTM and
+	// its AppleScript support only run there.
+	RemoteUsername string `mapstructure:"remote_username" required:"false"`
+	// The password of the remote user. Prefer `remote_private_key_file` or
+	// an SSH agent.
+	RemotePassword string `mapstructure:"remote_password" required:"false"`
+	// The private key to authenticate with. If neither this nor
+	// `remote_password` is set, the keys of the SSH agent (`SSH_AUTH_SOCK`)
+	// are used.
+	RemotePrivateKeyFile string `mapstructure:"remote_private_key_file" required:"false"`
+	// The known_hosts file to verify the key of the remote host with.
+	// Defaults to `~/.ssh/known_hosts`.
+	RemoteKnownHostsFile string `mapstructure:"remote_known_hosts_file" required:"false"`
+	// Don't verify the key of the remote host. Defaults to `false`.
+	RemoteSkipHostKeyCheck bool `mapstructure:"remote_skip_host_key_check" required:"false"`
+	// The path of utmctl on the remote host. Defaults to
+	// `/Applications/UTM.app/Contents/MacOS/utmctl`, as the PATH of a
+	// non-interactive SSH session does not usually contain it.
+	RemoteUtmctlPath string `mapstructure:"remote_utmctl_path" required:"false"`
+	// The path of qemu-img on the remote host, which is needed to change
+	// the disk images of the VMs, e.g. for `provision_snapshot`. Defaults to
+	// `/opt/homebrew/bin/qemu-img`, where Homebrew installs it.
+	RemoteQemuImgPath string `mapstructure:"remote_qemu_img_path" required:"false"`
+}
+
+func (c *RemoteConfig) Prepare(ctx *interpolate.Context) []error {
+	var errs []error
+
+	if c.RemoteHost == "" {
+		return nil
+	}
+
+	if c.RemotePort == 0 {
+		c.RemotePort = 22
+	}
+	if c.RemotePort < 1 || c.RemotePort > 65535 {
+		errs = append(errs, fmt.Errorf("remote_port must be a valid port number"))
+	}
+
+	if c.RemoteUtmctlPath == "" {
+		c.RemoteUtmctlPath = "/Applications/UTM.app/Contents/MacOS/utmctl"
+	}
+
+	if c.RemoteQemuImgPath == "" {
+		c.RemoteQemuImgPath = "/opt/homebrew/bin/qemu-img"
+	}
+
+	if c.RemotePrivateKeyFile != "" {
+		path, err := pathing.ExpandUser(c.RemotePrivateKeyFile)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("remote_private_key_file is invalid: %s", err))
+		} else if _, err := os.Stat(path); err != nil {
+			errs = append(errs, fmt.Errorf("remote_private_key_file is invalid: %s", err))
+		}
+		c.RemotePrivateKeyFile = path
+	}
+
+	if c.RemoteKnownHostsFile != "" {
+		path, err := pathing.ExpandUser(c.RemoteKnownHostsFile)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("remote_known_hosts_file is invalid: %s", err))
+		}
+		c.RemoteKnownHostsFile = path
+	}
+
+	if c.RemoteKnownHostsFile != "" && c.RemoteSkipHostKeyCheck {
+		errs = append(errs, fmt.Errorf("remote_known_hosts_file and remote_skip_host_key_check can not be used together"))
+	}
+
+	return errs
+}
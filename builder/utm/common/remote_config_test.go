@@ -0,0 +1,57 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+)
+
+func TestRemoteConfigPrepare_local(t *testing.T) {
+	c := new(RemoteConfig)
+	if errs := c.Prepare(interpolate.NewContext()); len(errs) > 0 {
+		t.Fatalf("err: %#v", errs)
+	}
+	if c.RemotePort != 0 || c.RemoteUtmctlPath != "" {
+		t.Fatalf("defaults should only be set for remote hosts: %#v", c)
+	}
+}
+
+func TestRemoteConfigPrepare_defaults(t *testing.T) {
+	c := &RemoteConfig{RemoteHost: "mac.example.com"}
+	if errs := c.Prepare(interpolate.NewContext()); len(errs) > 0 {
+		t.Fatalf("err: %#v", errs)
+	}
+	if c.RemotePort != 22 {
+		t.Fatalf("bad: %d", c.RemotePort)
+	}
+	if c.RemoteUtmctlPath != "/Applications/UTM.app/Contents/MacOS/utmctl" {
+		t.Fatalf("bad: %s", c.RemoteUtmctlPath)
+	}
+	if c.RemoteQemuImgPath != "/opt/homebrew/bin/qemu-img" {
+		t.Fatalf("bad: %s", c.RemoteQemuImgPath)
+	}
+}
+
+func TestRemoteConfigPrepare_invalid(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(keyFile, []byte("key"), 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	c := &RemoteConfig{RemoteHost: "mac.example.com", RemotePrivateKeyFile: keyFile}
+	if errs := c.Prepare(interpolate.NewContext()); len(errs) > 0 {
+		t.Fatalf("err: %#v", errs)
+	}
+
+	for _, c := range []*RemoteConfig{
+		{RemoteHost: "mac.example.com", RemotePort: 70000},
+		{RemoteHost: "mac.example.com", RemotePrivateKeyFile: keyFile + ".missing"},
+		{RemoteHost: "mac.example.com", RemoteKnownHostsFile: keyFile, RemoteSkipHostKeyCheck: true},
+	} {
+		if errs := c.Prepare(interpolate.NewContext()); len(errs) != 1 {
+			t.Fatalf("should error: %#v", c)
+		}
+	}
+}
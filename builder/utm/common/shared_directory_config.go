@@ -0,0 +1,129 @@
+//go:generate packer-sdc struct-markdown
+//go:generate packer-sdc mapstructure-to-hcl2 -type SharedDirectory
+
+package common
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+)
+
+// SharedDirectoryConfig shares a directory of the host with the guest
+// during the build, e.g. to give provisioners access to large files
+// without uploading them over the communicator. The share is added before
+// the VM is started, and removed before the export unless
+// `keep_in_artifact` is set.
+type SharedDirectoryConfig struct {
+	// The directory to share. See the shared directory configuration
+	// below. Needs a UTM version whose scripting supports the registry of a
+	// VM.
+	SharedDirectory *SharedDirectory `mapstructure:"shared_directory" required:"false"`
+}
+
+// A directory of the host shared with the guest.
+type SharedDirectory struct {
+	// The path of the directory on the machine that runs UTM.
+	Path string `mapstructure:"path" required:"true"`
+	// How the directory is shared: `virtfs` or `webdav` for a QEMU VM, and
+	// `virtiofs` for an Apple VM. Defaults to `virtfs`, or `virtiofs` for
+	// an Apple VM. Required by the utm and clone builders, which don't know
+	// the backend of the source VM.
+	Mode string `mapstructure:"mode" required:"false"`
+	// Mount the directory read-only in the guest. UTM can't restrict the
+	// share itself, so this sets the `ro` option of `mount_command`.
+	// Defaults to `false`.
+	ReadOnly bool `mapstructure:"read_only" required:"false"`
+	// Keep the share in the exported VM. Defaults to `false`, which
+	// removes it before the export, and restores the directories and the
+	// share mode the VM had before the build, e.g. the ones of a source VM.
+	KeepInArtifact bool `mapstructure:"keep_in_artifact" required:"false"`
+	// Where to mount the directory in the guest once the communicator has
+	// connected. The directory isn't mounted when this is unset.
+	MountPoint string `mapstructure:"mount_point" required:"false"`
+	// The command that mounts the directory in the guest. It is a template
+	// with the variables `MountPoint`, `Tag`, the name of the share, and
+	// `Options`, which is `ro` or `rw`. The default mounts the share
+	// with sudo on Linux, for the `virtfs` mode:
+	// `sudo mkdir -p {{.MountPoint}} && sudo mount -t 9p -o trans=virtio,version=9p2000.L,{{.Options}} {{.Tag}} {{.MountPoint}}`.
+	MountCommand string `mapstructure:"mount_command" required:"false"`
+
+	ctx interpolate.Context
+}
+
+// DirectoryShareModeEnumMap maps the share modes of QEMU VMs to their UTM
+// enum codes. Apple VMs always share with VirtioFS.
+var DirectoryShareModeEnumMap = map[string]string{
+	"none":   "SmOf",
+	"webdav": "SmWv",
+	"virtfs": "SmVs",
+}
+
+// The name UTM gives the share in the guest.
+const sharedDirectoryTag = "share"
+
+// defaultMountCommands are the Linux mount commands of the share modes.
+var defaultMountCommands = map[string]string{
+	"virtfs":   "sudo mkdir -p {{.MountPoint}} && sudo mount -t 9p -o trans=virtio,version=9p2000.L,{{.Options}} {{.Tag}} {{.MountPoint}}",
+	"virtiofs": "sudo mkdir -p {{.MountPoint}} && sudo mount -t virtiofs -o {{.Options}} {{.Tag}} {{.MountPoint}}",
+	// spice-webdavd serves the share in the guest
+	"webdav": "sudo mkdir -p {{.MountPoint}} && sudo mount -t davfs -o {{.Options}} http://127.0.0.1:9843 {{.MountPoint}}",
+}
+
+// Prepare sets the defaults of the shared directory. The backend is "qemu"
+// or "apple", or empty if the builder doesn't know it, e.g. for an
+// imported VM, which needs the mode to be set. The block isn't
+// interpolated when the config is decoded, as the mount command is
+// rendered once the guest is up.
+func (c *SharedDirectoryConfig) Prepare(ctx *interpolate.Context, backend string) []error {
+	dir := c.SharedDirectory
+	if dir == nil {
+		return nil
+	}
+	dir.ctx = *ctx
+
+	var errs []error
+	var err error
+	if dir.Path, err = interpolate.Render(dir.Path, ctx); err != nil {
+		errs = append(errs, fmt.Errorf("shared_directory: error parsing path: %s", err))
+	}
+	if dir.MountPoint, err = interpolate.Render(dir.MountPoint, ctx); err != nil {
+		errs = append(errs, fmt.Errorf("shared_directory: error parsing mount_point: %s", err))
+	}
+	if dir.Path == "" {
+		errs = append(errs, fmt.Errorf("shared_directory: path is required"))
+	}
+
+	switch {
+	case dir.Mode != "":
+	case backend == "qemu":
+		dir.Mode = "virtfs"
+	case backend == "apple":
+		dir.Mode = "virtiofs"
+	default:
+		errs = append(errs, fmt.Errorf("shared_directory: mode is required, as the backend of the source VM isn't known"))
+	}
+	switch {
+	case dir.Mode == "":
+	case dir.Mode == "virtiofs" && backend == "qemu",
+		(dir.Mode == "virtfs" || dir.Mode == "webdav") && backend == "apple":
+		errs = append(errs, fmt.Errorf("shared_directory: mode %s can't be used with the %s backend", dir.Mode, backend))
+	case dir.Mode != "virtfs" && dir.Mode != "webdav" && dir.Mode != "virtiofs":
+		errs = append(errs, fmt.Errorf("shared_directory: mode must be virtfs, webdav or virtiofs"))
+	}
+
+	if dir.MountCommand == "" {
+		dir.MountCommand = defaultMountCommands[dir.Mode]
+	}
+	if err := interpolate.Validate(dir.MountCommand, ctx); err != nil {
+		errs = append(errs, fmt.Errorf("shared_directory: error parsing mount_command: %s", err))
+	}
+
+	return errs
+}
+
+// ModeEnumCode returns the UTM enum code of the share mode, or "" for
+// VirtioFS, which is the only mode of Apple VMs.
+func (d *SharedDirectory) ModeEnumCode() string {
+	return DirectoryShareModeEnumMap[d.Mode]
+}
@@ -0,0 +1,41 @@
+// Code generated by "packer-sdc mapstructure-to-hcl2"; DO NOT EDIT.
+
+package common
+
+import (
+	"github.com/hashicorp/hcl/v2/hcldec"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// FlatSharedDirectory is an auto-generated flat version of SharedDirectory.
+// Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
+type FlatSharedDirectory struct {
+	Path           *string `mapstructure:"path" required:"true" cty:"path" hcl:"path"`
+	Mode           *string `mapstructure:"mode" required:"false" cty:"mode" hcl:"mode"`
+	ReadOnly       *bool   `mapstructure:"read_only" required:"false" cty:"read_only" hcl:"read_only"`
+	KeepInArtifact *bool   `mapstructure:"keep_in_artifact" required:"false" cty:"keep_in_artifact" hcl:"keep_in_artifact"`
+	MountPoint     *string `mapstructure:"mount_point" required:"false" cty:"mount_point" hcl:"mount_point"`
+	MountCommand   *string `mapstructure:"mount_command" required:"false" cty:"mount_command" hcl:"mount_command"`
+}
+
+// FlatMapstructure returns a new FlatSharedDirectory.
+// FlatSharedDirectory is an auto-generated flat version of SharedDirectory.
+// Where the contents a fields with a `mapstructure:,squash` tag are bubbled up.
+func (*SharedDirectory) FlatMapstructure() interface{ HCL2Spec() map[string]hcldec.Spec } {
+	return new(FlatSharedDirectory)
+}
+
+// HCL2Spec returns the hcl spec of a SharedDirectory.
+// This spec is used by HCL to read the fields of SharedDirectory.
+// The decoded values from this spec will then be applied to a FlatSharedDirectory.
+func (*FlatSharedDirectory) HCL2Spec() map[string]hcldec.Spec {
+	s := map[string]hcldec.Spec{
+		"path":             &hcldec.AttrSpec{Name: "path", Type: cty.String, Required: false},
+		"mode":             &hcldec.AttrSpec{Name: "mode", Type: cty.String, Required: false},
+		"read_only":        &hcldec.AttrSpec{Name: "read_only", Type: cty.Bool, Required: false},
+		"keep_in_artifact": &hcldec.AttrSpec{Name: "keep_in_artifact", Type: cty.Bool, Required: false},
+		"mount_point":      &hcldec.AttrSpec{Name: "mount_point", Type: cty.String, Required: false},
+		"mount_command":    &hcldec.AttrSpec{Name: "mount_command", Type: cty.String, Required: false},
+	}
+	return s
+}
@@ -0,0 +1,77 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+)
+
+func TestSharedDirectoryConfigPrepare(t *testing.T) {
+	c := &SharedDirectoryConfig{}
+	if errs := c.Prepare(interpolate.NewContext(), "qemu"); len(errs) > 0 {
+		t.Fatalf("err: %#v", errs)
+	}
+
+	c = &SharedDirectoryConfig{SharedDirectory: &SharedDirectory{Path: "/share", MountPoint: "/mnt/share"}}
+	if errs := c.Prepare(interpolate.NewContext(), "apple"); len(errs) > 0 {
+		t.Fatalf("err: %#v", errs)
+	}
+	if c.SharedDirectory.Mode != "virtiofs" || c.SharedDirectory.ModeEnumCode() != "" {
+		t.Fatalf("bad: %#v", c.SharedDirectory)
+	}
+
+	c = &SharedDirectoryConfig{SharedDirectory: &SharedDirectory{Path: "/share"}}
+	if errs := c.Prepare(interpolate.NewContext(), "qemu"); len(errs) > 0 {
+		t.Fatalf("err: %#v", errs)
+	}
+	if c.SharedDirectory.Mode != "virtfs" || c.SharedDirectory.ModeEnumCode() != "SmVs" {
+		t.Fatalf("bad: %#v", c.SharedDirectory)
+	}
+
+	// The mode of a VM with an unknown backend is set
+	c = &SharedDirectoryConfig{SharedDirectory: &SharedDirectory{Path: "/share", Mode: "virtiofs"}}
+	if errs := c.Prepare(interpolate.NewContext(), ""); len(errs) > 0 {
+		t.Fatalf("err: %#v", errs)
+	}
+	if c.SharedDirectory.ModeEnumCode() != "" || c.SharedDirectory.MountCommand != defaultMountCommands["virtiofs"] {
+		t.Fatalf("bad: %#v", c.SharedDirectory)
+	}
+
+	for _, tc := range []struct {
+		Dir     SharedDirectory
+		Backend string
+	}{
+		{SharedDirectory{}, "qemu"},
+		{SharedDirectory{Path: "/share"}, ""},
+		{SharedDirectory{Path: "/share", Mode: "smb"}, "qemu"},
+		{SharedDirectory{Path: "/share", Mode: "virtiofs"}, "qemu"},
+		{SharedDirectory{Path: "/share", Mode: "webdav"}, "apple"},
+		{SharedDirectory{Path: "/share", MountCommand: "mount {{.MountPoint"}, "qemu"},
+	} {
+		dir := tc.Dir
+		c := &SharedDirectoryConfig{SharedDirectory: &dir}
+		if errs := c.Prepare(interpolate.NewContext(), tc.Backend); len(errs) != 1 {
+			t.Fatalf("should error: %#v: %#v", tc, errs)
+		}
+	}
+}
+
+func TestSharedDirectory_renderMountCommand(t *testing.T) {
+	c := &SharedDirectoryConfig{SharedDirectory: &SharedDirectory{
+		Path:       "/share",
+		ReadOnly:   true,
+		MountPoint: "/mnt/share",
+	}}
+	if errs := c.Prepare(interpolate.NewContext(), "qemu"); len(errs) > 0 {
+		t.Fatalf("err: %#v", errs)
+	}
+
+	command, err := c.SharedDirectory.RenderMountCommand()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expected := "sudo mkdir -p /mnt/share && sudo mount -t 9p -o trans=virtio,version=9p2000.L,ro share /mnt/share"
+	if command != expected {
+		t.Fatalf("bad: %s", command)
+	}
+}
@@ -0,0 +1,57 @@
+//go:generate packer-sdc struct-markdown
+
+package common
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+)
+
+// SnapshotConfig configures a snapshot of the disks that is taken once the
+// communicator has connected, e.g. after the OS was installed from the ISO,
+// so that failed provisioning can be rolled back instead of rebuilding the
+// VM. To take the snapshot, the VM is shut down with `shutdown_command`,
+// `qemu-img snapshot` snapshots its qcow2 disks inside the bundle, and the
+// VM is started and connected to again. `shutdown_command` is required, as
+// halting the VM could lose the writes the guest has not flushed to the
+// disks yet. The snapshot is removed after the
+// final shutdown, before the VM is exported.
+//
+// qemu-img must be installed on the machine that runs UTM, e.g. with
+// `brew install qemu`. Only VMs with the QEMU backend have qcow2 disks.
+//
+// ```hcl
+// provision_snapshot = true
+// provision_retries  = 2
+// ```
+type SnapshotConfig struct {
+	// Snapshot the disks after connecting to the VM. Defaults to `false`.
+	ProvisionSnapshot bool `mapstructure:"provision_snapshot" required:"false"`
+	// How many times to roll back to the snapshot and run the provisioners
+	// again when they fail. Defaults to `0`, which does not retry.
+	ProvisionRetries int `mapstructure:"provision_retries" required:"false"`
+	// Roll back to the snapshot when the provisioners failed for the last
+	// time, before the build stops. Together with `-on-error=abort`, this
+	// leaves the VM as it was before provisioning, ready to try the
+	// provisioners by hand. Defaults to `false`.
+	ProvisionRollback bool `mapstructure:"provision_rollback" required:"false"`
+}
+
+func (c *SnapshotConfig) Prepare(ctx *interpolate.Context, shutdownCommand string) []error {
+	var errs []error
+
+	if c.ProvisionSnapshot && shutdownCommand == "" {
+		errs = append(errs, fmt.Errorf("provision_snapshot requires shutdown_command"))
+	}
+
+	if c.ProvisionRetries < 0 {
+		errs = append(errs, fmt.Errorf("provision_retries can not be negative"))
+	}
+
+	if !c.ProvisionSnapshot && (c.ProvisionRetries > 0 || c.ProvisionRollback) {
+		errs = append(errs, fmt.Errorf("provision_retries and provision_rollback require provision_snapshot"))
+	}
+
+	return errs
+}
@@ -0,0 +1,35 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+)
+
+func TestSnapshotConfigPrepare(t *testing.T) {
+	for _, c := range []*SnapshotConfig{
+		{},
+		{ProvisionSnapshot: true},
+		{ProvisionSnapshot: true, ProvisionRetries: 2, ProvisionRollback: true},
+	} {
+		if errs := c.Prepare(interpolate.NewContext(), "shutdown -P now"); len(errs) > 0 {
+			t.Fatalf("err: %#v", errs)
+		}
+	}
+
+	for _, c := range []*SnapshotConfig{
+		{ProvisionSnapshot: true, ProvisionRetries: -1},
+		{ProvisionRetries: 1},
+		{ProvisionRollback: true},
+	} {
+		if errs := c.Prepare(interpolate.NewContext(), "shutdown -P now"); len(errs) != 1 {
+			t.Fatalf("should error: %#v", c)
+		}
+	}
+
+	// Halting the VM to snapshot its disks could lose writes
+	c := &SnapshotConfig{ProvisionSnapshot: true}
+	if errs := c.Prepare(interpolate.NewContext(), ""); len(errs) != 1 {
+		t.Fatalf("should error: %#v", c)
+	}
+}
@@ -34,7 +34,7 @@ func (s *StepAttachDisplay) Run(ctx context.Context, state multistep.StateBag) m
 		"--hardware", s.HardwareType,
 	}
 
-	_, err := driver.ExecuteOsaScript(command...)
+	_, err := driver.ExecuteOsaScript(ctx, command...)
 	if err != nil {
 		err := fmt.Errorf("error attaching display: %s", err)
 		state.Put("error", err)
@@ -71,7 +71,7 @@ func (s *StepAttachDisplay) Cleanup(state multistep.StateBag) {
 	if !ok {
 		ui.Say("Detaching displays...")
 		for _, command := range s.detachDisplayCommands {
-			_, err := driver.ExecuteOsaScript(command...)
+			_, err := driver.ExecuteOsaScript(context.Background(), command...)
 			if err != nil {
 				log.Printf("error detaching display: %s", err)
 			}
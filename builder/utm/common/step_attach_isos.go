@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"log"
 	"path/filepath"
-	"regexp"
 
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
 	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
@@ -71,6 +70,15 @@ func (s *StepAttachISOs) Run(ctx context.Context, state multistep.StateBag) mult
 		}
 		isoPath = resolvedIsoPath
 
+		// Copy the ISO to a remote UTM host
+		isoPath, err = driver.Upload(ctx, isoPath)
+		if err != nil {
+			err := fmt.Errorf("error uploading ISO: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+
 		// We may have different potential iso we can attach.
 		var controllerName string
 		switch diskCategory {
@@ -99,7 +107,7 @@ func (s *StepAttachISOs) Run(ctx context.Context, state multistep.StateBag) mult
 			"--source", isoPath,
 		}
 
-		output, err := driver.ExecuteOsaScript(command...)
+		result, err := driver.ExecuteOsaScript(ctx, command...)
 		if err != nil {
 			err := fmt.Errorf("error attaching ISO: %s", err)
 			state.Put("error", err)
@@ -107,24 +115,18 @@ func (s *StepAttachISOs) Run(ctx context.Context, state multistep.StateBag) mult
 			return multistep.ActionHalt
 		}
 
-		// Track the disks we've mounted so we can remove them without having
-		// to re-derive what was mounted where
-
-		// Regular expression to capture the UUID from the output
-		re := regexp.MustCompile(`[0-9a-fA-F-]{36}`)
-		matches := re.FindStringSubmatch(output)
-		if len(matches) > 0 {
-			uuid := matches[0] // Capture the UUID
-			unmountCommand := []string{
-				"remove_drive.applescript", vmId, uuid,
-			}
-			s.diskUnmountCommands[diskCategory] = unmountCommand
-		} else {
-			err := fmt.Errorf("error extracting UUID from output: %s", output)
+		if result.DriveID == "" {
+			err := fmt.Errorf("error attaching ISO: no drive id was returned")
 			state.Put("error", err)
 			ui.Error(err.Error())
 			return multistep.ActionHalt
 		}
+
+		// Track the disks we've mounted so we can remove them without having
+		// to re-derive what was mounted where
+		s.diskUnmountCommands[diskCategory] = []string{
+			"remove_drive.applescript", vmId, result.DriveID,
+		}
 	}
 
 	state.Put("disk_unmount_commands", s.diskUnmountCommands)
@@ -141,7 +143,7 @@ func (s *StepAttachISOs) Cleanup(state multistep.StateBag) {
 
 	if !ok {
 		for _, command := range s.diskUnmountCommands {
-			_, err := driver.ExecuteOsaScript(command...)
+			_, err := driver.ExecuteOsaScript(context.Background(), command...)
 			if err != nil {
 				log.Printf("error detaching iso: %s", err)
 			}
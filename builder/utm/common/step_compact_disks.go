@@ -0,0 +1,171 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// CompactedDisk is a disk image rewritten by StepCompactDisks. It is
+// available to post-processors as the compacted_disks state of the
+// artifact.
+type CompactedDisk struct {
+	// The path of the image on the machine that runs UTM
+	Image string
+	// The size of the image file before and after, in bytes
+	SizeBefore int64
+	SizeAfter  int64
+}
+
+// This step rewrites the qcow2 disk images of the stopped VM with qemu-img
+// convert, which leaves out unused space, and optionally compresses them.
+// Each image is written next to the original and then moved over it.
+// qemu-img convert doesn't copy the internal snapshots of an image, so the
+// images which still have snapshots, e.g. the ones of the source VM, are
+// left as they are.
+//
+// Uses:
+//
+//	driver Driver
+//	ui packersdk.Ui
+//	vmId string
+//
+// Produces:
+//
+//	compacted_disks []CompactedDisk - The sizes of the images
+type StepCompactDisks struct {
+	Compact  bool
+	Compress bool
+}
+
+func (s *StepCompactDisks) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	if !s.Compact && !s.Compress {
+		return multistep.ActionContinue
+	}
+
+	driver := state.Get("driver").(Driver)
+	ui := state.Get("ui").(packersdk.Ui)
+	vmId := state.Get("vmId").(string)
+
+	images, err := driver.DiskImages(ctx, vmId)
+	if err != nil {
+		err := fmt.Errorf("error compacting disks: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	var compacted []CompactedDisk
+	for _, image := range images {
+		if path.Ext(image) != ".qcow2" {
+			ui.Say(fmt.Sprintf("Not compacting %s, only qcow2 disks can be compacted", path.Base(image)))
+			continue
+		}
+
+		info, err := imageInfo(ctx, driver, image)
+		if err != nil {
+			err := fmt.Errorf("error compacting disk %s: %s", path.Base(image), err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		if len(info.Snapshots) > 0 {
+			var names []string
+			for _, snapshot := range info.Snapshots {
+				names = append(names, snapshot.Name)
+			}
+			ui.Say(fmt.Sprintf("Not compacting %s, compacting would delete its snapshots: %s",
+				path.Base(image), strings.Join(names, ", ")))
+			continue
+		}
+
+		ui.Say(fmt.Sprintf("Compacting disk %s...", path.Base(image)))
+		disk, err := s.compact(ctx, driver, image, *info.ActualSize)
+		if err != nil {
+			err := fmt.Errorf("error compacting disk %s: %s", path.Base(image), err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		ui.Message(fmt.Sprintf("%s: %s -> %s", path.Base(image),
+			formatImageSize(disk.SizeBefore), formatImageSize(disk.SizeAfter)))
+		compacted = append(compacted, disk)
+	}
+	state.Put("compacted_disks", compacted)
+
+	return multistep.ActionContinue
+}
+
+// compact converts the image into a temporary image next to it, which then
+// replaces the image.
+func (s *StepCompactDisks) compact(ctx context.Context, driver Driver, image string, size int64) (CompactedDisk, error) {
+	disk := CompactedDisk{Image: image, SizeBefore: size}
+
+	var err error
+	output := image + ".compact"
+	args := []string{"convert", "-O", "qcow2"}
+	if s.Compress {
+		args = append(args, "-c")
+	}
+	args = append(args, image, output)
+	if _, err := driver.QemuImg(ctx, args...); err != nil {
+		removeImage(driver, output)
+		return disk, err
+	}
+
+	info, err := imageInfo(ctx, driver, output)
+	if err != nil {
+		removeImage(driver, output)
+		return disk, err
+	}
+	disk.SizeAfter = *info.ActualSize
+	if err := driver.MoveFile(ctx, output, image); err != nil {
+		removeImage(driver, output)
+		return disk, err
+	}
+	return disk, nil
+}
+
+// removeImage removes a partly written image, also when the build was
+// cancelled.
+func removeImage(driver Driver, image string) {
+	if err := driver.RemoveFile(context.Background(), image); err != nil {
+		log.Printf("Error removing %s: %s", image, err)
+	}
+}
+
+// qemuImgInfo is the output of qemu-img info --output=json.
+type qemuImgInfo struct {
+	// The size of the image file
+	ActualSize *int64 `json:"actual-size"`
+	// The internal snapshots of the image
+	Snapshots []struct {
+		Name string `json:"name"`
+	} `json:"snapshots"`
+}
+
+// imageInfo returns the size and the snapshots of the image, as reported by
+// qemu-img info.
+func imageInfo(ctx context.Context, driver Driver, image string) (*qemuImgInfo, error) {
+	output, err := driver.QemuImg(ctx, "info", "--output=json", image)
+	if err != nil {
+		return nil, err
+	}
+	var info qemuImgInfo
+	if err := json.Unmarshal([]byte(output), &info); err != nil || info.ActualSize == nil {
+		return nil, fmt.Errorf("invalid output from qemu-img info: %q", output)
+	}
+	return &info, nil
+}
+
+func formatImageSize(size int64) string {
+	return fmt.Sprintf("%.1f MiB", float64(size)/(1024*1024))
+}
+
+func (s *StepCompactDisks) Cleanup(state multistep.StateBag) {}
@@ -0,0 +1,181 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+func TestStepCompactDisks_impl(t *testing.T) {
+	var _ multistep.Step = new(StepCompactDisks)
+	var _ multistep.Step = new(StepZeroFreeSpace)
+}
+
+// simulatorCalled reports whether the simulator ran the command.
+func simulatorCalled(driver *DriverSimulator, command ...string) bool {
+	for _, call := range driver.Calls {
+		if reflect.DeepEqual(call, command) {
+			return true
+		}
+	}
+	return false
+}
+
+func testCompactState(t *testing.T) (multistep.StateBag, *DriverSimulator, string) {
+	driver := new(DriverSimulator)
+	vmId := driver.AddVM(SimulatedVM{
+		Name: "packer",
+		Drives: []SimulatedDrive{
+			{ID: "disk", Interface: "QdIv", Size: 10240, ImageSize: 4 << 30},
+			{ID: "data", Interface: "QdIv", Size: 1024, Raw: true},
+			{ID: "cd", Interface: "QdIu", Removable: true},
+		},
+	})
+
+	state := testState(t)
+	state.Put("driver", driver)
+	state.Put("vmId", vmId)
+	return state, driver, vmId
+}
+
+func TestStepCompactDisks(t *testing.T) {
+	state, driver, vmId := testCompactState(t)
+
+	step := &StepCompactDisks{Compact: true, Compress: true}
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v: %s", action, state.Get("error"))
+	}
+
+	image := "/simulated/" + vmId + ".utm/Data/disk.qcow2"
+	expected := []CompactedDisk{{Image: image, SizeBefore: 4 << 30, SizeAfter: 1 << 30}}
+	if compacted := state.Get("compacted_disks").([]CompactedDisk); !reflect.DeepEqual(compacted, expected) {
+		t.Fatalf("bad: %#v", compacted)
+	}
+
+	// Only the qcow2 image is replaced, the raw image is skipped
+	drives := driver.VM(vmId).Drives
+	if drives[0].ImageSize != 1<<30 || !drives[0].Compressed {
+		t.Fatalf("bad: %#v", drives[0])
+	}
+	if drives[1].ImageSize != 0 || drives[1].Compressed {
+		t.Fatalf("bad: %#v", drives[1])
+	}
+	if !simulatorCalled(driver, "qemu-img", "convert", "-O", "qcow2", "-c", image, image+".compact") ||
+		!simulatorCalled(driver, "mv", "-f", image+".compact", image) {
+		t.Fatalf("bad: %#v", driver.Calls)
+	}
+
+	// The sizes are reported
+	out := state.Get("ui").(*packersdk.BasicUi).Writer.(*bytes.Buffer).String()
+	if !strings.Contains(out, "disk.qcow2: 4096.0 MiB -> 1024.0 MiB") {
+		t.Fatalf("bad: %s", out)
+	}
+}
+
+func TestStepCompactDisks_snapshots(t *testing.T) {
+	state, driver, vmId := testCompactState(t)
+	image := "/simulated/" + vmId + ".utm/Data/disk.qcow2"
+	if _, err := driver.QemuImg(context.Background(), "snapshot", "-c", "old", image); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	step := &StepCompactDisks{Compact: true}
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v: %s", action, state.Get("error"))
+	}
+	// The image is left as it is, with its snapshots
+	if compacted := state.Get("compacted_disks").([]CompactedDisk); len(compacted) != 0 {
+		t.Fatalf("bad: %#v", compacted)
+	}
+	if drives := driver.VM(vmId).Drives; drives[0].ImageSize != 4<<30 || !reflect.DeepEqual(drives[0].Snapshots, []string{"old"}) {
+		t.Fatalf("bad: %#v", drives[0])
+	}
+	out := state.Get("ui").(*packersdk.BasicUi).Writer.(*bytes.Buffer).String()
+	if !strings.Contains(out, "Not compacting disk.qcow2, compacting would delete its snapshots: old") {
+		t.Fatalf("bad: %s", out)
+	}
+}
+
+func TestStepCompactDisks_disabled(t *testing.T) {
+	state, driver, _ := testCompactState(t)
+
+	step := new(StepCompactDisks)
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if len(driver.Calls) != 0 {
+		t.Fatalf("bad: %#v", driver.Calls)
+	}
+	if _, ok := state.GetOk("compacted_disks"); ok {
+		t.Fatal("should not compact")
+	}
+}
+
+func TestStepCompactDisks_running(t *testing.T) {
+	state, driver, vmId := testCompactState(t)
+	if _, err := driver.Utmctl(context.Background(), "start", vmId); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	step := &StepCompactDisks{Compact: true}
+	if action := step.Run(context.Background(), state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	// The partly written image is removed
+	image := "/simulated/" + vmId + ".utm/Data/disk.qcow2"
+	if !simulatorCalled(driver, "rm", "-f", image+".compact") {
+		t.Fatalf("bad: %#v", driver.Calls)
+	}
+	if drives := driver.VM(vmId).Drives; drives[0].ImageSize != 4<<30 {
+		t.Fatalf("bad: %#v", drives[0])
+	}
+}
+
+func TestStepCompactDisks_moveError(t *testing.T) {
+	state, driver, vmId := testCompactState(t)
+	driver.Errors = map[string]error{"mv": errors.New("mv failed")}
+
+	step := &StepCompactDisks{Compact: true}
+	if action := step.Run(context.Background(), state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	image := "/simulated/" + vmId + ".utm/Data/disk.qcow2"
+	if !simulatorCalled(driver, "rm", "-f", image+".compact") {
+		t.Fatalf("bad: %#v", driver.Calls)
+	}
+}
+
+func TestStepZeroFreeSpace(t *testing.T) {
+	state := testState(t)
+	comm := new(packersdk.MockCommunicator)
+	// dd fails once the disk is full
+	comm.StartExitStatus = 1
+	state.Put("communicator", comm)
+
+	step := &StepZeroFreeSpace{Command: "zero"}
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v: %s", action, state.Get("error"))
+	}
+	if !comm.StartCalled || comm.StartCmd.Command != "zero" {
+		t.Fatalf("bad: %#v", comm.StartCmd)
+	}
+
+	// Without a command or a communicator nothing is run
+	comm = new(packersdk.MockCommunicator)
+	state.Put("communicator", comm)
+	step = new(StepZeroFreeSpace)
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue || comm.StartCalled {
+		t.Fatalf("bad action: %#v", action)
+	}
+	state.Remove("communicator")
+	step = &StepZeroFreeSpace{Command: "zero"}
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+}
@@ -1,7 +1,7 @@
 // Copyright (c) HashiCorp, Inc.
 // SPDX-License-Identifier: MPL-2.0
 
-package cloud
+package common
 
 import (
 	"context"
@@ -18,9 +18,13 @@ import (
 	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
 	"github.com/hashicorp/packer-plugin-sdk/shell-local/localexec"
 	"github.com/hashicorp/packer-plugin-sdk/tmp"
+	"github.com/naveenrajm7/packer-plugin-utm/builder/utm/common/iso9660"
 )
 
-// StepCreateCD will create a CD disk with the given files.
+// StepCreateCD will create a CD disk with the given files. The ISO image is
+// written in-process, with the Joliet and Rock Ridge extensions. The
+// external tools are only used for what the built-in writer doesn't
+// support, like files larger than 4 GiB.
 type StepCreateCD struct {
 	// Files can be either files or directories. Any files provided here will
 	// be written to the root of the CD. Directories will be written to the
@@ -92,16 +96,19 @@ func (s *StepCreateCD) Run(ctx context.Context, state multistep.StateBag) multis
 		}
 	}
 
-	cmd, err := retrieveCDISOCreationCommand(s.Label, rootFolder, CDPath)
-	if err != nil {
-		state.Put("error", err)
-		return multistep.ActionHalt
-	}
+	if err := iso9660.Create(CDPath, s.Label, rootFolder); err != nil {
+		log.Printf("Error writing the CD, trying external tools: %s", err)
+		cmd, cmdErr := retrieveCDISOCreationCommand(s.Label, rootFolder, CDPath)
+		if cmdErr != nil {
+			state.Put("error", fmt.Errorf("Error creating CD: %s, and %s", err, cmdErr))
+			return multistep.ActionHalt
+		}
 
-	err = localexec.RunAndStream(cmd, ui, []string{})
-	if err != nil {
-		state.Put("error", err)
-		return multistep.ActionHalt
+		err = localexec.RunAndStream(cmd, ui, []string{})
+		if err != nil {
+			state.Put("error", err)
+			return multistep.ActionHalt
+		}
 	}
 
 	ui.Message("Done copying paths from CD_dirs")
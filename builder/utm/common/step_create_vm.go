@@ -2,10 +2,11 @@ package common
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
-	"regexp"
 	"strconv"
+	"time"
 
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
 	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
@@ -43,29 +44,27 @@ func (s *StepCreateVM) Run(ctx context.Context, state multistep.StateBag) multis
 	}
 
 	ui.Say("Creating virtual machine...")
-	output, err := driver.ExecuteOsaScript(createCommand...)
+	result, err := driver.ExecuteOsaScript(ctx, createCommand...)
 	if err != nil {
-		err := fmt.Errorf("error creating VM: %s", err)
+		err := fmt.Errorf("error creating VM: %w", err)
 		state.Put("error", err)
 		ui.Error(err.Error())
+		if hint := DriverErrorHint(err); hint != "" {
+			ui.Error(hint)
+		}
 		return multistep.ActionHalt
 	}
 
-	// Regular expression to capture the VM UUID
-	re := regexp.MustCompile(`[0-9a-fA-F-]{36}`)
-	matches := re.FindStringSubmatch(output)
-	var vmId string
-	if len(matches) > 0 {
-		vmId = matches[0] // Capture the VM UUID
-		s.vmId = vmId
-		state.Put("vmName", s.VMName)
-		state.Put("vmId", s.vmId)
-	} else {
-		err := fmt.Errorf("error extracting VM ID from output: %s", output)
+	if result.VMID == "" {
+		err := fmt.Errorf("error creating VM: no VM id was returned")
 		state.Put("error", err)
 		ui.Error(err.Error())
 		return multistep.ActionHalt
 	}
+	vmId := result.VMID
+	s.vmId = vmId
+	state.Put("vmName", s.VMName)
+	state.Put("vmId", s.vmId)
 
 	log.Printf("VM Id: %s", vmId)
 
@@ -80,7 +79,7 @@ func (s *StepCreateVM) Run(ctx context.Context, state multistep.StateBag) multis
 	}
 
 	ui.Say("Customizing virtual machine...")
-	_, err = driver.ExecuteOsaScript(customizeCommand...)
+	_, err = driver.ExecuteOsaScript(ctx, customizeCommand...)
 	if err != nil {
 		err := fmt.Errorf("error customizing VM: %s", err)
 		state.Put("error", err)
@@ -107,7 +106,34 @@ func (s *StepCreateVM) Cleanup(state multistep.StateBag) {
 	}
 
 	ui.Say("Deregistering and deleting VM...")
-	if err := driver.Delete(s.vmId); err != nil {
+	DeleteVM(context.Background(), driver, ui, s.vmId)
+}
+
+// busyRetryDelay is the time to wait before retrying an operation that
+// failed because UTM was busy.
+var busyRetryDelay = 2 * time.Second
+
+// DeleteVM deletes a VM during cleanup, reporting failures to the user
+// instead of returning them. A VM that is already gone is not an error.
+func DeleteVM(ctx context.Context, driver Driver, ui packersdk.Ui, vmId string) {
+	err := driver.Delete(ctx, vmId)
+	for retries := 0; errors.Is(err, ErrUTMBusy) && retries < 3; retries++ {
+		log.Printf("UTM is busy, retrying to delete VM %s in %s", vmId, busyRetryDelay)
+		time.Sleep(busyRetryDelay)
+		err = driver.Delete(ctx, vmId)
+	}
+
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrVMNotFound):
+		log.Printf("VM %s was already deleted", vmId)
+	case errors.Is(err, ErrUTMNotRunning):
+		ui.Error(fmt.Sprintf("Could not delete VM %s because UTM is not running. "+
+			"Please start UTM and delete the VM manually.", vmId))
+	default:
 		ui.Error(fmt.Sprintf("Error deleting VM: %s", err))
+		if hint := DriverErrorHint(err); hint != "" {
+			ui.Error(hint)
+		}
 	}
 }
@@ -0,0 +1,55 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+func TestStepCreateVM_impl(t *testing.T) {
+	var _ multistep.Step = new(StepCreateVM)
+}
+
+func TestStepCreateVM_Cleanup(t *testing.T) {
+	cases := []struct {
+		Name    string
+		Err     error
+		UIError bool
+	}{
+		{"deleted", nil, false},
+		{"already gone", &DriverError{Tool: "utmctl", Kind: ErrVMNotFound}, false},
+		{"UTM not running", &DriverError{Tool: "utmctl", Kind: ErrUTMNotRunning}, true},
+		{"unknown error", &DriverError{Tool: "utmctl", Stderr: "boom"}, true},
+	}
+
+	for _, tc := range cases {
+		state := testState(t)
+		var uiErrors []string
+		state.Put("ui", &testErrorUi{Ui: state.Get("ui").(packersdk.Ui), errors: &uiErrors})
+
+		driver := state.Get("driver").(*DriverMock)
+		driver.DeleteErr = tc.Err
+
+		step := &StepCreateVM{vmId: "foo"}
+		state.Put(multistep.StateHalted, true)
+		step.Cleanup(state)
+
+		if !driver.DeleteCalled || driver.DeleteName != "foo" {
+			t.Fatalf("%s: delete should be called", tc.Name)
+		}
+		if (len(uiErrors) > 0) != tc.UIError {
+			t.Fatalf("%s: bad errors: %#v", tc.Name, uiErrors)
+		}
+	}
+}
+
+// testErrorUi records the errors shown to the user.
+type testErrorUi struct {
+	packersdk.Ui
+	errors *[]string
+}
+
+func (u *testErrorUi) Error(message string) {
+	*u.errors = append(*u.errors, message)
+}
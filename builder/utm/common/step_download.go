@@ -4,22 +4,42 @@
 package common
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/multistep/commonsteps"
 	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/tmp"
+	"github.com/klauspost/pgzip"
+	"github.com/naveenrajm7/packer-plugin-utm/builder/utm/bundle"
 )
 
 // SDK Version StepDownload does not handle the local UTM file
-// So we need to modify the StepDownload to handle the local UTM file
-
+// So we need to modify the StepDownload to handle the local UTM file.
+// A local .utm directory is used in place. Other sources, URLs and local
+// files, are zip or tar.gz archives of a .utm directory, like the ones of
+// the zip post-processor: they are downloaded to the Packer cache with the
+// SDK StepDownload, which verifies the checksum, and extracted to a
+// temporary directory. The checksum of a .utm directory is its tree hash.
+//
 // Uses:
 //
 //	ui    packersdk.Ui
+//
+// Produces:
+//
+//	<ResultKey> string - The path of the .utm directory
+//	source_tree_hash string - The tree hash of the .utm directory
 type StepUtmDownload struct {
 	// The checksum and the type of the checksum for the download
 	Checksum string
@@ -41,22 +61,20 @@ type StepUtmDownload struct {
 
 	// Extension is the extension to force for the file that is downloaded.
 	// Some systems require a certain extension. If this isn't set, the
-	// extension on the URL is used. Otherwise, this will be forced
-	// on the downloaded file for every URL.
+	// extension of the archive in the URL is used.
 	Extension string
+
+	// The directory the archive is extracted to
+	extractDir string
 }
 
 func (s *StepUtmDownload) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
-	// TODO: Change this to handle the local UTM file
-	// by checking file existence
-	// setting the file path to the ResultKey
 	if len(s.Url) == 0 {
 		log.Printf("No URLs were provided to Step Download. Continuing...")
 		return multistep.ActionContinue
 	}
 
 	ui := state.Get("ui").(packersdk.Ui)
-	ui.Say(fmt.Sprintf("Retrieving %s", s.Description))
 
 	var errs []error
 
@@ -65,30 +83,77 @@ func (s *StepUtmDownload) Run(ctx context.Context, state multistep.StateBag) mul
 			state.Put("error", fmt.Errorf("download cancelled: %v", errs))
 			return multistep.ActionHalt
 		}
-		ui.Say(fmt.Sprintf("Trying %s", source))
-		// check is the source file exists
-		if _, err := os.Stat(source); err != nil {
-			state.Put("error", fmt.Errorf("file not found: %v", err))
-			return multistep.ActionHalt
-		}
 
-		var err error
-		var dst string
-		if s.Description == "UTM" && strings.HasSuffix(source, ".utm") {
-			// TODO(adrien): make go-getter allow using files in place.
-			// ovf files usually point to a file in the same directory, so
-			// using them in place is the only way.
+		// A local .utm directory is used in place
+		if info, err := os.Stat(source); err == nil && info.IsDir() {
+			if !strings.HasSuffix(strings.TrimRight(source, "/"), ".utm") {
+				errs = append(errs, fmt.Errorf("%s isn't a .utm directory", source))
+				continue
+			}
 			ui.Say("Using utm file inplace")
-			dst = source
-		}
-		if err == nil {
-			state.Put(s.ResultKey, dst)
+			hash, err := s.treeHash(ui, source)
+			if err == nil {
+				err = verifyTreeHash(s.Checksum, hash)
+			}
+			if err != nil {
+				state.Put("error", err)
+				ui.Error(err.Error())
+				return multistep.ActionHalt
+			}
+			state.Put("source_tree_hash", hash)
+			state.Put(s.ResultKey, source)
 			// Track the URL you actually used for the download.
 			state.Put("SourceImageURL", source)
 			return multistep.ActionContinue
 		}
-		// may be another url will work
-		errs = append(errs, err)
+
+		extension := s.Extension
+		if extension == "" {
+			extension = archiveExtension(source)
+		}
+		download := &commonsteps.StepDownload{
+			Checksum:    s.Checksum,
+			Description: s.Description,
+			Extension:   extension,
+			ResultKey:   "utm_archive_path",
+			TargetPath:  s.TargetPath,
+			Url:         []string{keepArchive(source)},
+		}
+		if action := download.Run(ctx, state); action != multistep.ActionContinue {
+			// may be another url will work
+			errs = append(errs, state.Get("error").(error))
+			state.Remove("error")
+			continue
+		}
+		archivePath := state.Get("utm_archive_path").(string)
+
+		dir, err := tmp.Dir("packer-utm")
+		if err != nil {
+			err := fmt.Errorf("error creating temporary directory: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		s.extractDir = dir
+
+		ui.Say(fmt.Sprintf("Extracting %s...", archivePath))
+		vmPath, err := extractUtmArchive(archivePath, dir)
+		if err != nil {
+			err := fmt.Errorf("error extracting %s: %s", archivePath, err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		log.Printf("Extracted UTM VM: %s", vmPath)
+		hash, err := s.treeHash(ui, vmPath)
+		if err != nil {
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		state.Put("source_tree_hash", hash)
+		state.Put(s.ResultKey, vmPath)
+		return multistep.ActionContinue
 	}
 
 	err := fmt.Errorf("error downloading %s: %v", s.Description, errs)
@@ -97,4 +162,214 @@ func (s *StepUtmDownload) Run(ctx context.Context, state multistep.StateBag) mul
 	return multistep.ActionHalt
 }
 
-func (s *StepUtmDownload) Cleanup(multistep.StateBag) {}
+func (s *StepUtmDownload) Cleanup(state multistep.StateBag) {
+	if s.extractDir == "" {
+		return
+	}
+	if err := os.RemoveAll(s.extractDir); err != nil {
+		ui := state.Get("ui").(packersdk.Ui)
+		ui.Error(fmt.Sprintf("error removing extracted UTM VM: %s", err))
+	}
+}
+
+// treeHash computes the tree hash of a .utm directory, which is the checksum
+// to set to use it in place.
+func (s *StepUtmDownload) treeHash(ui packersdk.Ui, vmPath string) (string, error) {
+	ui.Say(fmt.Sprintf("Computing the tree hash of %s...", vmPath))
+	hash, err := bundle.TreeHash(vmPath)
+	if err != nil {
+		return "", fmt.Errorf("error computing the tree hash of %s: %s", vmPath, err)
+	}
+	ui.Message(fmt.Sprintf("Tree hash: %s", hash))
+	return hash, nil
+}
+
+// verifyTreeHash verifies the checksum of a .utm directory, sha256:<hash>
+// or <hash>, against its tree hash. An empty checksum or none isn't
+// verified.
+func verifyTreeHash(checksum string, hash string) error {
+	if checksum == "" || checksum == "none" {
+		return nil
+	}
+	expected := strings.ToLower(checksum)
+	if !strings.Contains(expected, ":") {
+		expected = "sha256:" + expected
+	}
+	if !strings.HasPrefix(expected, "sha256:") {
+		return fmt.Errorf("the checksum of a .utm directory must be its sha256 tree hash: %s", checksum)
+	}
+	if expected != hash {
+		return fmt.Errorf("checksum mismatch: expected %s, got tree hash %s", checksum, hash)
+	}
+	return nil
+}
+
+// archiveExtension returns the extension of the archive in a URL, to keep
+// it in the cache.
+func archiveExtension(source string) string {
+	path := strings.ToLower(source)
+	if i := strings.Index(path, "?"); i >= 0 {
+		path = path[:i]
+	}
+	switch {
+	case strings.HasSuffix(path, ".tar.gz"), strings.HasSuffix(path, ".tgz"):
+		return "tar.gz"
+	case strings.HasSuffix(path, ".utm.zip"):
+		return "utm.zip"
+	default:
+		return "zip"
+	}
+}
+
+// keepArchive disables the extraction of the archive by the download, which
+// only extracts archives of a single file.
+func keepArchive(source string) string {
+	if i := strings.Index(source, "?"); i >= 0 {
+		if strings.Contains(source[i:], "archive=") {
+			return source
+		}
+		return source + "&archive=false"
+	}
+	return source + "?archive=false"
+}
+
+// extractUtmArchive extracts a zip or tar.gz archive of a .utm directory to
+// dir, and returns the path of the .utm directory.
+func extractUtmArchive(archivePath string, dir string) (string, error) {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	head, _ := bufio.NewReader(f).Peek(4)
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")):
+		err = extractZip(archivePath, dir)
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		err = extractTarGz(f, dir)
+	default:
+		err = fmt.Errorf("not a zip or tar.gz archive")
+	}
+	if err != nil {
+		return "", err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	var vmPath string
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasSuffix(entry.Name(), ".utm") {
+			continue
+		}
+		if vmPath != "" {
+			return "", fmt.Errorf("the archive has more than one .utm directory")
+		}
+		vmPath = filepath.Join(dir, entry.Name())
+	}
+	if vmPath == "" {
+		return "", fmt.Errorf("the archive has no .utm directory")
+	}
+	return vmPath, nil
+}
+
+// extractPath returns the path an entry of an archive is extracted to,
+// which must be in dir.
+func extractPath(dir string, name string) (string, error) {
+	path := filepath.Join(dir, filepath.FromSlash(name))
+	if path != dir && !strings.HasPrefix(path, dir+string(os.PathSeparator)) {
+		return "", fmt.Errorf("%s is outside of the archive", name)
+	}
+	return path, nil
+}
+
+func extractZip(archivePath string, dir string) error {
+	r, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for _, file := range r.File {
+		path, err := extractPath(dir, file.Name)
+		if err != nil {
+			return err
+		}
+		if file.FileInfo().IsDir() {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if !file.Mode().IsRegular() {
+			log.Printf("Skipping %s of the archive, it isn't a regular file", file.Name)
+			continue
+		}
+		rc, err := file.Open()
+		if err != nil {
+			return err
+		}
+		err = writeExtracted(path, rc, file.Mode())
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractTarGz(r io.Reader, dir string) error {
+	gz, err := pgzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		path, err := extractPath(dir, header.Name)
+		if err != nil {
+			return err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := writeExtracted(path, tr, header.FileInfo().Mode()); err != nil {
+				return err
+			}
+		default:
+			log.Printf("Skipping %s of the archive, it isn't a regular file", header.Name)
+		}
+	}
+}
+
+// writeExtracted writes a file of an archive.
+func writeExtracted(path string, r io.Reader, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm()|0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
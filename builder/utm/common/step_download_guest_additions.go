@@ -48,7 +48,7 @@ func (s *StepDownloadGuestAdditions) Run(ctx context.Context, state multistep.St
 	}
 
 	// Get UTM version
-	version, err := driver.Version()
+	version, err := driver.Version(ctx)
 	if err != nil {
 		state.Put("error", fmt.Errorf("error reading version for guest additions download: %s", err))
 		return multistep.ActionHalt
@@ -81,19 +81,23 @@ func (s *StepDownloadGuestAdditions) Run(ctx context.Context, state multistep.St
 	}
 
 	// If this resulted in an empty url, then ask the driver about it.
-	if url == "" {
+	if url == "" && driver.HasFeature(FeatureGuestTools) {
 		log.Printf("guest_additions_url is blank; querying driver for iso.")
-		url, err = driver.GuestToolsIsoPath()
+		url, err = driver.GuestToolsIsoPath(ctx)
 
 		if err == nil {
 			checksumType = "none"
 		} else {
 			ui.Error(err.Error())
-			url = fmt.Sprintf(
-				"https://getutm.app/downloads/%s", additionsName)
 		}
 	}
 
+	// Fall back to downloading the guest tools from the UTM website.
+	if url == "" {
+		url = fmt.Sprintf(
+			"https://getutm.app/downloads/%s", additionsName)
+	}
+
 	// The driver couldn't even figure it out, so fail hard.
 	if url == "" {
 		err := fmt.Errorf("couldn't detect guest additions URL.\n" +
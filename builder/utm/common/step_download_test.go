@@ -0,0 +1,274 @@
+package common
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/naveenrajm7/packer-plugin-utm/builder/utm/bundle"
+)
+
+// The files of a test UTM VM, in its .utm directory
+var testUtmFiles = map[string]string{
+	"config.plist":        "<plist/>",
+	"Data/disk.qcow2":     "disk",
+	"Data/efi_vars.fd":    "vars",
+	"Data/screenshot.png": "png",
+}
+
+// testUtmZip returns a zip archive of a .utm directory, laid out like the
+// archives of the zip post-processor.
+func testUtmZip(t *testing.T) []byte {
+	var b bytes.Buffer
+	w := zip.NewWriter(&b)
+	if _, err := w.Create("packer.utm/"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for name, data := range testUtmFiles {
+		f, err := w.Create("packer.utm/" + name)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		f.Write([]byte(data))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return b.Bytes()
+}
+
+func testUtmTarGz(t *testing.T, names ...string) []byte {
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	w := tar.NewWriter(gz)
+	for _, name := range names {
+		data := testUtmFiles[name]
+		if err := w.WriteHeader(&tar.Header{
+			Name:     "./packer.utm/" + name,
+			Mode:     0644,
+			Size:     int64(len(data)),
+			Typeflag: tar.TypeReg,
+		}); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		w.Write([]byte(data))
+	}
+	w.Close()
+	gz.Close()
+	return b.Bytes()
+}
+
+func checkUtmDir(t *testing.T, vmPath string) {
+	if filepath.Base(vmPath) != "packer.utm" {
+		t.Fatalf("bad: %s", vmPath)
+	}
+	for name, data := range testUtmFiles {
+		content, err := os.ReadFile(filepath.Join(vmPath, name))
+		if err != nil || string(content) != data {
+			t.Fatalf("bad: %s: %q %v", name, content, err)
+		}
+	}
+}
+
+// testDownloadState returns a state with an UI tracking the progress of
+// downloads.
+func testDownloadState(t *testing.T) multistep.StateBag {
+	state := testState(t)
+	state.Put("ui", packersdk.TestUi(t))
+	return state
+}
+
+func TestStepUtmDownload_impl(t *testing.T) {
+	var _ multistep.Step = new(StepUtmDownload)
+}
+
+func TestStepUtmDownload_url(t *testing.T) {
+	t.Setenv("PACKER_CACHE_DIR", t.TempDir())
+	archive := testUtmZip(t)
+	sum := sha256.Sum256(archive)
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write(archive)
+	}))
+	defer server.Close()
+
+	for i := 0; i < 2; i++ {
+		downloaded := requests
+		state := testDownloadState(t)
+		step := &StepUtmDownload{
+			Checksum:    "sha256:" + hex.EncodeToString(sum[:]),
+			Description: "UTM",
+			ResultKey:   "vm_path",
+			Url:         []string{server.URL + "/packer.utm.zip"},
+		}
+		if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+			t.Fatalf("bad action: %#v: %s", action, state.Get("error"))
+		}
+		vmPath := state.Get("vm_path").(string)
+		checkUtmDir(t, vmPath)
+		if hash, _ := bundle.TreeHash(vmPath); hash != state.Get("source_tree_hash") {
+			t.Fatalf("bad: %s", state.Get("source_tree_hash"))
+		}
+
+		// The archive is cached, the extracted VM is removed
+		archivePath := state.Get("utm_archive_path").(string)
+		if filepath.Dir(archivePath) != os.Getenv("PACKER_CACHE_DIR") || filepath.Ext(archivePath) != ".zip" {
+			t.Fatalf("bad: %s", archivePath)
+		}
+		step.Cleanup(state)
+		if _, err := os.Stat(vmPath); !os.IsNotExist(err) {
+			t.Fatalf("should be removed: %s", vmPath)
+		}
+		if cached := requests == downloaded; cached != (i == 1) {
+			t.Fatalf("bad: %d requests", requests)
+		}
+	}
+}
+
+func TestStepUtmDownload_badChecksum(t *testing.T) {
+	t.Setenv("PACKER_CACHE_DIR", t.TempDir())
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(testUtmZip(t))
+	}))
+	defer server.Close()
+
+	state := testDownloadState(t)
+	step := &StepUtmDownload{
+		Checksum:    "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+		Description: "UTM",
+		ResultKey:   "vm_path",
+		Url:         []string{server.URL + "/packer.utm.zip"},
+	}
+	if action := step.Run(context.Background(), state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("vm_path"); ok {
+		t.Fatal("should not have a VM")
+	}
+}
+
+func TestStepUtmDownload_localArchive(t *testing.T) {
+	t.Setenv("PACKER_CACHE_DIR", t.TempDir())
+	source := filepath.Join(t.TempDir(), "packer.tar.gz")
+	archive := testUtmTarGz(t, "config.plist", "Data/disk.qcow2", "Data/efi_vars.fd", "Data/screenshot.png")
+	if err := os.WriteFile(source, archive, 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	state := testDownloadState(t)
+	step := &StepUtmDownload{
+		Checksum:    "none",
+		Description: "UTM",
+		ResultKey:   "vm_path",
+		Url:         []string{source},
+	}
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v: %s", action, state.Get("error"))
+	}
+	defer step.Cleanup(state)
+	checkUtmDir(t, state.Get("vm_path").(string))
+}
+
+func TestStepUtmDownload_directory(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "source.utm")
+	for name, data := range testUtmFiles {
+		if err := writeExtracted(filepath.Join(source, name), strings.NewReader(data), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	hash, err := bundle.TreeHash(source)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for _, checksum := range []string{"", "none", hash, strings.TrimPrefix(hash, "sha256:")} {
+		state := testDownloadState(t)
+		step := &StepUtmDownload{Checksum: checksum, Description: "UTM", ResultKey: "vm_path", Url: []string{source}}
+		if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+			t.Fatalf("bad action: %#v: %s", action, state.Get("error"))
+		}
+		if vmPath := state.Get("vm_path").(string); vmPath != source {
+			t.Fatalf("bad: %s", vmPath)
+		}
+		if actual := state.Get("source_tree_hash").(string); actual != hash {
+			t.Fatalf("bad: %s", actual)
+		}
+	}
+
+	// The tree hash is verified before the import
+	for _, checksum := range []string{
+		"sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+		"md5:" + strings.TrimPrefix(hash, "sha256:"),
+	} {
+		state := testDownloadState(t)
+		step := &StepUtmDownload{Checksum: checksum, Description: "UTM", ResultKey: "vm_path", Url: []string{source}}
+		if action := step.Run(context.Background(), state); action != multistep.ActionHalt {
+			t.Fatalf("bad action: %#v: %s", action, checksum)
+		}
+		if _, ok := state.GetOk("vm_path"); ok {
+			t.Fatal("should not have a VM")
+		}
+	}
+
+	// Other directories aren't VMs
+	state := testDownloadState(t)
+	step := &StepUtmDownload{Description: "UTM", ResultKey: "vm_path", Url: []string{filepath.Dir(source)}}
+	if action := step.Run(context.Background(), state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+}
+
+func TestExtractUtmArchive_invalid(t *testing.T) {
+	for name, archive := range map[string][]byte{
+		"no VM":     testUtmTarGz(t),
+		"not a VM":  []byte("not an archive"),
+		"traversal": testTraversalZip(t),
+	} {
+		path := filepath.Join(t.TempDir(), "archive")
+		if err := os.WriteFile(path, archive, 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if _, err := extractUtmArchive(path, t.TempDir()); err == nil {
+			t.Fatalf("should have error: %s", name)
+		}
+	}
+}
+
+func testTraversalZip(t *testing.T) []byte {
+	var b bytes.Buffer
+	w := zip.NewWriter(&b)
+	f, err := w.Create("../packer.utm/config.plist")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	f.Write([]byte("<plist/>"))
+	w.Close()
+	return b.Bytes()
+}
+
+func TestKeepArchive(t *testing.T) {
+	cases := map[string]string{
+		"https://example.com/packer.utm.zip":         "https://example.com/packer.utm.zip?archive=false",
+		"https://example.com/packer.tar.gz?token=1":  "https://example.com/packer.tar.gz?token=1&archive=false",
+		"https://example.com/packer.zip?archive=zip": "https://example.com/packer.zip?archive=zip",
+		"./packer.utm.zip":                           "./packer.utm.zip?archive=false",
+	}
+	for source, expected := range cases {
+		if actual := keepArchive(source); actual != expected {
+			t.Fatalf("bad: %s: %s", source, actual)
+		}
+	}
+}
@@ -67,36 +67,63 @@ func (s *StepExport) Run(ctx context.Context, state multistep.StateBag) multiste
 			ui.Error(err.Error())
 			return multistep.ActionHalt
 		}
+		// The forward is on the 'Emulated VLAN' interface at index 1, unless
+		// StepPortForwarding reported another one
+		commInterfaceIndex := 1
+		if index, ok := state.GetOk("commInterfaceIndex"); ok {
+			commInterfaceIndex = index.(int)
+		}
 		command := []string{
 			"clear_port_forwards.applescript", vmId,
-			"--index", "1", strconv.Itoa(commPortInt),
+			"--index", strconv.Itoa(commInterfaceIndex), strconv.Itoa(commPortInt),
 		}
-		if _, err := driver.ExecuteOsaScript(command...); err != nil {
+		result, err := driver.ExecuteOsaScript(ctx, command...)
+		if err != nil {
 			err := fmt.Errorf("error deleting port forwarding rule: %s", err)
 			state.Put("error", err)
 			ui.Error(err.Error())
 			return multistep.ActionHalt
 		}
+		for _, warning := range result.Warnings {
+			ui.Message(fmt.Sprintf("Warning: %s", warning))
+		}
 	}
 
-	// Clear out the Packer-created qemu additional argument
-	qemuAdditionalArg := state.Get("qemuAdditionalArg")
-	if qemuAdditionalArg != nil {
-		ui.Message(fmt.Sprintf(
-			"Removing VNC QEMU additional argument %s", qemuAdditionalArg))
-		// Assert that qemuAdditionalArg is of type string
-		qemuAdditionalArgStr, ok := qemuAdditionalArg.(string)
-		if !ok {
-			err := fmt.Errorf("vncQemuArg is not of type string")
-			state.Put("error", err)
-			ui.Error(err.Error())
-			return multistep.ActionHalt
+	// Clear out the forwarded ports that aren't kept in the export
+	if forwarded, ok := state.GetOk("forwardedPorts"); ok {
+		forwarded := forwarded.(forwardedPorts)
+		command := []string{"clear_port_forwards.applescript", vmId}
+		for _, port := range forwarded.Ports {
+			if port.KeepInExport {
+				continue
+			}
+			ui.Message(fmt.Sprintf("Deleting forwarded port mapping %s (host port %d)", port.Name, port.HostPort))
+			command = append(command,
+				"--index", strconv.Itoa(forwarded.InterfaceIndex), strconv.Itoa(port.HostPort))
 		}
-		removeQemuArgsCommand := []string{
-			"remove_qemu_additional_args.applescript", vmId,
-			"--args", qemuAdditionalArgStr,
+		if len(command) > 2 {
+			result, err := driver.ExecuteOsaScript(ctx, command...)
+			if err != nil {
+				err := fmt.Errorf("error deleting forwarded port: %s", err)
+				state.Put("error", err)
+				ui.Error(err.Error())
+				return multistep.ActionHalt
+			}
+			for _, warning := range result.Warnings {
+				ui.Message(fmt.Sprintf("Warning: %s", warning))
+			}
 		}
-		_, err := driver.ExecuteOsaScript(removeQemuArgsCommand...)
+	}
+
+	// Clear out the Packer-created qemu additional arguments
+	if qemuAdditionalArgs, ok := state.Get("qemuAdditionalArgs").([]string); ok && len(qemuAdditionalArgs) > 0 {
+		for _, arg := range qemuAdditionalArgs {
+			ui.Message(fmt.Sprintf("Removing QEMU additional argument %s", arg))
+		}
+		removeQemuArgsCommand := append([]string{
+			"remove_qemu_additional_args.applescript", vmId, "--args",
+		}, qemuAdditionalArgs...)
+		_, err := driver.ExecuteOsaScript(ctx, removeQemuArgsCommand...)
 		if err != nil {
 			err := fmt.Errorf("error removing QEMU additional arguments: %s", err)
 			state.Put("error", err)
@@ -116,14 +143,24 @@ func (s *StepExport) Run(ctx context.Context, state multistep.StateBag) multiste
 
 	// Export via applescript POSIX only works with absolute paths.
 	outputPath := filepath.Join(absOutputDir, s.OutputFilename+"."+s.Format)
-	ui.Say("Exporting virtual machine...")
 
-	// Export the VM to an UTM file
-	if err := driver.Export(vmId, outputPath); err != nil {
-		err := fmt.Errorf("error exporting VM: %s", err)
-		state.Put("error", err)
-		ui.Error(err.Error())
-		return multistep.ActionHalt
+	if driver.HasFeature(FeatureExport) {
+		ui.Say("Exporting virtual machine...")
+
+		// Export the VM to an UTM file
+		if err := driver.Export(ctx, vmId, outputPath); err != nil {
+			err := fmt.Errorf("error exporting VM: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	} else {
+		// The installed UTM can't export through its API,
+		// the user has to export the VM manually.
+		ui.Say("UTM API does not support exporting VMs.")
+		ui.Message("Please manually export the VM using 'Share...' action in UTM VM menu.")
+		ui.Message(fmt.Sprintf("Please make sure the VM is exported to the path %s", outputPath))
+		ui.Message("The exported UTM file in the output directory will be passed as build Artifact.")
 	}
 
 	// We set export path as the output directory with UTM file.
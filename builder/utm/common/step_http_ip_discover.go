@@ -5,19 +5,229 @@ package common
 
 import (
 	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
 
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/multistep/commonsteps"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/naveenrajm7/packer-plugin-utm/builder/utm/bundle"
 )
 
+// The address of the host on the emulated VLAN network.
+const emulatedHostIP = "10.0.2.2"
+
+// The address of the host on the shared network, unless it's changed in the
+// vmnet preferences.
+const defaultSharedHostIP = "192.168.64.1"
+
+// vmnetPreferencesPath is the path of the vmnet preferences, which hold the
+// address of the host on the shared network.
+var vmnetPreferencesPath = "/Library/Preferences/SystemConfiguration/com.apple.vmnet.plist"
+
 // Step to discover the http ip
 // which guests use to reach the vm host
 // To make sure the IP is set before boot command and http server steps
-type StepHTTPIPDiscover struct{}
+//
+// The address is http_bind_address or the address of http_interface if
+// either is set. Otherwise it depends on the network the guest reaches the
+// host on: the emulated VLAN if the VM has such an interface, or else its
+// first interface. The HTTP server is bound to the address, except on the
+// shared network, whose host interface only exists while a VM runs.
+//
+// With a remote driver, the HTTP server runs on the Packer machine, and the
+// addresses of these networks are the ones of the remote host: the address
+// must be set with http_bind_address or http_interface.
+//
+// Uses:
+//
+//	driver Driver
+//	ui packersdk.Ui
+//
+// Produces:
+//
+//	http_ip string - The address of the host for the guest
+type StepHTTPIPDiscover struct {
+	HTTPAddress       string
+	HTTPInterface     string
+	NetworkInterfaces []NetworkInterface // if empty, the default interfaces are assumed
+	HTTPServer        *commonsteps.StepHTTPServer
+}
 
 func (s *StepHTTPIPDiscover) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
-	state.Put("http_ip", "10.0.2.2")
+	_, remote := state.Get("driver").(*RemoteDriver)
+	ip, bind, err := s.discover(remote)
+	if err != nil {
+		// Without files to serve, the address is only a convenience
+		if s.HTTPServer == nil || (s.HTTPServer.HTTPDir == "" && len(s.HTTPServer.HTTPContent) == 0) {
+			log.Printf("Not setting http_ip: %s", err)
+			return multistep.ActionContinue
+		}
+		err := fmt.Errorf("error discovering http_ip, set http_bind_address or http_interface: %s", err)
+		state.Put("error", err)
+		state.Get("ui").(packersdk.Ui).Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	log.Printf("Using http_ip %s", ip)
+	state.Put("http_ip", ip)
+	if bind && s.HTTPServer != nil {
+		s.HTTPServer.HTTPAddress = ip
+	}
 
 	return multistep.ActionContinue
 }
 
+// discover returns the address of the host for the guest, and whether the
+// HTTP server can be bound to it. The host of a remote driver isn't the
+// machine the HTTP server runs on.
+func (s *StepHTTPIPDiscover) discover(remote bool) (string, bool, error) {
+	if s.HTTPInterface != "" {
+		ip, err := hostInterfaceIP(s.HTTPInterface)
+		return ip, true, err
+	}
+	if s.HTTPAddress != "" && s.HTTPAddress != "0.0.0.0" {
+		return s.HTTPAddress, true, nil
+	}
+	if remote {
+		return "", false, fmt.Errorf("the VM runs on remote_host, which can't reach the HTTP server on this machine at an address of its own networks")
+	}
+
+	interfaces := s.NetworkInterfaces
+	if len(interfaces) == 0 {
+		interfaces = defaultNetworkInterfaces
+	}
+	for _, netIf := range interfaces {
+		if netIf.Mode == "emulated" {
+			return emulatedHostIP, false, nil
+		}
+	}
+
+	switch netIf := interfaces[0]; netIf.Mode {
+	case "shared":
+		ip, err := vmnetSharedHostIP(vmnetPreferencesPath)
+		return ip, false, err
+	case "bridged":
+		name := netIf.BridgeInterface
+		if name == "" {
+			var err error
+			if name, err = defaultHostInterface(); err != nil {
+				return "", false, err
+			}
+		}
+		ip, err := hostInterfaceIP(name)
+		return ip, true, err
+	default:
+		return "", false, fmt.Errorf("the address of the host can't be discovered in %s mode", netIf.Mode)
+	}
+}
+
+// hostInterface is a network interface of the host.
+type hostInterface struct {
+	Name     string
+	Up       bool
+	Loopback bool
+	IPs      []net.IP
+}
+
+// listHostInterfaces returns the network interfaces of the host.
+var listHostInterfaces = func() ([]hostInterface, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	var interfaces []hostInterface
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		hostIf := hostInterface{
+			Name:     iface.Name,
+			Up:       iface.Flags&net.FlagUp != 0,
+			Loopback: iface.Flags&net.FlagLoopback != 0,
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				hostIf.IPs = append(hostIf.IPs, ipNet.IP)
+			}
+		}
+		interfaces = append(interfaces, hostIf)
+	}
+	return interfaces, nil
+}
+
+// hostInterfaceIP returns the first IPv4 address of the host interface.
+func hostInterfaceIP(name string) (string, error) {
+	interfaces, err := listHostInterfaces()
+	if err != nil {
+		return "", err
+	}
+	for _, hostIf := range interfaces {
+		if hostIf.Name != name {
+			continue
+		}
+		for _, ip := range hostIf.IPs {
+			if ip.To4() != nil {
+				return ip.String(), nil
+			}
+		}
+		return "", fmt.Errorf("host interface %s has no IPv4 address", name)
+	}
+	return "", fmt.Errorf("host interface %s not found", name)
+}
+
+// defaultHostInterface returns the first host interface that is up and has
+// a non-loopback IPv4 address, like UTM bridges to by default.
+func defaultHostInterface() (string, error) {
+	interfaces, err := listHostInterfaces()
+	if err != nil {
+		return "", err
+	}
+	for _, hostIf := range interfaces {
+		if !hostIf.Up || hostIf.Loopback {
+			continue
+		}
+		for _, ip := range hostIf.IPs {
+			if ip.To4() != nil && !ip.IsLinkLocalUnicast() {
+				return hostIf.Name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no host interface with an IPv4 address found")
+}
+
+// vmnetSharedHostIP returns the address of the host on the shared network
+// from the vmnet preferences at path, or the default if it isn't set there.
+func vmnetSharedHostIP(path string) (string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return defaultSharedHostIP, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	root, err := bundle.DecodePlist(f)
+	if err != nil {
+		return "", fmt.Errorf("error reading %s: %s", path, err)
+	}
+	prefs, ok := root.(map[string]interface{})
+	if !ok {
+		return "", fmt.Errorf("error reading %s: not a dictionary", path)
+	}
+	address, ok := prefs["Shared_Net_Address"].(string)
+	if !ok {
+		return defaultSharedHostIP, nil
+	}
+	if net.ParseIP(address).To4() == nil {
+		return "", fmt.Errorf("invalid Shared_Net_Address %q in %s", address, path)
+	}
+	return address, nil
+}
+
 func (s *StepHTTPIPDiscover) Cleanup(state multistep.StateBag) {}
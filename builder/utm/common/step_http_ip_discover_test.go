@@ -5,9 +5,14 @@ package common
 
 import (
 	"context"
+	"encoding/hex"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/multistep/commonsteps"
 )
 
 func TestStepHTTPIPDiscover_Run(t *testing.T) {
@@ -27,3 +32,142 @@ func TestStepHTTPIPDiscover_Run(t *testing.T) {
 		t.Fatalf("bad: Http ip is %s but was supposed to be %s", httpIp, hostIp)
 	}
 }
+
+func TestStepHTTPIPDiscover_networkModes(t *testing.T) {
+	defer func(list func() ([]hostInterface, error), path string) {
+		listHostInterfaces, vmnetPreferencesPath = list, path
+	}(listHostInterfaces, vmnetPreferencesPath)
+	listHostInterfaces = func() ([]hostInterface, error) {
+		return []hostInterface{
+			{Name: "lo0", Up: true, Loopback: true, IPs: []net.IP{net.ParseIP("127.0.0.1")}},
+			{Name: "en0", Up: true, IPs: []net.IP{net.ParseIP("fe80::1"), net.ParseIP("192.168.1.10")}},
+			{Name: "en1", Up: true, IPs: []net.IP{net.ParseIP("10.1.0.5")}},
+		}, nil
+	}
+	vmnetPreferencesPath = filepath.Join(t.TempDir(), "com.apple.vmnet.plist")
+
+	cases := []struct {
+		step *StepHTTPIPDiscover
+		ip   string
+		bind string
+	}{
+		{&StepHTTPIPDiscover{}, "10.0.2.2", "0.0.0.0"},
+		{&StepHTTPIPDiscover{NetworkInterfaces: []NetworkInterface{{Mode: "bridged"}, {Mode: "emulated"}}}, "10.0.2.2", "0.0.0.0"},
+		{&StepHTTPIPDiscover{NetworkInterfaces: []NetworkInterface{{Mode: "shared"}}}, "192.168.64.1", "0.0.0.0"},
+		{&StepHTTPIPDiscover{NetworkInterfaces: []NetworkInterface{{Mode: "bridged"}}}, "192.168.1.10", "192.168.1.10"},
+		{&StepHTTPIPDiscover{NetworkInterfaces: []NetworkInterface{{Mode: "bridged", BridgeInterface: "en1"}}}, "10.1.0.5", "10.1.0.5"},
+		{&StepHTTPIPDiscover{HTTPAddress: "0.0.0.0", HTTPInterface: "en1"}, "10.1.0.5", "10.1.0.5"},
+		{&StepHTTPIPDiscover{HTTPAddress: "192.168.1.10", NetworkInterfaces: []NetworkInterface{{Mode: "shared"}}}, "192.168.1.10", "192.168.1.10"},
+	}
+	for _, c := range cases {
+		state := testState(t)
+		c.step.HTTPServer = &commonsteps.StepHTTPServer{HTTPAddress: "0.0.0.0", HTTPDir: "http"}
+		if action := c.step.Run(context.Background(), state); action != multistep.ActionContinue {
+			t.Fatalf("bad action: %#v: %s", action, state.Get("error"))
+		}
+		if ip := state.Get("http_ip"); ip != c.ip {
+			t.Fatalf("bad: %#v: %s", c.step, ip)
+		}
+		if c.step.HTTPServer.HTTPAddress != c.bind {
+			t.Fatalf("bad: %#v: %s", c.step, c.step.HTTPServer.HTTPAddress)
+		}
+	}
+}
+
+func TestStepHTTPIPDiscover_remote(t *testing.T) {
+	defer func(list func() ([]hostInterface, error)) { listHostInterfaces = list }(listHostInterfaces)
+	listHostInterfaces = func() ([]hostInterface, error) {
+		return []hostInterface{{Name: "en0", Up: true, IPs: []net.IP{net.ParseIP("192.168.1.10")}}}, nil
+	}
+
+	// The addresses of the networks are the ones of the remote host
+	for _, mode := range []string{"emulated", "shared", "bridged"} {
+		state := testState(t)
+		state.Put("driver", new(RemoteDriver))
+		step := &StepHTTPIPDiscover{
+			HTTPAddress:       "0.0.0.0",
+			NetworkInterfaces: []NetworkInterface{{Mode: mode}},
+			HTTPServer:        &commonsteps.StepHTTPServer{HTTPAddress: "0.0.0.0", HTTPDir: "http"},
+		}
+		if action := step.Run(context.Background(), state); action != multistep.ActionHalt {
+			t.Fatalf("bad action: %s: %#v", mode, action)
+		}
+		if _, ok := state.GetOk("http_ip"); ok {
+			t.Fatalf("should not have http_ip: %s", mode)
+		}
+	}
+
+	for _, step := range []*StepHTTPIPDiscover{
+		{HTTPAddress: "192.168.1.10"},
+		{HTTPAddress: "0.0.0.0", HTTPInterface: "en0"},
+	} {
+		state := testState(t)
+		state.Put("driver", new(RemoteDriver))
+		step.HTTPServer = &commonsteps.StepHTTPServer{HTTPAddress: "0.0.0.0", HTTPDir: "http"}
+		if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+			t.Fatalf("bad action: %#v: %s", action, state.Get("error"))
+		}
+		if ip := state.Get("http_ip"); ip != "192.168.1.10" || step.HTTPServer.HTTPAddress != ip {
+			t.Fatalf("bad: %#v: %s", step, ip)
+		}
+	}
+}
+
+func TestStepHTTPIPDiscover_vmnetPreferences(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "com.apple.vmnet.plist")
+	prefs := `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Shared_Net_Address</key>
+	<string>192.168.105.1</string>
+	<key>Shared_Net_Mask</key>
+	<string>255.255.255.0</string>
+</dict>
+</plist>
+`
+	if err := os.WriteFile(path, []byte(prefs), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if ip, err := vmnetSharedHostIP(path); err != nil || ip != "192.168.105.1" {
+		t.Fatalf("bad: %s: %v", ip, err)
+	}
+
+	// `defaults write` writes a binary plist
+	binary, _ := hex.DecodeString("62706c6973743030d101025f10125368617265645f4e65745f416464726573735d3139322e3136382e3130362e31" +
+		"080b20000000000000010100000000000000030000000000000000000000000000002e")
+	if err := os.WriteFile(path, binary, 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if ip, err := vmnetSharedHostIP(path); err != nil || ip != "192.168.106.1" {
+		t.Fatalf("bad: %s: %v", ip, err)
+	}
+
+	if err := os.WriteFile(path, []byte("bplist00"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := vmnetSharedHostIP(path); err == nil {
+		t.Fatal("should error")
+	}
+}
+
+func TestStepHTTPIPDiscover_failure(t *testing.T) {
+	step := &StepHTTPIPDiscover{HTTPInterface: "missing0"}
+
+	// Without files to serve, the step continues without http_ip
+	state := testState(t)
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("http_ip"); ok {
+		t.Fatal("should NOT have http_ip")
+	}
+
+	step.HTTPServer = &commonsteps.StepHTTPServer{HTTPContent: map[string]string{"/user-data": ""}}
+	if action := step.Run(context.Background(), state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); !ok {
+		t.Fatal("should have error")
+	}
+}
@@ -0,0 +1,90 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+)
+
+// This step mounts the shared directory in the guest with the mount
+// command, once the communicator has connected.
+//
+// Uses:
+//
+//	communicator packersdk.Communicator
+//	ui packersdk.Ui
+//
+// Produces:
+//
+//	<nothing>
+type StepMountSharedDirectory struct {
+	SharedDirectory *SharedDirectory
+}
+
+func (s *StepMountSharedDirectory) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	if s.SharedDirectory == nil || s.SharedDirectory.MountPoint == "" {
+		return multistep.ActionContinue
+	}
+
+	ui := state.Get("ui").(packersdk.Ui)
+	comm, ok := state.Get("communicator").(packersdk.Communicator)
+	if !ok {
+		ui.Say("No communicator, not mounting the shared directory in the guest.")
+		return multistep.ActionContinue
+	}
+
+	command, err := s.SharedDirectory.RenderMountCommand()
+	if err != nil {
+		err := fmt.Errorf("error rendering the mount command: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	ui.Say(fmt.Sprintf("Mounting the shared directory at %s...", s.SharedDirectory.MountPoint))
+	log.Printf("Executing mount command: %s", command)
+	cmd := &packersdk.RemoteCmd{Command: command}
+	if err := cmd.RunWithUi(ctx, comm, ui); err != nil {
+		err := fmt.Errorf("failed to send the mount command: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	if status := cmd.ExitStatus(); status != 0 {
+		err := fmt.Errorf("the mount command exited with status %d", status)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	return multistep.ActionContinue
+}
+
+func (s *StepMountSharedDirectory) Cleanup(state multistep.StateBag) {}
+
+// mountCommandData is the data of the mount_command template.
+type mountCommandData struct {
+	MountPoint string
+	Tag        string
+	Options    string
+}
+
+// RenderMountCommand returns the command that mounts the directory in the
+// guest.
+func (d *SharedDirectory) RenderMountCommand() (string, error) {
+	options := "rw"
+	if d.ReadOnly {
+		options = "ro"
+	}
+	ctx := d.ctx
+	ctx.Data = &mountCommandData{
+		MountPoint: d.MountPoint,
+		Tag:        sharedDirectoryTag,
+		Options:    options,
+	}
+	return interpolate.Render(d.MountCommand, &ctx)
+}
@@ -2,8 +2,12 @@ package common
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"strconv"
+	"strings"
 
 	"github.com/hashicorp/packer-plugin-sdk/communicator"
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
@@ -11,8 +15,9 @@ import (
 	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
 )
 
-// This step adds a Emulated VLAN port forwarding definition so that SSH (or WinRM ?)
-// is available on the guest machine.
+// This step sets up the network interfaces and adds a Emulated VLAN port
+// forwarding definition so that SSH (or WinRM ?) is available on the guest
+// machine, followed by the user-defined forwarded ports.
 //
 // Uses:
 //
@@ -21,13 +26,29 @@ import (
 //	vmName string
 //
 // Produces:
+//
+//	commHostPort int - The host port forwarded to the communicator port
+//	commInterfaceIndex int - The index of the network interface with the forward
+//	forwardedPorts forwardedPorts - The forwarded ports with their host ports
+//	generated_data map[string]interface{} - ForwardedPort_<name> host ports
 type StepPortForwarding struct {
 	CommConfig             *communicator.Config
 	HostPortMin            int
 	HostPortMax            int
 	SkipNatMapping         bool
-	ClearNetworkInterfaces bool // if true, all network interfaces will be cleared before adding new ones
+	ClearNetworkInterfaces bool               // if true, all network interfaces will be cleared before adding new ones
+	NetworkInterfaces      []NetworkInterface // if set, these replace the network interfaces of the VM
+	ForwardedPorts         []ForwardedPort
 	l                      *net.Listener
+	listeners              []*net.Listener
+	tunnels                []io.Closer
+}
+
+// forwardedPorts are the forwarded ports added by StepPortForwarding, with
+// the host ports it picked.
+type forwardedPorts struct {
+	InterfaceIndex int
+	Ports          []ForwardedPort
 }
 
 func (s *StepPortForwarding) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
@@ -35,6 +56,37 @@ func (s *StepPortForwarding) Run(ctx context.Context, state multistep.StateBag)
 	ui := state.Get("ui").(packersdk.Ui)
 	vmId := state.Get("vmId").(string)
 
+	forward := s.CommConfig.Type != "none" && !s.SkipNatMapping
+
+	// Replace the network interfaces with the configured ones. Without any,
+	// the VM is assumed to have a 'Shared Network' interface and an
+	// 'Emulated VLAN' interface at index 0 and 1 respectively, which are
+	// added if ClearNetworkInterfaces is set.
+	interfaces := s.NetworkInterfaces
+	if len(interfaces) == 0 && s.ClearNetworkInterfaces && (forward || len(s.ForwardedPorts) > 0) {
+		interfaces = defaultNetworkInterfaces
+	}
+	commInterfaceIndex := 1
+	if len(interfaces) > 0 {
+		index, err := setNetworkInterfaces(ctx, driver, vmId, interfaces)
+		if err != nil {
+			err := fmt.Errorf("error adding network interface: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		commInterfaceIndex = index
+	}
+
+	if len(s.ForwardedPorts) > 0 {
+		if err := s.forwardPorts(ctx, state, commInterfaceIndex); err != nil {
+			err := fmt.Errorf("error adding forwarded port: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+
 	if s.CommConfig.Type == "none" {
 		log.Printf("Not using a communicator, skipping setting up port forwarding...")
 		state.Put("commHostPort", 0)
@@ -43,89 +95,200 @@ func (s *StepPortForwarding) Run(ctx context.Context, state multistep.StateBag)
 
 	guestPort := s.CommConfig.Port()
 	commHostPort := guestPort
-	if !s.SkipNatMapping {
+	if forward {
+		if commInterfaceIndex < 0 {
+			err := fmt.Errorf("error creating port forwarding rule: there is no emulated VLAN network interface")
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+
 		log.Printf("Looking for available communicator (SSH, WinRM, etc) port between %d and %d",
 			s.HostPortMin, s.HostPortMax)
 
 		var err error
-		s.l, err = net.ListenRangeConfig{
-			Addr:    "127.0.0.1",
-			Min:     s.HostPortMin,
-			Max:     s.HostPortMax,
-			Network: "tcp",
-		}.Listen(ctx)
+		s.l, err = s.listenPort(ctx, driver, "tcp", "127.0.0.1", s.HostPortMin, s.HostPortMax)
 		if err != nil {
 			err := fmt.Errorf("error creating port forwarding rule: %s", err)
 			state.Put("error", err)
 			ui.Error(err.Error())
 			return multistep.ActionHalt
 		}
-		s.l.Listener.Close() // free port, but don't unlock lock file
 		commHostPort = s.l.Port
 
-		// Clear network interfaces and add new ones.
-		// Else, We assume the VM is already configured with a 'Shared Network' interface
-		// and 'Emulated VLAN' interface at index 0 and 1 respectively.
-		if s.ClearNetworkInterfaces {
-			// Make sure to clear the network interfaces and prepare for the new configuration
-			if _, err := driver.ExecuteOsaScript("clear_network_interfaces.applescript", vmId); err != nil {
-				err := fmt.Errorf("error clearing network interfaces: %s", err)
-				state.Put("error", err)
-				ui.Error(err.Error())
-				return multistep.ActionHalt
-			}
-
-			// We now hard code interfaces as needed by Vagrant and Packer.
-			// 0 index - 'Shared Network' interface
-			// 1 index - 'Emulated VLAN' interface
-			// but this should be configurable
-
-			// Add access to localhost => UTM 'Shared Network' interface
-			if _, err := driver.ExecuteOsaScript("add_network_interface.applescript", vmId, "ShRd"); err != nil {
-				err := fmt.Errorf("error adding network interface: %s", err)
-				state.Put("error", err)
-				ui.Error(err.Error())
-				return multistep.ActionHalt
-			}
-
-			// TODO: check if we need to add the 'Shared Network' interface
-			// TODO: check if we need to add the 'Emulated VLAN' interface
-			// and then add if needed
-			// Make sure to configure the network interface to 'Emulated VLAN' mode
-			// required for port forwarding now in packer , later in vagrant
-			if _, err := driver.ExecuteOsaScript("add_network_interface.applescript", vmId, "EmUd"); err != nil {
-				err := fmt.Errorf("error adding network interface: %s", err)
-				state.Put("error", err)
-				ui.Error(err.Error())
-				return multistep.ActionHalt
-			}
-		}
-
 		// Create a forwarded port mapping to the VM (on the 'Emulated VLAN' interface)
 		// "tcp, 127.0.0.1, hostPort, guestPort"
 		ui.Say(fmt.Sprintf("Creating forwarded port mapping for communicator (SSH, WinRM, etc) (host port %d)", commHostPort))
 		command := []string{
 			"add_port_forwards.applescript", vmId,
-			"--index", "1",
+			"--index", strconv.Itoa(commInterfaceIndex),
 			fmt.Sprintf("TcPp,,%d,127.0.0.1,%d", guestPort, commHostPort),
 		}
-		if _, err := driver.ExecuteOsaScript(command...); err != nil {
+		result, err := driver.ExecuteOsaScript(ctx, command...)
+		if err != nil {
 			err := fmt.Errorf("error adding port forwarding rule: %s", err)
 			state.Put("error", err)
 			ui.Error(err.Error())
 			return multistep.ActionHalt
 		}
+		// Without the rule the communicator can't connect
+		if len(result.Warnings) > 0 {
+			err := fmt.Errorf("error adding port forwarding rule: %s", strings.Join(result.Warnings, "; "))
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
 
 	}
 	// Save the port we're using so that future steps can use it
 	state.Put("commHostPort", commHostPort)
+	state.Put("commInterfaceIndex", commInterfaceIndex)
 
 	return multistep.ActionContinue
 }
 
+// forwardPorts adds the forwarded ports on the network interface at the
+// given UTM index, picking the host ports without one.
+func (s *StepPortForwarding) forwardPorts(ctx context.Context, state multistep.StateBag, index int) error {
+	driver := state.Get("driver").(Driver)
+	ui := state.Get("ui").(packersdk.Ui)
+	vmId := state.Get("vmId").(string)
+
+	if index < 0 {
+		return fmt.Errorf("there is no emulated VLAN network interface")
+	}
+
+	ports := make([]ForwardedPort, len(s.ForwardedPorts))
+	copy(ports, s.ForwardedPorts)
+	command := []string{"add_port_forwards.applescript", vmId}
+	for i := range ports {
+		port := &ports[i]
+		if port.HostPort == 0 {
+			log.Printf("Looking for available port for %s between %d and %d",
+				port.Name, port.HostPortMin, port.HostPortMax)
+			l, err := s.listenPort(ctx, driver, port.Protocol, port.HostAddress, port.HostPortMin, port.HostPortMax)
+			if err != nil {
+				return fmt.Errorf("%s: %s", port.Name, err)
+			}
+			s.listeners = append(s.listeners, l)
+			port.HostPort = l.Port
+		} else if port.Protocol == "tcp" {
+			// Make the port of a remote UTM host reachable here
+			tunnel, err := driver.Tunnel(ctx, fmt.Sprintf("%s:%d", port.HostAddress, port.HostPort))
+			if err != nil {
+				return fmt.Errorf("error tunneling %s: %s", port.Name, err)
+			}
+			s.tunnels = append(s.tunnels, tunnel)
+		}
+
+		ui.Say(fmt.Sprintf("Creating forwarded port mapping %s for guest port %d (host port %d)",
+			port.Name, port.GuestPort, port.HostPort))
+		command = append(command, "--index", strconv.Itoa(index), fmt.Sprintf("%s,%s,%d,%s,%d",
+			ForwardedPortProtocolEnumMap[port.Protocol], port.GuestAddress, port.GuestPort,
+			port.HostAddress, port.HostPort))
+	}
+
+	result, err := driver.ExecuteOsaScript(ctx, command...)
+	if err != nil {
+		return err
+	}
+	if len(result.Warnings) > 0 {
+		return fmt.Errorf("%s", strings.Join(result.Warnings, "; "))
+	}
+	state.Put("forwardedPorts", forwardedPorts{InterfaceIndex: index, Ports: ports})
+
+	// Expose the host ports to the provisioners
+	generatedData := make(map[string]interface{})
+	if data, ok := state.GetOk("generated_data"); ok {
+		generatedData = data.(map[string]interface{})
+	}
+	for _, port := range ports {
+		generatedData[forwardedPortVar(port.Name)] = port.HostPort
+	}
+	state.Put("generated_data", generatedData)
+
+	return nil
+}
+
+// listenPort picks a port between min and max that is free on addr, and
+// tunnels TCP ports of a remote UTM host here. A port that is free here can
+// be in use on the remote host, then another one is picked: the lock files
+// of the ports in use are kept until Cleanup, so that they aren't picked
+// again. Other protocols are only checked here, with TCP.
+func (s *StepPortForwarding) listenPort(ctx context.Context, driver Driver, protocol string, addr string, min int, max int) (*net.Listener, error) {
+	for attempt := 1; ; attempt++ {
+		// The lock file keeps other builds from picking the port
+		l, err := net.ListenRangeConfig{
+			Addr:    addr,
+			Min:     min,
+			Max:     max,
+			Network: "tcp",
+		}.Listen(ctx)
+		if err != nil {
+			return nil, err
+		}
+		l.Listener.Close() // free port, but don't unlock lock file
+		if protocol != "tcp" {
+			return l, nil
+		}
+
+		tunnel, err := driver.Tunnel(ctx, fmt.Sprintf("%s:%d", addr, l.Port))
+		if err == nil {
+			s.tunnels = append(s.tunnels, tunnel)
+			return l, nil
+		}
+		s.listeners = append(s.listeners, l)
+		if !errors.Is(err, errPortInUse) || attempt >= max-min {
+			return nil, fmt.Errorf("error tunneling port %d: %s", l.Port, err)
+		}
+		log.Printf("Port %d is in use on the UTM host, looking for another one", l.Port)
+	}
+}
+
+// setNetworkInterfaces replaces the network interfaces of the VM and returns
+// the UTM index of the interface for the communicator, or -1.
+func setNetworkInterfaces(ctx context.Context, driver Driver, vmId string, interfaces []NetworkInterface) (int, error) {
+	if _, err := driver.ExecuteOsaScript(ctx, "clear_network_interfaces.applescript", vmId); err != nil {
+		return -1, err
+	}
+
+	commInterface := communicatorInterface(interfaces)
+	commInterfaceIndex := -1
+	for i, netIf := range interfaces {
+		command := []string{"add_network_interface.applescript", vmId, NetworkModeEnumMap[netIf.Mode]}
+		if netIf.Hardware != "" {
+			command = append(command, "--hardware", netIf.Hardware)
+		}
+		if netIf.MacAddress != "" {
+			command = append(command, "--address", netIf.MacAddress)
+		}
+		if netIf.BridgeInterface != "" {
+			command = append(command, "--host-interface", netIf.BridgeInterface)
+		}
+
+		result, err := driver.ExecuteOsaScript(ctx, command...)
+		if err != nil {
+			return -1, err
+		}
+		if i == commInterface {
+			if result.InterfaceIndex == nil {
+				return -1, fmt.Errorf("no interface index was returned")
+			}
+			commInterfaceIndex = *result.InterfaceIndex
+		}
+	}
+	return commInterfaceIndex, nil
+}
+
 func (s *StepPortForwarding) Cleanup(state multistep.StateBag) {
-	if s.l != nil {
-		err := s.l.Close()
+	for _, tunnel := range s.tunnels {
+		tunnel.Close()
+	}
+	for _, l := range append(s.listeners, s.l) {
+		if l == nil {
+			continue
+		}
+		err := l.Close()
 		if err != nil {
 			log.Printf("failed to unlock port lockfile: %v", err)
 		}
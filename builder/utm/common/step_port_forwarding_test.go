@@ -0,0 +1,205 @@
+package common
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/packer-plugin-sdk/communicator"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+)
+
+func TestStepPortForwarding_impl(t *testing.T) {
+	var _ multistep.Step = new(StepPortForwarding)
+}
+
+func TestStepPortForwarding_networkInterfaces(t *testing.T) {
+	driver := new(DriverSimulator)
+	vmId := driver.AddVM(SimulatedVM{
+		Name:              "packer",
+		NetworkInterfaces: []SimulatedNetworkInterface{{Mode: "ShRd"}},
+	})
+
+	state := testState(t)
+	state.Put("driver", driver)
+	state.Put("vmId", vmId)
+
+	step := &StepPortForwarding{
+		CommConfig:  &communicator.Config{Type: "ssh", SSH: communicator.SSH{SSHPort: 22}},
+		HostPortMin: 2222,
+		HostPortMax: 4444,
+		NetworkInterfaces: []NetworkInterface{
+			{Mode: "bridged", BridgeInterface: "en0", MacAddress: "3E:4A:6F:12:9B:C0"},
+			{Mode: "host", Hardware: "e1000"},
+			{Mode: "emulated"},
+		},
+	}
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v: %s", action, state.Get("error"))
+	}
+	defer step.Cleanup(state)
+
+	interfaces := driver.VM(vmId).NetworkInterfaces
+	if len(interfaces) != 3 {
+		t.Fatalf("bad: %#v", interfaces)
+	}
+	bridged, host, emulated := interfaces[0], interfaces[1], interfaces[2]
+	if bridged.Mode != "BrDg" || bridged.HostInterface != "en0" || bridged.MacAddress != "3E:4A:6F:12:9B:C0" {
+		t.Fatalf("bad: %#v", bridged)
+	}
+	if host.Mode != "HsOn" || host.Hardware != "e1000" {
+		t.Fatalf("bad: %#v", host)
+	}
+	if emulated.Mode != "EmUd" || len(emulated.PortForwards) != 1 {
+		t.Fatalf("the communicator port should be forwarded on the emulated interface: %#v", emulated)
+	}
+	if index := state.Get("commInterfaceIndex").(int); index != 2 {
+		t.Fatalf("bad: %d", index)
+	}
+
+	// The forward is removed before the export, leaving the interfaces as
+	// configured
+	export := &StepExport{Format: "utm", OutputDir: t.TempDir()}
+	state.Put("vmName", "packer")
+	if action := export.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v: %s", action, state.Get("error"))
+	}
+	if forwards := driver.VM(vmId).NetworkInterfaces[2].PortForwards; len(forwards) != 0 {
+		t.Fatalf("bad: %#v", forwards)
+	}
+}
+
+func TestStepPortForwarding_noCommunicator(t *testing.T) {
+	driver := new(DriverSimulator)
+	vmId := driver.AddVM(SimulatedVM{
+		Name:              "packer",
+		NetworkInterfaces: []SimulatedNetworkInterface{{Mode: "ShRd"}, {Mode: "EmUd"}},
+	})
+
+	state := testState(t)
+	state.Put("driver", driver)
+	state.Put("vmId", vmId)
+
+	// Without a communicator, only the network interfaces are set up
+	step := &StepPortForwarding{
+		CommConfig:        &communicator.Config{Type: "none"},
+		NetworkInterfaces: []NetworkInterface{{Mode: "bridged"}},
+	}
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v: %s", action, state.Get("error"))
+	}
+	interfaces := driver.VM(vmId).NetworkInterfaces
+	if len(interfaces) != 1 || interfaces[0].Mode != "BrDg" || len(interfaces[0].PortForwards) != 0 {
+		t.Fatalf("bad: %#v", interfaces)
+	}
+}
+
+func TestStepPortForwarding_forwardedPorts(t *testing.T) {
+	driver := new(DriverSimulator)
+	vmId := driver.AddVM(SimulatedVM{
+		Name:              "packer",
+		NetworkInterfaces: []SimulatedNetworkInterface{{Mode: "ShRd"}, {Mode: "EmUd"}},
+	})
+
+	state := testState(t)
+	state.Put("driver", driver)
+	state.Put("vmId", vmId)
+	state.Put("vmName", "packer")
+
+	step := &StepPortForwarding{
+		CommConfig:  &communicator.Config{Type: "ssh", SSH: communicator.SSH{SSHPort: 22}},
+		HostPortMin: 2222,
+		HostPortMax: 4444,
+		ForwardedPorts: []ForwardedPort{
+			{Name: "web", Protocol: "tcp", GuestPort: 80, HostAddress: "127.0.0.1", HostPortMin: 8000, HostPortMax: 8100},
+			{Name: "dns", Protocol: "udp", GuestAddress: "10.0.2.15", GuestPort: 53,
+				HostAddress: "127.0.0.1", HostPort: 5353, KeepInExport: true},
+		},
+	}
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v: %s", action, state.Get("error"))
+	}
+	defer step.Cleanup(state)
+
+	forwards := driver.VM(vmId).NetworkInterfaces[1].PortForwards
+	if len(forwards) != 3 {
+		t.Fatalf("bad: %#v", forwards)
+	}
+	web, dns := forwards[0], forwards[1]
+	if web.Protocol != "TcPp" || web.GuestPort != 80 || web.HostPort < 8000 || web.HostPort >= 8100 {
+		t.Fatalf("bad: %#v", web)
+	}
+	if dns.Protocol != "UdPp" || dns.GuestAddress != "10.0.2.15" || dns.GuestPort != 53 || dns.HostPort != 5353 {
+		t.Fatalf("bad: %#v", dns)
+	}
+
+	// The host ports are exposed to the provisioners
+	data := state.Get("generated_data").(map[string]interface{})
+	if data["ForwardedPort_web"] != web.HostPort || data["ForwardedPort_dns"] != 5353 {
+		t.Fatalf("bad: %#v", data)
+	}
+
+	// Only the kept forward remains in the export
+	export := &StepExport{Format: "utm", OutputDir: t.TempDir()}
+	if action := export.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v: %s", action, state.Get("error"))
+	}
+	forwards = driver.VM(vmId).NetworkInterfaces[1].PortForwards
+	if len(forwards) != 1 || forwards[0] != dns {
+		t.Fatalf("bad: %#v", forwards)
+	}
+}
+
+func TestStepPortForwarding_forwardedPortsNoEmulatedInterface(t *testing.T) {
+	driver := new(DriverSimulator)
+	vmId := driver.AddVM(SimulatedVM{Name: "packer"})
+
+	state := testState(t)
+	state.Put("driver", driver)
+	state.Put("vmId", vmId)
+
+	step := &StepPortForwarding{
+		CommConfig:        &communicator.Config{Type: "none"},
+		NetworkInterfaces: []NetworkInterface{{Mode: "shared"}},
+		ForwardedPorts:    []ForwardedPort{{Name: "web", Protocol: "tcp", GuestPort: 80, HostPort: 8080}},
+	}
+	if action := step.Run(context.Background(), state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); !ok {
+		t.Fatal("should have error")
+	}
+}
+
+func TestStepPortForwarding_remotePortInUse(t *testing.T) {
+	state := testState(t)
+	driver := state.Get("driver").(*DriverMock)
+	driver.TunnelInUse = []string{"127.0.0.1:18000"}
+	state.Put("vmId", "packer")
+
+	// Another port is picked when the port is in use on the UTM host
+	step := &StepPortForwarding{
+		CommConfig:     &communicator.Config{Type: "none"},
+		ForwardedPorts: []ForwardedPort{{Name: "web", Protocol: "tcp", GuestPort: 80, HostAddress: "127.0.0.1", HostPortMin: 18000, HostPortMax: 18002}},
+	}
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v: %s", action, state.Get("error"))
+	}
+	step.Cleanup(state)
+	if port := state.Get("forwardedPorts").(forwardedPorts).Ports[0]; port.HostPort != 18001 {
+		t.Fatalf("bad: %#v", port)
+	}
+
+	// Without another port the step fails
+	state = testState(t)
+	driver = state.Get("driver").(*DriverMock)
+	driver.TunnelInUse = []string{"127.0.0.1:18000"}
+	state.Put("vmId", "packer")
+	step = &StepPortForwarding{
+		CommConfig:     &communicator.Config{Type: "none"},
+		ForwardedPorts: []ForwardedPort{{Name: "web", Protocol: "tcp", GuestPort: 80, HostAddress: "127.0.0.1", HostPortMin: 18000, HostPortMax: 18001}},
+	}
+	if action := step.Run(context.Background(), state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	step.Cleanup(state)
+}
@@ -12,13 +12,15 @@ import (
 )
 
 // This step removes any devices (floppy disks, ISOs, etc.) from the
-// machine that we may have added.
+// machine that we may have added, and the disks excluded from the export.
 //
 // Uses:
 //
 //	driver Driver
 //	ui packersdk.Ui
-//	vmName string
+//	vmId string
+//	disk_unmount_commands map[string][]string
+//	excluded_drives []string
 //
 // Produces:
 type StepRemoveDevices struct {
@@ -31,6 +33,24 @@ func (s *StepRemoveDevices) Run(ctx context.Context, state multistep.StateBag) m
 
 	// TODO: Remove the attached floppy disk, if it exists
 
+	// Detach the disks that are not kept in the exported VM
+	if excludedDrives, ok := state.GetOk("excluded_drives"); ok {
+		vmId := state.Get("vmId").(string)
+		for _, driveId := range excludedDrives.([]string) {
+			ui.Say(fmt.Sprintf("Detaching hard drive %s excluded from the export...", driveId))
+			result, err := driver.ExecuteOsaScript(ctx, "remove_drive.applescript", vmId, driveId)
+			if err != nil {
+				err := fmt.Errorf("error detaching hard drive: %s", err)
+				state.Put("error", err)
+				ui.Error(err.Error())
+				return multistep.ActionHalt
+			}
+			for _, warning := range result.Warnings {
+				ui.Message(fmt.Sprintf("Warning: %s", warning))
+			}
+		}
+	}
+
 	var isoUnmountCommands map[string][]string
 	isoUnmountCommandsRaw, ok := state.GetOk("disk_unmount_commands")
 	if !ok {
@@ -46,12 +66,16 @@ func (s *StepRemoveDevices) Run(ctx context.Context, state multistep.StateBag) m
 			continue
 		}
 
-		if _, err := driver.ExecuteOsaScript(unmountCommand...); err != nil {
+		result, err := driver.ExecuteOsaScript(ctx, unmountCommand...)
+		if err != nil {
 			err := fmt.Errorf("error detaching ISO: %s", err)
 			state.Put("error", err)
 			ui.Error(err.Error())
 			return multistep.ActionHalt
 		}
+		for _, warning := range result.Warnings {
+			ui.Message(fmt.Sprintf("Warning: %s", warning))
+		}
 	}
 
 	// log that we removed the isos, so we don't waste time trying to do it
@@ -130,3 +130,32 @@ func TestStepRemoveDevices_attachedIsoOnSata(t *testing.T) {
 // 		t.Fatalf("bad: %#v", driver.ExecuteOsaCalls)
 // 	}
 // }
+
+func TestStepRemoveDevices_excludedDrives(t *testing.T) {
+	state := testState(t)
+	step := new(StepRemoveDevices)
+
+	state.Put("excluded_drives", []string{"drive1", "drive2"})
+	state.Put("vmId", "myvm")
+
+	driver := state.Get("driver").(*DriverMock)
+
+	// Test the run
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); ok {
+		t.Fatal("should NOT have error")
+	}
+
+	// Test that the drives were detached, without unmount commands
+	if len(driver.ExecuteOsaCalls) != 2 {
+		t.Fatalf("bad: %#v", driver.ExecuteOsaCalls)
+	}
+	for i, driveId := range []string{"drive1", "drive2"} {
+		call := driver.ExecuteOsaCalls[i]
+		if call[0] != "remove_drive.applescript" || call[1] != "myvm" || call[2] != driveId {
+			t.Fatalf("bad: %#v", driver.ExecuteOsaCalls)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package common
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// This step removes the shared directory from the stopped VM before the
+// export, unless it is kept in the artifact. The directories and the share
+// mode the VM had before the build are restored.
+//
+// Uses:
+//
+//	driver Driver
+//	original_shared_directory originalSharedDirectory - optional
+//	ui packersdk.Ui
+//	vmId string
+//
+// Produces:
+//
+//	<nothing>
+type StepRemoveSharedDirectory struct {
+	SharedDirectory *SharedDirectory
+}
+
+func (s *StepRemoveSharedDirectory) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	if s.SharedDirectory == nil || s.SharedDirectory.KeepInArtifact {
+		return multistep.ActionContinue
+	}
+
+	driver := state.Get("driver").(Driver)
+	ui := state.Get("ui").(packersdk.Ui)
+	vmId := state.Get("vmId").(string)
+
+	original, _ := state.Get("original_shared_directory").(originalSharedDirectory)
+
+	ui.Say("Removing the shared directory...")
+	command := append([]string{"set_shared_directory.applescript", vmId}, original.Directories...)
+	if _, err := driver.ExecuteOsaScript(ctx, command...); err != nil {
+		err := fmt.Errorf("error removing the shared directory: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	if s.SharedDirectory.ModeEnumCode() != "" {
+		mode := original.Mode
+		if mode == "" {
+			mode = DirectoryShareModeEnumMap["none"]
+		}
+		if _, err := driver.ExecuteOsaScript(ctx, "customize_vm.applescript", vmId,
+			"--directory-share-mode", mode); err != nil {
+			err := fmt.Errorf("error setting the directory share mode: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+
+	return multistep.ActionContinue
+}
+
+func (s *StepRemoveSharedDirectory) Cleanup(state multistep.StateBag) {}
@@ -0,0 +1,47 @@
+package common
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// This step removes the snapshot taken by StepSnapshot from the disks, so
+// that it does not end up in the exported VM. The VM must be stopped.
+//
+// Uses:
+//
+//	disk_snapshot diskSnapshot - optional
+//	driver Driver
+//	ui packersdk.Ui
+//
+// Produces:
+//
+//	<nothing>
+type StepRemoveSnapshot struct{}
+
+func (s *StepRemoveSnapshot) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	rawSnapshot, ok := state.GetOk("disk_snapshot")
+	if !ok {
+		return multistep.ActionContinue
+	}
+
+	driver := state.Get("driver").(Driver)
+	ui := state.Get("ui").(packersdk.Ui)
+	snapshot := rawSnapshot.(diskSnapshot)
+
+	ui.Say(fmt.Sprintf("Removing disk snapshot %s...", snapshot.Name))
+	if err := snapshotImages(ctx, driver, "-d", snapshot); err != nil {
+		err := fmt.Errorf("error removing disk snapshot: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	state.Remove("disk_snapshot")
+
+	return multistep.ActionContinue
+}
+
+func (s *StepRemoveSnapshot) Cleanup(state multistep.StateBag) {}
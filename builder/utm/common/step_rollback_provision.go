@@ -0,0 +1,124 @@
+package common
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/packer-plugin-sdk/communicator"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/multistep/commonsteps"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// This step runs the provisioners. When they fail and StepSnapshot took a
+// snapshot, the VM is rolled back to the snapshot and the provisioners are
+// run again, up to Retries times, once the steps of AfterConnect, e.g. the
+// mount of the shared directory, have run again after the reconnection.
+// With Rollback, the VM is also rolled back after the last failure, and
+// left stopped.
+//
+// Uses:
+//
+//	disk_snapshot diskSnapshot - optional
+//	driver Driver
+//	ui packersdk.Ui
+//	vmId string
+//
+// Produces:
+//
+//	<nothing>
+type StepRollbackProvision struct {
+	Retries  int
+	Rollback bool
+	Shutdown *StepShutdown
+	Connect  *communicator.StepConnect
+	// The steps that ran after StepSnapshot, which are run again after each
+	// rollback, as their changes to the guest are rolled back
+	AfterConnect []multistep.Step
+
+	provision *commonsteps.StepProvision
+	connect   multistep.Step
+}
+
+func (s *StepRollbackProvision) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packersdk.Ui)
+
+	for attempt := 1; ; attempt++ {
+		s.provision = new(commonsteps.StepProvision)
+		action := s.provision.Run(ctx, state)
+		if action == multistep.ActionContinue {
+			return action
+		}
+
+		rawSnapshot, ok := state.GetOk("disk_snapshot")
+		rawErr, failed := state.GetOk("error")
+		if !ok || !failed || ctx.Err() != nil {
+			return action
+		}
+		if _, cancelled := state.GetOk(multistep.StateCancelled); cancelled {
+			return action
+		}
+		retry := attempt <= s.Retries
+		if !retry && !s.Rollback {
+			return action
+		}
+
+		snapshot := rawSnapshot.(diskSnapshot)
+		ui.Error(fmt.Sprintf("Provisioning failed: %s", rawErr))
+		ui.Say(fmt.Sprintf("Rolling back disks to snapshot %s...", snapshot.Name))
+		if err := s.rollback(ctx, state, snapshot); err != nil {
+			err := fmt.Errorf("error rolling back to snapshot %s: %s", snapshot.Name, err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		if !retry {
+			ui.Say("The virtual machine was rolled back to the state before provisioning")
+			return action
+		}
+
+		ui.Say(fmt.Sprintf("Retrying provisioning (retry %d of %d)...", attempt, s.Retries))
+		state.Remove("error")
+		if s.connect != nil {
+			s.connect.Cleanup(state)
+		}
+		s.connect, action = reconnect(ctx, state, s.Connect)
+		if action != multistep.ActionContinue {
+			return action
+		}
+		for _, step := range s.AfterConnect {
+			if action := step.Run(ctx, state); action != multistep.ActionContinue {
+				return action
+			}
+		}
+	}
+}
+
+// rollback stops the VM, as its state is discarded anyway, and reverts its
+// disks to the snapshot.
+func (s *StepRollbackProvision) rollback(ctx context.Context, state multistep.StateBag, snapshot diskSnapshot) error {
+	driver := state.Get("driver").(Driver)
+	vmId := state.Get("vmId").(string)
+
+	running, err := driver.IsRunning(ctx, vmId)
+	if err != nil {
+		return err
+	}
+	if running {
+		halt := &StepShutdown{Timeout: s.Shutdown.Timeout, Delay: s.Shutdown.Delay}
+		if action := halt.Run(ctx, state); action != multistep.ActionContinue {
+			return state.Get("error").(error)
+		}
+	}
+
+	return snapshotImages(ctx, driver, "-a", snapshot)
+}
+
+func (s *StepRollbackProvision) Cleanup(state multistep.StateBag) {
+	if s.provision != nil {
+		s.provision.Cleanup(state)
+	}
+	if s.connect != nil {
+		s.connect.Cleanup(state)
+	}
+}
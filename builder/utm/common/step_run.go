@@ -5,7 +5,10 @@ package common
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log"
+	"time"
 
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
 	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
@@ -31,10 +34,13 @@ func (s *StepRun) Run(ctx context.Context, state multistep.StateBag) multistep.S
 
 	ui.Say("Starting the virtual machine...")
 	command := []string{"start", vmId}
-	if _, err := driver.Utmctl(command...); err != nil {
-		err := fmt.Errorf("error starting VM: %s", err)
+	if _, err := driver.Utmctl(ctx, command...); err != nil {
+		err := fmt.Errorf("error starting VM: %w", err)
 		state.Put("error", err)
 		ui.Error(err.Error())
+		if hint := DriverErrorHint(err); hint != "" {
+			ui.Error(hint)
+		}
 		return multistep.ActionHalt
 	}
 
@@ -54,9 +60,32 @@ func (s *StepRun) Cleanup(state multistep.StateBag) {
 	driver := state.Get("driver").(Driver)
 	ui := state.Get("ui").(packersdk.Ui)
 
-	if running, _ := driver.IsRunning(s.vmId); running {
-		if _, err := driver.Utmctl("stop", s.vmId); err != nil {
-			ui.Error(fmt.Sprintf("Error shutting down VM: %s", err))
+	// The build context may already be cancelled, cleanup must still run
+	ctx := context.Background()
+	running, err := driver.IsRunning(ctx, s.vmId)
+	if err != nil {
+		// Nothing left to stop if the VM or UTM itself is gone
+		if errors.Is(err, ErrVMNotFound) || errors.Is(err, ErrUTMNotRunning) {
+			log.Printf("Not stopping VM %s: %s", s.vmId, err)
+			return
+		}
+		ui.Error(fmt.Sprintf("Error checking if VM is running: %s", err))
+		return
+	}
+	if !running {
+		return
+	}
+
+	_, err = driver.Utmctl(ctx, "stop", s.vmId)
+	for retries := 0; errors.Is(err, ErrUTMBusy) && retries < 3; retries++ {
+		log.Printf("UTM is busy, retrying to stop VM %s in %s", s.vmId, busyRetryDelay)
+		time.Sleep(busyRetryDelay)
+		_, err = driver.Utmctl(ctx, "stop", s.vmId)
+	}
+	if err != nil && !errors.Is(err, ErrVMNotFound) {
+		ui.Error(fmt.Sprintf("Error shutting down VM: %s", err))
+		if hint := DriverErrorHint(err); hint != "" {
+			ui.Error(hint)
 		}
 	}
 }
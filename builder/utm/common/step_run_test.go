@@ -0,0 +1,57 @@
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+)
+
+func TestStepRun_impl(t *testing.T) {
+	var _ multistep.Step = new(StepRun)
+}
+
+func TestStepRun_Cleanup(t *testing.T) {
+	state := testState(t)
+	driver := state.Get("driver").(*DriverMock)
+	driver.IsRunningReturn = true
+
+	step := &StepRun{vmId: "foo"}
+	step.Cleanup(state)
+	if len(driver.UtmctlCalls) != 1 || driver.UtmctlCalls[0][0] != "stop" {
+		t.Fatalf("bad: %#v", driver.UtmctlCalls)
+	}
+}
+
+func TestStepRun_CleanupBusy(t *testing.T) {
+	defer func(delay time.Duration) { busyRetryDelay = delay }(busyRetryDelay)
+	busyRetryDelay = 0
+
+	state := testState(t)
+	driver := state.Get("driver").(*DriverMock)
+	driver.IsRunningReturn = true
+	driver.UtmctlErrs = []error{
+		&DriverError{Tool: "utmctl", Kind: ErrUTMBusy},
+		&DriverError{Tool: "utmctl", Kind: ErrUTMBusy},
+	}
+
+	step := &StepRun{vmId: "foo"}
+	step.Cleanup(state)
+	if len(driver.UtmctlCalls) != 3 {
+		t.Fatalf("stop should be retried while UTM is busy: %#v", driver.UtmctlCalls)
+	}
+}
+
+func TestStepRun_CleanupGone(t *testing.T) {
+	for _, kind := range []error{ErrVMNotFound, ErrUTMNotRunning} {
+		state := testState(t)
+		driver := state.Get("driver").(*DriverMock)
+		driver.IsRunningErr = &DriverError{Tool: "utmctl", Kind: kind}
+
+		step := &StepRun{vmId: "foo"}
+		step.Cleanup(state)
+		if len(driver.UtmctlCalls) != 0 {
+			t.Fatalf("%s: stop should not be called: %#v", kind, driver.UtmctlCalls)
+		}
+	}
+}
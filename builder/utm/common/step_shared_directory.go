@@ -0,0 +1,87 @@
+package common
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// This step shares a directory of the host with the VM before it is
+// started. The share mode is set for QEMU VMs, while Apple VMs always
+// share with VirtioFS. The directories the VM already shared, e.g. a
+// source VM, and its share mode are kept for StepRemoveSharedDirectory.
+//
+// Uses:
+//
+//	driver Driver
+//	ui packersdk.Ui
+//	vmId string
+//
+// Produces:
+//
+//	original_shared_directory originalSharedDirectory - The share of the VM
+//	before the build
+type StepSharedDirectory struct {
+	SharedDirectory *SharedDirectory
+}
+
+// originalSharedDirectory is the share of a VM before the build.
+type originalSharedDirectory struct {
+	// The directories in the registry of the VM
+	Directories []string
+	// The enum code of the share mode, empty for an Apple VM
+	Mode string
+}
+
+func (s *StepSharedDirectory) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	if s.SharedDirectory == nil {
+		return multistep.ActionContinue
+	}
+
+	driver := state.Get("driver").(Driver)
+	ui := state.Get("ui").(packersdk.Ui)
+	vmId := state.Get("vmId").(string)
+
+	if !driver.HasFeature(FeatureSharedDirectories) {
+		err := fmt.Errorf("the installed UTM does not support shared directories")
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	result, err := driver.ExecuteOsaScript(ctx, "get_shared_directory.applescript", vmId)
+	if err != nil {
+		err := fmt.Errorf("error reading the shared directories of the VM: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	state.Put("original_shared_directory", originalSharedDirectory{
+		Directories: result.SharedDirectories,
+		Mode:        result.DirectoryShareMode,
+	})
+
+	ui.Say(fmt.Sprintf("Sharing directory %s with the VM...", s.SharedDirectory.Path))
+	if mode := s.SharedDirectory.ModeEnumCode(); mode != "" {
+		if _, err := driver.ExecuteOsaScript(ctx,
+			"customize_vm.applescript", vmId, "--directory-share-mode", mode); err != nil {
+			err := fmt.Errorf("error setting the directory share mode: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+	if _, err := driver.ExecuteOsaScript(ctx,
+		"set_shared_directory.applescript", vmId, s.SharedDirectory.Path); err != nil {
+		err := fmt.Errorf("error sharing directory: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	return multistep.ActionContinue
+}
+
+func (s *StepSharedDirectory) Cleanup(state multistep.StateBag) {}
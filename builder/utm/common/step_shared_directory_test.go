@@ -0,0 +1,145 @@
+package common
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+)
+
+func TestStepSharedDirectory_impl(t *testing.T) {
+	var _ multistep.Step = new(StepSharedDirectory)
+	var _ multistep.Step = new(StepMountSharedDirectory)
+	var _ multistep.Step = new(StepRemoveSharedDirectory)
+}
+
+func testSharedDirectory(t *testing.T, dir SharedDirectory) *SharedDirectory {
+	c := &SharedDirectoryConfig{SharedDirectory: &dir}
+	if errs := c.Prepare(interpolate.NewContext(), "qemu"); len(errs) > 0 {
+		t.Fatalf("err: %#v", errs)
+	}
+	return c.SharedDirectory
+}
+
+func TestStepSharedDirectory(t *testing.T) {
+	driver := new(DriverSimulator)
+	vmId := driver.AddVM(SimulatedVM{Name: "packer"})
+	state := testState(t)
+	state.Put("driver", driver)
+	state.Put("vmId", vmId)
+
+	dir := testSharedDirectory(t, SharedDirectory{Path: "/share", Mode: "webdav"})
+	step := &StepSharedDirectory{SharedDirectory: dir}
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v: %s", action, state.Get("error"))
+	}
+	vm := driver.VM(vmId)
+	if vm.DirectoryShareMode != "SmWv" || !reflect.DeepEqual(vm.SharedDirectories, []string{"/share"}) {
+		t.Fatalf("bad: %#v", vm)
+	}
+
+	// The share is removed before the export
+	remove := &StepRemoveSharedDirectory{SharedDirectory: dir}
+	if action := remove.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v: %s", action, state.Get("error"))
+	}
+	vm = driver.VM(vmId)
+	if vm.DirectoryShareMode != "SmOf" || len(vm.SharedDirectories) != 0 {
+		t.Fatalf("bad: %#v", vm)
+	}
+}
+
+func TestStepSharedDirectory_restore(t *testing.T) {
+	// The share of a source VM is restored before the export
+	driver := new(DriverSimulator)
+	vmId := driver.AddVM(SimulatedVM{Name: "packer", DirectoryShareMode: "SmVs", SharedDirectories: []string{"/source"}})
+	state := testState(t)
+	state.Put("driver", driver)
+	state.Put("vmId", vmId)
+
+	dir := testSharedDirectory(t, SharedDirectory{Path: "/share", Mode: "webdav"})
+	step := &StepSharedDirectory{SharedDirectory: dir}
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v: %s", action, state.Get("error"))
+	}
+	if vm := driver.VM(vmId); vm.DirectoryShareMode != "SmWv" || !reflect.DeepEqual(vm.SharedDirectories, []string{"/share"}) {
+		t.Fatalf("bad: %#v", vm)
+	}
+
+	remove := &StepRemoveSharedDirectory{SharedDirectory: dir}
+	if action := remove.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v: %s", action, state.Get("error"))
+	}
+	if vm := driver.VM(vmId); vm.DirectoryShareMode != "SmVs" || !reflect.DeepEqual(vm.SharedDirectories, []string{"/source"}) {
+		t.Fatalf("bad: %#v", vm)
+	}
+}
+
+func TestStepSharedDirectory_keepInArtifact(t *testing.T) {
+	state := testState(t)
+	driver := state.Get("driver").(*DriverMock)
+
+	dir := testSharedDirectory(t, SharedDirectory{Path: "/share", KeepInArtifact: true})
+	step := &StepRemoveSharedDirectory{SharedDirectory: dir}
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if len(driver.ExecuteOsaCalls) != 0 {
+		t.Fatalf("bad: %#v", driver.ExecuteOsaCalls)
+	}
+}
+
+func TestStepSharedDirectory_unsupported(t *testing.T) {
+	driver := new(DriverSimulator)
+	driver.UnsupportedFeatures = []Feature{FeatureSharedDirectories}
+	vmId := driver.AddVM(SimulatedVM{Name: "packer"})
+	state := testState(t)
+	state.Put("driver", driver)
+	state.Put("vmId", vmId)
+
+	step := &StepSharedDirectory{SharedDirectory: testSharedDirectory(t, SharedDirectory{Path: "/share"})}
+	if action := step.Run(context.Background(), state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if len(driver.Calls) != 0 {
+		t.Fatalf("bad: %#v", driver.Calls)
+	}
+}
+
+func TestStepMountSharedDirectory(t *testing.T) {
+	state := testState(t)
+	comm := new(packersdk.MockCommunicator)
+	state.Put("communicator", comm)
+
+	dir := testSharedDirectory(t, SharedDirectory{
+		Path:         "/share",
+		MountPoint:   "/mnt/share",
+		MountCommand: "mount {{.Tag}} {{.MountPoint}} -o {{.Options}}",
+	})
+	step := &StepMountSharedDirectory{SharedDirectory: dir}
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v: %s", action, state.Get("error"))
+	}
+	if comm.StartCmd.Command != "mount share /mnt/share -o rw" {
+		t.Fatalf("bad: %#v", comm.StartCmd)
+	}
+
+	// A failed mount fails the build
+	comm = new(packersdk.MockCommunicator)
+	comm.StartExitStatus = 32
+	state.Put("communicator", comm)
+	if action := step.Run(context.Background(), state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	// Without a mount point nothing is mounted
+	comm = new(packersdk.MockCommunicator)
+	state.Put("communicator", comm)
+	step = &StepMountSharedDirectory{SharedDirectory: testSharedDirectory(t, SharedDirectory{Path: "/share"})}
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue || comm.StartCalled {
+		t.Fatalf("bad action: %#v", action)
+	}
+}
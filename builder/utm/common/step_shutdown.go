@@ -53,7 +53,7 @@ func (s *StepShutdown) Run(ctx context.Context, state multistep.StateBag) multis
 
 		} else {
 			ui.Say("Halting the virtual machine...")
-			if err := driver.Stop(vmId); err != nil {
+			if err := driver.Stop(ctx, vmId); err != nil {
 				err := fmt.Errorf("error stopping VM: %s", err)
 				state.Put("error", err)
 				ui.Error(err.Error())
@@ -68,12 +68,16 @@ func (s *StepShutdown) Run(ctx context.Context, state multistep.StateBag) multis
 	log.Printf("Waiting max %s for shutdown to complete", s.Timeout)
 	shutdownTimer := time.After(s.Timeout)
 	for {
-		running, _ := driver.IsRunning(vmId)
+		running, _ := driver.IsRunning(ctx, vmId)
 		if !running {
 
 			if s.Delay.Nanoseconds() > 0 {
 				log.Printf("Delay for %s after shutdown to allow locks to clear...", s.Delay)
-				time.Sleep(s.Delay)
+				select {
+				case <-time.After(s.Delay):
+				case <-ctx.Done():
+					return s.interrupted(ctx, state, ui)
+				}
 			}
 
 			break
@@ -85,8 +89,9 @@ func (s *StepShutdown) Run(ctx context.Context, state multistep.StateBag) multis
 			state.Put("error", err)
 			ui.Error(err.Error())
 			return multistep.ActionHalt
-		default:
-			time.Sleep(500 * time.Millisecond)
+		case <-ctx.Done():
+			return s.interrupted(ctx, state, ui)
+		case <-time.After(500 * time.Millisecond):
 		}
 	}
 
@@ -94,4 +99,11 @@ func (s *StepShutdown) Run(ctx context.Context, state multistep.StateBag) multis
 	return multistep.ActionContinue
 }
 
+func (s *StepShutdown) interrupted(ctx context.Context, state multistep.StateBag, ui packersdk.Ui) multistep.StepAction {
+	err := fmt.Errorf("interrupted while waiting for machine to shutdown: %w", ctx.Err())
+	state.Put("error", err)
+	ui.Error(err.Error())
+	return multistep.ActionHalt
+}
+
 func (s *StepShutdown) Cleanup(state multistep.StateBag) {}
@@ -140,3 +140,31 @@ func TestStepShutdown_DisableShutdown(t *testing.T) {
 		t.Fatal("should NOT have error")
 	}
 }
+
+func TestStepShutdown_cancelled(t *testing.T) {
+	state := testState(t)
+	step := new(StepShutdown)
+	step.DisableShutdown = true
+	step.Timeout = time.Minute
+
+	comm := new(packersdk.MockCommunicator)
+	state.Put("communicator", comm)
+	state.Put("vmId", "foo")
+
+	driver := state.Get("driver").(*DriverMock)
+	driver.IsRunningReturn = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	if action := step.Run(ctx, state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); !ok {
+		t.Fatal("should have error")
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Fatal("should stop waiting when the context is cancelled")
+	}
+}
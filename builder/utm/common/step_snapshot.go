@@ -0,0 +1,123 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+
+	"github.com/hashicorp/packer-plugin-sdk/communicator"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// provisionSnapshot is the name of the snapshot taken by StepSnapshot.
+const provisionSnapshot = "packer-provision"
+
+// diskSnapshot is a snapshot of the disk images of a VM.
+type diskSnapshot struct {
+	Name   string
+	Images []string
+}
+
+// This step snapshots the qcow2 disks of the VM once the communicator has
+// connected. The VM is shut down for the snapshot, then started and
+// connected to again.
+//
+// Uses:
+//
+//	communicator packersdk.Communicator
+//	driver Driver
+//	ui packersdk.Ui
+//	vmId string
+//
+// Produces:
+//
+//	disk_snapshot diskSnapshot - The snapshot, for StepRollbackProvision
+//	  and StepRemoveSnapshot
+type StepSnapshot struct {
+	Enabled  bool
+	Shutdown *StepShutdown
+	Connect  *communicator.StepConnect
+
+	connect multistep.Step
+}
+
+func (s *StepSnapshot) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	if !s.Enabled {
+		return multistep.ActionContinue
+	}
+
+	driver := state.Get("driver").(Driver)
+	ui := state.Get("ui").(packersdk.Ui)
+	vmId := state.Get("vmId").(string)
+
+	images, err := driver.DiskImages(ctx, vmId)
+	if err == nil && len(images) == 0 {
+		err = fmt.Errorf("the VM has no disks")
+	}
+	for _, image := range images {
+		if path.Ext(image) != ".qcow2" {
+			err = fmt.Errorf("only qcow2 disks can be snapshotted, %s is not one", path.Base(image))
+		}
+	}
+	if err != nil {
+		err := fmt.Errorf("error snapshotting disks: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	// provision_snapshot requires a shutdown_command, which is run even with
+	// disable_shutdown
+	shutdown := *s.Shutdown
+	shutdown.DisableShutdown = false
+	ui.Say("Shutting down the virtual machine to snapshot its disks...")
+	if action := shutdown.Run(ctx, state); action != multistep.ActionContinue {
+		return action
+	}
+
+	snapshot := diskSnapshot{Name: provisionSnapshot, Images: images}
+	ui.Say(fmt.Sprintf("Snapshotting disks as %s...", snapshot.Name))
+	if err := snapshotImages(ctx, driver, "-c", snapshot); err != nil {
+		err := fmt.Errorf("error snapshotting disks: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	state.Put("disk_snapshot", snapshot)
+
+	var action multistep.StepAction
+	s.connect, action = reconnect(ctx, state, s.Connect)
+	return action
+}
+
+func (s *StepSnapshot) Cleanup(state multistep.StateBag) {
+	if s.connect != nil {
+		s.connect.Cleanup(state)
+	}
+}
+
+// snapshotImages runs qemu-img snapshot with the given option, "-c", "-a"
+// or "-d", on every image of the snapshot.
+func snapshotImages(ctx context.Context, driver Driver, option string, snapshot diskSnapshot) error {
+	for _, image := range snapshot.Images {
+		log.Printf("qemu-img snapshot %s %s %s", option, snapshot.Name, image)
+		if _, err := driver.QemuImg(ctx, "snapshot", option, snapshot.Name, image); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reconnect starts the VM and connects the communicator to it again. The
+// returned step holds the new connection and must be cleaned up.
+func reconnect(ctx context.Context, state multistep.StateBag, connect *communicator.StepConnect) (multistep.Step, multistep.StepAction) {
+	if action := new(StepRun).Run(ctx, state); action != multistep.ActionContinue {
+		return nil, action
+	}
+
+	// A copy, as the step keeps the connection it made
+	step := *connect
+	return &step, step.Run(ctx, state)
+}
@@ -0,0 +1,237 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/packer-plugin-sdk/communicator"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// testSnapshotState returns a state with a started VM in a DriverSimulator.
+func testSnapshotState(t *testing.T) (multistep.StateBag, *DriverSimulator, string) {
+	driver := new(DriverSimulator)
+	vmId := driver.AddVM(SimulatedVM{
+		Name:   "packer",
+		Status: "started",
+		Drives: []SimulatedDrive{
+			{ID: "disk", Interface: "QdIv", Size: 10240},
+			{ID: "cd", Interface: "QdIu", Removable: true},
+		},
+	})
+
+	state := testState(t)
+	state.Put("driver", driver)
+	state.Put("vmId", vmId)
+	state.Put("communicator", new(packersdk.MockCommunicator))
+	state.Put("hook", new(packersdk.MockHook))
+	return state, driver, vmId
+}
+
+func testSnapshotSteps() (*StepShutdown, *communicator.StepConnect) {
+	return &StepShutdown{Timeout: 5 * time.Second}, &communicator.StepConnect{
+		Config: &communicator.Config{Type: "none"},
+	}
+}
+
+// countingStep counts its runs.
+type countingStep struct {
+	runs int
+}
+
+func (s *countingStep) Run(context.Context, multistep.StateBag) multistep.StepAction {
+	s.runs++
+	return multistep.ActionContinue
+}
+
+func (s *countingStep) Cleanup(multistep.StateBag) {}
+
+func TestStepSnapshot_impl(t *testing.T) {
+	var _ multistep.Step = new(StepSnapshot)
+	var _ multistep.Step = new(StepRollbackProvision)
+	var _ multistep.Step = new(StepRemoveSnapshot)
+}
+
+func TestStepSnapshot(t *testing.T) {
+	state, driver, vmId := testSnapshotState(t)
+	shutdown, connect := testSnapshotSteps()
+
+	step := &StepSnapshot{Enabled: true, Shutdown: shutdown, Connect: connect}
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v: %s", action, state.Get("error"))
+	}
+	defer step.Cleanup(state)
+
+	vm := driver.VM(vmId)
+	if vm.Status != "started" {
+		t.Fatalf("VM should be started again: %s", vm.Status)
+	}
+	if len(vm.Drives[0].Snapshots) != 1 || vm.Drives[0].Snapshots[0] != provisionSnapshot {
+		t.Fatalf("bad: %#v", vm.Drives)
+	}
+	snapshot := state.Get("disk_snapshot").(diskSnapshot)
+	if len(snapshot.Images) != 1 {
+		t.Fatalf("the CD should not be snapshotted: %#v", snapshot)
+	}
+	if _, ok := state.Get("communicator").(*packersdk.MockCommunicator); ok {
+		t.Fatal("should reconnect")
+	}
+
+	// The snapshot is removed before the export
+	if _, err := driver.Utmctl(context.Background(), "stop", vmId); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	remove := new(StepRemoveSnapshot)
+	if action := remove.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v: %s", action, state.Get("error"))
+	}
+	if vm := driver.VM(vmId); len(vm.Drives[0].Snapshots) != 0 {
+		t.Fatalf("bad: %#v", vm.Drives)
+	}
+}
+
+func TestStepSnapshot_disabled(t *testing.T) {
+	state := testState(t)
+	driver := state.Get("driver").(*DriverMock)
+
+	step := &StepSnapshot{}
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if len(driver.QemuImgCalls) != 0 {
+		t.Fatalf("bad: %#v", driver.QemuImgCalls)
+	}
+	if _, ok := state.GetOk("disk_snapshot"); ok {
+		t.Fatal("should not snapshot")
+	}
+
+	// Nothing to remove
+	if action := new(StepRemoveSnapshot).Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if len(driver.QemuImgCalls) != 0 {
+		t.Fatalf("bad: %#v", driver.QemuImgCalls)
+	}
+}
+
+func TestStepSnapshot_raw(t *testing.T) {
+	state := testState(t)
+	state.Put("vmId", "foo")
+	driver := state.Get("driver").(*DriverMock)
+	driver.DiskImagesResult = []string{"/tmp/foo.utm/Data/disk.img"}
+	shutdown, connect := testSnapshotSteps()
+
+	step := &StepSnapshot{Enabled: true, Shutdown: shutdown, Connect: connect}
+	if action := step.Run(context.Background(), state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if driver.StopName != "" || len(driver.QemuImgCalls) != 0 {
+		t.Fatalf("VM should not be changed: %#v", driver.QemuImgCalls)
+	}
+}
+
+func TestStepRollbackProvision_retry(t *testing.T) {
+	state, driver, vmId := testSnapshotState(t)
+	shutdown, connect := testSnapshotSteps()
+
+	snapshot := &StepSnapshot{Enabled: true, Shutdown: shutdown, Connect: connect}
+	if action := snapshot.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v: %s", action, state.Get("error"))
+	}
+	defer snapshot.Cleanup(state)
+
+	attempts := 0
+	state.Put("hook", &packersdk.MockHook{RunFunc: func(context.Context) error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("provisioning failed")
+		}
+		return nil
+	}})
+
+	// The steps after the snapshot run again after each rollback
+	after := new(countingStep)
+	step := &StepRollbackProvision{Retries: 2, Shutdown: shutdown, Connect: connect, AfterConnect: []multistep.Step{after}}
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v: %s", action, state.Get("error"))
+	}
+	defer step.Cleanup(state)
+
+	if attempts != 3 || after.runs != 2 {
+		t.Fatalf("bad: %d %d", attempts, after.runs)
+	}
+	if _, ok := state.GetOk("error"); ok {
+		t.Fatalf("error should be cleared: %s", state.Get("error"))
+	}
+	rollbacks := 0
+	for _, call := range driver.Calls {
+		if call[0] == "qemu-img" && call[2] == "-a" {
+			rollbacks++
+		}
+	}
+	if rollbacks != 2 || driver.VM(vmId).Status != "started" {
+		t.Fatalf("bad: %#v", driver.Calls)
+	}
+}
+
+func TestStepRollbackProvision_rollback(t *testing.T) {
+	for _, rollback := range []bool{false, true} {
+		state, driver, vmId := testSnapshotState(t)
+		shutdown, connect := testSnapshotSteps()
+
+		snapshot := &StepSnapshot{Enabled: true, Shutdown: shutdown, Connect: connect}
+		if action := snapshot.Run(context.Background(), state); action != multistep.ActionContinue {
+			t.Fatalf("bad action: %#v: %s", action, state.Get("error"))
+		}
+
+		hook := &packersdk.MockHook{RunFunc: func(context.Context) error {
+			return errors.New("provisioning failed")
+		}}
+		state.Put("hook", hook)
+
+		step := &StepRollbackProvision{Retries: 1, Rollback: rollback, Shutdown: shutdown, Connect: connect}
+		if action := step.Run(context.Background(), state); action != multistep.ActionHalt {
+			t.Fatalf("bad action: %#v", action)
+		}
+		if err := state.Get("error").(error); err.Error() != "provisioning failed" {
+			t.Fatalf("bad: %s", err)
+		}
+
+		// Rolled back once for the retry, and once more at the end
+		rollbacks := 0
+		for _, call := range driver.Calls {
+			if call[0] == "qemu-img" && call[2] == "-a" {
+				rollbacks++
+			}
+		}
+		status := driver.VM(vmId).Status
+		if rollback && (rollbacks != 2 || status != "stopped") {
+			t.Fatalf("bad: %s %#v", status, driver.Calls)
+		}
+		if !rollback && (rollbacks != 1 || status != "started") {
+			t.Fatalf("bad: %s %#v", status, driver.Calls)
+		}
+
+		step.Cleanup(state)
+		snapshot.Cleanup(state)
+	}
+}
+
+func TestStepRollbackProvision_noSnapshot(t *testing.T) {
+	state, driver, _ := testSnapshotState(t)
+	shutdown, connect := testSnapshotSteps()
+	state.Put("hook", &packersdk.MockHook{RunFunc: func(context.Context) error {
+		return errors.New("provisioning failed")
+	}})
+
+	step := &StepRollbackProvision{Retries: 2, Rollback: true, Shutdown: shutdown, Connect: connect}
+	if action := step.Run(context.Background(), state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if len(driver.Calls) != 0 {
+		t.Fatalf("bad: %#v", driver.Calls)
+	}
+}
@@ -31,7 +31,7 @@ func (s *StepStopVm) Run(ctx context.Context, state multistep.StateBag) multiste
 	vmId := state.Get("vmId").(string)
 
 	ui.Say("Stopping virtual machine...")
-	if err := driver.Stop(vmId); err != nil {
+	if err := driver.Stop(ctx, vmId); err != nil {
 		err := fmt.Errorf("error stopping VM: %s", err)
 		state.Put("error", err)
 		ui.Error(err.Error())
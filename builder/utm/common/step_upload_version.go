@@ -29,7 +29,7 @@ func (s *StepUploadVersion) Run(ctx context.Context, state multistep.StateBag) m
 		return multistep.ActionContinue
 	}
 
-	version, err := driver.Version()
+	version, err := driver.Version(ctx)
 	if err != nil {
 		state.Put("error", fmt.Errorf("error reading version for metadata upload: %s", err))
 		return multistep.ActionHalt
@@ -0,0 +1,56 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// This step runs a command in the guest that fills its free space with
+// zeros, so that StepCompactDisks can leave the space out of the images.
+//
+// Uses:
+//
+//	communicator packersdk.Communicator
+//	ui packersdk.Ui
+//
+// Produces:
+//
+//	<nothing>
+type StepZeroFreeSpace struct {
+	Command string
+}
+
+func (s *StepZeroFreeSpace) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	if s.Command == "" {
+		return multistep.ActionContinue
+	}
+
+	ui := state.Get("ui").(packersdk.Ui)
+	comm, ok := state.Get("communicator").(packersdk.Communicator)
+	if !ok {
+		ui.Say("No communicator, not zeroing the free space of the guest.")
+		return multistep.ActionContinue
+	}
+
+	ui.Say("Zeroing the free space of the guest...")
+	log.Printf("Executing zero free space command: %s", s.Command)
+	cmd := &packersdk.RemoteCmd{Command: s.Command}
+	if err := cmd.RunWithUi(ctx, comm, ui); err != nil {
+		err := fmt.Errorf("failed to zero the free space: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	// Commands like dd fail once the disk is full, which is expected
+	if status := cmd.ExitStatus(); status != 0 {
+		ui.Message(fmt.Sprintf("Warning: the zero free space command exited with status %d", status))
+	}
+
+	return multistep.ActionContinue
+}
+
+func (s *StepZeroFreeSpace) Cleanup(state multistep.StateBag) {}
@@ -1,6 +1,12 @@
 package common
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+)
 
 // Map of controller names to their corresponding enum codes
 var ControllerEnumMap = map[string]string{
@@ -24,3 +30,58 @@ func GetControllerEnumCode(controllerName string) (string, error) {
 	}
 	return code, nil
 }
+
+// VMInfo is a virtual machine listed by `utmctl list`.
+type VMInfo struct {
+	ID     string
+	Status string
+	Name   string
+}
+
+// ListVMs returns the virtual machines registered in UTM.
+func ListVMs(ctx context.Context, driver Driver) ([]VMInfo, error) {
+	output, err := driver.Utmctl(ctx, "list")
+	if err != nil {
+		return nil, err
+	}
+	return parseUtmctlList(output)
+}
+
+// parseUtmctlList parses the output of `utmctl list`, a header line followed
+// by the UUID, status and name of every VM. Names may contain spaces.
+func parseUtmctlList(output string) ([]VMInfo, error) {
+	var vms []VMInfo
+	for i, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		if i == 0 && strings.HasPrefix(line, "UUID") {
+			continue
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("invalid utmctl list output: %q", line)
+		}
+		// The name is everything after the status
+		name := strings.TrimSpace(line)
+		for _, field := range fields[:2] {
+			name = strings.TrimSpace(strings.TrimPrefix(name, field))
+		}
+		vms = append(vms, VMInfo{ID: fields[0], Status: fields[1], Name: name})
+	}
+	return vms, nil
+}
+
+// AddQemuAdditionalArgs adds QEMU arguments to the VM, and records them in
+// the state as qemuAdditionalArgs, so that StepExport removes them before
+// the VM is exported.
+func AddQemuAdditionalArgs(ctx context.Context, state multistep.StateBag, driver Driver, vmId string, args ...string) error {
+	command := append([]string{"add_qemu_additional_args.applescript", vmId, "--args"}, args...)
+	if _, err := driver.ExecuteOsaScript(ctx, command...); err != nil {
+		return err
+	}
+
+	added, _ := state.Get("qemuAdditionalArgs").([]string)
+	state.Put("qemuAdditionalArgs", append(added, args...))
+	return nil
+}
@@ -0,0 +1,80 @@
+package common
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestParseUtmctlList(t *testing.T) {
+	output := `UUID                                 Status   Name
+6E1B0B4C-3C55-4A0C-9D8E-6F2B7A1C0D9E stopped  Debian 12
+0D0F6C8E-2B1A-4F3B-8C7D-5E4A3B2C1D0F started  packer
+`
+	vms, err := parseUtmctlList(output)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expected := []VMInfo{
+		{ID: "6E1B0B4C-3C55-4A0C-9D8E-6F2B7A1C0D9E", Status: "stopped", Name: "Debian 12"},
+		{ID: "0D0F6C8E-2B1A-4F3B-8C7D-5E4A3B2C1D0F", Status: "started", Name: "packer"},
+	}
+	if !reflect.DeepEqual(vms, expected) {
+		t.Fatalf("bad: %#v", vms)
+	}
+
+	if vms, err := parseUtmctlList("UUID Status Name\n"); err != nil || len(vms) != 0 {
+		t.Fatalf("bad: %#v %s", vms, err)
+	}
+	if _, err := parseUtmctlList("UUID Status Name\ngarbage\n"); err == nil {
+		t.Fatal("should error")
+	}
+}
+
+func TestListVMs_clone(t *testing.T) {
+	ctx := context.Background()
+	driver := new(DriverSimulator)
+	sourceId := driver.AddVM(SimulatedVM{
+		Name:   "Debian 12",
+		Drives: []SimulatedDrive{{ID: "disk", Interface: "QdIv", Size: 10240}},
+	})
+
+	if _, err := driver.Utmctl(ctx, "clone", "--name", "packer clone", sourceId); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	vms, err := ListVMs(ctx, driver)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(vms) != 2 || vms[0].ID != sourceId || vms[1].Name != "packer clone" || vms[1].Status != "stopped" {
+		t.Fatalf("bad: %#v", vms)
+	}
+
+	clone := driver.VM(vms[1].ID)
+	if clone.ID == sourceId || len(clone.Drives) != 1 || clone.Drives[0].ID == "disk" {
+		t.Fatalf("bad: %#v", clone)
+	}
+}
+
+func TestAddQemuAdditionalArgs(t *testing.T) {
+	ctx := context.Background()
+	driver := new(DriverSimulator)
+	vmId := driver.AddVM(SimulatedVM{Name: "packer"})
+	state := testState(t)
+
+	if err := AddQemuAdditionalArgs(ctx, state, driver, vmId, "-vnc 127.0.0.1:1"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := AddQemuAdditionalArgs(ctx, state, driver, vmId, "-fw_cfg name=a,string=b", "-fw_cfg name=c,string=d"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := []string{"-vnc 127.0.0.1:1", "-fw_cfg name=a,string=b", "-fw_cfg name=c,string=d"}
+	if args := state.Get("qemuAdditionalArgs").([]string); !reflect.DeepEqual(args, expected) {
+		t.Fatalf("bad: %#v", args)
+	}
+	if args := driver.VM(vmId).QEMUAdditionalArguments; !reflect.DeepEqual(args, expected) {
+		t.Fatalf("bad: %#v", args)
+	}
+}
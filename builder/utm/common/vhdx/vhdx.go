@@ -0,0 +1,299 @@
+// Package vhdx reads the disk images of Hyper-V, in the VHDX format, so
+// that they can be converted to qcow2.
+//
+// Only fixed and dynamic images are read: differencing images, and images
+// with a log to replay, aren't supported.
+package vhdx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+)
+
+// Magic is the first bytes of a VHDX image, its file type identifier.
+var Magic = []byte("vhdxfile")
+
+const (
+	kib = 1024
+	mib = 1024 * kib
+
+	headerSize      = 4 * kib
+	regionTableSize = 64 * kib
+
+	// The state of the payload blocks in the BAT
+	blockNotPresent       = 0
+	blockUndefined        = 1
+	blockZero             = 2
+	blockUnmapped         = 3
+	blockFullyPresent     = 6
+	blockPartiallyPresent = 7
+	blockStateMask        = 7
+)
+
+// The GUIDs of the regions and metadata items, as they are written in the
+// image: the first three fields are little-endian.
+var (
+	regionBAT         = guid("2DC27766-F623-4200-9D64-115E9BFD4A08")
+	regionMetadata    = guid("8B7CA206-4790-4B9A-B8FE-575F050F886E")
+	itemFileParams    = guid("CAA16737-FA36-4D43-B3B6-33F0AA44E76B")
+	itemDiskSize      = guid("2FA54224-CD1B-4876-B211-5DBED83BF4B8")
+	itemLogSectorSize = guid("8141BF1D-A96F-4709-BA47-F233A8FAAB5F")
+)
+
+func guid(s string) [16]byte {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(b) != 16 {
+		panic("invalid GUID " + s)
+	}
+	return [16]byte{
+		b[3], b[2], b[1], b[0], b[5], b[4], b[7], b[6],
+		b[8], b[9], b[10], b[11], b[12], b[13], b[14], b[15],
+	}
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// checksum verifies the CRC-32C of a structure, computed with its checksum
+// field, at offset 4, set to zero.
+func checksum(b []byte) bool {
+	expected := binary.LittleEndian.Uint32(b[4:])
+	crc := crc32.Update(0, castagnoli, b[:4])
+	crc = crc32.Update(crc, castagnoli, make([]byte, 4))
+	crc = crc32.Update(crc, castagnoli, b[8:])
+	return crc == expected
+}
+
+// Image is a VHDX image open for reading.
+type Image struct {
+	f         *os.File
+	size      int64
+	blockSize int64
+	bat       []uint64
+	// The number of payload blocks between the sector bitmap blocks of the
+	// BAT
+	chunkRatio int64
+}
+
+// Open opens the VHDX image at path.
+func Open(path string) (*Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	img := &Image{f: f}
+	if err := img.load(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return img, nil
+}
+
+func (img *Image) load() error {
+	b := make([]byte, len(Magic))
+	if _, err := img.f.ReadAt(b, 0); err != nil || !bytes.Equal(b, Magic) {
+		return errors.New("the image isn't a VHDX image")
+	}
+
+	// The current header is the valid one with the largest sequence number
+	var current []byte
+	for _, offset := range []int64{64 * kib, 128 * kib} {
+		h := make([]byte, headerSize)
+		if _, err := img.f.ReadAt(h, offset); err != nil {
+			continue
+		}
+		if string(h[:4]) != "head" || !checksum(h) {
+			continue
+		}
+		if current == nil || binary.LittleEndian.Uint64(h[8:]) > binary.LittleEndian.Uint64(current[8:]) {
+			current = h
+		}
+	}
+	if current == nil {
+		return errors.New("the image has no valid header")
+	}
+	// The log GUID is only set when the log has entries to replay
+	if !bytes.Equal(current[48:64], make([]byte, 16)) {
+		return errors.New("the image has a log to replay, which isn't supported: open it with Hyper-V first")
+	}
+
+	regions, err := img.regions()
+	if err != nil {
+		return err
+	}
+	metadata, ok := regions[regionMetadata]
+	if !ok {
+		return errors.New("the image has no metadata region")
+	}
+	bat, ok := regions[regionBAT]
+	if !ok {
+		return errors.New("the image has no BAT region")
+	}
+	if err := img.loadMetadata(metadata[0], metadata[1]); err != nil {
+		return err
+	}
+
+	blocks := (img.size + img.blockSize - 1) / img.blockSize
+	entries := blocks + (blocks-1)/img.chunkRatio
+	if entries*8 > bat[1] {
+		return errors.New("the BAT is too small for the disk")
+	}
+	b = make([]byte, entries*8)
+	if _, err := img.f.ReadAt(b, bat[0]); err != nil {
+		return fmt.Errorf("error reading the BAT: %s", err)
+	}
+	img.bat = make([]uint64, entries)
+	for i := range img.bat {
+		img.bat[i] = binary.LittleEndian.Uint64(b[8*i:])
+	}
+	return nil
+}
+
+// regions returns the offset and the length of the regions of the image,
+// by their GUID.
+func (img *Image) regions() (map[[16]byte][2]int64, error) {
+	for _, offset := range []int64{192 * kib, 256 * kib} {
+		t := make([]byte, regionTableSize)
+		if _, err := img.f.ReadAt(t, offset); err != nil {
+			continue
+		}
+		if string(t[:4]) != "regi" || !checksum(t) {
+			continue
+		}
+		count := int(binary.LittleEndian.Uint32(t[8:]))
+		if count > 2047 {
+			continue
+		}
+		regions := map[[16]byte][2]int64{}
+		for i := 0; i < count; i++ {
+			entry := t[16+32*i:]
+			var id [16]byte
+			copy(id[:], entry)
+			regions[id] = [2]int64{
+				int64(binary.LittleEndian.Uint64(entry[16:])),
+				int64(binary.LittleEndian.Uint32(entry[24:])),
+			}
+			required := binary.LittleEndian.Uint32(entry[28:])&1 != 0
+			if required && id != regionBAT && id != regionMetadata {
+				return nil, fmt.Errorf("the image has an unknown required region %x", id)
+			}
+		}
+		return regions, nil
+	}
+	return nil, errors.New("the image has no valid region table")
+}
+
+// loadMetadata reads the block size, the disk size and the logical sector
+// size from the metadata region.
+func (img *Image) loadMetadata(offset, length int64) error {
+	if length < 64*kib || length > 1*mib {
+		return fmt.Errorf("the metadata region length %d is invalid", length)
+	}
+	region := make([]byte, length)
+	if _, err := img.f.ReadAt(region, offset); err != nil {
+		return fmt.Errorf("error reading the metadata: %s", err)
+	}
+	if string(region[:8]) != "metadata" {
+		return errors.New("the metadata region is invalid")
+	}
+
+	items := map[[16]byte][]byte{}
+	count := int(binary.LittleEndian.Uint16(region[10:]))
+	if count > 2047 {
+		return errors.New("the metadata table is invalid")
+	}
+	for i := 0; i < count; i++ {
+		entry := region[32+32*i:]
+		var id [16]byte
+		copy(id[:], entry)
+		itemOffset := int64(binary.LittleEndian.Uint32(entry[16:]))
+		itemLength := int64(binary.LittleEndian.Uint32(entry[20:]))
+		if itemOffset+itemLength > length {
+			return errors.New("a metadata item is outside of the metadata region")
+		}
+		items[id] = region[itemOffset : itemOffset+itemLength]
+	}
+
+	params, size, sectorSize := items[itemFileParams], items[itemDiskSize], items[itemLogSectorSize]
+	if len(params) < 8 || len(size) < 8 || len(sectorSize) < 4 {
+		return errors.New("the image lacks required metadata")
+	}
+	if binary.LittleEndian.Uint32(params[4:])&2 != 0 {
+		return errors.New("differencing images aren't supported")
+	}
+	img.blockSize = int64(binary.LittleEndian.Uint32(params))
+	img.size = int64(binary.LittleEndian.Uint64(size))
+	logicalSectorSize := int64(binary.LittleEndian.Uint32(sectorSize))
+
+	switch {
+	case img.blockSize < 1*mib || img.blockSize > 256*mib || img.blockSize&(img.blockSize-1) != 0:
+		return fmt.Errorf("the block size %d is invalid", img.blockSize)
+	case logicalSectorSize != 512 && logicalSectorSize != 4096:
+		return fmt.Errorf("the logical sector size %d is invalid", logicalSectorSize)
+	case img.size <= 0 || img.size > 64*1024*1024*mib:
+		return fmt.Errorf("the disk size %d is invalid", img.size)
+	}
+	// A sector bitmap block covers 2^23 sectors
+	img.chunkRatio = (1 << 23) * logicalSectorSize / img.blockSize
+	return nil
+}
+
+// Size returns the size of the virtual disk, in bytes.
+func (img *Image) Size() int64 {
+	return img.size
+}
+
+// ReadAt reads the virtual disk, where the blocks that aren't present read
+// as zeros.
+func (img *Image) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	n := 0
+	for n < len(p) {
+		if off >= img.size {
+			return n, io.EOF
+		}
+		block := off / img.blockSize
+		length := img.blockSize - off%img.blockSize
+		if img.size-off < length {
+			length = img.size - off
+		}
+		if int64(len(p)-n) < length {
+			length = int64(len(p) - n)
+		}
+		chunk := p[n : n+int(length)]
+
+		entry := img.bat[block+block/img.chunkRatio]
+		switch entry & blockStateMask {
+		case blockNotPresent, blockUndefined, blockZero, blockUnmapped:
+			for i := range chunk {
+				chunk[i] = 0
+			}
+		case blockFullyPresent:
+			// The offset of the block is in MiB, in bits 20 to 63
+			offset := int64(entry>>20)*mib + off%img.blockSize
+			if _, err := img.f.ReadAt(chunk, offset); err != nil {
+				return n, fmt.Errorf("error reading block %d: %s", block, err)
+			}
+		case blockPartiallyPresent:
+			return n, errors.New("differencing images aren't supported")
+		default:
+			return n, fmt.Errorf("the state of block %d is invalid: %d", block, entry&blockStateMask)
+		}
+		n += len(chunk)
+		off += length
+	}
+	return n, nil
+}
+
+// Close closes the image.
+func (img *Image) Close() error {
+	return img.f.Close()
+}
@@ -0,0 +1,201 @@
+package vhdx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testImage describes a dynamic VHDX image with 1 MiB blocks.
+type testImage struct {
+	size int64
+	// The data of the present blocks, at offsets of the disk
+	data map[int64]string
+	// The state of the blocks which aren't present, by block
+	states map[int64]uint64
+	// The log GUID of the header, set when the log has entries
+	log bool
+	// Break the checksum of the header with the largest sequence number
+	corruptHeader bool
+}
+
+func putChecksum(b []byte) {
+	binary.LittleEndian.PutUint32(b[4:], 0)
+	binary.LittleEndian.PutUint32(b[4:], crc32.Checksum(b, crc32.MakeTable(crc32.Castagnoli)))
+}
+
+func (ti testImage) write(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "disk.vhdx")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer f.Close()
+	write := func(b []byte, offset int64) {
+		if _, err := f.WriteAt(b, offset); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	le := binary.LittleEndian
+
+	write(Magic, 0)
+	for i, offset := range []int64{64 * kib, 128 * kib} {
+		h := make([]byte, headerSize)
+		copy(h, "head")
+		le.PutUint64(h[8:], uint64(i+1))
+		if ti.log {
+			h[48] = 1
+		}
+		putChecksum(h)
+		if ti.corruptHeader && i == 1 {
+			h[4]++
+		}
+		write(h, offset)
+	}
+
+	regions := make([]byte, regionTableSize)
+	copy(regions, "regi")
+	le.PutUint32(regions[8:], 2)
+	for i, region := range []struct {
+		id     [16]byte
+		offset uint64
+	}{{regionMetadata, 1 * mib}, {regionBAT, 2 * mib}} {
+		entry := regions[16+32*i:]
+		copy(entry, region.id[:])
+		le.PutUint64(entry[16:], region.offset)
+		le.PutUint32(entry[24:], 1*mib)
+		le.PutUint32(entry[28:], 1)
+	}
+	putChecksum(regions)
+	write(regions, 192*kib)
+	write(regions, 256*kib)
+
+	metadata := make([]byte, 1*mib)
+	copy(metadata, "metadata")
+	items := []struct {
+		id   [16]byte
+		data []byte
+	}{
+		{itemFileParams, []byte{0, 0, 0x10, 0, 0, 0, 0, 0}},
+		{itemDiskSize, le.AppendUint64(nil, uint64(ti.size))},
+		{itemLogSectorSize, le.AppendUint32(nil, 512)},
+	}
+	le.PutUint16(metadata[10:], uint16(len(items)))
+	for i, item := range items {
+		entry := metadata[32+32*i:]
+		copy(entry, item.id[:])
+		le.PutUint32(entry[16:], uint32(64*kib+i*kib))
+		le.PutUint32(entry[20:], uint32(len(item.data)))
+		le.PutUint32(entry[24:], 4)
+		copy(metadata[64*kib+i*kib:], item.data)
+	}
+	write(metadata, 1*mib)
+
+	// The blocks follow the BAT, in the order of the disk
+	bat := make([]byte, 1*mib)
+	blocks := (ti.size + mib - 1) / mib
+	chunkRatio := int64((1 << 23) * 512 / mib)
+	next := int64(3 * mib)
+	for block := int64(0); block < blocks; block++ {
+		state, ok := ti.states[block]
+		if !ok {
+			state = blockNotPresent
+		}
+		content := make([]byte, mib)
+		present := false
+		for offset, data := range ti.data {
+			start := max(offset, block*mib)
+			end := min(offset+int64(len(data)), (block+1)*mib)
+			if start < end {
+				copy(content[start-block*mib:], data[start-offset:end-offset])
+				present = true
+			}
+		}
+		if present {
+			write(content, next)
+			state = uint64(next/mib)<<20 | blockFullyPresent
+			next += mib
+		}
+		le.PutUint64(bat[8*(block+block/chunkRatio):], state)
+	}
+	write(bat, 2*mib)
+	return path
+}
+
+func TestImage(t *testing.T) {
+	data := map[int64]string{
+		0:             "boot",
+		2*mib + 100:   "data",
+		3*mib - 2:     "across blocks",
+		4097*mib + 10: "after the sector bitmap",
+		4100 * mib:    "end",
+	}
+	ti := testImage{
+		size:   4100*mib + 512,
+		data:   data,
+		states: map[int64]uint64{1: blockZero, 4: blockUnmapped},
+	}
+	img, err := Open(ti.write(t))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer img.Close()
+
+	if img.Size() != ti.size || img.chunkRatio != 4096 {
+		t.Fatalf("bad: %d %d", img.Size(), img.chunkRatio)
+	}
+	for offset, content := range data {
+		b := make([]byte, len(content))
+		if _, err := img.ReadAt(b, offset); err != nil || string(b) != content {
+			t.Fatalf("bad: %d: %q %v", offset, b, err)
+		}
+	}
+
+	// The blocks which aren't present read as zeros
+	b := bytes.Repeat([]byte{1}, 3*mib)
+	if _, err := img.ReadAt(b, 0); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expected := make([]byte, 3*mib)
+	copy(expected, "boot")
+	copy(expected[2*mib+100:], "data")
+	copy(expected[3*mib-2:], "ac")
+	if !bytes.Equal(b, expected) {
+		t.Fatal("bad: the disk differs")
+	}
+
+	// Reads past the end of the disk are short
+	n, err := img.ReadAt(b[:1024], ti.size-512)
+	if n != 512 || err != io.EOF || string(b[:3]) != "end" {
+		t.Fatalf("bad: %d %v", n, err)
+	}
+}
+
+func TestOpen_headers(t *testing.T) {
+	// The other header is used when the current one is corrupt
+	ti := testImage{size: 2 * mib, data: map[int64]string{0: "boot"}, corruptHeader: true}
+	img, err := Open(ti.write(t))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	img.Close()
+
+	ti.log = true
+	if _, err := Open(ti.write(t)); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestOpen_invalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.vhdx")
+	if err := os.WriteFile(path, append(Magic, make([]byte, 512*kib)...), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := Open(path); err == nil {
+		t.Fatal("should have error")
+	}
+}
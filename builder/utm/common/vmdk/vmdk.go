@@ -0,0 +1,279 @@
+// Package vmdk reads the disk images of VMware, in the hosted sparse extent
+// format of the monolithicSparse and streamOptimized images that cloud
+// images are shipped as, so that they can be converted to qcow2.
+//
+// Images whose descriptor references separate extent files, and the
+// seSparse extents of ESXi, aren't supported.
+package vmdk
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Magic is the first bytes of a hosted sparse extent.
+var Magic = []byte{'K', 'D', 'M', 'V'}
+
+// DescriptorMagic is the first bytes of a VMDK descriptor file.
+var DescriptorMagic = []byte("# Disk DescriptorFile")
+
+const (
+	sectorSize = 512
+
+	flagCompressed = 1 << 16
+
+	compressionDeflate = 1
+
+	// The offset of the grain directory of streamOptimized images, which
+	// is written in the footer
+	gdAtEnd = 0xffffffffffffffff
+)
+
+// header is the header of a sparse extent, with the sizes and offsets in
+// sectors.
+type header struct {
+	Version           uint32
+	Flags             uint32
+	Capacity          uint64
+	GrainSize         uint64
+	DescriptorOffset  uint64
+	DescriptorSize    uint64
+	NumGTEsPerGT      uint32
+	RGDOffset         uint64
+	GDOffset          uint64
+	OverHead          uint64
+	UncleanShutdown   uint8
+	NewlineTest       [4]byte
+	CompressAlgorithm uint16
+}
+
+func readHeader(r io.ReaderAt, offset int64) (*header, error) {
+	b := make([]byte, sectorSize)
+	if _, err := r.ReadAt(b, offset); err != nil {
+		if err == io.EOF {
+			err = errors.New("the header of the image is truncated")
+		}
+		return nil, err
+	}
+	if !bytes.Equal(b[:4], Magic) {
+		if bytes.HasPrefix(b, DescriptorMagic) {
+			return nil, errors.New("VMDK descriptors with separate extent files aren't supported")
+		}
+		return nil, errors.New("the image isn't a VMDK sparse extent")
+	}
+
+	h := new(header)
+	if err := binary.Read(bytes.NewReader(b[4:]), binary.LittleEndian, h); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Image is a VMDK image open for reading. It isn't safe for concurrent
+// use.
+type Image struct {
+	f    *os.File
+	h    *header
+	gd   []uint32
+	size int64
+
+	// The last grain table and grain that were read
+	tableIndex int64
+	table      []uint32
+	grainIndex int64
+	grain      []byte
+}
+
+// Open opens the VMDK image at path.
+func Open(path string) (*Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	img := &Image{f: f, tableIndex: -1, grainIndex: -1}
+	if err := img.load(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return img, nil
+}
+
+func (img *Image) load() error {
+	h, err := readHeader(img.f, 0)
+	if err != nil {
+		return err
+	}
+	if h.GDOffset == gdAtEnd {
+		// The footer is followed by the end-of-stream marker
+		fi, err := img.f.Stat()
+		if err != nil {
+			return err
+		}
+		if h, err = readHeader(img.f, fi.Size()-2*sectorSize); err != nil {
+			return fmt.Errorf("error reading the footer: %s", err)
+		}
+		if h.GDOffset == gdAtEnd {
+			return errors.New("the footer has no grain directory")
+		}
+	}
+
+	switch {
+	case h.Version < 1 || h.Version > 3:
+		return fmt.Errorf("sparse extent version %d isn't supported", h.Version)
+	case h.GrainSize == 0 || h.GrainSize > 1<<16 || h.GrainSize&(h.GrainSize-1) != 0:
+		return fmt.Errorf("the grain size of %d sectors is invalid", h.GrainSize)
+	case h.NumGTEsPerGT == 0 || h.NumGTEsPerGT > 1<<16:
+		return fmt.Errorf("the grain table size %d is invalid", h.NumGTEsPerGT)
+	case h.Flags&flagCompressed != 0 && h.CompressAlgorithm != compressionDeflate:
+		return fmt.Errorf("the compression algorithm %d isn't supported", h.CompressAlgorithm)
+	case h.Capacity > 1<<40:
+		return fmt.Errorf("the capacity of %d sectors is too large", h.Capacity)
+	}
+	img.h = h
+	img.size = int64(h.Capacity) * sectorSize
+
+	grains := (h.Capacity + h.GrainSize - 1) / h.GrainSize
+	tables := (grains + uint64(h.NumGTEsPerGT) - 1) / uint64(h.NumGTEsPerGT)
+	b := make([]byte, tables*4)
+	if _, err := img.f.ReadAt(b, int64(h.GDOffset)*sectorSize); err != nil {
+		return fmt.Errorf("error reading the grain directory: %s", err)
+	}
+	img.gd = make([]uint32, tables)
+	for i := range img.gd {
+		img.gd[i] = binary.LittleEndian.Uint32(b[4*i:])
+	}
+	img.table = make([]uint32, h.NumGTEsPerGT)
+	img.grain = make([]byte, h.GrainSize*sectorSize)
+	return nil
+}
+
+// Size returns the size of the virtual disk, in bytes.
+func (img *Image) Size() int64 {
+	return img.size
+}
+
+// ReadAt reads the virtual disk, where the grains that aren't allocated
+// read as zeros.
+func (img *Image) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	grainSize := int64(len(img.grain))
+	n := 0
+	for n < len(p) {
+		if off >= img.size {
+			return n, io.EOF
+		}
+		if err := img.readGrain(off / grainSize); err != nil {
+			return n, err
+		}
+		end := grainSize
+		if img.size-off/grainSize*grainSize < end {
+			end = img.size - off/grainSize*grainSize
+		}
+		copied := copy(p[n:], img.grain[off%grainSize:end])
+		n += copied
+		off += int64(copied)
+	}
+	return n, nil
+}
+
+// readGrain reads a grain of the virtual disk into img.grain.
+func (img *Image) readGrain(index int64) error {
+	if index == img.grainIndex {
+		return nil
+	}
+	img.grainIndex = -1
+
+	perTable := int64(img.h.NumGTEsPerGT)
+	if err := img.readTable(index / perTable); err != nil {
+		return err
+	}
+	entry := int64(img.table[index%perTable])
+	// 0 is an unallocated grain, and 1 a zeroed grain
+	if entry <= 1 {
+		for i := range img.grain {
+			img.grain[i] = 0
+		}
+		img.grainIndex = index
+		return nil
+	}
+
+	if img.h.Flags&flagCompressed == 0 {
+		read, err := img.f.ReadAt(img.grain, entry*sectorSize)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("error reading grain %d: %s", index, err)
+		}
+		// The last grain may be truncated
+		for i := read; i < len(img.grain); i++ {
+			img.grain[i] = 0
+		}
+		img.grainIndex = index
+		return nil
+	}
+
+	// Compressed grains start with their LBA and their compressed size
+	marker := make([]byte, 12)
+	if _, err := img.f.ReadAt(marker, entry*sectorSize); err != nil {
+		return fmt.Errorf("error reading grain %d: %s", index, err)
+	}
+	length := int64(binary.LittleEndian.Uint32(marker[8:]))
+	if length > 2*int64(len(img.grain))+sectorSize {
+		return fmt.Errorf("the compressed grain %d is too large: %d bytes", index, length)
+	}
+	compressed := make([]byte, length)
+	if _, err := img.f.ReadAt(compressed, entry*sectorSize+12); err != nil {
+		return fmt.Errorf("error reading grain %d: %s", index, err)
+	}
+	r, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return fmt.Errorf("error inflating grain %d: %s", index, err)
+	}
+	defer r.Close()
+	// The last grain may be short
+	read, err := io.ReadFull(r, img.grain)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return fmt.Errorf("error inflating grain %d: %s", index, err)
+	}
+	for i := read; i < len(img.grain); i++ {
+		img.grain[i] = 0
+	}
+	img.grainIndex = index
+	return nil
+}
+
+// readTable reads a grain table into img.table.
+func (img *Image) readTable(index int64) error {
+	if index == img.tableIndex {
+		return nil
+	}
+	img.tableIndex = -1
+
+	offset := int64(img.gd[index])
+	if offset == 0 {
+		for i := range img.table {
+			img.table[i] = 0
+		}
+		img.tableIndex = index
+		return nil
+	}
+	b := make([]byte, len(img.table)*4)
+	if _, err := img.f.ReadAt(b, offset*sectorSize); err != nil {
+		return fmt.Errorf("error reading grain table %d: %s", index, err)
+	}
+	for i := range img.table {
+		img.table[i] = binary.LittleEndian.Uint32(b[4*i:])
+	}
+	img.tableIndex = index
+	return nil
+}
+
+// Close closes the image.
+func (img *Image) Close() error {
+	return img.f.Close()
+}
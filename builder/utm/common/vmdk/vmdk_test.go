@@ -0,0 +1,212 @@
+package vmdk
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const (
+	testGrainSize = 8
+	testGTEs      = 4
+)
+
+// testImage writes a VMDK image of a disk of the given sectors, with data
+// at the given offsets, and returns its path and the data of the disk.
+// Grains are compressed and the grain directory is in the footer, like in
+// streamOptimized images, when compressed is set.
+func testImage(t *testing.T, sectors uint64, data map[int64]string, compressed bool) (string, []byte) {
+	disk := make([]byte, sectors*sectorSize)
+	for offset, content := range data {
+		copy(disk[offset:], content)
+	}
+
+	grainBytes := testGrainSize * sectorSize
+	grains := (len(disk) + grainBytes - 1) / grainBytes
+	tables := (grains + testGTEs - 1) / testGTEs
+	sectorsOf := func(n int) int { return (n + sectorSize - 1) / sectorSize }
+
+	var out bytes.Buffer
+	pad := func() {
+		out.Write(make([]byte, sectorsOf(out.Len())*sectorSize-out.Len()))
+	}
+	h := header{
+		Version:          1,
+		Flags:            3,
+		Capacity:         sectors,
+		GrainSize:        testGrainSize,
+		DescriptorOffset: 1,
+		DescriptorSize:   1,
+		NumGTEsPerGT:     testGTEs,
+		GDOffset:         2,
+	}
+	writeHeader := func(h header) {
+		out.Write(Magic)
+		binary.Write(&out, binary.LittleEndian, h)
+		pad()
+	}
+	// The descriptor follows the header
+	writeDescriptor := func() {
+		out.Write(DescriptorMagic)
+		out.WriteString("\nversion=1\n")
+		pad()
+	}
+	// The markers of the metadata of streamOptimized images
+	writeMarker := func(sectors int, kind uint32) {
+		binary.Write(&out, binary.LittleEndian, struct {
+			Sectors uint64
+			Size    uint32
+			Type    uint32
+		}{uint64(sectors), 0, kind})
+		pad()
+	}
+	if compressed {
+		h.Version = 3
+		h.Flags |= flagCompressed | 1<<17
+		h.CompressAlgorithm = compressionDeflate
+		footer := h
+		h.GDOffset = gdAtEnd
+		writeHeader(h)
+		writeDescriptor()
+		h = footer
+	} else {
+		writeHeader(h)
+		writeDescriptor()
+		// The grain directory and the grain tables are written first
+		out.Write(make([]byte, (sectorsOf(tables*4)+tables*sectorsOf(testGTEs*4))*sectorSize))
+	}
+
+	gts := make([][]uint32, tables)
+	for i := 0; i < grains; i++ {
+		grain := make([]byte, grainBytes)
+		copy(grain, disk[i*grainBytes:])
+		if bytes.Count(grain, []byte{0}) == len(grain) {
+			continue
+		}
+		if gts[i/testGTEs] == nil {
+			gts[i/testGTEs] = make([]uint32, testGTEs)
+		}
+		gts[i/testGTEs][i%testGTEs] = uint32(out.Len() / sectorSize)
+		if compressed {
+			var b bytes.Buffer
+			w := zlib.NewWriter(&b)
+			// The last grain is short
+			end := (i + 1) * grainBytes
+			if end > len(disk) {
+				end = len(disk)
+			}
+			w.Write(disk[i*grainBytes : end])
+			w.Close()
+			binary.Write(&out, binary.LittleEndian, uint64(i*testGrainSize))
+			binary.Write(&out, binary.LittleEndian, uint32(b.Len()))
+			out.Write(b.Bytes())
+			pad()
+		} else {
+			out.Write(grain)
+		}
+	}
+
+	image := out.Bytes()
+	gd := make([]uint32, tables)
+	if compressed {
+		// Each table is preceded by a marker
+		for i, gt := range gts {
+			if gt == nil {
+				continue
+			}
+			writeMarker(sectorsOf(testGTEs*4), 1)
+			gd[i] = uint32(out.Len() / sectorSize)
+			binary.Write(&out, binary.LittleEndian, gt)
+			pad()
+		}
+		writeMarker(sectorsOf(tables*4), 2)
+		h.GDOffset = uint64(out.Len() / sectorSize)
+		binary.Write(&out, binary.LittleEndian, gd)
+		pad()
+		writeMarker(1, 3)
+		writeHeader(h)
+		// The end-of-stream marker
+		writeMarker(0, 0)
+		image = out.Bytes()
+	} else {
+		next := 2 + sectorsOf(tables*4)
+		for i, gt := range gts {
+			if gt == nil {
+				continue
+			}
+			gd[i] = uint32(next)
+			var b bytes.Buffer
+			binary.Write(&b, binary.LittleEndian, gt)
+			copy(image[next*sectorSize:], b.Bytes())
+			next += sectorsOf(testGTEs * 4)
+		}
+		var b bytes.Buffer
+		binary.Write(&b, binary.LittleEndian, gd)
+		copy(image[2*sectorSize:], b.Bytes())
+	}
+
+	path := filepath.Join(t.TempDir(), "disk.vmdk")
+	if err := os.WriteFile(path, image, 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return path, disk
+}
+
+func TestImage(t *testing.T) {
+	data := map[int64]string{
+		0:     "boot",
+		4090:  "across grains",
+		40000: "data",
+		// In the last grain, which is short
+		3*testGTEs*testGrainSize*sectorSize + 100: "end",
+	}
+	sectors := uint64(3*testGTEs*testGrainSize + 3)
+
+	for _, compressed := range []bool{false, true} {
+		path, disk := testImage(t, sectors, data, compressed)
+		img, err := Open(path)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		defer img.Close()
+
+		if img.Size() != int64(len(disk)) {
+			t.Fatalf("bad: %d", img.Size())
+		}
+		read, err := io.ReadAll(io.NewSectionReader(img, 0, img.Size()))
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if !bytes.Equal(read, disk) {
+			t.Fatalf("bad: the disk differs, compressed %t", compressed)
+		}
+
+		// Reads past the end of the disk are short
+		b := make([]byte, 1024)
+		n, err := img.ReadAt(b, img.Size()-512)
+		if n != 512 || err != io.EOF || !bytes.Equal(b[:n], disk[len(disk)-512:]) {
+			t.Fatalf("bad: %d %v", n, err)
+		}
+	}
+}
+
+func TestOpen_invalid(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"empty":      "",
+		"raw":        string(make([]byte, 1024)),
+		"descriptor": string(DescriptorMagic) + "\nversion=1\n" + string(make([]byte, 512)),
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if _, err := Open(path); err == nil {
+			t.Fatalf("should have error: %s", name)
+		}
+	}
+}
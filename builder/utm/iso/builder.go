@@ -30,15 +30,16 @@ func (b *Builder) Prepare(raws ...interface{}) ([]string, []string, error) {
 		return nil, warnings, errs
 	}
 
-	return nil, warnings, nil
+	return b.config.GeneratedVars(), warnings, nil
 }
 
 func (b *Builder) Run(ctx context.Context, ui packersdk.Ui, hook packersdk.Hook) (packersdk.Artifact, error) {
 	// Create the driver that we'll use to communicate with UTM
-	driver, err := utmcommon.NewDriver()
+	driver, err := utmcommon.NewDriver(ctx, b.config.RemoteConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed creating UTM driver: %s", err)
 	}
+	defer driver.Close()
 
 	// Setup the state bag
 	state := new(multistep.BasicStateBag)
@@ -48,6 +49,31 @@ func (b *Builder) Run(ctx context.Context, ui packersdk.Ui, hook packersdk.Hook)
 	state.Put("hook", hook)
 	state.Put("ui", ui)
 
+	// The VM is also shut down and connected to again to snapshot its disks
+	shutdown := &utmcommon.StepShutdown{
+		Command:         b.config.ShutdownCommand,
+		Timeout:         b.config.ShutdownTimeout,
+		Delay:           b.config.PostShutdownDelay,
+		DisableShutdown: b.config.DisableShutdown,
+	}
+	connect := &communicator.StepConnect{
+		Config:    &b.config.CommConfig.Comm,
+		Host:      utmcommon.CommHost(&b.config.CommConfig),
+		SSHConfig: b.config.CommConfig.Comm.SSHConfigFunc(),
+		SSHPort:   utmcommon.CommPort,
+		WinRMPort: utmcommon.CommPort,
+	}
+	// The changes these steps make to the guest are undone by a rollback
+	mountSharedDirectory := &utmcommon.StepMountSharedDirectory{
+		SharedDirectory: b.config.SharedDirectory,
+	}
+	uploadVersion := &utmcommon.StepUploadVersion{
+		Path: *b.config.UtmVersionFile,
+	}
+
+	// The HTTP server is bound to the address guests reach the host on
+	httpServer := commonsteps.HTTPServerFromHTTPConfig(&b.config.HTTPConfig)
+
 	// Build the steps.
 	steps := []multistep.Step{
 		&utmcommon.StepDownloadGuestAdditions{
@@ -73,13 +99,18 @@ func (b *Builder) Run(ctx context.Context, ui packersdk.Ui, hook packersdk.Hook)
 			Directories: b.config.FloppyConfig.FloppyDirectories,
 			Label:       b.config.FloppyConfig.FloppyLabel,
 		},
-		&commonsteps.StepCreateCD{
+		&utmcommon.StepCreateCD{
 			Files:   b.config.CDConfig.CDFiles,
 			Content: b.config.CDConfig.CDContent,
 			Label:   b.config.CDConfig.CDLabel,
 		},
-		new(utmcommon.StepHTTPIPDiscover),
-		commonsteps.HTTPServerFromHTTPConfig(&b.config.HTTPConfig),
+		&utmcommon.StepHTTPIPDiscover{
+			HTTPAddress:       b.config.HTTPAddress,
+			HTTPInterface:     b.config.HTTPInterface,
+			NetworkInterfaces: b.config.NetworkInterfaces,
+			HTTPServer:        httpServer,
+		},
+		httpServer,
 		&utmcommon.StepSshKeyPair{
 			Debug:        b.config.PackerDebug,
 			DebugKeyPath: fmt.Sprintf("%s.pem", b.config.PackerBuildName),
@@ -113,6 +144,8 @@ func (b *Builder) Run(ctx context.Context, ui packersdk.Ui, hook packersdk.Hook)
 			HostPortMax:            b.config.HostPortMax,
 			SkipNatMapping:         b.config.SkipNatMapping,
 			ClearNetworkInterfaces: true,
+			NetworkInterfaces:      b.config.NetworkInterfaces,
+			ForwardedPorts:         b.config.ForwardedPorts,
 		},
 		&stepConfigureVNC{
 			Enabled:            !b.config.DisableVNC,
@@ -125,6 +158,9 @@ func (b *Builder) Run(ctx context.Context, ui packersdk.Ui, hook packersdk.Hook)
 			Message: "UTM API Unavailable: Add a display device to the VM for VNC to work",
 			NoPause: b.config.DisplayNoPause,
 		},
+		&utmcommon.StepSharedDirectory{
+			SharedDirectory: b.config.SharedDirectory,
+		},
 		&utmcommon.StepRun{},
 		&stepTypeBootCommand{},
 		&utmcommon.StepPause{
@@ -140,30 +176,40 @@ func (b *Builder) Run(ctx context.Context, ui packersdk.Ui, hook packersdk.Hook)
 		// &stepRemoveFirstDisk{},
 		// // We start the VM again for the next steps.
 		// &utmcommon.StepRun{},
-		&communicator.StepConnect{
-			Config:    &b.config.CommConfig.Comm,
-			Host:      utmcommon.CommHost(b.config.CommConfig.Comm.Host()),
-			SSHConfig: b.config.CommConfig.Comm.SSHConfigFunc(),
-			SSHPort:   utmcommon.CommPort,
-			WinRMPort: utmcommon.CommPort,
-		},
-		&utmcommon.StepUploadVersion{
-			Path: *b.config.UtmVersionFile,
-		},
+		connect,
+		&utmcommon.StepSnapshot{
+			Enabled:  b.config.ProvisionSnapshot,
+			Shutdown: shutdown,
+			Connect:  connect,
+		},
+		mountSharedDirectory,
+		uploadVersion,
 		// TODO: Add StepUploadGuestAdditions
-		new(commonsteps.StepProvision),
+		&utmcommon.StepRollbackProvision{
+			Retries:      b.config.ProvisionRetries,
+			Rollback:     b.config.ProvisionRollback,
+			Shutdown:     shutdown,
+			Connect:      connect,
+			AfterConnect: []multistep.Step{mountSharedDirectory, uploadVersion},
+		},
 		&commonsteps.StepCleanupTempKeys{
 			Comm: &b.config.CommConfig.Comm,
 		},
-		&utmcommon.StepShutdown{
-			Command:         b.config.ShutdownCommand,
-			Timeout:         b.config.ShutdownTimeout,
-			Delay:           b.config.PostShutdownDelay,
-			DisableShutdown: b.config.DisableShutdown,
+		&utmcommon.StepZeroFreeSpace{
+			Command: b.config.ZeroFreeSpaceCommand,
+		},
+		shutdown,
+		new(utmcommon.StepRemoveSnapshot),
+		&utmcommon.StepRemoveSharedDirectory{
+			SharedDirectory: b.config.SharedDirectory,
 		},
 		&utmcommon.StepRemoveDevices{
 			Bundling: b.config.UtmBundleConfig,
 		},
+		&utmcommon.StepCompactDisks{
+			Compact:  b.config.CompactDisks,
+			Compress: b.config.CompressDisks,
+		},
 		&utmcommon.StepPause{
 			Message: "Make required changes to the VM before export.\nRemove display, Add Serial port, Icon, etc.",
 			NoPause: b.config.ExportNoPause,
@@ -195,6 +241,9 @@ func (b *Builder) Run(ctx context.Context, ui packersdk.Ui, hook packersdk.Hook)
 		return nil, errors.New("build was halted")
 	}
 
-	generatedData := map[string]interface{}{"generated_data": state.Get("generated_data")}
+	generatedData := map[string]interface{}{
+		"generated_data":  state.Get("generated_data"),
+		"compacted_disks": state.Get("compacted_disks"),
+	}
 	return utmcommon.NewArtifact(b.config.OutputDir, b.config.VMName, generatedData)
 }
@@ -18,21 +18,26 @@ import (
 
 // Config is the configuration structure for the UTM ISO builder.
 type Config struct {
-	common.PackerConfig            `mapstructure:",squash"`
-	commonsteps.HTTPConfig         `mapstructure:",squash"`
-	commonsteps.ISOConfig          `mapstructure:",squash"`
-	commonsteps.FloppyConfig       `mapstructure:",squash"`
-	commonsteps.CDConfig           `mapstructure:",squash"`
-	bootcommand.VNCConfig          `mapstructure:",squash"`
-	utmcommon.ExportConfig         `mapstructure:",squash"`
-	utmcommon.OutputConfig         `mapstructure:",squash"`
-	utmcommon.ShutdownConfig       `mapstructure:",squash"`
-	utmcommon.CommConfig           `mapstructure:",squash"`
-	utmcommon.HWConfig             `mapstructure:",squash"`
-	utmcommon.UtmVersionConfig     `mapstructure:",squash"`
-	utmcommon.UtmBundleConfig      `mapstructure:",squash"`
-	utmcommon.GuestAdditionsConfig `mapstructure:",squash"`
-	utmcommon.NoPauseConfig        `mapstructure:",squash"`
+	common.PackerConfig             `mapstructure:",squash"`
+	commonsteps.HTTPConfig          `mapstructure:",squash"`
+	commonsteps.ISOConfig           `mapstructure:",squash"`
+	commonsteps.FloppyConfig        `mapstructure:",squash"`
+	commonsteps.CDConfig            `mapstructure:",squash"`
+	bootcommand.VNCConfig           `mapstructure:",squash"`
+	utmcommon.ExportConfig          `mapstructure:",squash"`
+	utmcommon.OutputConfig          `mapstructure:",squash"`
+	utmcommon.ShutdownConfig        `mapstructure:",squash"`
+	utmcommon.CommConfig            `mapstructure:",squash"`
+	utmcommon.HWConfig              `mapstructure:",squash"`
+	utmcommon.UtmVersionConfig      `mapstructure:",squash"`
+	utmcommon.UtmBundleConfig       `mapstructure:",squash"`
+	utmcommon.GuestAdditionsConfig  `mapstructure:",squash"`
+	utmcommon.NoPauseConfig         `mapstructure:",squash"`
+	utmcommon.RemoteConfig          `mapstructure:",squash"`
+	utmcommon.SnapshotConfig        `mapstructure:",squash"`
+	utmcommon.NetworkConfig         `mapstructure:",squash"`
+	utmcommon.DiskConfig            `mapstructure:",squash"`
+	utmcommon.SharedDirectoryConfig `mapstructure:",squash"`
 
 	// Set this to true if you would like to use Hypervisor
 	// Defaults to false.
@@ -92,7 +97,7 @@ type Config struct {
 	// No display device is attached by default.
 	DisplayHardwareType string `mapstructure:"display_hardware_type" required:"false"`
 	// The size, in megabytes, of the hard disk to create for the VM. By
-	// default, this is 40000 (about 40 GB).
+	// default, this is 40000 (about 40 GB). Can't be used with `disk`.
 	DiskSize uint `mapstructure:"disk_size" required:"false"`
 	// The type of controller that the primary hard drive is attached to,
 	// defaults to VirtIO. When set to usb, the drive is attached to an USB
@@ -109,7 +114,8 @@ type Config struct {
 	// Additional disks to create. Attachment starts at 1 since 0
 	// is the default disk. Each value represents the disk image size in MiB.
 	// Each additional disk uses the same disk parameters as the default disk.
-	// Unset by default.
+	// Unset by default. Can't be used with `disk`, which configures each
+	// disk on its own.
 	AdditionalDiskSize []uint `mapstructure:"disk_additional_size" required:"false"`
 	// Set this to true if you would like to keep the VM registered with
 	// UTM. Defaults to false.
@@ -165,6 +171,7 @@ func (c *Config) Prepare(raws ...interface{}) ([]string, error) {
 				"boot_steps",
 				"guest_additions_path",
 				"guest_additions_url",
+				"shared_directory",
 			},
 		},
 	}, raws...)
@@ -188,18 +195,30 @@ func (c *Config) Prepare(raws ...interface{}) ([]string, error) {
 	errs = packersdk.MultiErrorAppend(errs, c.HTTPConfig.Prepare(&c.ctx)...)
 	errs = packersdk.MultiErrorAppend(errs, c.ShutdownConfig.Prepare(&c.ctx)...)
 	errs = packersdk.MultiErrorAppend(errs, c.CommConfig.Prepare(&c.ctx)...)
+	errs = packersdk.MultiErrorAppend(errs, c.RemoteConfig.Prepare(&c.ctx)...)
+	errs = packersdk.MultiErrorAppend(errs, c.SnapshotConfig.Prepare(&c.ctx, c.ShutdownCommand)...)
+	errs = packersdk.MultiErrorAppend(errs, c.NetworkConfig.Prepare(&c.ctx, &c.CommConfig)...)
 	errs = packersdk.MultiErrorAppend(errs, c.UtmBundleConfig.Prepare(&c.ctx)...)
 	errs = packersdk.MultiErrorAppend(errs, c.UtmVersionConfig.Prepare(c.CommConfig.Comm.Type)...)
 	errs = packersdk.MultiErrorAppend(errs, c.VNCConfig.Prepare(&c.ctx)...)
 
-	if c.DiskSize == 0 {
-		c.DiskSize = 40960
-	}
-
 	if c.HardDriveInterface == "" {
 		c.HardDriveInterface = "virtio"
 	}
 
+	if len(c.Disks) > 0 {
+		if c.DiskSize != 0 || len(c.AdditionalDiskSize) > 0 {
+			errs = packersdk.MultiErrorAppend(errs,
+				errors.New("disk can't be used with disk_size or disk_additional_size"))
+		}
+	} else {
+		if c.DiskSize == 0 {
+			c.DiskSize = 40960
+		}
+		c.Disks = utmcommon.LegacyDisks(c.DiskSize, c.AdditionalDiskSize)
+	}
+	errs = packersdk.MultiErrorAppend(errs, c.DiskConfig.Prepare(&c.ctx, c.HardDriveInterface)...)
+
 	if c.VMArch == "" {
 		c.VMArch = "aarch64"
 	}
@@ -207,6 +226,7 @@ func (c *Config) Prepare(raws ...interface{}) ([]string, error) {
 	if c.VMBackend == "" {
 		c.VMBackend = "qemu"
 	}
+	errs = packersdk.MultiErrorAppend(errs, c.SharedDirectoryConfig.Prepare(&c.ctx, c.VMBackend)...)
 	// Validate and use Enums for the VM backend
 	switch c.VMBackend {
 	case "apple":
@@ -6,8 +6,11 @@ package iso
 import (
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
+	gonet "net"
+	"strconv"
 
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
 	"github.com/hashicorp/packer-plugin-sdk/net"
@@ -31,7 +34,8 @@ type stepConfigureVNC struct {
 	VNCPortMax         int
 	VNCDisablePassword bool
 
-	l *net.Listener
+	l      *net.Listener
+	tunnel io.Closer
 }
 
 func VNCPassword(skipPassword bool) string {
@@ -94,26 +98,30 @@ func (s *stepConfigureVNC) Run(ctx context.Context, state multistep.StateBag) mu
 	// Add VNC arguments to the VM via Qemu additional arguments.
 	// Send choosen vncPort - 5900 as the VNC port.
 	vncQemuArg := fmt.Sprintf("-vnc %s:%d", s.VNCBindAddress, vncPort-5900)
-	addQemuArgsCommand := []string{
-		"add_qemu_additional_args.applescript", vmId,
-		"--args", vncQemuArg,
+	ui.Say("Adding QEMU additional arguments...")
+	if err := utmcommon.AddQemuAdditionalArgs(ctx, state, driver, vmId, vncQemuArg); err != nil {
+		err := fmt.Errorf("error adding QEMU additional arguments: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
 	}
 
-	ui.Say("Adding QEMU additional arguments...")
-	_, err = driver.ExecuteOsaScript(addQemuArgsCommand...)
+	// Make the VNC server of a remote UTM host reachable here
+	s.tunnel, err = driver.Tunnel(ctx, gonet.JoinHostPort(s.VNCBindAddress, strconv.Itoa(vncPort)))
 	if err != nil {
-		err := fmt.Errorf("error adding QEMU additional arguments: %s", err)
+		err := fmt.Errorf("error tunneling VNC port: %s", err)
 		state.Put("error", err)
 		ui.Error(err.Error())
 		return multistep.ActionHalt
 	}
-	// Save the VNC QEMU argument for later cleanup
-	state.Put("qemuAdditionalArg", vncQemuArg)
 
 	return multistep.ActionContinue
 }
 
 func (s *stepConfigureVNC) Cleanup(multistep.StateBag) {
+	if s.tunnel != nil {
+		s.tunnel.Close()
+	}
 	// release the port
 	if s.l != nil {
 		err := s.l.Close()
@@ -3,7 +3,6 @@ package iso
 import (
 	"context"
 	"fmt"
-	"strconv"
 
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
 	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
@@ -20,38 +19,29 @@ func (s *stepCreateDisk) Run(ctx context.Context, state multistep.StateBag) mult
 	ui := state.Get("ui").(packersdk.Ui)
 	vmId := state.Get("vmId").(string)
 
-	// The main disk and additional disks
+	// Create all required disks, in order
 	// We do not give names to the disks, as UTM does not support it
-	diskSizes := []uint{config.DiskSize}
-	if len(config.AdditionalDiskSize) > 0 {
-		diskSizes = append(diskSizes, config.AdditionalDiskSize...)
-	}
-
-	// Create all required disks
-	for i := range diskSizes {
-		ui.Say(fmt.Sprintf("Creating hard drive with size %d MiB...", diskSizes[i]))
-
-		// Convert controllerName to the corresponding enum code
-		controllerEnumCode, err := utmcommon.GetControllerEnumCode(config.HardDriveInterface)
-		if err != nil {
-			state.Put("error", err)
-			ui.Error(err.Error())
-			return multistep.ActionHalt
+	var excludedDrives []string
+	for _, disk := range config.Disks {
+		if disk.Source != "" {
+			ui.Say(fmt.Sprintf("Attaching hard drive with image %s...", disk.Source))
+		} else {
+			ui.Say(fmt.Sprintf("Creating hard drive with size %d MiB...", disk.Size))
 		}
 
-		command := []string{
-			"add_drive.applescript", vmId,
-			"--interface", controllerEnumCode,
-			"--size", strconv.FormatUint(uint64(diskSizes[i]), 10),
-		}
-		_, err = driver.ExecuteOsaScript(command...)
+		driveId, err := utmcommon.AddDisk(ctx, driver, vmId, disk)
 		if err != nil {
 			err := fmt.Errorf("error creating hard drive: %s", err)
 			state.Put("error", err)
 			ui.Error(err.Error())
 			return multistep.ActionHalt
 		}
+		if disk.SkipExport {
+			excludedDrives = append(excludedDrives, driveId)
+		}
 	}
+	// Detached by StepRemoveDevices before the export
+	state.Put("excluded_drives", excludedDrives)
 
 	// In UTM disk creation and attaching are done in the same step
 
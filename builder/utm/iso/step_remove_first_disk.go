@@ -22,7 +22,7 @@ func (s *stepRemoveFirstDisk) Run(ctx context.Context, state multistep.StateBag)
 	command := []string{
 		"remove_first_drive.applescript", vmId,
 	}
-	_, err := driver.ExecuteOsaScript(command...)
+	_, err := driver.ExecuteOsaScript(ctx, command...)
 	if err != nil {
 		err := fmt.Errorf("error removing first drive: %s", err)
 		state.Put("error", err)
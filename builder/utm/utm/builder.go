@@ -28,17 +28,18 @@ func (b *Builder) Prepare(raws ...interface{}) ([]string, []string, error) {
 		return nil, warnings, errs
 	}
 
-	return nil, warnings, nil
+	return b.config.GeneratedVars(), warnings, nil
 }
 
 // Run executes a Packer build and returns a packersdk.Artifact representing
 // a UTM appliance.
 func (b *Builder) Run(ctx context.Context, ui packersdk.Ui, hook packersdk.Hook) (packersdk.Artifact, error) {
 	// Create the driver that we'll use to communicate with UTM
-	driver, err := utmcommon.NewDriver()
+	driver, err := utmcommon.NewDriver(ctx, b.config.RemoteConfig)
 	if err != nil {
 		return nil, fmt.Errorf("Failed creating UTM driver: %s", err)
 	}
+	defer driver.Close()
 
 	// Set up the state
 	state := new(multistep.BasicStateBag)
@@ -48,6 +49,28 @@ func (b *Builder) Run(ctx context.Context, ui packersdk.Ui, hook packersdk.Hook)
 	state.Put("hook", hook)
 	state.Put("ui", ui)
 
+	// The VM is also shut down and connected to again to snapshot its disks
+	shutdown := &utmcommon.StepShutdown{
+		Command:         b.config.ShutdownCommand,
+		Timeout:         b.config.ShutdownTimeout,
+		Delay:           b.config.PostShutdownDelay,
+		DisableShutdown: b.config.DisableShutdown,
+	}
+	connect := &communicator.StepConnect{
+		Config:    &b.config.CommConfig.Comm,
+		Host:      utmcommon.CommHost(&b.config.CommConfig),
+		SSHConfig: b.config.CommConfig.Comm.SSHConfigFunc(),
+		SSHPort:   utmcommon.CommPort,
+		WinRMPort: utmcommon.CommPort,
+	}
+	// The changes these steps make to the guest are undone by a rollback
+	mountSharedDirectory := &utmcommon.StepMountSharedDirectory{
+		SharedDirectory: b.config.SharedDirectory,
+	}
+	uploadVersion := &utmcommon.StepUploadVersion{
+		Path: *b.config.UtmVersionFile,
+	}
+
 	// Build the steps
 	steps := []multistep.Step{
 		&commonsteps.StepOutputDir{
@@ -62,7 +85,6 @@ func (b *Builder) Run(ctx context.Context, ui packersdk.Ui, hook packersdk.Hook)
 		&utmcommon.StepUtmDownload{
 			Checksum:    b.config.Checksum,
 			Description: "UTM",
-			Extension:   "utm",
 			ResultKey:   "vm_path",
 			TargetPath:  b.config.TargetPath,
 			Url:         []string{b.config.SourcePath},
@@ -72,31 +94,46 @@ func (b *Builder) Run(ctx context.Context, ui packersdk.Ui, hook packersdk.Hook)
 			KeepRegistered: b.config.KeepRegistered,
 		},
 		&utmcommon.StepPortForwarding{
-			CommConfig:     &b.config.CommConfig.Comm,
-			HostPortMin:    b.config.HostPortMin,
-			HostPortMax:    b.config.HostPortMax,
-			SkipNatMapping: b.config.SkipNatMapping,
+			CommConfig:        &b.config.CommConfig.Comm,
+			HostPortMin:       b.config.HostPortMin,
+			HostPortMax:       b.config.HostPortMax,
+			SkipNatMapping:    b.config.SkipNatMapping,
+			NetworkInterfaces: b.config.NetworkInterfaces,
+			ForwardedPorts:    b.config.ForwardedPorts,
+		},
+		&utmcommon.StepSharedDirectory{
+			SharedDirectory: b.config.SharedDirectory,
 		},
 		&utmcommon.StepRun{},
-		&communicator.StepConnect{
-			Config:    &b.config.CommConfig.Comm,
-			Host:      utmcommon.CommHost(b.config.CommConfig.Comm.Host()),
-			SSHConfig: b.config.CommConfig.Comm.SSHConfigFunc(),
-			SSHPort:   utmcommon.CommPort,
-			WinRMPort: utmcommon.CommPort,
+		connect,
+		&utmcommon.StepSnapshot{
+			Enabled:  b.config.ProvisionSnapshot,
+			Shutdown: shutdown,
+			Connect:  connect,
 		},
-		&utmcommon.StepUploadVersion{
-			Path: *b.config.UtmVersionFile,
+		mountSharedDirectory,
+		uploadVersion,
+		&utmcommon.StepRollbackProvision{
+			Retries:      b.config.ProvisionRetries,
+			Rollback:     b.config.ProvisionRollback,
+			Shutdown:     shutdown,
+			Connect:      connect,
+			AfterConnect: []multistep.Step{mountSharedDirectory, uploadVersion},
 		},
-		new(commonsteps.StepProvision),
 		&commonsteps.StepCleanupTempKeys{
 			Comm: &b.config.CommConfig.Comm,
 		},
-		&utmcommon.StepShutdown{
-			Command:         b.config.ShutdownCommand,
-			Timeout:         b.config.ShutdownTimeout,
-			Delay:           b.config.PostShutdownDelay,
-			DisableShutdown: b.config.DisableShutdown,
+		&utmcommon.StepZeroFreeSpace{
+			Command: b.config.ZeroFreeSpaceCommand,
+		},
+		shutdown,
+		new(utmcommon.StepRemoveSnapshot),
+		&utmcommon.StepRemoveSharedDirectory{
+			SharedDirectory: b.config.SharedDirectory,
+		},
+		&utmcommon.StepCompactDisks{
+			Compact:  b.config.CompactDisks,
+			Compress: b.config.CompressDisks,
 		},
 		&utmcommon.StepExport{
 			Format:         b.config.Format,
@@ -125,6 +162,10 @@ func (b *Builder) Run(ctx context.Context, ui packersdk.Ui, hook packersdk.Hook)
 		return nil, errors.New("build was halted")
 	}
 
-	generatedData := map[string]interface{}{"generated_data": state.Get("generated_data")}
+	generatedData := map[string]interface{}{
+		"generated_data":   state.Get("generated_data"),
+		"compacted_disks":  state.Get("compacted_disks"),
+		"source_tree_hash": state.Get("source_tree_hash"),
+	}
 	return utmcommon.NewArtifact(b.config.OutputDir, b.config.VMName, generatedData)
 }
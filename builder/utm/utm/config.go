@@ -21,9 +21,13 @@ type Config struct {
 	// TODO: Use run config to fill remote connection details
 	// like VRDP for VirtualBox, VNC for UTM (QEMU) ?
 	// RunConfig           `mapstructure:",squash"`
-	utmcommon.CommConfig       `mapstructure:",squash"`
-	utmcommon.ShutdownConfig   `mapstructure:",squash"`
-	utmcommon.UtmVersionConfig `mapstructure:",squash"`
+	utmcommon.CommConfig            `mapstructure:",squash"`
+	utmcommon.ShutdownConfig        `mapstructure:",squash"`
+	utmcommon.UtmVersionConfig      `mapstructure:",squash"`
+	utmcommon.RemoteConfig          `mapstructure:",squash"`
+	utmcommon.SnapshotConfig        `mapstructure:",squash"`
+	utmcommon.NetworkConfig         `mapstructure:",squash"`
+	utmcommon.SharedDirectoryConfig `mapstructure:",squash"`
 	// The checksum for the source_path file. The type of the checksum is
 	// specified within the checksum field as a prefix, ex: "md5:{$checksum}".
 	// The type of the checksum can also be omitted and Packer will try to
@@ -43,14 +47,24 @@ type Config struct {
 	//  * none
 	// Although the checksum will not be verified when it is set to "none",
 	// this is not recommended since these files can be very large and
-	// corruption does happen from time to time.
+	// corruption does happen from time to time. The checksum of an archive
+	// is the checksum of the archive file. The checksum of a .utm directory
+	// is its tree hash, `sha256:<hash>` or `<hash>`: the SHA-256 of the
+	// sha256sum listing of its files, by relative path in byte order. The
+	// build prints it, and keeps it in the `source_tree_hash` artifact state.
+	// On macOS, it is the output of
+	// `find . -type f | cut -c3- | LC_ALL=C sort | tr '\n' '\0' | xargs -0 shasum -a 256 | shasum -a 256`
+	// in the .utm directory.
 	Checksum string `mapstructure:"checksum" required:"true"`
-	// The filepath or URL to a UTM file that acts as the
-	// source of this build.
+	// The source of this build: the path of a .utm directory, which is used
+	// in place, or the path or URL of a zip or tar.gz archive of a .utm
+	// directory, like the `.utm.zip` files of the utm-zip post-processor.
+	// Archives are downloaded to the packer cache, and extracted to a
+	// temporary directory for the build.
 	SourcePath string `mapstructure:"source_path" required:"true"`
-	// The path where the UTM file should be saved
+	// The path where the archive should be saved
 	// after download. By default, it will go in the packer cache, with a hash of
-	// the original filename as its name.
+	// the checksum, or of the URL without a checksum, as its name.
 	TargetPath string `mapstructure:"target_path" required:"false"`
 	// This is the name of the UTM file for the new virtual machine, without
 	// the file extension. Make sure VMName in UTM after import is same
@@ -76,6 +90,7 @@ func (c *Config) Prepare(raws ...interface{}) ([]string, error) {
 		InterpolateFilter: &interpolate.RenderFilter{
 			Exclude: []string{
 				"boot_command",
+				"shared_directory",
 			},
 		},
 	}, raws...)
@@ -97,6 +112,11 @@ func (c *Config) Prepare(raws ...interface{}) ([]string, error) {
 	// errs = packersdk.MultiErrorAppend(errs, c.RunConfig.Prepare(&c.ctx)...)
 	errs = packersdk.MultiErrorAppend(errs, c.ShutdownConfig.Prepare(&c.ctx)...)
 	errs = packersdk.MultiErrorAppend(errs, c.CommConfig.Prepare(&c.ctx)...)
+	errs = packersdk.MultiErrorAppend(errs, c.RemoteConfig.Prepare(&c.ctx)...)
+	errs = packersdk.MultiErrorAppend(errs, c.SnapshotConfig.Prepare(&c.ctx, c.ShutdownCommand)...)
+	errs = packersdk.MultiErrorAppend(errs, c.NetworkConfig.Prepare(&c.ctx, &c.CommConfig)...)
+	// The backend of the source VM is only known once it is imported
+	errs = packersdk.MultiErrorAppend(errs, c.SharedDirectoryConfig.Prepare(&c.ctx, "")...)
 	errs = packersdk.MultiErrorAppend(errs, c.UtmVersionConfig.Prepare(c.CommConfig.Comm.Type)...)
 
 	if c.SourcePath == "" {
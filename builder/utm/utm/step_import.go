@@ -30,8 +30,16 @@ func (s *StepImport) Run(ctx context.Context, state multistep.StateBag) multiste
 	var vmId string
 	var err error
 
+	if !driver.HasFeature(utmcommon.FeatureImport) {
+		err := fmt.Errorf("the installed version of UTM does not support importing VMs, " +
+			"please upgrade UTM to use the utm builder")
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
 	ui.Say(fmt.Sprintf("Importing VM: %s", vmPath))
-	if vmId, err = driver.Import(vmPath); err != nil {
+	if vmId, err = driver.Import(ctx, vmPath); err != nil {
 		err := fmt.Errorf("error importing VM: %s", err)
 		state.Put("error", err)
 		ui.Error(err.Error())
@@ -41,7 +49,7 @@ func (s *StepImport) Run(ctx context.Context, state multistep.StateBag) multiste
 	state.Put("vmId", s.vmId)
 
 	// set VM name
-	if _, err = driver.ExecuteOsaScript("customize_vm.applescript", vmId, "--name", s.Name); err != nil {
+	if _, err = driver.ExecuteOsaScript(ctx, "customize_vm.applescript", vmId, "--name", s.Name); err != nil {
 		err := fmt.Errorf("error setting VM name: %s", err)
 		state.Put("error", err)
 		ui.Error(err.Error())
@@ -69,7 +77,5 @@ func (s *StepImport) Cleanup(state multistep.StateBag) {
 	}
 
 	ui.Say("Deregistering and deleting imported VM...")
-	if err := driver.Delete(s.vmId); err != nil {
-		ui.Error(fmt.Sprintf("Error deleting VM: %s", err))
-	}
+	utmcommon.DeleteVM(context.Background(), driver, ui, s.vmId)
 }
@@ -0,0 +1,70 @@
+package utm
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/packer-plugin-sdk/communicator"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/naveenrajm7/packer-plugin-utm/builder/utm/bundle"
+	utmcommon "github.com/naveenrajm7/packer-plugin-utm/builder/utm/common"
+)
+
+func TestBuilderSteps_simulated(t *testing.T) {
+	// A bundle with the shared and emulated network interfaces the
+	// builder expects
+	source := filepath.Join(t.TempDir(), "source.utm")
+	if _, err := bundle.Create(source, &bundle.Config{
+		Backend:              bundle.BackendQEMU,
+		ConfigurationVersion: 4,
+		Information:          bundle.Information{Name: "source", UUID: "6E1B0B4C-3C55-4A0C-9D8E-6F2B7A1C0D9E"},
+		Networks:             []bundle.Network{{Mode: "Shared"}, {Mode: "Emulated"}},
+	}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	driver := new(utmcommon.DriverSimulator)
+	state := testState(t)
+	state.Put("driver", driver)
+	state.Put("vm_path", source)
+	state.Put("communicator", new(packersdk.MockCommunicator))
+
+	outputDir := t.TempDir()
+	runner := &multistep.BasicRunner{Steps: []multistep.Step{
+		&StepImport{Name: "packer", KeepRegistered: true},
+		&utmcommon.StepPortForwarding{
+			CommConfig: &communicator.Config{
+				Type: "ssh",
+				SSH:  communicator.SSH{SSHPort: 22},
+			},
+			HostPortMin: 2222,
+			HostPortMax: 4444,
+		},
+		new(utmcommon.StepRun),
+		&utmcommon.StepShutdown{Timeout: 5 * time.Second},
+		&utmcommon.StepExport{Format: "utm", OutputDir: outputDir},
+	}}
+	runner.Run(context.Background(), state)
+	if rawErr, ok := state.GetOk("error"); ok {
+		t.Fatalf("err: %s", rawErr)
+	}
+
+	vms := driver.VMs()
+	if len(vms) != 1 || vms[0].Status != "stopped" {
+		t.Fatalf("bad: %#v", vms)
+	}
+	if forwards := vms[0].NetworkInterfaces[1].PortForwards; len(forwards) != 0 {
+		t.Fatalf("communicator port forward should be removed: %#v", forwards)
+	}
+
+	exported, err := bundle.Open(filepath.Join(outputDir, "packer.utm"))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(exported.Config.Networks) != 2 || len(exported.Config.Networks[1].PortForwards) != 0 {
+		t.Fatalf("bad: %#v", exported.Config.Networks)
+	}
+}
@@ -0,0 +1,105 @@
+package cloudimage
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	// A line of sha256sum, e.g. `<hash>  <file>`, or `<hash> *<file>` for
+	// binary files
+	gnuChecksum = regexp.MustCompile(`^([0-9a-fA-F]+) [ *](.+)$`)
+	// A line of sha256sum --tag, e.g. `SHA256 (<file>) = <hash>`
+	bsdChecksum = regexp.MustCompile(`^(\w+) \((.+)\) = ([0-9a-fA-F]+)$`)
+)
+
+// The checksum types by the length of their hexadecimal checksum.
+var checksumTypes = map[int]string{
+	32:  "md5",
+	40:  "sha1",
+	64:  "sha256",
+	128: "sha512",
+}
+
+// The ends of the file names of the disk images in a checksum listing
+// without image_type. The listings also have other files, like compressed
+// raw images, vmdk images or archives.
+var diskImageSuffixes = []string{".img", ".qcow2"}
+
+// findChecksums finds the image in the checksum listing at location. The
+// newest image is the last file name of the listing in version order.
+func (d *Datasource) findChecksums(location string, data []byte) (*DatasourceOutput, error) {
+	var archs []*regexp.Regexp
+	for _, arch := range d.archAliases() {
+		archs = append(archs, nameToken(arch))
+	}
+	suffixes := diskImageSuffixes
+	if d.config.ImageType != "" {
+		suffixes = []string{d.config.ImageType}
+	}
+	var release *regexp.Regexp
+	if d.config.Release != "" {
+		release = nameToken(d.config.Release)
+	}
+
+	var file, checksum string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		name, sum := parseChecksumLine(strings.TrimSpace(scanner.Text()))
+		if name == "" {
+			continue
+		}
+		if release != nil && !release.MatchString(name) {
+			continue
+		}
+		isImage := false
+		for _, suffix := range suffixes {
+			isImage = isImage || strings.HasSuffix(name, suffix)
+		}
+		if !isImage {
+			continue
+		}
+		matches := false
+		for _, arch := range archs {
+			matches = matches || arch.MatchString(name)
+		}
+		if matches && (file == "" || versionLess(file, name)) {
+			file, checksum = name, sum
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading the checksums %s: %s", location, err)
+	}
+	if file == "" {
+		return nil, d.notFound(location)
+	}
+
+	u, err := resolve(location, file)
+	if err != nil {
+		return nil, err
+	}
+	return &DatasourceOutput{URL: u, Checksum: checksum}, nil
+}
+
+// parseChecksumLine returns the file name and the checksum of a line of a
+// checksum listing, or an empty name for other lines, like the comments
+// and the signature of the listing.
+func parseChecksumLine(line string) (string, string) {
+	if m := bsdChecksum.FindStringSubmatch(line); m != nil {
+		return m[2], strings.ToLower(m[1]) + ":" + strings.ToLower(m[3])
+	}
+	if m := gnuChecksum.FindStringSubmatch(line); m != nil {
+		if checksumType, ok := checksumTypes[len(m[1])]; ok {
+			return m[2], checksumType + ":" + strings.ToLower(m[1])
+		}
+	}
+	return "", ""
+}
+
+// nameToken matches a word of a file name, delimited by punctuation.
+func nameToken(word string) *regexp.Regexp {
+	return regexp.MustCompile(`(^|[^A-Za-z0-9])` + regexp.QuoteMeta(word) + `($|[^A-Za-z0-9])`)
+}
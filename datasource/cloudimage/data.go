@@ -0,0 +1,197 @@
+//go:generate packer-sdc struct-markdown
+//go:generate packer-sdc mapstructure-to-hcl2 -type Config,DatasourceOutput
+
+package cloudimage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/hcl/v2/hcldec"
+	"github.com/hashicorp/packer-plugin-sdk/hcl2helper"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/template/config"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// Config is the configuration of the cloud image data source.
+type Config struct {
+	// The simplestreams index of the images, in the format of Ubuntu, or a
+	// checksum listing like SHA256SUMS. This is a local file or an HTTP URL,
+	// and the paths it lists are relative to it. The index may be a
+	// `streams/v1/index.json` file, or the products file it points to.
+	URL string `mapstructure:"url" required:"true"`
+	// The release of the image. With a simplestreams index, this is the
+	// release, version or alias of a product, e.g. `noble`, `24.04` or
+	// `lts`. In a checksum listing, the file name must have the release.
+	Release string `mapstructure:"release" required:"false"`
+	// The architecture of the image, as in `vm_arch` of the cloud builder.
+	// `aarch64` and `x86_64` also match the `arm64` and `amd64` names of
+	// the distros. Defaults to `aarch64`.
+	Arch string `mapstructure:"arch" required:"false"`
+	// The type of image. With a simplestreams index, this is the ftype of
+	// the image, defaults to `disk1.img`. In a checksum listing, this is the
+	// end of the file name, e.g. `.qcow2`, and defaults to the disk images,
+	// the files ending with `.img` or `.qcow2`.
+	ImageType string `mapstructure:"image_type" required:"false"`
+}
+
+// Datasource finds the newest cloud image of a release in a simplestreams
+// index or in a checksum listing.
+type Datasource struct {
+	config Config
+}
+
+// DatasourceOutput is the image found by the data source.
+type DatasourceOutput struct {
+	// The URL of the image, or its path when the index is a local file.
+	URL string `mapstructure:"url"`
+	// The checksum of the image, e.g. `sha256:...`, for `iso_checksum`.
+	Checksum string `mapstructure:"checksum"`
+	// The version of the image in a simplestreams index, e.g. `20240423`.
+	// Empty with a checksum listing.
+	Version string `mapstructure:"version"`
+}
+
+// The names distros give to the architectures of vm_arch.
+var archNames = map[string]string{
+	"aarch64": "arm64",
+	"x86_64":  "amd64",
+	"ppc64":   "ppc64el",
+}
+
+func (d *Datasource) ConfigSpec() hcldec.ObjectSpec {
+	return d.config.FlatMapstructure().HCL2Spec()
+}
+
+func (d *Datasource) Configure(raws ...interface{}) error {
+	err := config.Decode(&d.config, nil, raws...)
+	if err != nil {
+		return err
+	}
+
+	var errs *packersdk.MultiError
+	if d.config.URL == "" {
+		errs = packersdk.MultiErrorAppend(errs, errors.New("url is required"))
+	}
+	if d.config.Arch == "" {
+		d.config.Arch = "aarch64"
+	}
+
+	if errs != nil && len(errs.Errors) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (d *Datasource) OutputSpec() hcldec.ObjectSpec {
+	return (&DatasourceOutput{}).FlatMapstructure().HCL2Spec()
+}
+
+func (d *Datasource) Execute() (cty.Value, error) {
+	index, err := fetch(d.config.URL)
+	if err != nil {
+		return cty.NullVal(cty.EmptyObject), fmt.Errorf("error reading %s: %s", d.config.URL, err)
+	}
+
+	var output *DatasourceOutput
+	if bytes.HasPrefix(bytes.TrimSpace(index), []byte("{")) {
+		output, err = d.findSimplestreams(d.config.URL, index)
+	} else {
+		output, err = d.findChecksums(d.config.URL, index)
+	}
+	if err != nil {
+		return cty.NullVal(cty.EmptyObject), err
+	}
+	return hcl2helper.HCL2ValueFromConfig(output, d.OutputSpec()), nil
+}
+
+// archAliases returns the names of the architecture.
+func (d *Datasource) archAliases() []string {
+	aliases := []string{d.config.Arch}
+	if name, ok := archNames[d.config.Arch]; ok {
+		aliases = append(aliases, name)
+	}
+	return aliases
+}
+
+var httpClient = &http.Client{Timeout: 5 * time.Minute}
+
+// fetch reads a local file or an HTTP URL.
+func fetch(location string) ([]byte, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+	case "file":
+		return os.ReadFile(u.Path)
+	case "":
+		return os.ReadFile(location)
+	default:
+		return nil, fmt.Errorf("unsupported scheme %s", u.Scheme)
+	}
+
+	resp, err := httpClient.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// resolve returns the location of a path listed by the index at base.
+func resolve(base string, path string) (string, error) {
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	ref, err := url.Parse(path)
+	if err != nil {
+		return "", err
+	}
+	return baseURL.ResolveReference(ref).String(), nil
+}
+
+var versionPart = regexp.MustCompile(`\d+|\D+`)
+
+// versionLess compares two versions, or file names with versions, with
+// their numbers compared as numbers.
+func versionLess(a string, b string) bool {
+	partsA := versionPart.FindAllString(a, -1)
+	partsB := versionPart.FindAllString(b, -1)
+	for i := 0; i < len(partsA) && i < len(partsB); i++ {
+		pa, pb := partsA[i], partsB[i]
+		if pa == pb {
+			continue
+		}
+		if isDigit(pa[0]) && isDigit(pb[0]) {
+			na, nb := strings.TrimLeft(pa, "0"), strings.TrimLeft(pb, "0")
+			if len(na) != len(nb) {
+				return len(na) < len(nb)
+			}
+			if na != nb {
+				return na < nb
+			}
+			continue
+		}
+		return pa < pb
+	}
+	return len(partsA) < len(partsB)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
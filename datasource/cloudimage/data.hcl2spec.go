@@ -0,0 +1,64 @@
+// Code generated by "packer-sdc mapstructure-to-hcl2"; DO NOT EDIT.
+
+package cloudimage
+
+import (
+	"github.com/hashicorp/hcl/v2/hcldec"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// FlatConfig is an auto-generated flat version of Config.
+// Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
+type FlatConfig struct {
+	URL       *string `mapstructure:"url" required:"true" cty:"url" hcl:"url"`
+	Release   *string `mapstructure:"release" required:"false" cty:"release" hcl:"release"`
+	Arch      *string `mapstructure:"arch" required:"false" cty:"arch" hcl:"arch"`
+	ImageType *string `mapstructure:"image_type" required:"false" cty:"image_type" hcl:"image_type"`
+}
+
+// FlatMapstructure returns a new FlatConfig.
+// FlatConfig is an auto-generated flat version of Config.
+// Where the contents a fields with a `mapstructure:,squash` tag are bubbled up.
+func (*Config) FlatMapstructure() interface{ HCL2Spec() map[string]hcldec.Spec } {
+	return new(FlatConfig)
+}
+
+// HCL2Spec returns the hcl spec of a Config.
+// This spec is used by HCL to read the fields of Config.
+// The decoded values from this spec will then be applied to a FlatConfig.
+func (*FlatConfig) HCL2Spec() map[string]hcldec.Spec {
+	s := map[string]hcldec.Spec{
+		"url":        &hcldec.AttrSpec{Name: "url", Type: cty.String, Required: false},
+		"release":    &hcldec.AttrSpec{Name: "release", Type: cty.String, Required: false},
+		"arch":       &hcldec.AttrSpec{Name: "arch", Type: cty.String, Required: false},
+		"image_type": &hcldec.AttrSpec{Name: "image_type", Type: cty.String, Required: false},
+	}
+	return s
+}
+
+// FlatDatasourceOutput is an auto-generated flat version of DatasourceOutput.
+// Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
+type FlatDatasourceOutput struct {
+	URL      *string `mapstructure:"url" cty:"url" hcl:"url"`
+	Checksum *string `mapstructure:"checksum" cty:"checksum" hcl:"checksum"`
+	Version  *string `mapstructure:"version" cty:"version" hcl:"version"`
+}
+
+// FlatMapstructure returns a new FlatDatasourceOutput.
+// FlatDatasourceOutput is an auto-generated flat version of DatasourceOutput.
+// Where the contents a fields with a `mapstructure:,squash` tag are bubbled up.
+func (*DatasourceOutput) FlatMapstructure() interface{ HCL2Spec() map[string]hcldec.Spec } {
+	return new(FlatDatasourceOutput)
+}
+
+// HCL2Spec returns the hcl spec of a DatasourceOutput.
+// This spec is used by HCL to read the fields of DatasourceOutput.
+// The decoded values from this spec will then be applied to a FlatDatasourceOutput.
+func (*FlatDatasourceOutput) HCL2Spec() map[string]hcldec.Spec {
+	s := map[string]hcldec.Spec{
+		"url":      &hcldec.AttrSpec{Name: "url", Type: cty.String, Required: false},
+		"checksum": &hcldec.AttrSpec{Name: "checksum", Type: cty.String, Required: false},
+		"version":  &hcldec.AttrSpec{Name: "version", Type: cty.String, Required: false},
+	}
+	return s
+}
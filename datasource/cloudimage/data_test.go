@@ -0,0 +1,241 @@
+package cloudimage
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testIndex = `{
+  "format": "index:1.0",
+  "index": {
+    "com.ubuntu.cloud:released:aws": {
+      "datatype": "image-ids",
+      "format": "products:1.0",
+      "path": "streams/v1/com.ubuntu.cloud:released:aws.json"
+    },
+    "com.ubuntu.cloud:released:download": {
+      "datatype": "image-downloads",
+      "format": "products:1.0",
+      "path": "streams/v1/com.ubuntu.cloud:released:download.json"
+    }
+  }
+}`
+
+const testProducts = `{
+  "format": "products:1.0",
+  "products": {
+    "com.ubuntu.cloud:server:24.04:arm64": {
+      "arch": "arm64",
+      "release": "noble",
+      "version": "24.04",
+      "aliases": "24.04,default,lts,n,noble",
+      "versions": {
+        "20240423": {
+          "items": {
+            "disk1.img": {"ftype": "disk1.img", "path": "server/releases/noble/release-20240423/ubuntu-24.04-server-cloudimg-arm64.img", "sha256": "aaaa"}
+          }
+        },
+        "20241004.1": {
+          "items": {
+            "disk1.img": {"ftype": "disk1.img", "path": "server/releases/noble/release-20241004.1/ubuntu-24.04-server-cloudimg-arm64.img", "sha256": "bbbb"},
+            "uefi1.img": {"ftype": "uefi1.img", "path": "server/releases/noble/release-20241004.1/ubuntu-24.04-server-cloudimg-arm64-uefi1.img", "sha256": "cccc"}
+          }
+        },
+        "20240821": {
+          "items": {
+            "disk1.img": {"ftype": "disk1.img", "path": "server/releases/noble/release-20240821/ubuntu-24.04-server-cloudimg-arm64.img", "sha256": "dddd"}
+          }
+        }
+      }
+    },
+    "com.ubuntu.cloud:server:24.04:amd64": {
+      "arch": "amd64",
+      "release": "noble",
+      "version": "24.04",
+      "versions": {
+        "20241004.1": {
+          "items": {
+            "disk1.img": {"ftype": "disk1.img", "path": "server/releases/noble/release-20241004.1/ubuntu-24.04-server-cloudimg-amd64.img", "sha256": "eeee"}
+          }
+        }
+      }
+    }
+  }
+}`
+
+const testChecksums = `-----BEGIN PGP SIGNED MESSAGE-----
+Hash: SHA256
+
+# Fedora-Cloud-41-1.4-aarch64-CHECKSUM
+SHA256 (Fedora-Cloud-Base-Generic-41-1.4.aarch64.qcow2) = 1111
+SHA256 (Fedora-Cloud-Base-Generic-41-1.10.aarch64.qcow2) = 2222
+SHA256 (Fedora-Cloud-Base-Generic-41-1.10.aarch64.raw.xz) = 3333
+SHA256 (Fedora-Cloud-Base-Generic-41-1.10.x86_64.qcow2) = 4444
+-----BEGIN PGP SIGNATURE-----
+`
+
+func testServer(t *testing.T) *httptest.Server {
+	files := map[string]string{
+		"/releases/streams/v1/index.json":                                      testIndex,
+		"/releases/streams/v1/com.ubuntu.cloud:released:download.json":         testProducts,
+		"/fedora/41/Cloud/aarch64/images/Fedora-Cloud-41-1.4-aarch64-CHECKSUM": testChecksums,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(data))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func testExecute(t *testing.T, raw map[string]interface{}) (DatasourceOutput, error) {
+	var d Datasource
+	if err := d.Configure(raw); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	value, err := d.Execute()
+	if err != nil {
+		return DatasourceOutput{}, err
+	}
+	attrs := value.AsValueMap()
+	return DatasourceOutput{
+		URL:      attrs["url"].AsString(),
+		Checksum: attrs["checksum"].AsString(),
+		Version:  attrs["version"].AsString(),
+	}, nil
+}
+
+func TestDatasource_simplestreams(t *testing.T) {
+	server := testServer(t)
+
+	for _, u := range []string{
+		server.URL + "/releases/streams/v1/index.json",
+		server.URL + "/releases/streams/v1/com.ubuntu.cloud:released:download.json",
+	} {
+		for _, release := range []string{"noble", "24.04", "lts"} {
+			output, err := testExecute(t, map[string]interface{}{"url": u, "release": release})
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			expected := DatasourceOutput{
+				URL:      server.URL + "/releases/server/releases/noble/release-20241004.1/ubuntu-24.04-server-cloudimg-arm64.img",
+				Checksum: "sha256:bbbb",
+				Version:  "20241004.1",
+			}
+			if output != expected {
+				t.Fatalf("bad: %#v", output)
+			}
+		}
+	}
+
+	output, err := testExecute(t, map[string]interface{}{
+		"url":        server.URL + "/releases/streams/v1/index.json",
+		"release":    "noble",
+		"arch":       "x86_64",
+		"image_type": "disk1.img",
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if output.Checksum != "sha256:eeee" {
+		t.Fatalf("bad: %#v", output)
+	}
+
+	for _, raw := range []map[string]interface{}{
+		{"url": server.URL + "/releases/streams/v1/index.json", "release": "jammy"},
+		{"url": server.URL + "/releases/streams/v1/index.json", "release": "noble", "arch": "riscv64"},
+		{"url": server.URL + "/releases/streams/v1/index.json"},
+		{"url": server.URL + "/missing.json", "release": "noble"},
+	} {
+		if _, err := testExecute(t, raw); err == nil {
+			t.Fatalf("should have error: %#v", raw)
+		}
+	}
+}
+
+func TestDatasource_checksums(t *testing.T) {
+	server := testServer(t)
+	u := server.URL + "/fedora/41/Cloud/aarch64/images/Fedora-Cloud-41-1.4-aarch64-CHECKSUM"
+
+	output, err := testExecute(t, map[string]interface{}{"url": u, "release": "41", "image_type": ".qcow2"})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expected := DatasourceOutput{
+		URL:      server.URL + "/fedora/41/Cloud/aarch64/images/Fedora-Cloud-Base-Generic-41-1.10.aarch64.qcow2",
+		Checksum: "sha256:2222",
+	}
+	if output != expected {
+		t.Fatalf("bad: %#v", output)
+	}
+
+	output, err = testExecute(t, map[string]interface{}{"url": u, "arch": "x86_64"})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if output.Checksum != "sha256:4444" {
+		t.Fatalf("bad: %#v", output)
+	}
+
+	// Without image_type, only the disk images are found
+	output, err = testExecute(t, map[string]interface{}{"url": u, "release": "41"})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if output.Checksum != "sha256:2222" {
+		t.Fatalf("bad: %#v", output)
+	}
+
+	if _, err := testExecute(t, map[string]interface{}{"url": u, "release": "40"}); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestDatasource_localFile(t *testing.T) {
+	dir := t.TempDir()
+	sums := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef *noble-server-cloudimg-arm64.img\n" +
+		"fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210 *noble-server-cloudimg-amd64.img\n"
+	path := filepath.Join(dir, "SHA256SUMS")
+	if err := os.WriteFile(path, []byte(sums), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	output, err := testExecute(t, map[string]interface{}{"url": path, "release": "noble", "image_type": ".img"})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expected := DatasourceOutput{
+		URL:      filepath.Join(dir, "noble-server-cloudimg-arm64.img"),
+		Checksum: "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+	}
+	if output != expected {
+		t.Fatalf("bad: %#v", output)
+	}
+}
+
+func TestDatasource_Configure(t *testing.T) {
+	var d Datasource
+	if err := d.Configure(map[string]interface{}{}); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestVersionLess(t *testing.T) {
+	for _, versions := range [][2]string{
+		{"20240423", "20241004.1"},
+		{"20241004", "20241004.1"},
+		{"1.4", "1.10"},
+		{"Fedora-41-1.9.qcow2", "Fedora-41-1.10.qcow2"},
+	} {
+		if !versionLess(versions[0], versions[1]) || versionLess(versions[1], versions[0]) {
+			t.Fatalf("bad: %#v", versions)
+		}
+	}
+}
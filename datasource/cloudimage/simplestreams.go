@@ -0,0 +1,171 @@
+package cloudimage
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// An index of simplestreams, which points to the products files.
+type streamsIndex struct {
+	Format string `json:"format"`
+	Index  map[string]struct {
+		Datatype string `json:"datatype"`
+		Format   string `json:"format"`
+		Path     string `json:"path"`
+	} `json:"index"`
+}
+
+// A products file of simplestreams, with the versions of the images of
+// every product.
+type streamsProducts struct {
+	Format   string                    `json:"format"`
+	Products map[string]streamsProduct `json:"products"`
+}
+
+type streamsProduct struct {
+	Arch    string `json:"arch"`
+	Release string `json:"release"`
+	Version string `json:"version"`
+	// The other names of the release, separated by commas
+	Aliases  string `json:"aliases"`
+	Versions map[string]struct {
+		Items map[string]struct {
+			Ftype  string `json:"ftype"`
+			Path   string `json:"path"`
+			SHA256 string `json:"sha256"`
+			SHA512 string `json:"sha512"`
+		} `json:"items"`
+	} `json:"versions"`
+}
+
+// mirrorRoot returns the location the paths of a simplestreams file are
+// relative to, the parent of its streams/v1 directory.
+func mirrorRoot(location string) string {
+	if i := strings.LastIndex(location, "streams/v1/"); i >= 0 {
+		return location[:i]
+	}
+	return location
+}
+
+// findSimplestreams finds the image in the simplestreams file at location,
+// an index or a products file.
+func (d *Datasource) findSimplestreams(location string, data []byte) (*DatasourceOutput, error) {
+	var index streamsIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("error parsing the simplestreams index %s: %s", location, err)
+	}
+	if d.config.Release == "" {
+		return nil, fmt.Errorf("release is required with the simplestreams index %s", location)
+	}
+	if index.Format != "index:1.0" {
+		output, err := d.findProduct(location, data)
+		if err == nil && output == nil {
+			err = d.notFound(location)
+		}
+		return output, err
+	}
+
+	// Look for the image in the products files of image downloads
+	ids := make([]string, 0, len(index.Index))
+	for id, entry := range index.Index {
+		if entry.Datatype == "image-downloads" && entry.Format == "products:1.0" {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		productsLocation, err := resolve(mirrorRoot(location), index.Index[id].Path)
+		if err != nil {
+			return nil, err
+		}
+		products, err := fetch(productsLocation)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %s", productsLocation, err)
+		}
+		output, err := d.findProduct(productsLocation, products)
+		if err != nil {
+			return nil, err
+		}
+		if output != nil {
+			return output, nil
+		}
+	}
+	return nil, d.notFound(location)
+}
+
+// findProduct finds the newest version of the image in a products file. It
+// returns nil when the file has no such image.
+func (d *Datasource) findProduct(location string, data []byte) (*DatasourceOutput, error) {
+	var products streamsProducts
+	if err := json.Unmarshal(data, &products); err != nil {
+		return nil, fmt.Errorf("error parsing the simplestreams products %s: %s", location, err)
+	}
+	if products.Format != "products:1.0" {
+		return nil, fmt.Errorf("%s isn't a simplestreams index or products file", location)
+	}
+
+	imageType := d.config.ImageType
+	if imageType == "" {
+		imageType = "disk1.img"
+	}
+	archs := d.archAliases()
+
+	var output *DatasourceOutput
+	for _, product := range products.Products {
+		if !d.releaseMatches(product) || !contains(archs, product.Arch) {
+			continue
+		}
+		for version, v := range product.Versions {
+			if output != nil && !versionLess(output.Version, version) {
+				continue
+			}
+			for _, item := range v.Items {
+				if item.Ftype != imageType {
+					continue
+				}
+				checksum := "sha256:" + item.SHA256
+				if item.SHA256 == "" {
+					checksum = "sha512:" + item.SHA512
+				}
+				u, err := resolve(mirrorRoot(location), item.Path)
+				if err != nil {
+					return nil, err
+				}
+				output = &DatasourceOutput{URL: u, Checksum: checksum, Version: version}
+				break
+			}
+		}
+	}
+
+	return output, nil
+}
+
+// releaseMatches reports whether the product is of the release of the
+// config.
+func (d *Datasource) releaseMatches(product streamsProduct) bool {
+	release := d.config.Release
+	if release == product.Release || release == product.Version {
+		return true
+	}
+	for _, alias := range strings.Split(product.Aliases, ",") {
+		if release == strings.TrimSpace(alias) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Datasource) notFound(location string) error {
+	return fmt.Errorf("%s has no image of release %q for %s", location, d.config.Release, d.config.Arch)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
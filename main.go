@@ -9,9 +9,11 @@ import (
 
 	"github.com/hashicorp/packer-plugin-sdk/plugin"
 
+	"github.com/naveenrajm7/packer-plugin-utm/builder/utm/clone"
 	"github.com/naveenrajm7/packer-plugin-utm/builder/utm/cloud"
 	"github.com/naveenrajm7/packer-plugin-utm/builder/utm/iso"
 	"github.com/naveenrajm7/packer-plugin-utm/builder/utm/utm"
+	"github.com/naveenrajm7/packer-plugin-utm/datasource/cloudimage"
 	utmPPvagrant "github.com/naveenrajm7/packer-plugin-utm/post-processor/vagrant"
 	utmPPzip "github.com/naveenrajm7/packer-plugin-utm/post-processor/zip"
 	"github.com/naveenrajm7/packer-plugin-utm/version"
@@ -22,6 +24,8 @@ func main() {
 	pps.RegisterBuilder("iso", new(iso.Builder))
 	pps.RegisterBuilder("utm", new(utm.Builder))
 	pps.RegisterBuilder("cloud", new(cloud.Builder))
+	pps.RegisterBuilder("clone", new(clone.Builder))
+	pps.RegisterDatasource("cloud-image", new(cloudimage.Datasource))
 	pps.RegisterPostProcessor("zip", new(utmPPzip.PostProcessor))
 	pps.RegisterPostProcessor("vagrant", new(utmPPvagrant.PostProcessor))
 	pps.SetVersion(version.PluginVersion)